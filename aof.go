@@ -2,35 +2,370 @@ package kvbench
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 )
 
 var errInvalidLog = errors.New("invalid log")
+var errChecksum = errors.New("log checksum mismatch")
+var errLogEncrypted = errors.New("log is encrypted, a key file is required")
+var errLogNotEncrypted = errors.New("log is not encrypted, use a key rotation to encrypt it")
+
+// aofFormat is the file format of a log. A plain log is a sequence of RESP
+// commands, which is what Redis writes. The other formats start with a magic
+// header and store each written buffer as a length-prefixed frame.
+type aofFormat int
+
+const (
+	aofPlain aofFormat = iota
+	aofChecksum
+	aofCompress
+	aofEncrypt
+)
+
+var aofMagics = [...][]byte{
+	aofChecksum: []byte("KVBCRC1\n"),
+	aofCompress: []byte("KVBZIP1\n"),
+	aofEncrypt:  cryptMagic,
+}
+
+var aofFormatNames = [...]string{
+	aofPlain:    "plain",
+	aofChecksum: "checksum",
+	aofCompress: "compress",
+	aofEncrypt:  "encrypt",
+}
+
+func (format aofFormat) String() string {
+	return aofFormatNames[format]
+}
+
+func parseAOFFormat(s string) (aofFormat, error) {
+	for i, name := range aofFormatNames {
+		if s == name {
+			return aofFormat(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log format: %v", s)
+}
+
+// aofFramer encodes and decodes the frames of a framed log.
+type aofFramer interface {
+	appendFrame(dst, data []byte) []byte
+	readFrame(rd io.Reader, buf []byte) ([]byte, error)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crcFramer writes frames with a CRC-32C of the data, which is optionally
+// compressed using deflate.
+type crcFramer struct {
+	compress bool
+	zbuf     bytes.Buffer
+	zw       *flate.Writer
+}
+
+func (fr *crcFramer) appendFrame(dst, data []byte) []byte {
+	sum := crc32.Checksum(data, crcTable)
+	if fr.compress {
+		fr.zbuf.Reset()
+		if fr.zw == nil {
+			fr.zw, _ = flate.NewWriter(&fr.zbuf, flate.BestSpeed)
+		} else {
+			fr.zw.Reset(&fr.zbuf)
+		}
+		fr.zw.Write(data)
+		fr.zw.Close()
+		data = fr.zbuf.Bytes()
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[4:], sum)
+	dst = append(dst, hdr[:]...)
+	return append(dst, data...)
+}
+
+func (fr *crcFramer) readFrame(rd io.Reader, buf []byte) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[0:]))
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	data := buf[:n]
+	if _, err := io.ReadFull(rd, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if fr.compress {
+		var err error
+		data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, errChecksum
+	}
+	return data, nil
+}
+
+func newAOFFramer(format aofFormat, crypt *crypter) aofFramer {
+	switch format {
+	case aofChecksum:
+		return &crcFramer{}
+	case aofCompress:
+		return &crcFramer{compress: true}
+	case aofEncrypt:
+		return crypt
+	}
+	return nil
+}
+
+// readAOFHeader reads the magic headers, if any, and returns the format and
+// encoding of the log.
+func readAOFHeader(rd *bufio.Reader, crypt *crypter) (aofFormat, aofEncoding, error) {
+	encoding := aofRESP
+	hdr, _ := rd.Peek(len(binaryMagic))
+	if bytes.Equal(hdr, binaryMagic) {
+		encoding = aofBinary
+		rd.Discard(len(binaryMagic))
+		hdr, _ = rd.Peek(len(cryptMagic))
+	}
+	for format, magic := range aofMagics {
+		if len(magic) == 0 || !bytes.Equal(hdr, magic) {
+			continue
+		}
+		if aofFormat(format) == aofEncrypt {
+			if crypt == nil {
+				return 0, 0, errLogEncrypted
+			}
+			return aofEncrypt, encoding, crypt.readHeader(rd)
+		}
+		_, err := rd.Discard(len(magic))
+		return aofFormat(format), encoding, err
+	}
+	return aofPlain, encoding, nil
+}
+
+// readEncodedCommands reads commands of any encoding until EOF.
+func readEncodedCommands(rd *bufio.Reader, encoding aofEncoding,
+	cmd func(args [][]byte) error,
+) error {
+	if encoding == aofBinary {
+		return readBinaryCommands(rd, cmd)
+	}
+	return readCommands(rd, cmd)
+}
+
+// readAOFBody reads all commands that follow the header.
+func readAOFBody(rd *bufio.Reader, format aofFormat, encoding aofEncoding,
+	crypt *crypter, cmd func(args [][]byte) error,
+) error {
+	framer := newAOFFramer(format, crypt)
+	if framer == nil {
+		return readEncodedCommands(rd, encoding, cmd)
+	}
+	var data []byte
+	var br bytes.Reader
+	frd := bufio.NewReader(nil)
+	for {
+		var err error
+		data, err = framer.readFrame(rd, data)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		br.Reset(data)
+		frd.Reset(&br)
+		if err := readEncodedCommands(frd, encoding, cmd); err != nil {
+			return err
+		}
+	}
+}
+
+// readAOF reads every command in a log of any format and encoding.
+func readAOF(rd *bufio.Reader, crypt *crypter, cmd func(args [][]byte) error,
+) (aofFormat, aofEncoding, error) {
+	format, encoding, err := readAOFHeader(rd, crypt)
+	if err != nil {
+		return format, encoding, err
+	}
+	return format, encoding, readAOFBody(rd, format, encoding, crypt, cmd)
+}
+
+// aofWriter writes commands in any log format and encoding. Each flush
+// writes the buffered commands as a single frame.
+type aofWriter struct {
+	w        io.Writer
+	format   aofFormat
+	encoding aofEncoding
+	framer   aofFramer
+	buf      []byte
+	fbuf     []byte
+	size     int64
+}
+
+func newAOFWriter(w io.Writer, format aofFormat, encoding aofEncoding,
+	crypt *crypter,
+) *aofWriter {
+	return &aofWriter{w: w, format: format, encoding: encoding,
+		framer: newAOFFramer(format, crypt)}
+}
+
+func (aw *aofWriter) writeHeader() error {
+	var hdr []byte
+	if aw.encoding == aofBinary {
+		hdr = append(hdr, binaryMagic...)
+	}
+	if aw.format == aofEncrypt {
+		hdr = aw.framer.(*crypter).appendHeader(hdr)
+	} else if aw.format != aofPlain {
+		hdr = append(hdr, aofMagics[aw.format]...)
+	}
+	if len(hdr) == 0 {
+		return nil
+	}
+	_, err := aw.w.Write(hdr)
+	aw.size += int64(len(hdr))
+	return err
+}
+
+func (aw *aofWriter) append(args ...[]byte) {
+	if aw.encoding == aofBinary {
+		aw.buf = appendBinaryCommand(aw.buf, args...)
+	} else {
+		aw.buf = appendCommand(aw.buf, args...)
+	}
+}
+
+func (aw *aofWriter) flush() error {
+	out := aw.buf
+	if aw.framer != nil {
+		aw.fbuf = aw.framer.appendFrame(aw.fbuf[:0], aw.buf)
+		out = aw.fbuf
+	}
+	aw.buf = aw.buf[:0]
+	n, err := aw.w.Write(out)
+	aw.size += int64(n)
+	return err
+}
 
 type AOF struct {
-	f     *os.File
+	fs    vfs
+	f     vfsFile
+	path  string
 	fsync bool
-	buf   []byte
+	aw    *aofWriter
+}
+
+func openAOF(path string, opts storeOptions, cmd func(args [][]byte) error) (*AOF, error) {
+	return loadAOF(path, opts, func(f vfsFile, rd *bufio.Reader,
+		format aofFormat, encoding aofEncoding,
+	) error {
+		return readAOFBody(rd, format, encoding, opts.crypt, cmd)
+	})
 }
 
-func openAOF(path string, fsync bool, cmd func(args [][]byte) error) (*AOF, error) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+// loadAOF opens the log at path. For an existing log the load function is
+// called to read the commands that follow the header, using either the
+// buffered reader or the file itself.
+func loadAOF(path string, opts storeOptions, load func(f vfsFile,
+	rd *bufio.Reader, format aofFormat, encoding aofEncoding) error,
+) (*AOF, error) {
+	fs := opts.filesystem()
+	f, err := fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
+	crypt := opts.crypt
+	aof := &AOF{fs: fs, f: f, path: path, fsync: opts.fsync}
 	err = func() error {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() == 0 {
+			format := aofPlain
+			if crypt != nil {
+				format = aofEncrypt
+			}
+			aof.aw = newAOFWriter(f, format, opts.encoding, crypt)
+			if err := aof.aw.writeHeader(); err != nil {
+				return err
+			}
+			// the new file
+			return fs.SyncDir(filepath.Dir(path))
+		}
 		rd := bufio.NewReader(f)
-		var args [][]byte
-		for {
+		format, encoding, err := readAOFHeader(rd, crypt)
+		if err != nil {
+			return err
+		}
+		if crypt != nil && format != aofEncrypt {
+			return errLogNotEncrypted
+		}
+		if encoding != opts.encoding {
+			log.Warningf("log encoding is %v, use 'aof convert' to change it",
+				encoding)
+		}
+		aof.aw = newAOFWriter(f, format, encoding, crypt)
+		if err := load(f, rd, format, encoding); err != nil {
+			return err
+		}
+		aof.aw.size, err = f.Seek(0, io.SeekEnd)
+		return err
+	}()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return aof, nil
+}
+
+// readCommands reads RESP formatted commands until EOF.
+func readCommands(rd *bufio.Reader, cmd func(args [][]byte) error) error {
+	var args [][]byte
+	for {
+		if c, err := rd.ReadByte(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		} else if c != '*' {
+			return errInvalidLog
+		}
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if len(line) == 1 || line[len(line)-2] != '\r' {
+			return errInvalidLog
+		}
+		n, err := strconv.ParseUint(line[:len(line)-2], 10, 64)
+		if err != nil {
+			return err
+		}
+		args = args[:0]
+		for i := 0; i < int(n); i++ {
 			if c, err := rd.ReadByte(); err != nil {
-				if err == io.EOF {
-					break
-				}
 				return err
-			} else if c != '*' {
+			} else if c != '$' {
 				return errInvalidLog
 			}
 			line, err := rd.ReadString('\n')
@@ -44,54 +379,32 @@ func openAOF(path string, fsync bool, cmd func(args [][]byte) error) (*AOF, erro
 			if err != nil {
 				return err
 			}
-			args = args[:0]
-			for i := 0; i < int(n); i++ {
-				if c, err := rd.ReadByte(); err != nil {
-					return err
-				} else if c != '$' {
-					return errInvalidLog
-				}
-				line, err := rd.ReadString('\n')
-				if err != nil {
-					return err
-				}
-				if len(line) == 1 || line[len(line)-2] != '\r' {
-					return errInvalidLog
-				}
-				n, err := strconv.ParseUint(line[:len(line)-2], 10, 64)
-				if err != nil {
-					return err
-				}
-				arg := make([]byte, int(n))
-				if _, err := io.ReadFull(rd, arg); err != nil {
-					return err
-				}
-				if c, err := rd.ReadByte(); err != nil {
-					return err
-				} else if c != '\r' {
-					return errInvalidLog
-				}
-				if c, err := rd.ReadByte(); err != nil {
-					return err
-				} else if c != '\n' {
-					return errInvalidLog
-				}
-				args = append(args, arg)
+			arg := make([]byte, int(n))
+			if _, err := io.ReadFull(rd, arg); err != nil {
+				return err
 			}
-			if len(args) == 0 {
-				continue
+			if c, err := rd.ReadByte(); err != nil {
+				return err
+			} else if c != '\r' {
+				return errInvalidLog
 			}
-			if err := cmd(args); err != nil {
+			if c, err := rd.ReadByte(); err != nil {
 				return err
+			} else if c != '\n' {
+				return errInvalidLog
 			}
+			args = append(args, arg)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if err := cmd(args); err != nil {
+			return err
 		}
-		return nil
-	}()
-	if err != nil {
-		f.Close()
 	}
-	return &AOF{f: f, fsync: fsync}, nil
+	return nil
 }
+
 func (aof *AOF) Write(args ...[]byte) error {
 	aof.BeginBuffer()
 	aof.AppendBuffer(args...)
@@ -99,31 +412,136 @@ func (aof *AOF) Write(args ...[]byte) error {
 }
 
 func (aof *AOF) BeginBuffer() {
-	aof.buf = aof.buf[:0]
+	aof.aw.buf = aof.aw.buf[:0]
 }
 
 func (aof *AOF) AppendBuffer(args ...[]byte) {
-	aof.buf = append(aof.buf, '*')
-	aof.buf = strconv.AppendInt(aof.buf, int64(len(args)), 10)
-	aof.buf = append(aof.buf, '\r', '\n')
+	aof.aw.append(args...)
+}
+
+func appendCommand(buf []byte, args ...[]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
 	for _, arg := range args {
-		aof.buf = append(aof.buf, '$')
-		aof.buf = strconv.AppendInt(aof.buf, int64(len(arg)), 10)
-		aof.buf = append(aof.buf, '\r', '\n')
-		aof.buf = append(aof.buf, arg...)
-		aof.buf = append(aof.buf, '\r', '\n')
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
 	}
+	return buf
 }
 
 func (aof *AOF) WriteBuffer() error {
-	_, err := aof.f.Write(aof.buf)
-	if err != nil {
+	size := aof.aw.size
+	if err := aof.aw.flush(); err != nil {
+		// drop a partial write, so that the log still ends with a whole
+		// command
+		if aof.f.Truncate(size) == nil {
+			if _, serr := aof.f.Seek(size, io.SeekStart); serr == nil {
+				aof.aw.size = size
+			}
+		}
 		return err
 	}
 	if aof.fsync {
-		aof.f.Sync()
+		return aof.f.Sync()
 	}
-	return err
+	return nil
+}
+
+// Rewrite replaces the log with a compacted one that's produced by the each
+// function, which must call emit for every command that should be in the new
+// log. The new log is encrypted using the provided crypter, which allows for
+// rotating the key. Otherwise the format and encoding of the log are kept.
+func (aof *AOF) Rewrite(crypt *crypter,
+	each func(emit func(args ...[]byte) error) error,
+) error {
+	rw, err := aof.beginRewrite(crypt)
+	if err != nil {
+		return err
+	}
+	if err := each(rw.emit); err != nil {
+		rw.abort()
+		return err
+	}
+	return aof.finishRewrite(rw)
+}
+
+// aofRewrite is a new log that's being written next to the current one.
+// Only beginRewrite and finishRewrite use the current log, so the commands
+// can be emitted while the current log is still being written to.
+type aofRewrite struct {
+	fs      vfs
+	f       vfsFile
+	aw      *aofWriter
+	tmppath string
+}
+
+func (aof *AOF) beginRewrite(crypt *crypter) (*aofRewrite, error) {
+	format := aof.aw.format
+	if crypt != nil {
+		format = aofEncrypt
+	} else if format == aofEncrypt {
+		format = aofPlain
+	}
+	tmppath := aof.path + ".rewrite"
+	f, err := vfsCreate(aof.fs, tmppath)
+	if err != nil {
+		return nil, err
+	}
+	rw := &aofRewrite{fs: aof.fs, f: f, tmppath: tmppath,
+		aw: newAOFWriter(f, format, aof.aw.encoding, crypt)}
+	if err := rw.aw.writeHeader(); err != nil {
+		rw.abort()
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *aofRewrite) emit(args ...[]byte) error {
+	const flushSize = 1024 * 1024
+	rw.aw.append(args...)
+	if len(rw.aw.buf) >= flushSize {
+		return rw.aw.flush()
+	}
+	return nil
+}
+
+func (rw *aofRewrite) abort() {
+	rw.f.Close()
+	rw.fs.Remove(rw.tmppath)
+}
+
+// finishRewrite syncs the new log and replaces the current one with it.
+func (aof *AOF) finishRewrite(rw *aofRewrite) error {
+	err := func() error {
+		if len(rw.aw.buf) > 0 {
+			if err := rw.aw.flush(); err != nil {
+				return err
+			}
+		}
+		if err := rw.f.Sync(); err != nil {
+			return err
+		}
+		return aof.fs.Rename(rw.tmppath, aof.path)
+	}()
+	if err != nil {
+		rw.abort()
+		return err
+	}
+	aof.f.Close()
+	aof.f = rw.f
+	aof.aw = rw.aw
+	// The log was replaced, so the rename must be durable before the
+	// writes that follow are acknowledged.
+	return aof.fs.SyncDir(filepath.Dir(aof.path))
+}
+
+// size returns the size of the log in bytes.
+func (aof *AOF) size() int64 {
+	return aof.aw.size
 }
 
 func (aof *AOF) Close() error {
@@ -0,0 +1,185 @@
+package kvbench
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// aofEncoding is the encoding of the commands in a log. The binary encoding
+// is a compact alternative to RESP. A record is an opcode byte that's
+// followed by the arguments, each with a uvarint length prefix. The set, del
+// and flushdb commands have their own opcodes, all other commands are
+// written with a uvarint argument count.
+type aofEncoding int
+
+const (
+	aofRESP aofEncoding = iota
+	aofBinary
+)
+
+// binaryMagic is the header of a binary log. It comes before the header of
+// a framed format.
+var binaryMagic = []byte("KVBBIN1\n")
+
+const (
+	binCommand = 0
+	binSet     = 1
+	binDel     = 2
+	binFlushDB = 3
+)
+
+var binSetName = []byte("set")
+var binDelName = []byte("del")
+var binFlushDBName = []byte("flushdb")
+
+func (enc aofEncoding) String() string {
+	if enc == aofBinary {
+		return "binary"
+	}
+	return "resp"
+}
+
+func parseAOFEncoding(s string) (aofEncoding, error) {
+	switch s {
+	case "resp":
+		return aofRESP, nil
+	case "binary":
+		return aofBinary, nil
+	}
+	return 0, fmt.Errorf("unknown log encoding: %v", s)
+}
+
+// eqFold compares a command name to a lowercase string.
+func eqFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	return append(buf, b[:n]...)
+}
+
+func appendBinaryArg(buf, arg []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(arg)))
+	return append(buf, arg...)
+}
+
+func appendBinaryCommand(buf []byte, args ...[]byte) []byte {
+	switch {
+	case len(args) == 3 && eqFold(args[0], "set"):
+		buf = append(buf, binSet)
+		buf = appendBinaryArg(buf, args[1])
+		return appendBinaryArg(buf, args[2])
+	case len(args) == 2 && eqFold(args[0], "del"):
+		buf = append(buf, binDel)
+		return appendBinaryArg(buf, args[1])
+	case len(args) == 1 && eqFold(args[0], "flushdb"):
+		return append(buf, binFlushDB)
+	}
+	buf = append(buf, binCommand)
+	buf = appendUvarint(buf, uint64(len(args)))
+	for _, arg := range args {
+		buf = appendBinaryArg(buf, arg)
+	}
+	return buf
+}
+
+func readUvarint(rd *bufio.Reader) (uint64, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readBinaryCommands reads binary encoded commands until EOF. The arguments
+// share one buffer that's reused for every command, so they are only valid
+// until the cmd function returns.
+func readBinaryCommands(rd *bufio.Reader, cmd func(args [][]byte) error) error {
+	var args [][]byte
+	var scratch []byte
+	var offs []int
+	for {
+		op, err := rd.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		args = args[:0]
+		var n int
+		switch op {
+		case binSet:
+			args, n = append(args, binSetName), 2
+		case binDel:
+			args, n = append(args, binDelName), 1
+		case binFlushDB:
+			args, n = append(args, binFlushDBName), 0
+		case binCommand:
+			un, err := readUvarint(rd)
+			if err != nil {
+				return err
+			}
+			if un > math.MaxInt32 {
+				return errInvalidLog
+			}
+			n = int(un)
+		default:
+			return errInvalidLog
+		}
+		scratch, offs = scratch[:0], offs[:0]
+		for i := 0; i < n; i++ {
+			l, err := readUvarint(rd)
+			if err != nil {
+				return err
+			}
+			if l > math.MaxInt32 {
+				return errInvalidLog
+			}
+			start := len(scratch)
+			if cap(scratch)-start < int(l) {
+				nscratch := make([]byte, start, cap(scratch)*2+int(l))
+				copy(nscratch, scratch)
+				scratch = nscratch
+			}
+			scratch = scratch[:start+int(l)]
+			if _, err := io.ReadFull(rd, scratch[start:]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			offs = append(offs, start)
+		}
+		for i := 0; i < n; i++ {
+			end := len(scratch)
+			if i+1 < n {
+				end = offs[i+1]
+			}
+			args = append(args, scratch[offs[i]:end:end])
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if err := cmd(args); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package kvbench
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestAOFBinaryReopen(t *testing.T) {
+	for _, which := range []string{"map", "btree", "mvcc", "art"} {
+		for _, encrypt := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s,encrypt=%v", which, encrypt), func(t *testing.T) {
+				opts := storeOptions{encoding: aofBinary}
+				if encrypt {
+					opts.crypt = testCrypter(t, 1)
+				}
+				path := filepath.Join(t.TempDir(), which+".db")
+				testReopen(t, which, path, opts)
+			})
+		}
+	}
+}
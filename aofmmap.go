@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package kvbench
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mmapShared is true when the writes to a file are visible in its mapping.
+const mmapShared = true
+
+// mmapFile maps the file into memory as read-only. The returned function
+// unmaps the file. A file that's not an OS file is read into memory, with
+// zeros past its end.
+func mmapFile(vf vfsFile, size int64) ([]byte, func() error, error) {
+	if size == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	f, ok := vf.(*os.File)
+	if !ok {
+		data := make([]byte, size)
+		if _, err := vf.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		return data, func() error { return nil }, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
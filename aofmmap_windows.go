@@ -0,0 +1,16 @@
+package kvbench
+
+import "io"
+
+// mmapShared is false because the mapping is a copy of the file.
+const mmapShared = false
+
+// mmapFile reads the file into memory, because there's no syscall.Mmap on
+// Windows. The data past the end of the file is zero.
+func mmapFile(f vfsFile, size int64) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,384 @@
+package kvbench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The parallel replay engine loads a log into the in-memory stores. The log
+// is memory-mapped and split into segments at record boundaries, which only
+// requires reading the record headers. The segments are parsed in parallel
+// and every set, del and flushdb is routed to a shard by the hash of its
+// key. Each shard then applies its mutations in log order, which leaves the
+// live keys of the log spread over the shards. A flushdb goes to every
+// shard.
+
+const (
+	replayOpSet = iota + 1
+	replayOpDel
+	replayOpFlushDB
+)
+
+type replayRecord struct {
+	op    byte
+	key   []byte
+	value []byte
+}
+
+// replayStats are the statistics of a replay.
+type replayStats struct {
+	count int
+	bytes int64
+	start time.Time
+}
+
+// logLoaded logs the number of replayed commands and the throughput.
+func (rs replayStats) logLoaded() {
+	if rs.count == 0 {
+		return
+	}
+	elapsed := time.Since(rs.start)
+	log.Printf("loaded %d commands in %s, %.2f MB/s", rs.count, elapsed,
+		float64(rs.bytes)/1024/1024/elapsed.Seconds())
+}
+
+// openAOFParallel opens the log at path and replays it in parallel. The
+// load function receives the live keys of the log in shards. Values are
+// only valid until the load function returns.
+func openAOFParallel(path string, opts storeOptions,
+	load func(shards []map[string][]byte),
+) (*AOF, replayStats, error) {
+	stats := replayStats{start: time.Now()}
+	aof, err := loadAOF(path, opts, func(f vfsFile, rd *bufio.Reader,
+		format aofFormat, encoding aofEncoding,
+	) error {
+		pos, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		data, unmap, err := mmapFile(f, fi.Size())
+		if err != nil {
+			return err
+		}
+		defer unmap()
+		stats.bytes = fi.Size()
+		body := data[pos-int64(rd.Buffered()):]
+		nshards := runtime.GOMAXPROCS(0)
+		shards, count, err := replayParallel(body, format, encoding, opts.crypt,
+			nshards)
+		if err != nil {
+			return err
+		}
+		stats.count = count
+		load(shards)
+		return nil
+	})
+	return aof, stats, err
+}
+
+// nextRecord parses the record at data[i:] and returns its arguments and
+// the offset of the next record. The arguments point into data.
+func nextRecord(data []byte, i int, encoding aofEncoding, args [][]byte,
+) ([][]byte, int, error) {
+	args = args[:0]
+	if encoding == aofBinary {
+		var n int
+		switch data[i] {
+		case binSet:
+			args, n = append(args, binSetName), 2
+		case binDel:
+			args, n = append(args, binDelName), 1
+		case binFlushDB:
+			args, n = append(args, binFlushDBName), 0
+		case binCommand:
+			un, sz := binary.Uvarint(data[i+1:])
+			if sz <= 0 {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+			if un > uint64(len(data)) {
+				return nil, 0, errInvalidLog
+			}
+			n = int(un)
+			i += sz
+		default:
+			return nil, 0, errInvalidLog
+		}
+		i++
+		for j := 0; j < n; j++ {
+			l, sz := binary.Uvarint(data[i:])
+			if sz <= 0 {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+			i += sz
+			if l > uint64(len(data)-i) {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+			args = append(args, data[i:i+int(l)])
+			i += int(l)
+		}
+		return args, i, nil
+	}
+	n, i, err := parseRESPLength(data, i, '*')
+	if err != nil {
+		return nil, 0, err
+	}
+	for j := 0; j < n; j++ {
+		var l int
+		l, i, err = parseRESPLength(data, i, '$')
+		if err != nil {
+			return nil, 0, err
+		}
+		if l+2 > len(data)-i {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		if data[i+l] != '\r' || data[i+l+1] != '\n' {
+			return nil, 0, errInvalidLog
+		}
+		args = append(args, data[i:i+l])
+		i += l + 2
+	}
+	return args, i, nil
+}
+
+// parseRESPLength parses a "*N\r\n" or "$N\r\n" header.
+func parseRESPLength(data []byte, i int, prefix byte) (int, int, error) {
+	if i >= len(data) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	if data[i] != prefix {
+		return 0, 0, errInvalidLog
+	}
+	i++
+	var n int
+	start := i
+	for ; i < len(data) && data[i] != '\r'; i++ {
+		c := data[i]
+		if c < '0' || c > '9' || i-start > 10 {
+			return 0, 0, errInvalidLog
+		}
+		n = n*10 + int(c-'0')
+	}
+	if i+1 >= len(data) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	if i == start || data[i+1] != '\n' {
+		return 0, 0, errInvalidLog
+	}
+	return n, i + 2, nil
+}
+
+// frameSize returns the size of the frame at data[i:], including its
+// header.
+func frameSize(data []byte, i int, format aofFormat) (int, error) {
+	hdr := 8
+	if format == aofEncrypt {
+		hdr = 4
+	}
+	if len(data)-i < hdr {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := hdr + int(binary.BigEndian.Uint32(data[i:]))
+	if n > len(data)-i {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// splitSegments splits the data at record or frame boundaries into
+// segments of about size bytes.
+func splitSegments(data []byte, format aofFormat, encoding aofEncoding,
+	size int,
+) ([][]byte, error) {
+	var segs [][]byte
+	var args [][]byte
+	var start, i int
+	for i < len(data) {
+		var err error
+		if format == aofPlain {
+			args, i, err = nextRecord(data, i, encoding, args)
+		} else {
+			var n int
+			n, err = frameSize(data, i, format)
+			i += n
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i-start >= size {
+			segs = append(segs, data[start:i])
+			start = i
+		}
+	}
+	if start < len(data) {
+		segs = append(segs, data[start:])
+	}
+	return segs, nil
+}
+
+// keyShard returns the shard of a key using FNV-1a.
+func keyShard(key []byte, nshards int) int {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return int(h % uint32(nshards))
+}
+
+// applyRecord applies a mutation to the keys of a shard.
+func applyRecord(keys map[string][]byte, rec replayRecord) map[string][]byte {
+	switch rec.op {
+	case replayOpSet:
+		keys[string(rec.key)] = rec.value
+	case replayOpDel:
+		delete(keys, string(rec.key))
+	case replayOpFlushDB:
+		keys = make(map[string][]byte)
+	}
+	return keys
+}
+
+// parseSegment parses the records of a segment and routes them to the
+// shards through the emit function.
+func parseSegment(seg []byte, format aofFormat, encoding aofEncoding,
+	framer aofFramer, nshards int, emit func(shard int, rec replayRecord),
+) (int, error) {
+	var count int
+	var args [][]byte
+	parse := func(data []byte) error {
+		for i := 0; i < len(data); {
+			var err error
+			args, i, err = nextRecord(data, i, encoding, args)
+			if err != nil {
+				return err
+			}
+			if len(args) == 0 {
+				continue
+			}
+			count++
+			switch {
+			case len(args) >= 3 && eqFold(args[0], "set"):
+				emit(keyShard(args[1], nshards),
+					replayRecord{replayOpSet, args[1], args[2]})
+			case len(args) >= 2 && eqFold(args[0], "del"):
+				emit(keyShard(args[1], nshards),
+					replayRecord{op: replayOpDel, key: args[1]})
+			case eqFold(args[0], "flushdb"):
+				for s := 0; s < nshards; s++ {
+					emit(s, replayRecord{op: replayOpFlushDB})
+				}
+			}
+		}
+		return nil
+	}
+	if framer == nil {
+		return count, parse(seg)
+	}
+	rd := bytes.NewReader(seg)
+	for {
+		// each frame gets its own buffer because the records point into it
+		data, err := framer.readFrame(rd, nil)
+		if err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+		if err := parse(data); err != nil {
+			return count, err
+		}
+	}
+}
+
+// replayParallel replays the log data that follows the header, using one
+// worker per shard.
+func replayParallel(data []byte, format aofFormat, encoding aofEncoding,
+	crypt *crypter, nshards int,
+) ([]map[string][]byte, int, error) {
+	size := len(data) / (nshards * 8)
+	if size < 1024*1024 {
+		size = 1024 * 1024
+	} else if size > 64*1024*1024 {
+		size = 64 * 1024 * 1024
+	}
+	segs, err := splitSegments(data, format, encoding, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	shards := make([]map[string][]byte, nshards)
+	for i := range shards {
+		shards[i] = make(map[string][]byte)
+	}
+	var count int
+	if nshards == 1 {
+		// no need for routing
+		framer := newAOFFramer(format, crypt)
+		emit := func(_ int, rec replayRecord) {
+			shards[0] = applyRecord(shards[0], rec)
+		}
+		for _, seg := range segs {
+			n, err := parseSegment(seg, format, encoding, framer, 1, emit)
+			if err != nil {
+				return nil, 0, err
+			}
+			count += n
+		}
+		return shards, count, nil
+	}
+	// The segments are processed in batches of one per worker, which
+	// bounds the memory used by the parsed records.
+	for len(segs) > 0 {
+		n := nshards
+		if n > len(segs) {
+			n = len(segs)
+		}
+		batch := segs[:n]
+		segs = segs[n:]
+		recs := make([][][]replayRecord, n)
+		counts := make([]int, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := range batch {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				recs[i] = make([][]replayRecord, nshards)
+				emit := func(s int, rec replayRecord) {
+					recs[i][s] = append(recs[i][s], rec)
+				}
+				counts[i], errs[i] = parseSegment(batch[i], format, encoding,
+					newAOFFramer(format, crypt), nshards, emit)
+			}(i)
+		}
+		wg.Wait()
+		for i := range batch {
+			if errs[i] != nil {
+				return nil, 0, errs[i]
+			}
+			count += counts[i]
+		}
+		for s := range shards {
+			wg.Add(1)
+			go func(s int) {
+				defer wg.Done()
+				keys := shards[s]
+				for i := range recs {
+					for _, rec := range recs[i][s] {
+						keys = applyRecord(keys, rec)
+					}
+				}
+				shards[s] = keys
+			}(s)
+		}
+		wg.Wait()
+	}
+	return shards, count, nil
+}
@@ -0,0 +1,161 @@
+package kvbench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testReplayLog returns the body of a log with the commands, one frame
+// for every flushEvery commands, and the keys that it holds.
+func testReplayLog(t *testing.T, format aofFormat, encoding aofEncoding,
+	crypt *crypter, cmds [][]string, flushEvery int,
+) ([]byte, map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	aw := newAOFWriter(&buf, format, encoding, crypt)
+	if err := aw.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	hdr := buf.Len()
+	want := make(map[string]string)
+	for i, cmd := range cmds {
+		args := make([][]byte, len(cmd))
+		for j := range cmd {
+			args[j] = []byte(cmd[j])
+		}
+		aw.append(args...)
+		if (i+1)%flushEvery == 0 || i == len(cmds)-1 {
+			if err := aw.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		switch cmd[0] {
+		case "set":
+			want[cmd[1]] = cmd[2]
+		case "del":
+			delete(want, cmd[1])
+		case "flushdb":
+			want = make(map[string]string)
+		}
+	}
+	return buf.Bytes()[hdr:], want
+}
+
+// testReplayCommands returns n sets with a del and a flushdb in the middle.
+func testReplayCommands(n, valueSize int) [][]string {
+	var cmds [][]string
+	value := strings.Repeat("v", valueSize)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key:%d", i%(n/3))
+		cmds = append(cmds, []string{"set", key, fmt.Sprint(i) + value})
+		switch i {
+		case n / 2:
+			cmds = append(cmds, []string{"flushdb"})
+		case n/2 + 10:
+			cmds = append(cmds, []string{"del", "key:5"})
+		}
+	}
+	return cmds
+}
+
+func TestSplitSegments(t *testing.T) {
+	cmds := testReplayCommands(300, 10)
+	for _, encoding := range []aofEncoding{aofRESP, aofBinary} {
+		data, _ := testReplayLog(t, aofPlain, encoding, nil, cmds, 1)
+		for _, size := range []int{1, 7, 100, 1000, len(data), 2 * len(data)} {
+			segs, err := splitSegments(data, aofPlain, encoding, size)
+			if err != nil {
+				t.Fatalf("%s %d: %v", encoding, size, err)
+			}
+			var count int
+			var joined []byte
+			for i, seg := range segs {
+				// every segment ends at a record boundary
+				var args [][]byte
+				for j := 0; j < len(seg); count++ {
+					if args, j, err = nextRecord(seg, j, encoding, args); err != nil {
+						t.Fatalf("%s %d: segment %d: %v", encoding, size, i, err)
+					}
+				}
+				if len(seg) < size && i < len(segs)-1 {
+					t.Fatalf("%s %d: segment %d has %d bytes",
+						encoding, size, i, len(seg))
+				}
+				joined = append(joined, seg...)
+			}
+			if !bytes.Equal(joined, data) || count != len(cmds) {
+				t.Fatalf("%s %d: got %d records in %d bytes, expected %d in %d",
+					encoding, size, count, len(joined), len(cmds), len(data))
+			}
+		}
+		// a torn tail, in the header and in the value of the last record
+		for _, cut := range []int{1, 5} {
+			_, err := splitSegments(data[:len(data)-cut], aofPlain, encoding, 100)
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s: cut %d: got %v, expected %v",
+					encoding, cut, err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+	// the frames of the framed formats are not split
+	data, _ := testReplayLog(t, aofChecksum, aofRESP, nil, cmds, 10)
+	segs, err := splitSegments(data, aofChecksum, aofRESP, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != (len(cmds)+9)/10 {
+		t.Fatalf("got %d segments, expected %d", len(segs), (len(cmds)+9)/10)
+	}
+	if _, err := splitSegments(data[:len(data)-1], aofChecksum, aofRESP,
+		1); err != io.ErrUnexpectedEOF {
+		t.Fatalf("torn frame: got %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReplayParallel(t *testing.T) {
+	// values large enough for a few segments of the minimum size, so that
+	// the flushdb is in the middle of one
+	cmds := testReplayCommands(3000, 1000)
+	tests := []struct {
+		format   aofFormat
+		encoding aofEncoding
+		crypt    *crypter
+	}{
+		{aofPlain, aofRESP, nil},
+		{aofPlain, aofBinary, nil},
+		{aofChecksum, aofRESP, nil},
+		{aofCompress, aofBinary, nil},
+		{aofEncrypt, aofRESP, testCrypter(t, 1)},
+		{aofEncrypt, aofBinary, testCrypter(t, 1)},
+	}
+	for _, tc := range tests {
+		data, want := testReplayLog(t, tc.format, tc.encoding, tc.crypt, cmds, 7)
+		for _, nshards := range []int{1, 3, 8} {
+			name := fmt.Sprintf("%s,%s,%d", tc.format, tc.encoding, nshards)
+			shards, count, err := replayParallel(data, tc.format, tc.encoding,
+				tc.crypt, nshards)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if count != len(cmds) {
+				t.Fatalf("%s: got %d commands, expected %d", name, count, len(cmds))
+			}
+			got := make(map[string]string)
+			for i, shard := range shards {
+				for key, value := range shard {
+					if keyShard([]byte(key), nshards) != i {
+						t.Fatalf("%s: %s in shard %d", name, key, i)
+					}
+					got[key] = string(value)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: got %d keys, expected %d", name, len(got), len(want))
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package kvbench
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/match"
+)
+
+const aofUsage = `usage: kvbench aof <command> [options] path
+
+commands:
+  dump [--json] path                   print every command
+  stats path                           print command counts and sizes
+  grep [--json] pattern path           print commands with matching keys
+  convert [--format fmt] [--encoding enc] src dst
+                                       write src to dst using another format
+
+formats: plain, checksum, compress, encrypt
+encodings: resp, binary
+`
+
+// AOFCommand runs the "aof" subcommand, which inspects a log without
+// starting a server.
+func AOFCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(aofUsage)
+	}
+	fs := flag.NewFlagSet("aof "+args[0], flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "output JSON, one command per line")
+	keyFile := fs.String("keyfile", "", "key file of an encrypted log")
+	outFormat := fs.String("format", "plain", "output format for convert")
+	outEncoding := fs.String("encoding", "resp", "output encoding for convert")
+	outKeyFile := fs.String("out-keyfile", "", "key file for an encrypted output")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	var crypt *crypter
+	if *keyFile != "" {
+		var err error
+		if crypt, err = loadKeyFile(*keyFile); err != nil {
+			return err
+		}
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	switch args[0] {
+	case "dump":
+		if fs.NArg() != 1 {
+			return errors.New(aofUsage)
+		}
+		return aofDump(out, fs.Arg(0), crypt, "", *asJSON)
+	case "grep":
+		if fs.NArg() != 2 {
+			return errors.New(aofUsage)
+		}
+		return aofDump(out, fs.Arg(1), crypt, fs.Arg(0), *asJSON)
+	case "stats":
+		if fs.NArg() != 1 {
+			return errors.New(aofUsage)
+		}
+		return aofStats(out, fs.Arg(0), crypt)
+	case "convert":
+		if fs.NArg() != 2 {
+			return errors.New(aofUsage)
+		}
+		format, err := parseAOFFormat(*outFormat)
+		if err != nil {
+			return err
+		}
+		encoding, err := parseAOFEncoding(*outEncoding)
+		if err != nil {
+			return err
+		}
+		var outCrypt *crypter
+		if format == aofEncrypt {
+			if *outKeyFile == "" {
+				return errors.New("--out-keyfile is required for the encrypt format")
+			}
+			if outCrypt, err = loadKeyFile(*outKeyFile); err != nil {
+				return err
+			}
+		}
+		return aofConvert(fs.Arg(0), crypt, fs.Arg(1), format, encoding,
+			outCrypt)
+	}
+	return fmt.Errorf("unknown aof command: %v", args[0])
+}
+
+// scanAOF reads every command in the log at path.
+func scanAOF(path string, crypt *crypter, cmd func(args [][]byte) error,
+) (aofFormat, aofEncoding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return readAOF(bufio.NewReader(f), crypt, cmd)
+}
+
+// aofDump prints the commands of a log. When a pattern is provided, only
+// the commands with a matching key are printed.
+func aofDump(w io.Writer, path string, crypt *crypter, pattern string,
+	asJSON bool,
+) error {
+	var n int
+	var line []byte
+	_, _, err := scanAOF(path, crypt, func(args [][]byte) error {
+		n++
+		if pattern != "" {
+			if len(args) < 2 || !match.Match(string(args[1]), pattern) {
+				return nil
+			}
+		}
+		line = line[:0]
+		if asJSON {
+			sargs := make([]string, len(args))
+			for i := range args {
+				sargs[i] = string(args[i])
+			}
+			data, err := json.Marshal(struct {
+				N    int      `json:"n"`
+				Args []string `json:"args"`
+			}{n, sargs})
+			if err != nil {
+				return err
+			}
+			line = append(line, data...)
+		} else {
+			line = strconv.AppendInt(line, int64(n), 10)
+			line = append(line, ')')
+			for i, arg := range args {
+				line = append(line, ' ')
+				if i == 0 {
+					line = append(line, strings.ToLower(string(arg))...)
+				} else {
+					line = strconv.AppendQuote(line, string(arg))
+				}
+			}
+		}
+		line = append(line, '\n')
+		_, err := w.Write(line)
+		return err
+	})
+	return err
+}
+
+// respSize returns the number of bytes that a command uses in RESP, which
+// is what the stats report regardless of the encoding of the log.
+func respSize(args [][]byte) int {
+	n := 1 + len(strconv.Itoa(len(args))) + 2
+	for _, arg := range args {
+		n += 1 + len(strconv.Itoa(len(arg))) + 2 + len(arg) + 2
+	}
+	return n
+}
+
+func aofStats(w io.Writer, path string, crypt *crypter) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	live := make(map[string]int)
+	var total, cmdBytes, sets, overwrites int
+	format, encoding, err := scanAOF(path, crypt, func(args [][]byte) error {
+		name := strings.ToLower(string(args[0]))
+		counts[name]++
+		total++
+		cmdBytes += respSize(args)
+		switch name {
+		case "set":
+			if len(args) >= 3 {
+				sets++
+				if _, ok := live[string(args[1])]; ok {
+					overwrites++
+				}
+				live[string(args[1])] = len(args[2])
+			}
+		case "del":
+			if len(args) >= 2 {
+				delete(live, string(args[1]))
+			}
+		case "flushdb":
+			live = make(map[string]int)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var liveBytes int
+	for key, vlen := range live {
+		liveBytes += len(key) + vlen
+	}
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ratio float64
+	if sets > 0 {
+		ratio = float64(overwrites) / float64(sets) * 100
+	}
+	fmt.Fprintf(w, "format:          %v\n", format)
+	fmt.Fprintf(w, "encoding:        %v\n", encoding)
+	fmt.Fprintf(w, "file bytes:      %d\n", fi.Size())
+	fmt.Fprintf(w, "command bytes:   %d\n", cmdBytes)
+	fmt.Fprintf(w, "commands:        %d\n", total)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-15s%d\n", name+":", counts[name])
+	}
+	fmt.Fprintf(w, "live keys:       %d\n", len(live))
+	fmt.Fprintf(w, "live bytes:      %d\n", liveBytes)
+	fmt.Fprintf(w, "overwrites:      %d (%.2f%% of sets)\n", overwrites, ratio)
+	return nil
+}
+
+// aofConvert writes the commands of the src log to a new dst log using
+// another format and encoding.
+func aofConvert(src string, crypt *crypter, dst string, format aofFormat,
+	encoding aofEncoding, outCrypt *crypter,
+) error {
+	const flushSize = 1024 * 1024
+	// the destination is replaced atomically, which also allows for
+	// converting a file in place
+	tmppath := dst + ".tmp"
+	f, err := os.Create(tmppath)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		aw := newAOFWriter(f, format, encoding, outCrypt)
+		if err := aw.writeHeader(); err != nil {
+			return err
+		}
+		_, _, err := scanAOF(src, crypt, func(args [][]byte) error {
+			aw.append(args...)
+			if len(aw.buf) >= flushSize {
+				return aw.flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(aw.buf) > 0 {
+			if err := aw.flush(); err != nil {
+				return err
+			}
+		}
+		return f.Sync()
+	}()
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmppath, dst)
+	}
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	return osFS{}.SyncDir(filepath.Dir(dst))
+}
@@ -0,0 +1,163 @@
+package kvbench
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testAOFCommands = [][]string{
+	{"set", "key:1", "value:1"},
+	{"set", "key:2", ""},
+	{"del", "key:1"},
+	{"flushdb"},
+	{"set", "key:3", strings.Repeat("x", 10000)},
+}
+
+// writeTestAOF writes the test commands to a new log at path.
+func writeTestAOF(t *testing.T, path string, format aofFormat,
+	encoding aofEncoding, crypt *crypter,
+) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	aw := newAOFWriter(f, format, encoding, crypt)
+	if err := aw.writeHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range testAOFCommands {
+		args := make([][]byte, len(cmd))
+		for i := range cmd {
+			args[i] = []byte(cmd[i])
+		}
+		aw.append(args...)
+		// a frame for every command
+		if err := aw.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestAOF returns the commands of the log at path.
+func readTestAOF(t *testing.T, path string, crypt *crypter,
+) ([][]string, aofFormat, aofEncoding) {
+	t.Helper()
+	var cmds [][]string
+	format, encoding, err := scanAOF(path, crypt, func(args [][]byte) error {
+		cmd := make([]string, len(args))
+		for i := range args {
+			cmd[i] = string(args[i])
+		}
+		cmds = append(cmds, cmd)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmds, format, encoding
+}
+
+func TestAOFConvert(t *testing.T) {
+	crypt := testCrypter(t, 1)
+	for format := aofPlain; format <= aofEncrypt; format++ {
+		for _, encoding := range []aofEncoding{aofRESP, aofBinary} {
+			name := fmt.Sprintf("%v-%v", format, encoding)
+			t.Run(name, func(t *testing.T) {
+				var fcrypt *crypter
+				if format == aofEncrypt {
+					fcrypt = crypt
+				}
+				dir := t.TempDir()
+				src := filepath.Join(dir, "src.aof")
+				dst := filepath.Join(dir, "dst.aof")
+				writeTestAOF(t, src, aofPlain, aofRESP, nil)
+				err := aofConvert(src, nil, dst, format, encoding, fcrypt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cmds, gformat, gencoding := readTestAOF(t, dst, fcrypt)
+				if gformat != format || gencoding != encoding {
+					t.Fatalf("got %v-%v", gformat, gencoding)
+				}
+				want, _, _ := readTestAOF(t, src, nil)
+				if !reflect.DeepEqual(cmds, want) {
+					t.Fatalf("got %q, expected %q", cmds, want)
+				}
+				// back to plain, in place
+				if err := aofConvert(dst, fcrypt, dst, aofPlain, aofRESP, nil); err != nil {
+					t.Fatal(err)
+				}
+				a, _ := ioutil.ReadFile(src)
+				b, _ := ioutil.ReadFile(dst)
+				if !bytes.Equal(a, b) {
+					t.Fatal("the converted log differs from the source")
+				}
+				if _, err := os.Stat(dst + ".tmp"); !os.IsNotExist(err) {
+					t.Fatalf("temporary file is left: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestAOFConvertFailureKeepsDst(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.aof")
+	dst := filepath.Join(dir, "dst.aof")
+	writeTestAOF(t, src, aofEncrypt, aofRESP, testCrypter(t, 1))
+	if err := ioutil.WriteFile(dst, []byte("keep"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// the wrong key
+	err := aofConvert(src, testCrypter(t, 2), dst, aofPlain, aofRESP, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != "keep" {
+		t.Fatalf("dst was changed: %q", data)
+	}
+}
+
+func TestAOFDumpStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.aof")
+	writeTestAOF(t, path, aofChecksum, aofBinary, nil)
+	tests := []struct {
+		name    string
+		run     func(w *bytes.Buffer) error
+		expects []string
+	}{
+		{"dump", func(w *bytes.Buffer) error {
+			return aofDump(w, path, nil, "", false)
+		}, []string{"key:1", "flushdb", "key:3"}},
+		{"grep", func(w *bytes.Buffer) error {
+			return aofDump(w, path, nil, "key:2", false)
+		}, []string{"key:2"}},
+		{"stats", func(w *bytes.Buffer) error {
+			return aofStats(w, path, nil)
+		}, []string{"commands:        5", "live keys:       1"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tc.run(&buf); err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.expects {
+				if !strings.Contains(buf.String(), s) {
+					t.Fatalf("%q not in:\n%s", s, buf.String())
+				}
+			}
+			if tc.name == "grep" && strings.Contains(buf.String(), "key:1") {
+				t.Fatalf("grep output has other keys:\n%s", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package kvbench
+
+import "bytes"
+
+// artTree is an adaptive radix tree. Inner nodes grow from 4 to 16, 48 and
+// 256 children and shrink back when children are removed. The common bytes
+// of a path are compressed into the prefix of a node. A key that ends at an
+// inner node, because it's a prefix of other keys, is kept in its leaf.
+
+const (
+	artLeaf uint8 = iota
+	artNode4
+	artNode16
+	artNode48
+	artNode256
+)
+
+type artEntry struct {
+	key   []byte
+	value []byte
+}
+
+type artNode struct {
+	kind   uint8
+	num    int
+	prefix []byte
+	leaf   *artEntry
+	// keys are the sorted key bytes of node4 and node16, and the child index
+	// plus one for every byte of node48.
+	keys     []byte
+	children []*artNode
+}
+
+type artTree struct {
+	root  *artNode
+	count int
+}
+
+func newARTLeaf(key, value []byte) *artNode {
+	return &artNode{kind: artLeaf, leaf: &artEntry{key, value}}
+}
+
+func newARTNode(kind uint8) *artNode {
+	n := &artNode{kind: kind}
+	switch kind {
+	case artNode4:
+		n.keys = make([]byte, 0, 4)
+		n.children = make([]*artNode, 0, 4)
+	case artNode16:
+		n.keys = make([]byte, 0, 16)
+		n.children = make([]*artNode, 0, 16)
+	case artNode48:
+		n.keys = make([]byte, 256)
+		n.children = make([]*artNode, 48)
+	case artNode256:
+		n.children = make([]*artNode, 256)
+	}
+	return n
+}
+
+// child returns the slot of the child for the byte, or nil.
+func (n *artNode) child(b byte) **artNode {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if k == b {
+				return &n.children[i]
+			}
+		}
+	case artNode48:
+		if i := n.keys[b]; i > 0 {
+			return &n.children[i-1]
+		}
+	case artNode256:
+		if n.children[b] != nil {
+			return &n.children[b]
+		}
+	}
+	return nil
+}
+
+// full returns true when the node can't hold another child.
+func (n *artNode) full() bool {
+	switch n.kind {
+	case artNode4:
+		return n.num == 4
+	case artNode16:
+		return n.num == 16
+	case artNode48:
+		return n.num == 48
+	}
+	return false
+}
+
+// addChild adds a child to a node that isn't full.
+func (n *artNode) addChild(b byte, c *artNode) {
+	switch n.kind {
+	case artNode4, artNode16:
+		i := 0
+		for i < len(n.keys) && n.keys[i] < b {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = b
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = c
+	case artNode48:
+		i := 0
+		for n.children[i] != nil {
+			i++
+		}
+		n.children[i] = c
+		n.keys[b] = byte(i + 1)
+	case artNode256:
+		n.children[b] = c
+	}
+	n.num++
+}
+
+func (n *artNode) removeChild(b byte) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if k == b {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				copy(n.children[i:], n.children[i+1:])
+				n.children[len(n.children)-1] = nil
+				n.children = n.children[:len(n.children)-1]
+				break
+			}
+		}
+	case artNode48:
+		n.children[n.keys[b]-1] = nil
+		n.keys[b] = 0
+	case artNode256:
+		n.children[b] = nil
+	}
+	n.num--
+}
+
+// each calls fn for every child in byte order.
+func (n *artNode) each(fn func(b byte, c *artNode) bool) bool {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i, k := range n.keys {
+			if !fn(k, n.children[i]) {
+				return false
+			}
+		}
+	case artNode48:
+		for b, i := range n.keys {
+			if i > 0 && !fn(byte(b), n.children[i-1]) {
+				return false
+			}
+		}
+	case artNode256:
+		for b, c := range n.children {
+			if c != nil && !fn(byte(b), c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resize returns a copy of the node of another kind.
+func (n *artNode) resize(kind uint8) *artNode {
+	n2 := newARTNode(kind)
+	n2.prefix = n.prefix
+	n2.leaf = n.leaf
+	n.each(func(b byte, c *artNode) bool {
+		n2.addChild(b, c)
+		return true
+	})
+	return n2
+}
+
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// setLeaf adds the leaf to a new node, either as its leaf or as a child.
+func (n *artNode) setLeaf(leaf *artNode, depth int) {
+	if len(leaf.leaf.key) == depth {
+		n.leaf = leaf.leaf
+	} else {
+		n.addChild(leaf.leaf.key[depth], leaf)
+	}
+}
+
+func (t *artTree) get(key []byte) ([]byte, bool) {
+	n := t.root
+	depth := 0
+	for n != nil {
+		if n.kind == artLeaf {
+			if bytes.Equal(n.leaf.key, key) {
+				return n.leaf.value, true
+			}
+			return nil, false
+		}
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil, false
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			if n.leaf == nil {
+				return nil, false
+			}
+			return n.leaf.value, true
+		}
+		c := n.child(key[depth])
+		if c == nil {
+			return nil, false
+		}
+		n = *c
+		depth++
+	}
+	return nil, false
+}
+
+// set inserts or replaces a key and returns true when it was replaced. The
+// key and value are not copied.
+func (t *artTree) set(key, value []byte) bool {
+	replaced := artInsert(&t.root, key, value, 0)
+	if !replaced {
+		t.count++
+	}
+	return replaced
+}
+
+func artInsert(ref **artNode, key, value []byte, depth int) bool {
+	n := *ref
+	if n == nil {
+		*ref = newARTLeaf(key, value)
+		return false
+	}
+	if n.kind == artLeaf {
+		if bytes.Equal(n.leaf.key, key) {
+			n.leaf.value = value
+			return true
+		}
+		p := commonPrefix(n.leaf.key[depth:], key[depth:])
+		nn := newARTNode(artNode4)
+		nn.prefix = key[depth : depth+p]
+		nn.setLeaf(n, depth+p)
+		nn.setLeaf(newARTLeaf(key, value), depth+p)
+		*ref = nn
+		return false
+	}
+	if p := commonPrefix(n.prefix, key[depth:]); p < len(n.prefix) {
+		nn := newARTNode(artNode4)
+		nn.prefix = n.prefix[:p]
+		nn.addChild(n.prefix[p], n)
+		n.prefix = n.prefix[p+1:]
+		nn.setLeaf(newARTLeaf(key, value), depth+p)
+		*ref = nn
+		return false
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf != nil {
+			n.leaf.value = value
+			return true
+		}
+		n.leaf = &artEntry{key, value}
+		return false
+	}
+	if c := n.child(key[depth]); c != nil {
+		return artInsert(c, key, value, depth+1)
+	}
+	if n.full() {
+		n = n.resize(n.kind + 1)
+		*ref = n
+	}
+	n.addChild(key[depth], newARTLeaf(key, value))
+	return false
+}
+
+// del deletes a key and returns true when it was found.
+func (t *artTree) del(key []byte) bool {
+	deleted := artDelete(&t.root, key, 0)
+	if deleted {
+		t.count--
+	}
+	return deleted
+}
+
+func artDelete(ref **artNode, key []byte, depth int) bool {
+	n := *ref
+	if n == nil {
+		return false
+	}
+	if n.kind == artLeaf {
+		if !bytes.Equal(n.leaf.key, key) {
+			return false
+		}
+		*ref = nil
+		return true
+	}
+	if !bytes.HasPrefix(key[depth:], n.prefix) {
+		return false
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf == nil {
+			return false
+		}
+		n.leaf = nil
+	} else {
+		c := n.child(key[depth])
+		if c == nil || !artDelete(c, key, depth+1) {
+			return false
+		}
+		if *c == nil {
+			n.removeChild(key[depth])
+		}
+	}
+	artShrink(ref)
+	return true
+}
+
+// artShrink replaces a node that has too few children.
+func artShrink(ref **artNode) {
+	n := *ref
+	switch {
+	case n.num == 0:
+		if n.leaf == nil {
+			*ref = nil
+		} else {
+			*ref = &artNode{kind: artLeaf, leaf: n.leaf}
+		}
+	case n.num == 1 && n.leaf == nil:
+		// merge with the only child
+		n.each(func(b byte, c *artNode) bool {
+			if c.kind != artLeaf {
+				prefix := make([]byte, 0, len(n.prefix)+1+len(c.prefix))
+				prefix = append(prefix, n.prefix...)
+				prefix = append(prefix, b)
+				c.prefix = append(prefix, c.prefix...)
+			}
+			*ref = c
+			return false
+		})
+	case n.kind == artNode16 && n.num <= 3:
+		*ref = n.resize(artNode4)
+	case n.kind == artNode48 && n.num <= 12:
+		*ref = n.resize(artNode16)
+	case n.kind == artNode256 && n.num <= 37:
+		*ref = n.resize(artNode48)
+	}
+}
+
+// seekPrefix returns the subtree that holds every key with the prefix.
+func (t *artTree) seekPrefix(prefix []byte) *artNode {
+	n := t.root
+	depth := 0
+	for n != nil {
+		if n.kind == artLeaf {
+			if bytes.HasPrefix(n.leaf.key, prefix) {
+				return n
+			}
+			return nil
+		}
+		for _, b := range n.prefix {
+			if depth == len(prefix) {
+				return n
+			}
+			if b != prefix[depth] {
+				return nil
+			}
+			depth++
+		}
+		if depth == len(prefix) {
+			return n
+		}
+		c := n.child(prefix[depth])
+		if c == nil {
+			return nil
+		}
+		n = *c
+		depth++
+	}
+	return nil
+}
+
+// ascend calls iter for every key of the subtree in order.
+func (n *artNode) ascend(iter func(key, value []byte) bool) bool {
+	if n == nil {
+		return true
+	}
+	if n.leaf != nil && !iter(n.leaf.key, n.leaf.value) {
+		return false
+	}
+	return n.each(func(b byte, c *artNode) bool {
+		return c.ascend(iter)
+	})
+}
+
+// ascendFrom calls iter in order for every key of the subtree that isn't
+// less than start, where depth is the number of key bytes above the node.
+func (n *artNode) ascendFrom(start []byte, depth int,
+	iter func(key, value []byte) bool,
+) bool {
+	if n == nil {
+		return true
+	}
+	if n.kind == artLeaf {
+		if bytes.Compare(n.leaf.key, start) < 0 {
+			return true
+		}
+		return iter(n.leaf.key, n.leaf.value)
+	}
+	for _, b := range n.prefix {
+		if depth == len(start) || b > start[depth] {
+			return n.ascend(iter)
+		}
+		if b < start[depth] {
+			return true
+		}
+		depth++
+	}
+	if depth == len(start) {
+		return n.ascend(iter)
+	}
+	// the key of the leaf is a prefix of start, so it's less
+	return n.each(func(b byte, c *artNode) bool {
+		switch {
+		case b < start[depth]:
+			return true
+		case b == start[depth]:
+			return c.ascendFrom(start, depth+1, iter)
+		}
+		return c.ascend(iter)
+	})
+}
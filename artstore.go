@@ -0,0 +1,212 @@
+package kvbench
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/match"
+)
+
+type artStore struct {
+	mu  sync.RWMutex
+	tr  *artTree
+	aof *AOF
+}
+
+func newARTStore(path string, opts storeOptions) (*artStore, error) {
+	tr := &artTree{}
+	var err error
+	var aof *AOF
+	if path == ":memory:" {
+		log.Printf("persistance disabled")
+	} else {
+		var stats replayStats
+		aof, stats, err = openAOFParallel(path, opts,
+			func(shards []map[string][]byte) {
+				for _, shard := range shards {
+					for key, value := range shard {
+						tr.set([]byte(key), bcopy(value))
+					}
+				}
+			})
+		if err != nil {
+			return nil, err
+		}
+		stats.logLoaded()
+	}
+	return &artStore{
+		aof: aof,
+		tr:  tr,
+	}, nil
+}
+
+func (s *artStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof != nil {
+		s.aof.Close()
+	}
+	return nil
+}
+
+func (s *artStore) PSet(keys, values [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof != nil {
+		s.aof.BeginBuffer()
+		for i := range keys {
+			s.aof.AppendBuffer([]byte("set"), keys[i], values[i])
+		}
+		err := s.aof.WriteBuffer()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range keys {
+		s.tr.set(bcopy(keys[i]), bcopy(values[i]))
+	}
+	return nil
+}
+
+func (s *artStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var values [][]byte
+	var oks []bool
+	for i := range keys {
+		v, ok := s.tr.get(keys[i])
+		values = append(values, v)
+		oks = append(oks, ok)
+	}
+	return values, oks, nil
+}
+
+func (s *artStore) Set(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof != nil {
+		if err := s.aof.Write([]byte("set"), key, value); err != nil {
+			return err
+		}
+	}
+	s.tr.set(bcopy(key), bcopy(value))
+	return nil
+}
+
+func (s *artStore) Get(key []byte) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.tr.get(key)
+	return v, ok, nil
+}
+
+func (s *artStore) Del(key []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tr.get(key); !ok {
+		return false, nil
+	}
+	if s.aof != nil {
+		if err := s.aof.Write([]byte("del"), key); err != nil {
+			return false, err
+		}
+	}
+	s.tr.del(key)
+	return true, nil
+}
+
+// Keys descends directly to the subtree of the literal prefix of the
+// pattern.
+func (s *artStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spattern := string(pattern)
+	prefix, _ := match.Allowable(spattern)
+	if i := strings.IndexAny(spattern, "?[\\"); i >= 0 && i < len(prefix) {
+		prefix = prefix[:i]
+	}
+	var keys [][]byte
+	var vals [][]byte
+	s.tr.seekPrefix([]byte(prefix)).ascend(func(key, value []byte) bool {
+		if limit > -1 && len(keys) >= limit {
+			return false
+		}
+		if match.Match(string(key), spattern) {
+			keys = append(keys, bcopy(key))
+			if withvalues {
+				vals = append(vals, bcopy(value))
+			}
+		}
+		return true
+	})
+	return keys, vals, nil
+}
+
+// keysFrom seeks to the start key, or to the literal prefix of the pattern
+// when it's greater, and stops after the keys with the prefix.
+func (s *artStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spattern := string(pattern)
+	prefix, _ := match.Allowable(spattern)
+	if i := strings.IndexAny(spattern, "?[\\"); i >= 0 && i < len(prefix) {
+		prefix = prefix[:i]
+	}
+	if bytes.Compare(start, []byte(prefix)) < 0 {
+		start = []byte(prefix)
+	}
+	var keys [][]byte
+	var vals [][]byte
+	s.tr.root.ascendFrom(start, 0, func(key, value []byte) bool {
+		if limit > -1 && len(keys) >= limit {
+			return false
+		}
+		if !bytes.HasPrefix(key, []byte(prefix)) {
+			return false
+		}
+		if match.Match(string(key), spattern) {
+			keys = append(keys, bcopy(key))
+			if withvalues {
+				vals = append(vals, bcopy(value))
+			}
+		}
+		return true
+	})
+	return keys, vals, nil
+}
+
+func (s *artStore) FlushDB() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof != nil {
+		if err := s.aof.Write([]byte("flushdb")); err != nil {
+			return err
+		}
+	}
+	s.tr = &artTree{}
+	return nil
+}
+
+func (s *artStore) rotateKey(crypt *crypter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof == nil {
+		return nil
+	}
+	return s.aof.Rewrite(crypt, func(emit func(args ...[]byte) error) error {
+		var err error
+		s.tr.root.ascend(func(key, value []byte) bool {
+			err = emit([]byte("set"), key, value)
+			return err == nil
+		})
+		return err
+	})
+}
+
+func (s *artStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.tr.root.ascend(iter)
+	return nil
+}
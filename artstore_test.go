@@ -0,0 +1,13 @@
+package kvbench
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestARTReopen(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "art.db")
+		testReopen(t, "art", path, storeOptions{fsync: fsync})
+	}
+}
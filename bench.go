@@ -0,0 +1,567 @@
+package kvbench
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const benchUsage = `usage: kvbench bench [options]
+
+Sends a mix of commands to a kvbench server, or any other RESP server, and
+reports the throughput and latency of every command.
+
+commands: set, get, del, mset, scan
+`
+
+type benchOp int
+
+const (
+	benchSet benchOp = iota
+	benchGet
+	benchDel
+	benchMSet
+	benchScan
+	numBenchOps
+)
+
+var benchOpNames = [numBenchOps]string{"set", "get", "del", "mset", "scan"}
+
+// parseBenchMix parses the weights of the commands, such as
+// "set:50,get:50". A command without a weight has the weight 1.
+func parseBenchMix(s string) ([numBenchOps]int, error) {
+	var mix [numBenchOps]int
+	var total int
+	for _, part := range strings.Split(s, ",") {
+		name, value := strings.ToLower(strings.TrimSpace(part)), "1"
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name, value = name[:i], name[i+1:]
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 0 {
+			return mix, fmt.Errorf("invalid weight: %v", value)
+		}
+		op := benchOp(-1)
+		for i, opName := range benchOpNames {
+			if name == opName {
+				op = benchOp(i)
+			}
+		}
+		if op < 0 {
+			return mix, fmt.Errorf("unknown command: %v", name)
+		}
+		mix[op] = weight
+		total += weight
+	}
+	if total == 0 {
+		return mix, errors.New("no commands in the mix")
+	}
+	return mix, nil
+}
+
+type benchConfig struct {
+	addr     string
+	clients  int
+	pipeline int
+	// requests is the number of requests to send, unless duration is set.
+	requests int64
+	duration time.Duration
+	// warmup is the time that requests are sent before they're measured.
+	warmup    time.Duration
+	keyspace  int64
+	keyPrefix string
+	// sizes are the value sizes, and the values compress to about
+	// compressRatio of their size.
+	sizes         valueSizes
+	compressRatio float64
+	mix           [numBenchOps]int
+	msetKeys      int
+	scanCount     int
+	// dist chooses the keys, every client uses a clone. Nil is uniform.
+	dist keyDist
+	// useKeys is set when the scan command uses KEYS with a LIMIT instead of
+	// SCAN, which is the case for a kvbench server.
+	useKeys bool
+}
+
+// benchResult are the measured requests of every command.
+type benchResult struct {
+	count   [numBenchOps]int64
+	errors  [numBenchOps]int64
+	hists   [numBenchOps]*hdrHist
+	elapsed time.Duration
+}
+
+// benchHighest is the highest latency that the histograms of a benchmark
+// tell apart.
+const benchHighest = int64(time.Hour)
+
+func newBenchResult() *benchResult {
+	res := new(benchResult)
+	for op := range res.hists {
+		res.hists[op] = newHDRHist(benchHighest, 3)
+	}
+	return res
+}
+
+// BenchCommand runs the "bench" subcommand, a load generator that doesn't
+// need redis-benchmark.
+func BenchCommand(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), benchUsage+"\noptions:\n")
+		fs.PrintDefaults()
+	}
+	var cfg benchConfig
+	fs.StringVar(&cfg.addr, "addr", "127.0.0.1:6380", "server address")
+	fs.IntVar(&cfg.clients, "clients", 50, "number of connections")
+	fs.IntVar(&cfg.pipeline, "pipeline", 1, "requests per pipeline")
+	fs.Int64Var(&cfg.requests, "requests", 100000, "number of requests")
+	fs.DurationVar(&cfg.duration, "duration", 0, "run for a duration instead of a number of requests")
+	fs.DurationVar(&cfg.warmup, "warmup", 0, "send requests for a duration before measuring")
+	fs.Int64Var(&cfg.keyspace, "keyspace", 100000, "number of distinct keys")
+	fs.StringVar(&cfg.keyPrefix, "key-prefix", "key:", "prefix of every key")
+	valueSize := fs.String("value-size", "100", "value size, such as 100 or 64mb, or the mean of a normal distribution")
+	valueDist := fs.String("value-dist", "constant", "value size distribution: constant,uniform,normal,histogram")
+	valueMin := fs.String("value-min", "0", "smallest value size of a uniform or normal distribution")
+	valueMax := fs.String("value-max", "", "largest value size of a uniform or normal distribution (default the value size, or twice that for normal)")
+	valueStddev := fs.String("value-stddev", "", "standard deviation of a normal distribution (default a quarter of the value size)")
+	valueHist := fs.String("value-hist", "", "histogram file with a value size and a weight on every line")
+	fs.Float64Var(&cfg.compressRatio, "compress-ratio", 1, "compressed size of the values divided by their size, where 1 is incompressible")
+	fs.IntVar(&cfg.msetKeys, "mset-keys", 10, "keys per MSET")
+	fs.IntVar(&cfg.scanCount, "scan-count", 10, "keys per scan")
+	mix := fs.String("mix", "set:50,get:50", "weights of the commands")
+	hgrm := fs.String("hgrm", "", "write the latency distribution of every command to <prefix>.<command>.hgrm")
+	workload := fs.String("workload", "", "YCSB core workload: a,b,c,d,e,f")
+	phase := fs.String("phase", "both", "phase of the YCSB workload: load,run,both")
+	var ycfg ycsbConfig
+	fs.IntVar(&ycfg.fieldCount, "field-count", 10, "fields per YCSB record")
+	fs.IntVar(&ycfg.fieldLength, "field-length", 100, "bytes per YCSB field")
+	fs.IntVar(&ycfg.maxScanLength, "max-scan-length", 100, "maximum keys per YCSB scan")
+	insertOrder := fs.String("insert-order", "hashed", "key order of the YCSB inserts: hashed,ordered")
+	keyDist := fs.String("key-dist", "", "key distribution: "+strings.Join(keyDistNames, ",")+" (default uniform, or the one of the workload)")
+	theta := fs.Float64("theta", zipfianTheta, "skew of the zipfian distributions")
+	hotKeys := fs.Float64("hotspot-keys", 0.2, "fraction of the keys in the hot set")
+	hotOps := fs.Float64("hotspot-ops", 0.8, "fraction of the requests to the hot set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New(benchUsage)
+	}
+	var err error
+	if cfg.mix, err = parseBenchMix(*mix); err != nil {
+		return err
+	}
+	switch {
+	case cfg.clients <= 0:
+		return fmt.Errorf("invalid --clients: %d", cfg.clients)
+	case cfg.pipeline <= 0:
+		return fmt.Errorf("invalid --pipeline: %d", cfg.pipeline)
+	case cfg.requests <= 0 && cfg.duration <= 0:
+		return fmt.Errorf("invalid --requests: %d", cfg.requests)
+	case cfg.keyspace <= 0:
+		return fmt.Errorf("invalid --keyspace: %d", cfg.keyspace)
+	case cfg.compressRatio <= 0 || cfg.compressRatio > 1:
+		return fmt.Errorf("invalid --compress-ratio: %v", cfg.compressRatio)
+	case cfg.msetKeys <= 0:
+		return fmt.Errorf("invalid --mset-keys: %d", cfg.msetKeys)
+	case cfg.scanCount <= 0:
+		return fmt.Errorf("invalid --scan-count: %d", cfg.scanCount)
+	}
+	cfg.sizes, err = parseValueSizes(*valueDist, *valueSize, *valueMin,
+		*valueMax, *valueStddev, *valueHist)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	dist := *keyDist
+	if *workload != "" {
+		if err := ycfg.setWorkload(*workload, *phase); err != nil {
+			return err
+		}
+		if dist == "" {
+			dist = ycfg.workload.dist
+		}
+	} else if dist == "" {
+		dist = "uniform"
+	}
+	cfg.dist, err = newKeyDist(dist, cfg.keyspace, *theta, *hotKeys, *hotOps)
+	if err != nil {
+		return err
+	}
+	if *workload != "" {
+		switch *insertOrder {
+		case "hashed":
+		case "ordered":
+			ycfg.ordered = true
+		default:
+			return fmt.Errorf("unknown insert order: %v", *insertOrder)
+		}
+		switch {
+		case cfg.pipeline != 1:
+			return errors.New("YCSB workloads send one request at a time")
+		case ycfg.fieldCount <= 0:
+			return fmt.Errorf("invalid --field-count: %d", ycfg.fieldCount)
+		case ycfg.fieldLength < 0:
+			return fmt.Errorf("invalid --field-length: %d", ycfg.fieldLength)
+		case ycfg.maxScanLength <= 0:
+			return fmt.Errorf("invalid --max-scan-length: %d",
+				ycfg.maxScanLength)
+		}
+		return runYCSB(out, &cfg, &ycfg, *hgrm)
+	}
+	res, err := runBench(&cfg)
+	if err != nil {
+		return err
+	}
+	printBench(out, &cfg, res)
+	if *hgrm != "" {
+		return writeBenchHgrm(*hgrm, res)
+	}
+	return nil
+}
+
+// benchClient is a connection that sends pipelines of random commands.
+type benchClient struct {
+	cfg  *benchConfig
+	conn net.Conn
+	rd   *bufio.Reader
+	rnd  *rand.Rand
+	dist keyDist
+	buf  []byte
+	ops  []benchOp
+	key  []byte
+	pool *valuePool
+	// total is the sum of the weights of the mix.
+	total int
+}
+
+func newBenchClient(cfg *benchConfig, pool *valuePool, seed int64,
+) (*benchClient, error) {
+	conn, err := net.Dial("tcp", cfg.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &benchClient{
+		cfg:  cfg,
+		conn: conn,
+		rd:   bufio.NewReader(conn),
+		rnd:  rand.New(rand.NewSource(seed)),
+		dist: uniformDist{},
+		pool: pool,
+	}
+	if cfg.dist != nil {
+		c.dist = cfg.dist.clone()
+	}
+	for _, weight := range cfg.mix {
+		c.total += weight
+	}
+	return c, nil
+}
+
+// do sends one command and reads its reply.
+func (c *benchClient) do(args ...[]byte) (respReply, error) {
+	c.buf = appendCommand(c.buf[:0], args...)
+	if _, err := c.conn.Write(c.buf); err != nil {
+		return respReply{}, err
+	}
+	return readReply(c.rd)
+}
+
+func (c *benchClient) nextOp() benchOp {
+	n := c.rnd.Intn(c.total)
+	for op, weight := range c.cfg.mix {
+		if n < weight {
+			return benchOp(op)
+		}
+		n -= weight
+	}
+	return benchGet
+}
+
+// nextKey returns a key of the keyspace, chosen by the key distribution.
+// The key is only valid until the next call.
+func (c *benchClient) nextKey() []byte {
+	return c.appendKey(c.cfg.keyPrefix, c.dist.next(c.rnd, c.cfg.keyspace))
+}
+
+// nextValue returns a value of a size of the value size distribution.
+func (c *benchClient) nextValue() []byte {
+	return c.pool.value(c.rnd, c.cfg.sizes.next(c.rnd))
+}
+
+// appendKey returns the key of the number, which is zero padded so that
+// the key order is the number order. The key is only valid until the next
+// call.
+func (c *benchClient) appendKey(prefix string, n int64) []byte {
+	c.key = append(c.key[:0], prefix...)
+	var num [20]byte
+	digits := strconv.AppendInt(num[:0], n, 10)
+	for i := len(digits); i < 12; i++ {
+		c.key = append(c.key, '0')
+	}
+	c.key = append(c.key, digits...)
+	return c.key
+}
+
+func (c *benchClient) appendOp(op benchOp) {
+	switch op {
+	case benchSet:
+		c.buf = appendCommand(c.buf, []byte("set"), c.nextKey(),
+			c.nextValue())
+	case benchGet:
+		c.buf = appendCommand(c.buf, []byte("get"), c.nextKey())
+	case benchDel:
+		c.buf = appendCommand(c.buf, []byte("del"), c.nextKey())
+	case benchMSet:
+		args := make([][]byte, 1, 1+c.cfg.msetKeys*2)
+		args[0] = []byte("mset")
+		for i := 0; i < c.cfg.msetKeys; i++ {
+			args = append(args, append([]byte(nil), c.nextKey()...),
+				c.nextValue())
+		}
+		c.buf = appendCommand(c.buf, args...)
+	case benchScan:
+		pattern := []byte(c.cfg.keyPrefix + "*")
+		count := []byte(strconv.Itoa(c.cfg.scanCount))
+		if c.cfg.useKeys {
+			c.buf = appendCommand(c.buf, []byte("keys"), pattern,
+				[]byte("limit"), count)
+		} else {
+			c.buf = appendCommand(c.buf, []byte("scan"), []byte("0"),
+				[]byte("match"), pattern, []byte("count"), count)
+		}
+	}
+}
+
+// benchRun is the state that the clients of a run share.
+type benchRun struct {
+	res *benchResult
+	// remaining is the number of requests that aren't claimed yet.
+	remaining int64
+	stopped   int32
+	measure   time.Time
+	deadline  time.Time
+}
+
+// run sends pipelines until the requests are claimed, the deadline is
+// reached or the run is stopped. The requests before the start of the
+// measurement aren't recorded.
+func (c *benchClient) run(br *benchRun) error {
+	res := br.res
+	for atomic.LoadInt32(&br.stopped) == 0 {
+		now := time.Now()
+		warm := now.Before(br.measure)
+		n := c.cfg.pipeline
+		if !warm {
+			if c.cfg.duration > 0 {
+				if !now.Before(br.deadline) {
+					return nil
+				}
+			} else {
+				left := atomic.AddInt64(&br.remaining, -int64(n))
+				if left+int64(n) <= 0 {
+					return nil
+				}
+				if left < 0 {
+					n += int(left)
+				}
+			}
+		}
+		c.buf = c.buf[:0]
+		c.ops = c.ops[:0]
+		for i := 0; i < n; i++ {
+			op := c.nextOp()
+			c.ops = append(c.ops, op)
+			c.appendOp(op)
+		}
+		start := time.Now()
+		if _, err := c.conn.Write(c.buf); err != nil {
+			return err
+		}
+		for _, op := range c.ops {
+			_, err := readReply(c.rd)
+			if err != nil {
+				if _, ok := err.(remoteError); !ok {
+					return err
+				}
+			}
+			if warm {
+				continue
+			}
+			res.hists[op].record(int64(time.Since(start)))
+			atomic.AddInt64(&res.count[op], 1)
+			if err != nil {
+				atomic.AddInt64(&res.errors[op], 1)
+			}
+		}
+	}
+	return nil
+}
+
+// dialBenchClients connects the clients, which share the pool of values.
+func dialBenchClients(cfg *benchConfig) ([]*benchClient, error) {
+	seed := time.Now().UnixNano()
+	// the clients share the values
+	pool := newValuePool(cfg.sizes.max(), cfg.compressRatio,
+		rand.New(rand.NewSource(seed)))
+	clients := make([]*benchClient, 0, cfg.clients)
+	for i := 0; i < cfg.clients; i++ {
+		c, err := newBenchClient(cfg, pool, seed+int64(i))
+		if err != nil {
+			closeBenchClients(clients)
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+func closeBenchClients(clients []*benchClient) {
+	for _, c := range clients {
+		c.conn.Close()
+	}
+}
+
+// probeScan sets useKeys when the server doesn't know SCAN. A kvbench
+// server has KEYS with a LIMIT instead.
+func probeScan(cfg *benchConfig, c *benchClient) error {
+	_, err := c.do([]byte("scan"), []byte("0"), []byte("count"), []byte("1"))
+	if err != nil {
+		if _, ok := err.(remoteError); !ok {
+			return err
+		}
+		cfg.useKeys = true
+	}
+	return nil
+}
+
+// runBenchClients runs every client in its own goroutine. The first error
+// sets stopped, so that the other clients stop too.
+func runBenchClients(clients []*benchClient, stopped *int32,
+	run func(c *benchClient) error,
+) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *benchClient) {
+			defer wg.Done()
+			if err := run(c); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				atomic.StoreInt32(stopped, 1)
+			}
+		}(c)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// runBench connects the clients and runs the benchmark.
+func runBench(cfg *benchConfig) (*benchResult, error) {
+	clients, err := dialBenchClients(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBenchClients(clients)
+	if cfg.mix[benchScan] > 0 {
+		if err := probeScan(cfg, clients[0]); err != nil {
+			return nil, err
+		}
+	}
+	br := &benchRun{res: newBenchResult(), remaining: cfg.requests}
+	br.measure = time.Now().Add(cfg.warmup)
+	br.deadline = br.measure.Add(cfg.duration)
+	if err := runBenchClients(clients, &br.stopped, func(c *benchClient) error {
+		return c.run(br)
+	}); err != nil {
+		return nil, err
+	}
+	br.res.elapsed = time.Since(br.measure)
+	return br.res, nil
+}
+
+// benchPercentiles are the latency percentiles that are printed for every
+// command.
+var benchPercentiles = []float64{50, 90, 99, 99.9, 99.99, 100}
+
+func printBench(w io.Writer, cfg *benchConfig, res *benchResult) {
+	secs := res.elapsed.Seconds()
+	fmt.Fprintf(w, "addr: %s, clients: %d, pipeline: %d, keyspace: %d, value size: %v, compress ratio: %v\n",
+		cfg.addr, cfg.clients, cfg.pipeline, cfg.keyspace, cfg.sizes,
+		cfg.compressRatio)
+	fmt.Fprintf(w, "%-8s %10s %8s %12s %9s", "command", "requests", "errors",
+		"req/sec", "avg")
+	for _, p := range benchPercentiles {
+		if p == 100 {
+			fmt.Fprintf(w, " %9s", "max")
+		} else {
+			fmt.Fprintf(w, " %9s", "p"+strconv.FormatFloat(p, 'f', -1, 64))
+		}
+	}
+	fmt.Fprintf(w, "\n")
+	var total, errs int64
+	for op := range benchOpNames {
+		h := res.hists[op]
+		if res.count[op] == 0 {
+			continue
+		}
+		total += res.count[op]
+		errs += res.errors[op]
+		mean, _ := h.meanStdDev()
+		fmt.Fprintf(w, "%-8s %10d %8d %12.2f %9.3f", benchOpNames[op],
+			res.count[op], res.errors[op], float64(res.count[op])/secs,
+			mean/1e6)
+		for _, p := range benchPercentiles {
+			fmt.Fprintf(w, " %9.3f", float64(h.percentile(p))/1e6)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "%-8s %10d %8d %12.2f\n", "total", total, errs,
+		float64(total)/secs)
+	fmt.Fprintf(w, "%d requests in %.2f seconds, latencies in milliseconds\n",
+		total, secs)
+}
+
+// writeBenchHgrm writes the latency distribution of every command that was
+// sent to an HdrHistogram percentile file, in milliseconds.
+func writeBenchHgrm(prefix string, res *benchResult) error {
+	for op, h := range res.hists {
+		if h.total() == 0 {
+			continue
+		}
+		if err := writeHgrm(prefix+"."+benchOpNames[op]+".hgrm", h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHgrm(path string, h *hdrHist) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = h.writePercentiles(f, 1e6)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
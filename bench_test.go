@@ -0,0 +1,147 @@
+package kvbench
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseBenchMix(t *testing.T) {
+	tests := []struct {
+		s   string
+		mix [numBenchOps]int
+		err string
+	}{
+		{"set:50,get:50", [numBenchOps]int{50, 50, 0, 0, 0}, ""},
+		{"get", [numBenchOps]int{0, 1, 0, 0, 0}, ""},
+		{" SET:3 , scan ,mset:0", [numBenchOps]int{3, 0, 0, 0, 1}, ""},
+		{"del:2,set:1,get:1,mset:4,scan:5", [numBenchOps]int{1, 1, 2, 4, 5}, ""},
+		// the last weight of a command wins
+		{"set:1,set:7", [numBenchOps]int{7, 0, 0, 0, 0}, ""},
+		{"set:0,get:0", [numBenchOps]int{}, "no commands"},
+		{"set:-1", [numBenchOps]int{}, "invalid weight"},
+		{"set:x", [numBenchOps]int{}, "invalid weight"},
+		{"set:50,incr:50", [numBenchOps]int{}, "unknown command"},
+		{"", [numBenchOps]int{}, "unknown command"},
+	}
+	for _, tc := range tests {
+		mix, err := parseBenchMix(tc.s)
+		if tc.err == "" && (err != nil || mix != tc.mix) {
+			t.Fatalf("parseBenchMix(%q) = %v, %v", tc.s, mix, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("parseBenchMix(%q): %v", tc.s, err)
+		}
+	}
+}
+
+// countStore counts the writes that reach the store.
+type countStore struct {
+	Store
+	sets int64
+}
+
+func (s *countStore) Set(key, value []byte) error {
+	atomic.AddInt64(&s.sets, 1)
+	return s.Store.Set(key, value)
+}
+
+// testBenchConfig returns a config of a run against the server at addr.
+func testBenchConfig(t *testing.T, addr, mix string) *benchConfig {
+	t.Helper()
+	cfg := &benchConfig{addr: addr, clients: 3, pipeline: 4, keyspace: 1000,
+		keyPrefix: "key:", msetKeys: 3, scanCount: 5, compressRatio: 1}
+	var err error
+	if cfg.mix, err = parseBenchMix(mix); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.sizes, err = parseValueSizes("constant", "10", "0", "", "",
+		""); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// resultTotals returns the requests and the errors of every command, and
+// checks that every recorded request has a latency.
+func resultTotals(t *testing.T, res *benchResult) (count, errors int64) {
+	t.Helper()
+	for op := range res.count {
+		count += res.count[op]
+		errors += res.errors[op]
+		if n := res.hists[op].count; n != res.count[op] {
+			t.Fatalf("%d %s latencies for %d requests", n, benchOpNames[op],
+				res.count[op])
+		}
+	}
+	return count, errors
+}
+
+func TestBenchRun(t *testing.T) {
+	base, err := openStore("btree", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countStore{Store: base}
+	defer store.Close()
+	addr, _ := testServer(t, store)
+
+	// a number of requests that isn't a multiple of the pipelines
+	cfg := testBenchConfig(t, addr, "set:2,get:2,del:1,mset:1,scan:1")
+	cfg.requests = 1001
+	res, err := runBench(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.useKeys {
+		t.Fatal("expected KEYS instead of SCAN")
+	}
+	count, errs := resultTotals(t, res)
+	if count != cfg.requests || errs != 0 {
+		t.Fatalf("got %d requests and %d errors, expected %d", count, errs,
+			cfg.requests)
+	}
+	for op, n := range res.count {
+		if n == 0 {
+			t.Fatalf("no %s requests", benchOpNames[op])
+		}
+	}
+	var out bytes.Buffer
+	printBench(&out, cfg, res)
+	if !strings.Contains(out.String(), "1001 requests in") {
+		t.Fatalf("output:\n%s", out.String())
+	}
+
+	// the requests of the warmup aren't recorded
+	cfg = testBenchConfig(t, addr, "set")
+	cfg.requests = 500
+	cfg.warmup = 100 * time.Millisecond
+	atomic.StoreInt64(&store.sets, 0)
+	if res, err = runBench(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := resultTotals(t, res); count != cfg.requests {
+		t.Fatalf("got %d requests, expected %d", count, cfg.requests)
+	}
+	if sets := atomic.LoadInt64(&store.sets); sets <= cfg.requests {
+		t.Fatalf("%d sets reached the store, expected more than %d",
+			sets, cfg.requests)
+	}
+
+	// a duration instead of a number of requests
+	cfg = testBenchConfig(t, addr, "get")
+	cfg.duration = 200 * time.Millisecond
+	cfg.warmup = 50 * time.Millisecond
+	start := time.Now()
+	if res, err = runBench(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if res.elapsed < cfg.duration || time.Since(start) < cfg.warmup+cfg.duration {
+		t.Fatalf("ran for %s", res.elapsed)
+	}
+	if count, _ := resultTotals(t, res); count == 0 || count != res.count[benchGet] {
+		t.Fatalf("got %d requests, %d gets", count, res.count[benchGet])
+	}
+}
@@ -0,0 +1,764 @@
+package kvbench
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/match"
+)
+
+// The bitcask store is a log-structured hash table. Every write is appended
+// to the active data file and the in-memory keydir maps each key to the
+// location of its latest value, so a read is a single disk read. A record is
+// a CRC-32C, the key size and the value size, followed by the key and the
+// value. A delete writes a tombstone record, which has a value size of
+// 0xFFFFFFFF.
+//
+// The active data file is sealed once it reaches bitcaskMaxFileSize. A
+// background job writes a hint file for each sealed data file, which holds
+// the keydir entries of the data file and is loaded at startup instead of
+// the data file. The job also merges the data files into a single file
+// when at least half of the bytes of the sealed files are dead.
+
+const (
+	bitcaskMaxFileSize   = 64 * 1024 * 1024
+	bitcaskMergeInterval = 10 * time.Second
+	bitcaskMergeRatio    = 0.5
+	bitcaskHeaderSize    = 12
+	bitcaskTombstone     = math.MaxUint32
+)
+
+// bitcaskEntry is the location of a value in a data file.
+type bitcaskEntry struct {
+	fid  uint32
+	size uint32
+	pos  int64
+}
+
+// recordSize returns the size of the record of a key/value.
+func (e bitcaskEntry) recordSize(key string) int64 {
+	return bitcaskHeaderSize + int64(len(key)) + int64(e.size)
+}
+
+type bitcaskFile struct {
+	f    vfsFile
+	size int64
+	dead int64
+	// broken is set when a partial record couldn't be truncated, which
+	// must be done before the next write.
+	broken bool
+}
+
+type bitcaskStore struct {
+	mu     sync.RWMutex
+	fs     vfs
+	path   string
+	fsync  bool
+	keydir map[string]bitcaskEntry
+	files  map[uint32]*bitcaskFile
+	active uint32
+	buf    []byte
+
+	// merging is held by the background job, which allows for a FlushDB
+	// to wait for a running merge.
+	merging sync.Mutex
+	closed  chan struct{}
+	done    chan struct{}
+}
+
+func bitcaskDataPath(dir string, fid uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d.data", fid))
+}
+
+func bitcaskHintPath(dir string, fid uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d.hint", fid))
+}
+
+func newBitcaskStore(path string, opts storeOptions) (*bitcaskStore, error) {
+	if path == ":memory:" {
+		return nil, errMemoryNotAllowed
+	}
+	fs := opts.filesystem()
+	if err := fs.MkdirAll(path, 0777); err != nil {
+		return nil, err
+	}
+	s := &bitcaskStore{
+		fs:     fs,
+		path:   path,
+		fsync:  opts.fsync,
+		keydir: make(map[string]bitcaskEntry),
+		files:  make(map[uint32]*bitcaskFile),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	go s.background()
+	return s, nil
+}
+
+// load opens the data files and fills the keydir.
+func (s *bitcaskStore) load() error {
+	fids, err := bitcaskDataFiles(s.fs, s.path)
+	if err != nil {
+		return err
+	}
+	for i, fid := range fids {
+		last := i == len(fids)-1
+		flag := os.O_RDONLY
+		if last {
+			flag = os.O_RDWR | os.O_APPEND
+		}
+		f, err := s.fs.OpenFile(bitcaskDataPath(s.path, fid), flag, 0666)
+		if err != nil {
+			return err
+		}
+		bf := &bitcaskFile{f: f}
+		s.files[fid] = bf
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		bf.size = fi.Size()
+		if !last {
+			if ok, err := s.loadHint(fid); ok || err != nil {
+				continue
+			}
+		}
+		valid, err := bitcaskScan(f, func(key []byte, e bitcaskEntry) {
+			e.fid = fid
+			s.apply(string(key), e)
+		})
+		if err != nil {
+			return err
+		}
+		if valid < bf.size {
+			if !last {
+				return fmt.Errorf("%v: %v", bitcaskDataPath(s.path, fid),
+					errInvalidLog)
+			}
+			// torn write of the active file
+			log.Warningf("bitcask: truncating %d bytes of %s", bf.size-valid,
+				bitcaskDataPath(s.path, fid))
+			if err := f.Truncate(valid); err != nil {
+				return err
+			}
+			bf.size = valid
+		}
+	}
+	if len(fids) > 0 {
+		s.active = fids[len(fids)-1]
+		if s.files[s.active].size < bitcaskMaxFileSize {
+			return nil
+		}
+	}
+	return s.openActive(s.active + 1)
+}
+
+// bitcaskDataFiles returns the ids of the data files in dir, in order.
+func bitcaskDataFiles(fs vfs, dir string) ([]uint32, error) {
+	fis, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fids []uint32
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".data") {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(name, ".data"), 10, 32)
+		if err != nil {
+			continue
+		}
+		fids = append(fids, uint32(fid))
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	return fids, nil
+}
+
+// apply updates the keydir with an entry that was read from a data file or
+// a hint file.
+func (s *bitcaskStore) apply(key string, e bitcaskEntry) {
+	if old, ok := s.keydir[key]; ok {
+		s.files[old.fid].dead += old.recordSize(key)
+	}
+	if e.size == bitcaskTombstone {
+		delete(s.keydir, key)
+		s.files[e.fid].dead += bitcaskHeaderSize + int64(len(key))
+		return
+	}
+	s.keydir[key] = e
+}
+
+// bitcaskScan reads the records of a data file and returns the size of the
+// valid part of the file.
+func bitcaskScan(f vfsFile, fn func(key []byte, e bitcaskEntry)) (int64, error) {
+	rd := bufio.NewReaderSize(io.NewSectionReader(f, 0, math.MaxInt64), 256*1024)
+	var hdr [bitcaskHeaderSize]byte
+	var buf []byte
+	var pos int64
+	for {
+		if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return pos, nil
+			}
+			return pos, err
+		}
+		ksz := binary.BigEndian.Uint32(hdr[4:])
+		vsz := binary.BigEndian.Uint32(hdr[8:])
+		n := int64(ksz)
+		if vsz != bitcaskTombstone {
+			n += int64(vsz)
+		}
+		if n > bitcaskMaxFileSize*4 {
+			return pos, nil
+		}
+		if int64(cap(buf)) < n {
+			buf = make([]byte, n)
+		}
+		data := buf[:n]
+		if _, err := io.ReadFull(rd, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return pos, nil
+			}
+			return pos, err
+		}
+		sum := crc32.Update(crc32.Checksum(hdr[4:], crcTable), crcTable, data)
+		if sum != binary.BigEndian.Uint32(hdr[0:]) {
+			return pos, nil
+		}
+		fn(data[:ksz], bitcaskEntry{
+			size: vsz,
+			pos:  pos + bitcaskHeaderSize + int64(ksz),
+		})
+		pos += bitcaskHeaderSize + n
+	}
+}
+
+// loadHint loads the hint file of a data file. A missing or corrupt hint
+// file is ignored.
+func (s *bitcaskStore) loadHint(fid uint32) (bool, error) {
+	data, err := vfsReadFile(s.fs, bitcaskHintPath(s.path, fid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if len(data) < 4 {
+		return false, nil
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[len(body):]) {
+		log.Warningf("bitcask: ignoring corrupt %s", bitcaskHintPath(s.path, fid))
+		return false, nil
+	}
+	type hint struct {
+		key string
+		e   bitcaskEntry
+	}
+	var hints []hint
+	for len(body) > 0 {
+		if len(body) < 16 {
+			return false, nil
+		}
+		ksz := int(binary.BigEndian.Uint32(body[0:]))
+		if ksz > len(body)-16 {
+			return false, nil
+		}
+		hints = append(hints, hint{string(body[16 : 16+ksz]), bitcaskEntry{
+			fid:  fid,
+			size: binary.BigEndian.Uint32(body[4:]),
+			pos:  int64(binary.BigEndian.Uint64(body[8:])),
+		}})
+		body = body[16+ksz:]
+	}
+	for _, h := range hints {
+		s.apply(h.key, h.e)
+	}
+	return true, nil
+}
+
+// writeHint writes the hint file of a sealed data file.
+func (s *bitcaskStore) writeHint(fid uint32, f vfsFile) error {
+	var buf []byte
+	_, err := bitcaskScan(f, func(key []byte, e bitcaskEntry) {
+		var hdr [16]byte
+		binary.BigEndian.PutUint32(hdr[0:], uint32(len(key)))
+		binary.BigEndian.PutUint32(hdr[4:], e.size)
+		binary.BigEndian.PutUint64(hdr[8:], uint64(e.pos))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, key...)
+	})
+	if err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(buf, crcTable))
+	buf = append(buf, sum[:]...)
+	return writeFileAtomic(s.fs, bitcaskHintPath(s.path, fid), buf)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path,
+// and syncs the directory.
+func writeFileAtomic(fs vfs, path string, data []byte) error {
+	tmppath := path + ".tmp"
+	f, err := vfsCreate(fs, tmppath)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = fs.Rename(tmppath, path)
+	}
+	if err != nil {
+		fs.Remove(tmppath)
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(path))
+}
+
+func (s *bitcaskStore) openActive(fid uint32) error {
+	f, err := s.fs.OpenFile(bitcaskDataPath(s.path, fid),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	s.files[fid] = &bitcaskFile{f: f}
+	s.active = fid
+	// the new file, and the removes of a flush
+	return s.fs.SyncDir(s.path)
+}
+
+// appendRecord appends a record to the write buffer and returns the entry of
+// its value.
+func (s *bitcaskStore) appendRecord(key, value []byte, tombstone bool) bitcaskEntry {
+	vsz := uint32(len(value))
+	if tombstone {
+		vsz, value = bitcaskTombstone, nil
+	}
+	var hdr [bitcaskHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(key)))
+	binary.BigEndian.PutUint32(hdr[8:], vsz)
+	sum := crc32.Checksum(hdr[4:], crcTable)
+	sum = crc32.Update(sum, crcTable, key)
+	sum = crc32.Update(sum, crcTable, value)
+	binary.BigEndian.PutUint32(hdr[0:], sum)
+	pos := s.files[s.active].size + int64(len(s.buf))
+	s.buf = append(s.buf, hdr[:]...)
+	s.buf = append(s.buf, key...)
+	s.buf = append(s.buf, value...)
+	return bitcaskEntry{
+		fid:  s.active,
+		size: vsz,
+		pos:  pos + bitcaskHeaderSize + int64(len(key)),
+	}
+}
+
+// write writes the buffered records to the active file, which is sealed
+// when it's full.
+func (s *bitcaskStore) write() error {
+	bf := s.files[s.active]
+	if bf.broken {
+		if err := bf.f.Truncate(bf.size); err != nil {
+			s.buf = s.buf[:0]
+			return err
+		}
+		bf.broken = false
+	}
+	n, err := bf.f.Write(s.buf)
+	s.buf = s.buf[:0]
+	if err != nil {
+		// drop a partial record, which would hide the records that are
+		// written after it
+		if n > 0 && bf.f.Truncate(bf.size) != nil {
+			bf.broken = true
+		}
+		return err
+	}
+	bf.size += int64(n)
+	if s.fsync {
+		if err := bf.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if bf.size >= bitcaskMaxFileSize {
+		return s.openActive(s.active + 1)
+	}
+	return nil
+}
+
+// set updates the keydir after a record was written.
+func (s *bitcaskStore) set(key string, e bitcaskEntry) {
+	if old, ok := s.keydir[key]; ok {
+		s.files[old.fid].dead += old.recordSize(key)
+	}
+	s.keydir[key] = e
+}
+
+func (s *bitcaskStore) read(e bitcaskEntry) ([]byte, error) {
+	value := make([]byte, e.size)
+	if _, err := s.files[e.fid].f.ReadAt(value, e.pos); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (s *bitcaskStore) closeFiles() {
+	for _, bf := range s.files {
+		bf.f.Close()
+	}
+}
+
+func (s *bitcaskStore) Close() error {
+	close(s.closed)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeFiles()
+	return nil
+}
+
+func (s *bitcaskStore) PSet(keys, values [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	es := make([]bitcaskEntry, len(keys))
+	for i := range keys {
+		es[i] = s.appendRecord(keys[i], values[i], false)
+	}
+	if err := s.write(); err != nil {
+		return err
+	}
+	for i := range keys {
+		s.set(string(keys[i]), es[i])
+	}
+	return nil
+}
+
+func (s *bitcaskStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var values [][]byte
+	var oks []bool
+	for i := range keys {
+		e, ok := s.keydir[string(keys[i])]
+		if !ok {
+			values = append(values, nil)
+			oks = append(oks, false)
+			continue
+		}
+		value, err := s.read(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, value)
+		oks = append(oks, true)
+	}
+	return values, oks, nil
+}
+
+func (s *bitcaskStore) Set(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.appendRecord(key, value, false)
+	if err := s.write(); err != nil {
+		return err
+	}
+	s.set(string(key), e)
+	return nil
+}
+
+func (s *bitcaskStore) Get(key []byte) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.keydir[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+	value, err := s.read(e)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *bitcaskStore) Del(key []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.keydir[string(key)]
+	if !ok {
+		return false, nil
+	}
+	fid := s.active
+	s.appendRecord(key, nil, true)
+	if err := s.write(); err != nil {
+		return false, err
+	}
+	s.files[old.fid].dead += old.recordSize(string(key))
+	s.files[fid].dead += bitcaskHeaderSize + int64(len(key))
+	delete(s.keydir, string(key))
+	return true, nil
+}
+
+func (s *bitcaskStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spattern := string(pattern)
+	var keys [][]byte
+	var vals [][]byte
+	for key, e := range s.keydir {
+		if limit > -1 && len(keys) >= limit {
+			break
+		}
+		if match.Match(key, spattern) {
+			keys = append(keys, []byte(key))
+			if withvalues {
+				value, err := s.read(e)
+				if err != nil {
+					return nil, nil, err
+				}
+				vals = append(vals, value)
+			}
+		}
+	}
+	return keys, vals, nil
+}
+
+func (s *bitcaskStore) FlushDB() error {
+	s.merging.Lock()
+	defer s.merging.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.active + 1
+	for fid, bf := range s.files {
+		bf.f.Close()
+		delete(s.files, fid)
+	}
+	// The files are removed in order. A crash leaves a suffix of the data
+	// files, which never brings back a key that was deleted before the
+	// flush.
+	fids, err := bitcaskDataFiles(s.fs, s.path)
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		s.fs.Remove(bitcaskHintPath(s.path, fid))
+		if err := s.fs.Remove(bitcaskDataPath(s.path, fid)); err != nil {
+			return err
+		}
+	}
+	s.keydir = make(map[string]bitcaskEntry)
+	return s.openActive(next)
+}
+
+func (s *bitcaskStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, e := range s.keydir {
+		value, err := s.read(e)
+		if err != nil {
+			return err
+		}
+		if !iter([]byte(key), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// background writes the hint files and merges the sealed data files until
+// the store is closed.
+func (s *bitcaskStore) background() {
+	defer close(s.done)
+	t := time.NewTicker(bitcaskMergeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-t.C:
+		}
+		s.merging.Lock()
+		err := s.writeHints()
+		if err == nil {
+			err = s.maybeMerge()
+		}
+		s.merging.Unlock()
+		if err != nil {
+			log.Warningf("bitcask: %v", err)
+		}
+	}
+}
+
+// sealed returns the ids of the sealed data files, in order.
+func (s *bitcaskStore) sealed() []uint32 {
+	var fids []uint32
+	for fid := range s.files {
+		if fid != s.active {
+			fids = append(fids, fid)
+		}
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	return fids
+}
+
+func (s *bitcaskStore) writeHints() error {
+	s.mu.RLock()
+	fids := s.sealed()
+	files := make([]vfsFile, len(fids))
+	for i, fid := range fids {
+		files[i] = s.files[fid].f
+	}
+	s.mu.RUnlock()
+	// sealed files are not written, and only removed by a merge or a flush,
+	// which is excluded by the merging lock
+	for i, fid := range fids {
+		if _, err := s.fs.Stat(bitcaskHintPath(s.path, fid)); err == nil {
+			continue
+		}
+		if err := s.writeHint(fid, files[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maybeMerge merges the data files when enough bytes of the sealed files
+// are dead. The active file is sealed and merged too, so that the merged
+// file comes after every input and before all later writes.
+func (s *bitcaskStore) maybeMerge() error {
+	s.mu.Lock()
+	fids := s.sealed()
+	var size, dead int64
+	for _, fid := range fids {
+		size += s.files[fid].size
+		dead += s.files[fid].dead
+	}
+	if len(fids) == 0 || float64(dead) < float64(size)*bitcaskMergeRatio {
+		s.mu.Unlock()
+		return nil
+	}
+	fids = append(fids, s.active)
+	size += s.files[s.active].size
+	inputs := make(map[uint32]vfsFile, len(fids))
+	for _, fid := range fids {
+		inputs[fid] = s.files[fid].f
+	}
+	type live struct {
+		key string
+		e   bitcaskEntry
+	}
+	var lives []live
+	for key, e := range s.keydir {
+		if _, ok := inputs[e.fid]; ok {
+			lives = append(lives, live{key, e})
+		}
+	}
+	// reserve the id of the merged file
+	mfid := s.active + 1
+	if err := s.openActive(s.active + 2); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+
+	start := time.Now()
+	mpath := bitcaskDataPath(s.path, mfid)
+	f, err := vfsCreate(s.fs, mpath+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, 256*1024)
+	merged := make([]bitcaskEntry, len(lives))
+	var value []byte
+	var pos int64
+	for i, l := range lives {
+		if cap(value) < int(l.e.size) {
+			value = make([]byte, l.e.size)
+		}
+		value = value[:l.e.size]
+		if _, err = inputs[l.e.fid].ReadAt(value, l.e.pos); err != nil {
+			break
+		}
+		var hdr [bitcaskHeaderSize]byte
+		binary.BigEndian.PutUint32(hdr[4:], uint32(len(l.key)))
+		binary.BigEndian.PutUint32(hdr[8:], l.e.size)
+		sum := crc32.Checksum(hdr[4:], crcTable)
+		sum = crc32.Update(sum, crcTable, []byte(l.key))
+		sum = crc32.Update(sum, crcTable, value)
+		binary.BigEndian.PutUint32(hdr[0:], sum)
+		w.Write(hdr[:])
+		w.WriteString(l.key)
+		w.Write(value)
+		merged[i] = bitcaskEntry{
+			fid:  mfid,
+			size: l.e.size,
+			pos:  pos + bitcaskHeaderSize + int64(len(l.key)),
+		}
+		pos = merged[i].pos + int64(l.e.size)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = s.fs.Rename(mpath+".tmp", mpath)
+	}
+	if err == nil {
+		// the merged file must be durable before the inputs are removed
+		err = s.fs.SyncDir(s.path)
+	}
+	if err != nil {
+		f.Close()
+		s.fs.Remove(mpath + ".tmp")
+		return err
+	}
+	if err := s.writeHint(mfid, f); err != nil {
+		f.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mf := &bitcaskFile{f: f, size: pos}
+	s.files[mfid] = mf
+	for i, l := range lives {
+		if e, ok := s.keydir[l.key]; ok && e == l.e {
+			s.keydir[l.key] = merged[i]
+		} else {
+			// overwritten or deleted during the merge
+			mf.dead += merged[i].recordSize(l.key)
+		}
+	}
+	// A crash while removing the inputs is safe because the merged file
+	// comes after them.
+	for _, fid := range fids {
+		s.files[fid].f.Close()
+		delete(s.files, fid)
+		s.fs.Remove(bitcaskHintPath(s.path, fid))
+		s.fs.Remove(bitcaskDataPath(s.path, fid))
+	}
+	log.Printf("bitcask: merged %d files (%d bytes) into %d bytes in %s",
+		len(fids), size, pos, time.Since(start))
+	return nil
+}
@@ -0,0 +1,42 @@
+package kvbench
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBitcaskReopen(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "bitcask")
+		testReopen(t, "bitcask", path, storeOptions{fsync: fsync})
+	}
+}
+
+func TestBitcaskPartialWrite(t *testing.T) {
+	fs := newFaultFS()
+	opts := storeOptions{fs: fs}
+	s, err := openStore("bitcask", "db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set([]byte("a"), []byte("1"))
+	s.Close()
+	// the reopened active file
+	if s, err = openStore("bitcask", "db", opts); err != nil {
+		t.Fatal(err)
+	}
+	fs.setShortWrites(1)
+	if err := s.Set([]byte("b"), []byte("2")); err == nil {
+		t.Fatal("expected a short write")
+	}
+	if err := s.Set([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, s, map[string]string{"a": "1", "c": "3"})
+	s.Close()
+	if s, err = openStore("bitcask", "db", opts); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkStore(t, s, map[string]string{"a": "1", "c": "3"})
+}
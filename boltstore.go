@@ -108,13 +108,21 @@ func (s *boltStore) Del(key []byte) (bool, error) {
 }
 
 func (s *boltStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keysFrom(nil, pattern, limit, withvalues)
+}
+
+func (s *boltStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
 	spattern := string(pattern)
 	min, max := match.Allowable(spattern)
-	bmin := []byte(min)
+	useMax := !(len(spattern) > 0 && spattern[0] == '*')
+	if string(start) > min {
+		min = string(start)
+	}
+	bmin := boltKey([]byte(min))
 	var keys [][]byte
 	var vals [][]byte
 	err := s.db.View(func(tx *bolt.Tx) error {
-		if len(spattern) > 0 && spattern[0] == '*' {
+		if start == nil && !useMax {
 			err := tx.Bucket(boltBucket).ForEach(func(key, value []byte) error {
 				if limit > -1 && len(keys) >= limit {
 					return errors.New("done")
@@ -139,7 +147,7 @@ func (s *boltStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte,
 				break
 			}
 			skey := string(key[1:])
-			if skey >= max {
+			if useMax && skey >= max {
 				break
 			}
 			if match.Match(skey, spattern) {
@@ -163,3 +171,20 @@ func (s *boltStore) FlushDB() error {
 		return err
 	})
 }
+
+var errStopScan = errors.New("stop scan")
+
+func (s *boltStore) scan(iter func(key, value []byte) bool) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(key, value []byte) error {
+			if !iter(key[1:], value) {
+				return errStopScan
+			}
+			return nil
+		})
+	})
+	if err == errStopScan {
+		err = nil
+	}
+	return err
+}
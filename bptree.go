@@ -0,0 +1,920 @@
+package kvbench
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// bpDB is a copy-on-write B+tree in a single memory-mapped file. Pages are
+// never modified in place. A write transaction copies the nodes that it
+// changes into memory and writes them to newly allocated pages on commit.
+// The pages of the old nodes are freed, but they are only reused once no
+// reader is left that started before the commit.
+//
+// The first two pages are meta pages, which hold the root, the freelist
+// page, the number of pages and the transaction id. A commit writes the
+// data pages, syncs, then writes the meta page of the new transaction id,
+// alternating between the two, and syncs again. On open the valid meta page
+// with the highest transaction id wins, so a torn commit falls back to the
+// previous transaction.
+//
+// There's a single writer at a time and any number of readers. Readers
+// read the pages straight from the mapping.
+
+const (
+	bpPageHeaderSize = 16
+	bpLeafElemSize   = 12
+	bpBranchElemSize = 16
+	bpMetaSize       = 56
+	bpMagic          = 0x4b564250 // "KVBP"
+	bpVersion        = 1
+	bpMaxElems       = 0xFFFF
+	bpMaxPageSize    = 64 * 1024
+	bpMinFillPercent = 0.1
+	bpMaxFillPercent = 1.0
+	bpMaxMmapStep    = 1 << 30
+)
+
+const (
+	bpBranchPage   = 1
+	bpLeafPage     = 2
+	bpMetaPage     = 4
+	bpFreelistPage = 8
+)
+
+var errBPInvalid = errors.New("invalid bptree file")
+var errBPVersion = errors.New("unsupported bptree file version")
+
+// bpOptions are the tuning knobs of a bpDB.
+type bpOptions struct {
+	pageSize    int
+	fillPercent float64
+	mmapSize    int
+	fsync       bool
+	fs          vfs
+}
+
+type bpMeta struct {
+	pageSize uint32
+	root     uint64
+	freelist uint64
+	pgcount  uint64
+	txid     uint64
+}
+
+func (m *bpMeta) write(p []byte) {
+	binary.LittleEndian.PutUint32(p[0:], bpMagic)
+	binary.LittleEndian.PutUint32(p[4:], bpVersion)
+	binary.LittleEndian.PutUint32(p[8:], m.pageSize)
+	binary.LittleEndian.PutUint32(p[12:], 0)
+	binary.LittleEndian.PutUint64(p[16:], m.root)
+	binary.LittleEndian.PutUint64(p[24:], m.freelist)
+	binary.LittleEndian.PutUint64(p[32:], m.pgcount)
+	binary.LittleEndian.PutUint64(p[40:], m.txid)
+	binary.LittleEndian.PutUint64(p[48:], bpChecksum(p[:48]))
+}
+
+func (m *bpMeta) read(p []byte) error {
+	if len(p) < bpMetaSize || binary.LittleEndian.Uint32(p[0:]) != bpMagic {
+		return errBPInvalid
+	}
+	if binary.LittleEndian.Uint32(p[4:]) != bpVersion {
+		return errBPVersion
+	}
+	if binary.LittleEndian.Uint64(p[48:]) != bpChecksum(p[:48]) {
+		return errBPInvalid
+	}
+	m.pageSize = binary.LittleEndian.Uint32(p[8:])
+	m.root = binary.LittleEndian.Uint64(p[16:])
+	m.freelist = binary.LittleEndian.Uint64(p[24:])
+	m.pgcount = binary.LittleEndian.Uint64(p[32:])
+	m.txid = binary.LittleEndian.Uint64(p[40:])
+	return nil
+}
+
+func bpChecksum(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// bpPage is a page, including its overflow pages.
+type bpPage []byte
+
+func (p bpPage) id() uint64       { return binary.LittleEndian.Uint64(p[0:]) }
+func (p bpPage) flags() uint16    { return binary.LittleEndian.Uint16(p[8:]) }
+func (p bpPage) count() int       { return int(binary.LittleEndian.Uint16(p[10:])) }
+func (p bpPage) overflow() uint32 { return binary.LittleEndian.Uint32(p[12:]) }
+
+func (p bpPage) leafElem(i int) (key, value []byte) {
+	e := p[bpPageHeaderSize+i*bpLeafElemSize:]
+	pos := binary.LittleEndian.Uint32(e[0:])
+	ksize := binary.LittleEndian.Uint32(e[4:])
+	vsize := binary.LittleEndian.Uint32(e[8:])
+	return p[pos : pos+ksize], p[pos+ksize : pos+ksize+vsize]
+}
+
+func (p bpPage) branchElem(i int) (key []byte, child uint64) {
+	e := p[bpPageHeaderSize+i*bpBranchElemSize:]
+	pos := binary.LittleEndian.Uint32(e[0:])
+	ksize := binary.LittleEndian.Uint32(e[4:])
+	return p[pos : pos+ksize], binary.LittleEndian.Uint64(e[8:])
+}
+
+func (p bpPage) key(i int) []byte {
+	if p.flags()&bpLeafPage != 0 {
+		key, _ := p.leafElem(i)
+		return key
+	}
+	key, _ := p.branchElem(i)
+	return key
+}
+
+// search returns the index of the first key that's greater than or equal
+// to key.
+func (p bpPage) search(key []byte) int {
+	return sort.Search(p.count(), func(i int) bool {
+		return bytes.Compare(p.key(i), key) >= 0
+	})
+}
+
+// childIndex returns the index of the child of a branch that holds key.
+func (p bpPage) childIndex(key []byte) int {
+	i := p.search(key)
+	if i == p.count() || !bytes.Equal(p.key(i), key) {
+		i--
+	}
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+// bpNode is a node that's copied into memory by a write transaction.
+type bpNode struct {
+	leaf     bool
+	keys     [][]byte
+	vals     [][]byte
+	children []uint64
+	nodes    []*bpNode
+}
+
+func (n *bpNode) size() int {
+	sz := bpPageHeaderSize
+	for i := range n.keys {
+		if n.leaf {
+			sz += bpLeafElemSize + len(n.keys[i]) + len(n.vals[i])
+		} else {
+			sz += bpBranchElemSize + len(n.keys[i])
+		}
+	}
+	return sz
+}
+
+// search returns the index of the first key that's greater than or equal
+// to key.
+func (n *bpNode) search(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) >= 0
+	})
+}
+
+func (n *bpNode) childIndex(key []byte) int {
+	i := n.search(key)
+	if i == len(n.keys) || !bytes.Equal(n.keys[i], key) {
+		i--
+	}
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+// remove removes the element at i.
+func (n *bpNode) remove(i int) {
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	if n.leaf {
+		n.vals = append(n.vals[:i], n.vals[i+1:]...)
+	} else {
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		n.nodes = append(n.nodes[:i], n.nodes[i+1:]...)
+	}
+}
+
+// freelist tracks the free pages. The pages that are freed by a commit are
+// pending until every reader that may use them is done.
+type freelist struct {
+	ids     []uint64
+	pending map[uint64][]uint64
+}
+
+// allocate returns the first page of n contiguous free pages, or zero.
+func (fl *freelist) allocate(n int) uint64 {
+	var start int
+	for i := range fl.ids {
+		if i > 0 && fl.ids[i] != fl.ids[i-1]+1 {
+			start = i
+		}
+		if i-start+1 == n {
+			id := fl.ids[start]
+			fl.ids = append(fl.ids[:start], fl.ids[i+1:]...)
+			return id
+		}
+	}
+	return 0
+}
+
+// release frees the pending pages of the transactions up to txid.
+func (fl *freelist) release(txid uint64) {
+	var released bool
+	for tx, ids := range fl.pending {
+		if tx <= txid {
+			fl.ids = append(fl.ids, ids...)
+			delete(fl.pending, tx)
+			released = true
+		}
+	}
+	if released {
+		sort.Slice(fl.ids, func(i, j int) bool { return fl.ids[i] < fl.ids[j] })
+	}
+}
+
+// all returns the free and pending pages, and the extra pages, in order.
+func (fl *freelist) all(extra []uint64) []uint64 {
+	ids := append(append([]uint64(nil), fl.ids...), extra...)
+	for _, pids := range fl.pending {
+		ids = append(ids, pids...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+type bpDB struct {
+	opts     bpOptions
+	pageSize int
+	f        vfsFile
+	// shared is true when the writes to the file are visible in the
+	// mapping, so that it's only remapped when the file outgrew it.
+	shared bool
+	// mmapLock is held by readers while they use the mapping, and by the
+	// writer while it remaps.
+	mmapLock sync.RWMutex
+	data     []byte
+	unmap    func() error
+
+	// writer is held by the write transaction.
+	writer sync.Mutex
+	fl     freelist
+	err    error
+
+	metaLock sync.Mutex
+	meta     bpMeta
+	readers  map[uint64]int
+}
+
+func openBPDB(path string, opts bpOptions) (*bpDB, error) {
+	if opts.pageSize == 0 {
+		opts.pageSize = os.Getpagesize()
+	}
+	if opts.pageSize < 512 || opts.pageSize > bpMaxPageSize ||
+		opts.pageSize&(opts.pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size: %d", opts.pageSize)
+	}
+	if opts.fillPercent == 0 {
+		opts.fillPercent = 0.5
+	}
+	if opts.fillPercent < bpMinFillPercent || opts.fillPercent > bpMaxFillPercent {
+		return nil, fmt.Errorf("invalid fill percent: %v", opts.fillPercent)
+	}
+	f, err := opts.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	db := &bpDB{
+		opts:    opts,
+		f:       f,
+		shared:  mmapShares(f),
+		readers: make(map[uint64]int),
+		fl:      freelist{pending: make(map[uint64][]uint64)},
+	}
+	if err := db.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load initializes a new file or reads the meta pages and the freelist of
+// an existing file.
+func (db *bpDB) load() error {
+	fi, err := db.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		if err := db.init(); err != nil {
+			return err
+		}
+	}
+	var metas [2]bpMeta
+	var errs [2]error
+	buf := make([]byte, bpPageHeaderSize+bpMetaSize)
+	if _, err := db.f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	errs[0] = metas[0].read(buf[bpPageHeaderSize:])
+	pageSize := db.opts.pageSize
+	if errs[0] == nil {
+		pageSize = int(metas[0].pageSize)
+	}
+	if _, err := db.f.ReadAt(buf, int64(pageSize)); err != nil && err != io.EOF {
+		return err
+	}
+	errs[1] = metas[1].read(buf[bpPageHeaderSize:])
+	switch {
+	case errs[0] != nil && errs[1] != nil:
+		return errs[0]
+	case errs[1] != nil || (errs[0] == nil && metas[0].txid > metas[1].txid):
+		db.meta = metas[0]
+	default:
+		db.meta = metas[1]
+	}
+	db.pageSize = int(db.meta.pageSize)
+	if db.pageSize != db.opts.pageSize {
+		log.Warningf("bptree: using the page size of the file: %d",
+			db.pageSize)
+	}
+	if err := db.mmap(); err != nil {
+		return err
+	}
+	p := db.page(db.meta.freelist)
+	if p.flags() != bpFreelistPage {
+		return errBPInvalid
+	}
+	n := binary.LittleEndian.Uint64(p[bpPageHeaderSize:])
+	for i := uint64(0); i < n; i++ {
+		db.fl.ids = append(db.fl.ids,
+			binary.LittleEndian.Uint64(p[bpPageHeaderSize+8+i*8:]))
+	}
+	return nil
+}
+
+// init writes the meta pages, an empty freelist and an empty root leaf.
+func (db *bpDB) init() error {
+	ps := db.opts.pageSize
+	buf := make([]byte, ps*4)
+	for i := 0; i < 2; i++ {
+		p := buf[i*ps:]
+		writePageHeader(p, uint64(i), bpMetaPage, 0, 0)
+		m := bpMeta{pageSize: uint32(ps), root: 3, freelist: 2, pgcount: 4,
+			txid: uint64(i)}
+		m.write(p[bpPageHeaderSize:])
+	}
+	writePageHeader(buf[2*ps:], 2, bpFreelistPage, 0, 0)
+	writePageHeader(buf[3*ps:], 3, bpLeafPage, 0, 0)
+	if _, err := db.f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	if err := db.f.Sync(); err != nil {
+		return err
+	}
+	// the new file
+	return db.opts.fs.SyncDir(filepath.Dir(db.f.Name()))
+}
+
+func writePageHeader(p []byte, id uint64, flags uint16, count int,
+	overflow uint32,
+) {
+	binary.LittleEndian.PutUint64(p[0:], id)
+	binary.LittleEndian.PutUint16(p[8:], flags)
+	binary.LittleEndian.PutUint16(p[10:], uint16(count))
+	binary.LittleEndian.PutUint32(p[12:], overflow)
+}
+
+// remap maps the file again when it outgrew the mapping. It waits for the
+// readers that use the old mapping.
+func (db *bpDB) remap() error {
+	need := int64(db.meta.pgcount) * int64(db.pageSize)
+	if db.shared && int64(len(db.data)) >= need {
+		return nil
+	}
+	db.mmapLock.Lock()
+	defer db.mmapLock.Unlock()
+	return db.mmap()
+}
+
+// mmap maps the file with room to grow. The caller holds the mmapLock or
+// is the only user of the db.
+func (db *bpDB) mmap() error {
+	need := int64(db.meta.pgcount) * int64(db.pageSize)
+	size := int64(32 * 1024)
+	if int64(db.opts.mmapSize) > size {
+		size = int64(db.opts.mmapSize)
+	}
+	for size < need {
+		if size < bpMaxMmapStep {
+			size *= 2
+		} else {
+			size += bpMaxMmapStep
+		}
+	}
+	size = (size + int64(db.pageSize) - 1) / int64(db.pageSize) *
+		int64(db.pageSize)
+	if db.unmap != nil {
+		if err := db.unmap(); err != nil {
+			return err
+		}
+		db.data, db.unmap = nil, nil
+	}
+	data, unmap, err := mmapFile(db.f, size)
+	if err != nil {
+		return err
+	}
+	db.data, db.unmap = data, unmap
+	return nil
+}
+
+// page returns the page with its overflow pages.
+func (db *bpDB) page(id uint64) bpPage {
+	off := int(id) * db.pageSize
+	p := bpPage(db.data[off : off+db.pageSize])
+	if n := p.overflow(); n > 0 {
+		p = db.data[off : off+(int(n)+1)*db.pageSize]
+	}
+	return p
+}
+
+func (db *bpDB) close() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mmapLock.Lock()
+	defer db.mmapLock.Unlock()
+	if db.unmap != nil {
+		db.unmap()
+	}
+	return db.f.Close()
+}
+
+// bpReadTx is a read transaction, which sees the tree of the last commit
+// before it began.
+type bpReadTx struct {
+	db   *bpDB
+	meta bpMeta
+}
+
+func (db *bpDB) beginRead() *bpReadTx {
+	db.mmapLock.RLock()
+	db.metaLock.Lock()
+	tx := &bpReadTx{db: db, meta: db.meta}
+	db.readers[tx.meta.txid]++
+	db.metaLock.Unlock()
+	return tx
+}
+
+func (tx *bpReadTx) done() {
+	db := tx.db
+	db.metaLock.Lock()
+	if db.readers[tx.meta.txid]--; db.readers[tx.meta.txid] == 0 {
+		delete(db.readers, tx.meta.txid)
+	}
+	db.metaLock.Unlock()
+	db.mmapLock.RUnlock()
+}
+
+// get returns the value of a key. The value points into the mapping.
+func (tx *bpReadTx) get(key []byte) ([]byte, bool) {
+	return tx.db.get(tx.meta.root, key)
+}
+
+func (db *bpDB) get(root uint64, key []byte) ([]byte, bool) {
+	p := db.page(root)
+	for p.flags()&bpBranchPage != 0 {
+		_, child := p.branchElem(p.childIndex(key))
+		p = db.page(child)
+	}
+	i := p.search(key)
+	if i == p.count() {
+		return nil, false
+	}
+	k, v := p.leafElem(i)
+	if !bytes.Equal(k, key) {
+		return nil, false
+	}
+	return v, true
+}
+
+// bpCursor iterates over the leaf elements of a read transaction in order.
+type bpCursor struct {
+	db    *bpDB
+	stack []bpCursorElem
+}
+
+type bpCursorElem struct {
+	p bpPage
+	i int
+}
+
+// seek positions the cursor at the first key that's greater than or equal
+// to key.
+func (c *bpCursor) seek(root uint64, key []byte) {
+	c.stack = c.stack[:0]
+	p := c.db.page(root)
+	for p.flags()&bpBranchPage != 0 {
+		i := p.childIndex(key)
+		c.stack = append(c.stack, bpCursorElem{p, i})
+		_, child := p.branchElem(i)
+		p = c.db.page(child)
+	}
+	c.stack = append(c.stack, bpCursorElem{p, p.search(key)})
+	c.settle()
+}
+
+// settle moves past the end of exhausted leaves.
+func (c *bpCursor) settle() {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if top.i < top.p.count() {
+			if top.p.flags()&bpLeafPage != 0 {
+				return
+			}
+			_, child := top.p.branchElem(top.i)
+			c.stack = append(c.stack, bpCursorElem{c.db.page(child), 0})
+			continue
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+		if len(c.stack) > 0 {
+			c.stack[len(c.stack)-1].i++
+		}
+	}
+}
+
+func (c *bpCursor) valid() bool {
+	return len(c.stack) > 0
+}
+
+func (c *bpCursor) item() ([]byte, []byte) {
+	top := c.stack[len(c.stack)-1]
+	return top.p.leafElem(top.i)
+}
+
+func (c *bpCursor) next() {
+	c.stack[len(c.stack)-1].i++
+	c.settle()
+}
+
+// bpWriteTx is the write transaction. Every node that it reads is copied
+// into memory and its pages are freed, because it will be written to new
+// pages on commit.
+type bpWriteTx struct {
+	db    *bpDB
+	meta  bpMeta
+	root  *bpNode
+	freed []uint64
+	pages map[uint64][]byte
+}
+
+func (db *bpDB) beginWrite() (*bpWriteTx, error) {
+	db.writer.Lock()
+	if db.err != nil {
+		db.writer.Unlock()
+		return nil, db.err
+	}
+	db.metaLock.Lock()
+	minTx := db.meta.txid
+	for txid := range db.readers {
+		if txid < minTx {
+			minTx = txid
+		}
+	}
+	meta := db.meta
+	db.metaLock.Unlock()
+	db.fl.release(minTx)
+	return &bpWriteTx{db: db, meta: meta}, nil
+}
+
+// rollback ends a transaction without writing anything. Only transactions
+// that didn't change the tree may be rolled back.
+func (tx *bpWriteTx) rollback() {
+	tx.db.writer.Unlock()
+}
+
+func (tx *bpWriteTx) free(id uint64) {
+	p := tx.db.page(id)
+	for i := uint64(0); i <= uint64(p.overflow()); i++ {
+		tx.freed = append(tx.freed, id+i)
+	}
+}
+
+// node copies a page into a node and frees the page.
+func (tx *bpWriteTx) node(id uint64) *bpNode {
+	p := tx.db.page(id)
+	n := &bpNode{leaf: p.flags()&bpLeafPage != 0}
+	count := p.count()
+	n.keys = make([][]byte, count)
+	if n.leaf {
+		n.vals = make([][]byte, count)
+		for i := 0; i < count; i++ {
+			k, v := p.leafElem(i)
+			n.keys[i], n.vals[i] = bcopy(k), bcopy(v)
+		}
+	} else {
+		n.children = make([]uint64, count)
+		n.nodes = make([]*bpNode, count)
+		for i := 0; i < count; i++ {
+			k, child := p.branchElem(i)
+			n.keys[i], n.children[i] = bcopy(k), child
+		}
+	}
+	tx.free(id)
+	return n
+}
+
+func (tx *bpWriteTx) child(n *bpNode, i int) *bpNode {
+	if n.nodes[i] == nil {
+		n.nodes[i] = tx.node(n.children[i])
+	}
+	return n.nodes[i]
+}
+
+// path returns the nodes from the root to the leaf of key, with the index
+// of each node in its parent.
+func (tx *bpWriteTx) path(key []byte) ([]*bpNode, []int) {
+	if tx.root == nil {
+		tx.root = tx.node(tx.meta.root)
+	}
+	nodes := []*bpNode{tx.root}
+	idxs := []int{0}
+	n := tx.root
+	for !n.leaf {
+		i := n.childIndex(key)
+		n = tx.child(n, i)
+		nodes = append(nodes, n)
+		idxs = append(idxs, i)
+	}
+	return nodes, idxs
+}
+
+func (tx *bpWriteTx) put(key, value []byte) {
+	nodes, _ := tx.path(key)
+	n := nodes[len(nodes)-1]
+	i := n.search(key)
+	if i < len(n.keys) && bytes.Equal(n.keys[i], key) {
+		n.vals[i] = bcopy(value)
+		return
+	}
+	n.keys = append(n.keys, nil)
+	n.vals = append(n.vals, nil)
+	copy(n.keys[i+1:], n.keys[i:])
+	copy(n.vals[i+1:], n.vals[i:])
+	n.keys[i], n.vals[i] = bcopy(key), bcopy(value)
+}
+
+// del deletes a key and merges the nodes that are less than a quarter full
+// with a sibling.
+func (tx *bpWriteTx) del(key []byte) bool {
+	nodes, idxs := tx.path(key)
+	n := nodes[len(nodes)-1]
+	i := n.search(key)
+	if i == len(n.keys) || !bytes.Equal(n.keys[i], key) {
+		return false
+	}
+	n.remove(i)
+	for l := len(nodes) - 1; l > 0; l-- {
+		n, parent, idx := nodes[l], nodes[l-1], idxs[l]
+		if n.size() >= tx.db.pageSize/4 && len(n.keys) > 1 {
+			break
+		}
+		if len(n.keys) == 0 {
+			parent.remove(idx)
+			continue
+		}
+		if len(parent.keys) < 2 {
+			break
+		}
+		left, right := idx-1, idx
+		if idx == 0 {
+			left, right = 0, 1
+		}
+		ln, rn := tx.child(parent, left), tx.child(parent, right)
+		ln.keys = append(ln.keys, rn.keys...)
+		if ln.leaf {
+			ln.vals = append(ln.vals, rn.vals...)
+		} else {
+			ln.children = append(ln.children, rn.children...)
+			ln.nodes = append(ln.nodes, rn.nodes...)
+		}
+		parent.remove(right)
+	}
+	for !tx.root.leaf && len(tx.root.keys) == 1 {
+		tx.root = tx.child(tx.root, 0)
+	}
+	if !tx.root.leaf && len(tx.root.keys) == 0 {
+		tx.root = &bpNode{leaf: true}
+	}
+	return true
+}
+
+// clear frees every page of the tree and starts a new empty tree.
+func (tx *bpWriteTx) clear() {
+	var walk func(id uint64)
+	walk = func(id uint64) {
+		p := tx.db.page(id)
+		if p.flags()&bpBranchPage != 0 {
+			for i := 0; i < p.count(); i++ {
+				_, child := p.branchElem(i)
+				walk(child)
+			}
+		}
+		tx.free(id)
+	}
+	walk(tx.meta.root)
+	tx.root = &bpNode{leaf: true}
+}
+
+// allocate returns the first of n contiguous pages.
+func (tx *bpWriteTx) allocate(n int) uint64 {
+	if id := tx.db.fl.allocate(n); id != 0 {
+		return id
+	}
+	id := tx.meta.pgcount
+	tx.meta.pgcount += uint64(n)
+	return id
+}
+
+type bpEntry struct {
+	key []byte
+	id  uint64
+}
+
+// spill writes a node and its children to new pages. A node that doesn't
+// fit in a page is split at the fill percent into multiple pages. The first
+// key and page of each part are returned.
+func (tx *bpWriteTx) spill(n *bpNode) []bpEntry {
+	if !n.leaf {
+		var keys [][]byte
+		var children []uint64
+		for i, child := range n.nodes {
+			if child == nil {
+				keys = append(keys, n.keys[i])
+				children = append(children, n.children[i])
+				continue
+			}
+			for _, e := range tx.spill(child) {
+				keys = append(keys, e.key)
+				children = append(children, e.id)
+			}
+		}
+		n.keys, n.children = keys, children
+		n.nodes = make([]*bpNode, len(keys))
+	}
+	var entries []bpEntry
+	threshold := int(float64(tx.db.pageSize) * tx.db.opts.fillPercent)
+	fits := n.size() <= tx.db.pageSize && len(n.keys) <= bpMaxElems
+	start, size := 0, bpPageHeaderSize
+	for i := 0; i <= len(n.keys); i++ {
+		if i < len(n.keys) {
+			esz := bpBranchElemSize + len(n.keys[i])
+			if n.leaf {
+				esz = bpLeafElemSize + len(n.keys[i]) + len(n.vals[i])
+			}
+			split := !fits && i-start >= 2 &&
+				(size+esz > threshold || i-start == bpMaxElems)
+			if !split {
+				size += esz
+				continue
+			}
+		}
+		entries = append(entries, tx.write(n, start, i, size))
+		start, size = i, bpPageHeaderSize
+		if i < len(n.keys) {
+			i--
+		}
+	}
+	return entries
+}
+
+// write writes the elements start to end of a node to new pages.
+func (tx *bpWriteTx) write(n *bpNode, start, end, size int) bpEntry {
+	npages := (size + tx.db.pageSize - 1) / tx.db.pageSize
+	id := tx.allocate(npages)
+	p := make([]byte, npages*tx.db.pageSize)
+	flags := uint16(bpBranchPage)
+	esize := bpBranchElemSize
+	if n.leaf {
+		flags, esize = bpLeafPage, bpLeafElemSize
+	}
+	writePageHeader(p, id, flags, end-start, uint32(npages-1))
+	pos := bpPageHeaderSize + (end-start)*esize
+	for i := start; i < end; i++ {
+		e := p[bpPageHeaderSize+(i-start)*esize:]
+		binary.LittleEndian.PutUint32(e[0:], uint32(pos))
+		binary.LittleEndian.PutUint32(e[4:], uint32(len(n.keys[i])))
+		pos += copy(p[pos:], n.keys[i])
+		if n.leaf {
+			binary.LittleEndian.PutUint32(e[8:], uint32(len(n.vals[i])))
+			pos += copy(p[pos:], n.vals[i])
+		} else {
+			binary.LittleEndian.PutUint64(e[8:], n.children[i])
+		}
+	}
+	tx.pages[id] = p
+	var key []byte
+	if end > start {
+		key = n.keys[start]
+	}
+	return bpEntry{key, id}
+}
+
+// commit writes the changed nodes and the freelist, then the meta page.
+func (tx *bpWriteTx) commit() error {
+	db := tx.db
+	defer db.writer.Unlock()
+	if tx.root == nil {
+		return nil
+	}
+	tx.pages = make(map[uint64][]byte)
+	entries := tx.spill(tx.root)
+	for len(entries) > 1 {
+		root := &bpNode{nodes: make([]*bpNode, len(entries))}
+		for _, e := range entries {
+			root.keys = append(root.keys, e.key)
+			root.children = append(root.children, e.id)
+		}
+		entries = tx.spill(root)
+	}
+	tx.meta.root = entries[0].id
+
+	// The freelist holds the pending pages too, because every reader is
+	// gone after a restart.
+	tx.free(tx.meta.freelist)
+	count := len(db.fl.ids) + len(tx.freed)
+	for _, ids := range db.fl.pending {
+		count += len(ids)
+	}
+	size := bpPageHeaderSize + 8 + count*8
+	npages := (size + db.pageSize - 1) / db.pageSize
+	tx.meta.freelist = tx.allocate(npages)
+	ids := db.fl.all(tx.freed)
+	p := make([]byte, npages*db.pageSize)
+	writePageHeader(p, tx.meta.freelist, bpFreelistPage, 0, uint32(npages-1))
+	binary.LittleEndian.PutUint64(p[bpPageHeaderSize:], uint64(len(ids)))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(p[bpPageHeaderSize+8+i*8:], id)
+	}
+	tx.pages[tx.meta.freelist] = p
+
+	if err := tx.writePages(); err != nil {
+		db.err = err
+		return err
+	}
+	tx.meta.txid++
+	meta := make([]byte, db.pageSize)
+	writePageHeader(meta, tx.meta.txid%2, bpMetaPage, 0, 0)
+	tx.meta.write(meta[bpPageHeaderSize:])
+	if _, err := db.f.WriteAt(meta, int64(tx.meta.txid%2)*int64(db.pageSize)); err != nil {
+		db.err = err
+		return err
+	}
+	if db.opts.fsync {
+		if err := db.f.Sync(); err != nil {
+			db.err = err
+			return err
+		}
+	}
+	db.fl.pending[tx.meta.txid] = tx.freed
+	db.metaLock.Lock()
+	db.meta = tx.meta
+	db.metaLock.Unlock()
+	if err := db.remap(); err != nil {
+		db.err = err
+		return err
+	}
+	return nil
+}
+
+// writePages writes the pages in order and syncs the file.
+func (tx *bpWriteTx) writePages() error {
+	ids := make([]uint64, 0, len(tx.pages))
+	for id := range tx.pages {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		_, err := tx.db.f.WriteAt(tx.pages[id], int64(id)*int64(tx.db.pageSize))
+		if err != nil {
+			return err
+		}
+	}
+	if tx.db.opts.fsync {
+		return tx.db.f.Sync()
+	}
+	return nil
+}
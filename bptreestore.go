@@ -0,0 +1,163 @@
+package kvbench
+
+import (
+	"fmt"
+
+	"github.com/tidwall/match"
+)
+
+type bptreeStore struct {
+	db *bpDB
+}
+
+func newBPTreeStore(path string, opts storeOptions) (*bptreeStore, error) {
+	if path == ":memory:" {
+		return nil, errMemoryNotAllowed
+	}
+	db, err := openBPDB(path, bpOptions{
+		pageSize:    opts.pageSize,
+		fillPercent: opts.fillPercent,
+		mmapSize:    opts.mmapSize,
+		fsync:       opts.fsync,
+		fs:          opts.filesystem(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bptreeStore{db: db}, nil
+}
+
+func (s *bptreeStore) Close() error {
+	return s.db.close()
+}
+
+func (s *bptreeStore) PSet(keys, values [][]byte) error {
+	tx, err := s.db.beginWrite()
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		tx.put(keys[i], values[i])
+	}
+	return tx.commit()
+}
+
+func (s *bptreeStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	tx := s.db.beginRead()
+	defer tx.done()
+	var values [][]byte
+	var oks []bool
+	for i := range keys {
+		v, ok := tx.get(keys[i])
+		if ok {
+			v = bcopy(v)
+		}
+		values = append(values, v)
+		oks = append(oks, ok)
+	}
+	return values, oks, nil
+}
+
+func (s *bptreeStore) Set(key, value []byte) error {
+	tx, err := s.db.beginWrite()
+	if err != nil {
+		return err
+	}
+	tx.put(key, value)
+	return tx.commit()
+}
+
+func (s *bptreeStore) Get(key []byte) ([]byte, bool, error) {
+	tx := s.db.beginRead()
+	defer tx.done()
+	v, ok := tx.get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return bcopy(v), true, nil
+}
+
+func (s *bptreeStore) Del(key []byte) (bool, error) {
+	tx, err := s.db.beginWrite()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := s.db.get(tx.meta.root, key); !ok {
+		tx.rollback()
+		return false, nil
+	}
+	tx.del(key)
+	if err := tx.commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *bptreeStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keysFrom(nil, pattern, limit, withvalues)
+}
+
+func (s *bptreeStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	tx := s.db.beginRead()
+	defer tx.done()
+	spattern := string(pattern)
+	min, max := match.Allowable(spattern)
+	useMax := !(len(spattern) > 0 && spattern[0] == '*')
+	if string(start) > min {
+		min = string(start)
+	}
+	var keys [][]byte
+	var vals [][]byte
+	c := bpCursor{db: s.db}
+	for c.seek(tx.meta.root, []byte(min)); c.valid(); c.next() {
+		if limit > -1 && len(keys) >= limit {
+			break
+		}
+		key, value := c.item()
+		skey := string(key)
+		if useMax && skey >= max {
+			break
+		}
+		if match.Match(skey, spattern) {
+			keys = append(keys, []byte(skey))
+			if withvalues {
+				vals = append(vals, bcopy(value))
+			}
+		}
+	}
+	return keys, vals, nil
+}
+
+func (s *bptreeStore) FlushDB() error {
+	tx, err := s.db.beginWrite()
+	if err != nil {
+		return err
+	}
+	tx.clear()
+	return tx.commit()
+}
+
+func (s *bptreeStore) scan(iter func(key, value []byte) bool) error {
+	tx := s.db.beginRead()
+	defer tx.done()
+	c := bpCursor{db: s.db}
+	for c.seek(tx.meta.root, nil); c.valid(); c.next() {
+		if !iter(c.item()) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *bptreeStore) info(buf []byte) []byte {
+	tx := s.db.beginRead()
+	meta := tx.meta
+	tx.done()
+	buf = append(buf, "# BPTree\r\n"...)
+	buf = append(buf, fmt.Sprintf("page_size:%d\r\n", s.db.pageSize)...)
+	buf = append(buf, fmt.Sprintf("fill_percent:%.2f\r\n",
+		s.db.opts.fillPercent)...)
+	buf = append(buf, fmt.Sprintf("pages:%d\r\n", meta.pgcount)...)
+	buf = append(buf, fmt.Sprintf("txid:%d\r\n", meta.txid)...)
+	return buf
+}
@@ -0,0 +1,29 @@
+package kvbench
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBPTreeReopen(t *testing.T) {
+	tests := []struct {
+		fsync    bool
+		pageSize string
+	}{
+		{false, "0"},
+		{true, "0"},
+		// small pages, which split often
+		{false, "1024"},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("fsync=%v,page-size=%s", tc.fsync, tc.pageSize),
+			func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "bptree.db")
+				testReopen(t, "bptree", path, storeOptions{
+					fsync:  tc.fsync,
+					values: map[string]string{"page-size": tc.pageSize},
+				})
+			})
+	}
+}
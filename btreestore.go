@@ -1,9 +1,8 @@
 package kvbench
 
 import (
-	"strings"
+	"sort"
 	"sync"
-	"time"
 
 	"github.com/tidwall/btree"
 	"github.com/tidwall/match"
@@ -13,6 +12,7 @@ type btreeStore struct {
 	mu  sync.RWMutex
 	tr  *btree.BTree
 	aof *AOF
+	mem *memLimit
 }
 
 type btreeItem struct {
@@ -24,45 +24,108 @@ func (a *btreeItem) Less(v btree.Item, ctx interface{}) bool {
 	return a.key < v.(*btreeItem).key
 }
 
-func newBTreeStore(path string, fsync bool) (*btreeStore, error) {
+func newBTreeStore(path string, opts storeOptions) (*btreeStore, error) {
 	tr := btree.New(32, nil)
 	var err error
 	var aof *AOF
 	if path == ":memory:" {
 		log.Printf("persistance disabled")
 	} else {
-		var count int
-		start := time.Now()
-		aof, err = openAOF(path, fsync, func(args [][]byte) error {
-			switch strings.ToLower(string(args[0])) {
-			case "set":
-				if len(args) >= 3 {
-					tr.ReplaceOrInsert(
-						&btreeItem{string(args[1]), bcopy(args[2])})
-				}
-			case "del":
-				if len(args) >= 2 {
-					tr.Delete(&btreeItem{string(args[1]), nil})
-				}
-			case "flushdb":
-				tr = btree.New(32, nil)
-			}
-			count++
-			return nil
-		})
+		var stats replayStats
+		aof, stats, err = openAOFParallel(path, opts,
+			func(shards []map[string][]byte) {
+				tr = loadBTree(shards)
+			})
 		if err != nil {
 			return nil, err
 		}
-		if count > 0 {
-			log.Printf("loaded %d commands in %s", count, time.Since(start))
-		}
+		stats.logLoaded()
+	}
+	mem := newMemLimit(opts)
+	if mem != nil {
+		tr.Ascend(func(v btree.Item) bool {
+			a := v.(*btreeItem)
+			mem.set(a.key, len(a.key)+len(a.value))
+			return true
+		})
 	}
 	return &btreeStore{
 		aof: aof,
 		tr:  tr,
+		mem: mem,
 	}, nil
 }
 
+// evict deletes keys until the memory limit is met and writes a DEL record
+// for every evicted key.
+func (s *btreeStore) evict() error {
+	if s.mem == nil {
+		return nil
+	}
+	keys, err := s.mem.victims()
+	if len(keys) > 0 {
+		if s.aof != nil {
+			s.aof.BeginBuffer()
+			for _, key := range keys {
+				s.aof.AppendBuffer([]byte("del"), []byte(key))
+			}
+			if err := s.aof.WriteBuffer(); err != nil {
+				return err
+			}
+		}
+		for _, key := range keys {
+			s.tr.Delete(&btreeItem{key, nil})
+		}
+		s.mem.evict(keys)
+	}
+	return err
+}
+
+// loadBTree creates a btree from the replayed shards.
+func loadBTree(shards []map[string][]byte) *btree.BTree {
+	tr := btree.New(32, nil)
+	mergeShards(shards, func(key string, value []byte) {
+		tr.ReplaceOrInsert(&btreeItem{key, value})
+	})
+	return tr
+}
+
+// mergeShards calls fn for every key/value of the replayed shards in key
+// order, so that ordered stores can insert them in ascending order. Each
+// shard is sorted in parallel and the values passed to fn are copies.
+func mergeShards(shards []map[string][]byte, fn func(key string, value []byte)) {
+	sorted := make([][]*btreeItem, len(shards))
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			items := make([]*btreeItem, 0, len(shards[i]))
+			for key, value := range shards[i] {
+				items = append(items, &btreeItem{key, bcopy(value)})
+			}
+			sort.Slice(items, func(a, b int) bool {
+				return items[a].key < items[b].key
+			})
+			sorted[i] = items
+		}(i)
+	}
+	wg.Wait()
+	for {
+		min := -1
+		for i, items := range sorted {
+			if len(items) > 0 && (min == -1 || items[0].key < sorted[min][0].key) {
+				min = i
+			}
+		}
+		if min == -1 {
+			return
+		}
+		fn(sorted[min][0].key, sorted[min][0].value)
+		sorted[min] = sorted[min][1:]
+	}
+}
+
 func (s *btreeStore) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -75,6 +138,9 @@ func (s *btreeStore) Close() error {
 func (s *btreeStore) PSet(keys, values [][]byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.evict(); err != nil {
+		return err
+	}
 	if s.aof != nil {
 		s.aof.BeginBuffer()
 		for i := range keys {
@@ -87,6 +153,9 @@ func (s *btreeStore) PSet(keys, values [][]byte) error {
 	}
 	for i := range keys {
 		s.tr.ReplaceOrInsert(&btreeItem{string(keys[i]), bcopy(values[i])})
+		if s.mem != nil {
+			s.mem.set(string(keys[i]), len(keys[i])+len(values[i]))
+		}
 	}
 	return nil
 }
@@ -104,6 +173,9 @@ func (s *btreeStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
 		} else {
 			values = append(values, v.(*btreeItem).value)
 			oks = append(oks, true)
+			if s.mem != nil {
+				s.mem.touch(string(keys[i]))
+			}
 		}
 	}
 	return values, oks, nil
@@ -112,12 +184,18 @@ func (s *btreeStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
 func (s *btreeStore) Set(key, value []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.evict(); err != nil {
+		return err
+	}
 	if s.aof != nil {
 		if err := s.aof.Write([]byte("set"), key, value); err != nil {
 			return err
 		}
 	}
 	s.tr.ReplaceOrInsert(&btreeItem{string(key), bcopy(value)})
+	if s.mem != nil {
+		s.mem.set(string(key), len(key)+len(value))
+	}
 	return nil
 }
 
@@ -128,6 +206,9 @@ func (s *btreeStore) Get(key []byte) ([]byte, bool, error) {
 	if v == nil {
 		return nil, false, nil
 	}
+	if s.mem != nil {
+		s.mem.touch(string(key))
+	}
 	return v.(*btreeItem).value, true, nil
 }
 
@@ -136,6 +217,9 @@ func (s *btreeStore) Del(key []byte) (bool, error) {
 	defer s.mu.Unlock()
 	v := s.tr.Delete(&btreeItem{string(key), nil})
 	if v != nil {
+		if s.mem != nil {
+			s.mem.del(string(key))
+		}
 		if s.aof != nil {
 			if err := s.aof.Write([]byte("del"), key); err != nil {
 				return false, err
@@ -146,6 +230,10 @@ func (s *btreeStore) Del(key []byte) (bool, error) {
 }
 
 func (s *btreeStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keysFrom(nil, pattern, limit, withvalues)
+}
+
+func (s *btreeStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	spattern := string(pattern)
@@ -156,6 +244,9 @@ func (s *btreeStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte,
 		pivot.key = min
 		useMax = true
 	}
+	if string(start) > pivot.key {
+		pivot.key = string(start)
+	}
 	var keys [][]byte
 	var vals [][]byte
 	s.tr.AscendGreaterOrEqual(pivot, func(v btree.Item) bool {
@@ -169,7 +260,7 @@ func (s *btreeStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte,
 		if match.Match(a.key, spattern) {
 			keys = append(keys, []byte(a.key))
 			if withvalues {
-				vals = append(keys, []byte(a.value))
+				vals = append(vals, bcopy(a.value))
 			}
 		}
 		return true
@@ -186,5 +277,53 @@ func (s *btreeStore) FlushDB() error {
 		}
 	}
 	s.tr = btree.New(32, nil)
+	if s.mem != nil {
+		s.mem.reset()
+	}
+	return nil
+}
+
+func (s *btreeStore) rotateKey(crypt *crypter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof == nil {
+		return nil
+	}
+	return s.aof.Rewrite(crypt, func(emit func(args ...[]byte) error) error {
+		var err error
+		s.tr.Ascend(func(v btree.Item) bool {
+			a := v.(*btreeItem)
+			err = emit([]byte("set"), []byte(a.key), a.value)
+			return err == nil
+		})
+		return err
+	})
+}
+
+func (s *btreeStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.tr.Ascend(func(v btree.Item) bool {
+		a := v.(*btreeItem)
+		return iter([]byte(a.key), a.value)
+	})
 	return nil
 }
+
+func (s *btreeStore) info(buf []byte) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.mem == nil {
+		return buf
+	}
+	return s.mem.info(buf)
+}
+
+func (s *btreeStore) memUsage() (used, evicted int64, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.mem == nil {
+		return 0, 0, false
+	}
+	return s.mem.used, s.mem.evicted, true
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	"github.com/tidwall/kvbench"
 	"github.com/tidwall/redlog"
@@ -11,12 +12,51 @@ import (
 var log = redlog.New(os.Stderr)
 
 func main() {
+	if len(os.Args) > 1 {
+		var command func(args []string) error
+		switch os.Args[1] {
+		case "aof":
+			command = kvbench.AOFCommand
+		case "migrate":
+			command = kvbench.MigrateCommand
+		case "import-rdb":
+			command = kvbench.ImportRDBCommand
+		case "export-rdb":
+			command = kvbench.ExportRDBCommand
+		case "bench":
+			command = kvbench.BenchCommand
+		}
+		if command != nil {
+			if err := command(os.Args[2:]); err != nil {
+				log.Warningf("%v", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 	var opts kvbench.Options
 	flag.IntVar(&opts.Port, "p", 6380, "server port")
-	flag.StringVar(&opts.Which, "store", "map", "store type: map,btree,bolt,leveldb")
+	flag.StringVar(&opts.Which, "store", "map", "store type: "+strings.Join(kvbench.RegisteredStores(), ","))
 	flag.BoolVar(&opts.Fsync, "fsync", true, "fsync")
 	flag.StringVar(&opts.Path, "path", "", "database path or ':memory:' for none")
+	flag.StringVar(&opts.KeyFile, "keyfile", "", "AES key file for encryption at rest")
+	flag.StringVar(&opts.NewKeyFile, "rotate-keyfile", "", "rewrite all data using this new key file")
+	flag.StringVar(&opts.AOFEncoding, "aof-encoding", "resp", "encoding of a new AOF: resp,binary")
+	middleware := flag.String("middleware", "", "store middleware, outermost first: "+strings.Join(kvbench.RegisteredMiddleware(), ","))
+	storeFlags := make(map[string]*string)
+	for _, opt := range kvbench.RegisteredStoreOptions() {
+		storeFlags[opt.Name] = flag.String(opt.Name, opt.Default, opt.Usage)
+	}
 	flag.Parse()
+	opts.StoreOptions = make(map[string]string)
+	if *middleware != "" {
+		opts.Middleware = strings.Split(*middleware, ",")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if value, ok := storeFlags[f.Name]; ok {
+			opts.StoreOptions[f.Name] = *value
+		}
+	})
 	opts.Log = log
 	if err := kvbench.Start(opts); err != nil {
 		log.Warningf("%v", err)
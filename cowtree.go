@@ -0,0 +1,294 @@
+package kvbench
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// cowTree is a copy-on-write B-tree. A copy of a tree is made in constant
+// time by sharing the nodes. Each tree has an id and only modifies the nodes
+// that carry its id, all other nodes are copied first. Making a copy gives
+// both trees new ids, so neither tree changes the shared nodes. The
+// algorithms are those of github.com/google/btree.
+
+const (
+	cowDegree   = 32
+	cowMaxItems = cowDegree*2 - 1
+	cowMinItems = cowDegree - 1
+)
+
+var cowNextID uint64
+
+func newCowID() uint64 {
+	return atomic.AddUint64(&cowNextID, 1)
+}
+
+type cowItem struct {
+	key   string
+	value []byte
+}
+
+type cowNode struct {
+	id       uint64
+	items    []cowItem
+	children []*cowNode
+}
+
+type cowTree struct {
+	id    uint64
+	root  *cowNode
+	count int
+}
+
+func newCowTree() *cowTree {
+	return &cowTree{id: newCowID()}
+}
+
+// copy returns a copy of the tree.
+func (t *cowTree) copy() *cowTree {
+	t2 := *t
+	t.id = newCowID()
+	t2.id = newCowID()
+	return &t2
+}
+
+func (t *cowTree) len() int {
+	return t.count
+}
+
+// mutable returns a node that's owned by the tree.
+func (t *cowTree) mutable(n *cowNode) *cowNode {
+	if n.id == t.id {
+		return n
+	}
+	n2 := &cowNode{id: t.id}
+	n2.items = make([]cowItem, len(n.items), cowMaxItems)
+	copy(n2.items, n.items)
+	if len(n.children) > 0 {
+		n2.children = make([]*cowNode, len(n.children), cowMaxItems+1)
+		copy(n2.children, n.children)
+	}
+	return n2
+}
+
+func (t *cowTree) mutableChild(n *cowNode, i int) *cowNode {
+	c := t.mutable(n.children[i])
+	n.children[i] = c
+	return c
+}
+
+// find returns the index of the first item with a key that's greater than
+// or equal to key.
+func (n *cowNode) find(key string) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].key >= key
+	})
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+func (t *cowTree) get(key string) ([]byte, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].value, true
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return nil, false
+}
+
+// set inserts or replaces an item and returns true when it was replaced.
+func (t *cowTree) set(key string, value []byte) bool {
+	item := cowItem{key, value}
+	if t.root == nil {
+		t.root = &cowNode{id: t.id}
+		t.root.items = append(make([]cowItem, 0, cowMaxItems), item)
+		t.count++
+		return false
+	}
+	t.root = t.mutable(t.root)
+	if len(t.root.items) >= cowMaxItems {
+		mid, second := t.split(t.root, cowMaxItems/2)
+		old := t.root
+		t.root = &cowNode{id: t.id}
+		t.root.items = append(make([]cowItem, 0, cowMaxItems), mid)
+		t.root.children = append(make([]*cowNode, 0, cowMaxItems+1),
+			old, second)
+	}
+	replaced := t.insert(t.root, item)
+	if !replaced {
+		t.count++
+	}
+	return replaced
+}
+
+// split splits a node at i and returns the item at i and the new node with
+// the items after i.
+func (t *cowTree) split(n *cowNode, i int) (cowItem, *cowNode) {
+	item := n.items[i]
+	next := &cowNode{id: t.id}
+	next.items = append(make([]cowItem, 0, cowMaxItems), n.items[i+1:]...)
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = append(make([]*cowNode, 0, cowMaxItems+1),
+			n.children[i+1:]...)
+		n.children = n.children[:i+1]
+	}
+	return item, next
+}
+
+func (t *cowTree) insert(n *cowNode, item cowItem) bool {
+	i, found := n.find(item.key)
+	if found {
+		n.items[i] = item
+		return true
+	}
+	if len(n.children) == 0 {
+		n.items = append(n.items, cowItem{})
+		copy(n.items[i+1:], n.items[i:])
+		n.items[i] = item
+		return false
+	}
+	if len(n.children[i].items) >= cowMaxItems {
+		mid, second := t.split(t.mutableChild(n, i), cowMaxItems/2)
+		n.items = append(n.items, cowItem{})
+		copy(n.items[i+1:], n.items[i:])
+		n.items[i] = mid
+		n.children = append(n.children, nil)
+		copy(n.children[i+2:], n.children[i+1:])
+		n.children[i+1] = second
+		switch {
+		case item.key < mid.key:
+		case item.key > mid.key:
+			i++
+		default:
+			n.items[i] = item
+			return true
+		}
+	}
+	return t.insert(t.mutableChild(n, i), item)
+}
+
+// del deletes an item and returns true when it was found.
+func (t *cowTree) del(key string) bool {
+	if t.root == nil || len(t.root.items) == 0 {
+		return false
+	}
+	t.root = t.mutable(t.root)
+	_, found := t.remove(t.root, key, false)
+	if len(t.root.items) == 0 && len(t.root.children) > 0 {
+		t.root = t.root.children[0]
+	}
+	if found {
+		t.count--
+	}
+	return found
+}
+
+// remove removes the item with key, or the largest item when max is true,
+// from the subtree of n.
+func (t *cowTree) remove(n *cowNode, key string, max bool) (cowItem, bool) {
+	var i int
+	var found bool
+	if max {
+		i = len(n.items)
+		if len(n.children) == 0 {
+			i--
+			found = true
+		}
+	} else {
+		i, found = n.find(key)
+	}
+	if len(n.children) == 0 {
+		if !found {
+			return cowItem{}, false
+		}
+		item := n.items[i]
+		n.items = append(n.items[:i], n.items[i+1:]...)
+		return item, true
+	}
+	if len(n.children[i].items) <= cowMinItems {
+		t.growChild(n, i)
+		return t.remove(n, key, max)
+	}
+	child := t.mutableChild(n, i)
+	if found {
+		item := n.items[i]
+		n.items[i], _ = t.remove(child, "", true)
+		return item, true
+	}
+	return t.remove(child, key, max)
+}
+
+// growChild makes sure that the child at i has more than the minimum number
+// of items, by stealing an item from a sibling or merging with a sibling.
+func (t *cowTree) growChild(n *cowNode, i int) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > cowMinItems:
+		child := t.mutableChild(n, i)
+		from := t.mutableChild(n, i-1)
+		stolen := from.items[len(from.items)-1]
+		from.items = from.items[:len(from.items)-1]
+		child.items = append(child.items, cowItem{})
+		copy(child.items[1:], child.items)
+		child.items[0] = n.items[i-1]
+		n.items[i-1] = stolen
+		if len(from.children) > 0 {
+			c := from.children[len(from.children)-1]
+			from.children = from.children[:len(from.children)-1]
+			child.children = append(child.children, nil)
+			copy(child.children[1:], child.children)
+			child.children[0] = c
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > cowMinItems:
+		child := t.mutableChild(n, i)
+		from := t.mutableChild(n, i+1)
+		stolen := from.items[0]
+		from.items = append(from.items[:0], from.items[1:]...)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		if len(from.children) > 0 {
+			child.children = append(child.children, from.children[0])
+			from.children = append(from.children[:0], from.children[1:]...)
+		}
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := t.mutableChild(n, i)
+		merge := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		child.items = append(child.items, merge.items...)
+		child.children = append(child.children, merge.children...)
+		n.items = append(n.items[:i], n.items[i+1:]...)
+		n.children = append(n.children[:i+1], n.children[i+2:]...)
+	}
+}
+
+// ascend calls iter for every item with a key that's greater than or equal
+// to pivot, in order.
+func (t *cowTree) ascend(pivot string, iter func(item cowItem) bool) {
+	if t.root != nil {
+		t.root.ascend(pivot, iter)
+	}
+}
+
+func (n *cowNode) ascend(pivot string, iter func(item cowItem) bool) bool {
+	i, _ := n.find(pivot)
+	for ; i < len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(pivot, iter) {
+			return false
+		}
+		if !iter(n.items[i]) {
+			return false
+		}
+	}
+	if len(n.children) > 0 {
+		return n.children[len(n.children)-1].ascend(pivot, iter)
+	}
+	return true
+}
@@ -0,0 +1,464 @@
+package kvbench
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errWrongKey = errors.New("wrong encryption key")
+var errDecrypt = errors.New("decryption failed: data is corrupt or the key is wrong")
+var errInvalidKeyFile = errors.New("invalid key file: expecting 16, 24 or 32 bytes, raw or hex encoded")
+var errEncrypted = errors.New("store is encrypted: a key file is required")
+var errNotEncrypted = errors.New("store is not encrypted: use --rotate-keyfile to encrypt it")
+var errRotating = errors.New("a key rotation was interrupted: run it again with the same new key file")
+
+// cryptMagic marks the start of an encrypted file. It's followed by a frame
+// holding the sealed cryptCheck value, which allows for a wrong key to be
+// detected before any data is read.
+var cryptMagic = []byte("KVBENC1\n")
+var cryptCheck = []byte("kvbench")
+
+// cryptMarkerKey is the reserved key that marks a store with encrypted
+// values. Its value is cryptCheck sealed with the key of the store.
+var cryptMarkerKey = []byte("\x00kvbench:crypt")
+
+// cryptRotateKey is the reserved key that holds cryptCheck sealed with the
+// new key while a key rotation is in progress.
+var cryptRotateKey = []byte("\x00kvbench:crypt-rotate")
+
+func isCryptReserved(key []byte) bool {
+	return bytes.Equal(key, cryptMarkerKey) || bytes.Equal(key, cryptRotateKey)
+}
+
+// crypter seals and opens data using AES-GCM. Every sealed message carries
+// its own random nonce.
+type crypter struct {
+	aead cipher.AEAD
+}
+
+func loadKeyFile(path string) (*crypter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 32 || len(key) == 48 || len(key) == 64 {
+		if hkey, err := hex.DecodeString(string(key)); err == nil {
+			key = hkey
+		}
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		key = data
+		if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			return nil, errInvalidKeyFile
+		}
+	}
+	return newCrypter(key)
+}
+
+func newCrypter(key []byte) (*crypter, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &crypter{aead: aead}, nil
+}
+
+// seal appends the nonce and the encrypted data to dst.
+func (c *crypter) seal(dst, data []byte) []byte {
+	n := len(dst)
+	ns := c.aead.NonceSize()
+	for i := 0; i < ns; i++ {
+		dst = append(dst, 0)
+	}
+	if _, err := io.ReadFull(rand.Reader, dst[n:n+ns]); err != nil {
+		panic(err)
+	}
+	return c.aead.Seal(dst, dst[n:n+ns], data, nil)
+}
+
+// open appends the decrypted data to dst.
+func (c *crypter) open(dst, data []byte) ([]byte, error) {
+	ns := c.aead.NonceSize()
+	if len(data) < ns {
+		return nil, errDecrypt
+	}
+	dst, err := c.aead.Open(dst, data[:ns], data[ns:], nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return dst, nil
+}
+
+// sealsCheck returns whether data is cryptCheck sealed with the key.
+func (c *crypter) sealsCheck(data []byte) bool {
+	check, err := c.open(nil, data)
+	return err == nil && bytes.Equal(check, cryptCheck)
+}
+
+// appendFrame appends a length-prefixed sealed frame to dst.
+func (c *crypter) appendFrame(dst, data []byte) []byte {
+	n := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	dst = c.seal(dst, data)
+	binary.BigEndian.PutUint32(dst[n:], uint32(len(dst)-n-4))
+	return dst
+}
+
+// readFrame reads and opens the next frame. Returns io.EOF when there are
+// no more frames.
+func (c *crypter) readFrame(rd io.Reader, buf []byte) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(rd, sealed); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return c.open(buf[:0], sealed)
+}
+
+// appendHeader appends the file header to dst.
+func (c *crypter) appendHeader(dst []byte) []byte {
+	dst = append(dst, cryptMagic...)
+	return c.appendFrame(dst, cryptCheck)
+}
+
+// readHeader reads the file header which must have been written with the
+// same key.
+func (c *crypter) readHeader(rd io.Reader) error {
+	magic := make([]byte, len(cryptMagic))
+	if _, err := io.ReadFull(rd, magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, cryptMagic) {
+		return errInvalidLog
+	}
+	check, err := c.readFrame(rd, nil)
+	if err == errDecrypt || (err == nil && !bytes.Equal(check, cryptCheck)) {
+		return errWrongKey
+	}
+	return err
+}
+
+// cryptStore is a value-encoding wrapper that encrypts the values of the
+// underlying store. Keys are stored as-is. An encrypted store holds the
+// cryptMarkerKey, so that it isn't opened with the wrong key or without one.
+type cryptStore struct {
+	Store
+	crypt *crypter
+	// rotating is set when the store holds an unfinished key rotation.
+	rotating bool
+}
+
+func newCryptStore(store Store, crypt *crypter) (*cryptStore, error) {
+	s := &cryptStore{Store: store, crypt: crypt}
+	vals, oks, err := store.PGet([][]byte{cryptMarkerKey, cryptRotateKey})
+	if err != nil {
+		return nil, err
+	}
+	if oks[0] {
+		if crypt == nil {
+			return nil, errEncrypted
+		}
+		if !crypt.sealsCheck(vals[0]) {
+			return nil, errWrongKey
+		}
+	} else if crypt != nil {
+		if oks[1] {
+			// the rotation of an unencrypted store
+			return nil, errRotating
+		}
+		keys, _, err := store.Keys([]byte("*"), 1, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			return nil, errNotEncrypted
+		}
+		if err := store.Set(cryptMarkerKey, crypt.seal(nil, cryptCheck)); err != nil {
+			return nil, err
+		}
+	}
+	if oks[1] {
+		if oks[0] && crypt.sealsCheck(vals[1]) {
+			// interrupted after the marker was updated
+			if _, err := store.Del(cryptRotateKey); err != nil {
+				return nil, err
+			}
+		} else {
+			s.rotating = true
+		}
+	}
+	return s, nil
+}
+
+func (s *cryptStore) encode(value []byte) []byte {
+	if s.crypt == nil {
+		return value
+	}
+	return s.crypt.seal(nil, value)
+}
+
+func (s *cryptStore) decode(value []byte) ([]byte, error) {
+	if s.crypt == nil {
+		return value, nil
+	}
+	return s.crypt.open(nil, value)
+}
+
+func (s *cryptStore) Set(key, value []byte) error {
+	return s.Store.Set(key, s.encode(value))
+}
+
+func (s *cryptStore) PSet(keys, values [][]byte) error {
+	evalues := make([][]byte, len(values))
+	for i := range values {
+		evalues[i] = s.encode(values[i])
+	}
+	return s.Store.PSet(keys, evalues)
+}
+
+func (s *cryptStore) Get(key []byte) ([]byte, bool, error) {
+	v, ok, err := s.Store.Get(key)
+	if !ok || err != nil {
+		return v, ok, err
+	}
+	v, err = s.decode(v)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (s *cryptStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	values, oks, err := s.Store.PGet(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range values {
+		if oks[i] {
+			values[i], err = s.decode(values[i])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return values, oks, nil
+}
+
+func (s *cryptStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	keys, vals, err := s.Store.Keys(pattern, reservedLimit(limit), withvalues)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.decodeKeys(keys, vals, limit, withvalues)
+}
+
+func (s *cryptStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	keys, vals, err := keysFrom(s.Store, start, pattern, reservedLimit(limit),
+		withvalues)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.decodeKeys(keys, vals, limit, withvalues)
+}
+
+// reservedLimit leaves room for the reserved keys in a limit of keys.
+func reservedLimit(limit int) int {
+	if limit >= 0 {
+		return limit + 2
+	}
+	return limit
+}
+
+// decodeKeys drops the reserved keys and decrypts the values.
+func (s *cryptStore) decodeKeys(keys, vals [][]byte, limit int,
+	withvalues bool,
+) ([][]byte, [][]byte, error) {
+	var err error
+	var j int
+	for i := range keys {
+		if isCryptReserved(keys[i]) {
+			continue
+		}
+		keys[j] = keys[i]
+		if withvalues {
+			vals[j], err = s.decode(vals[i])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		j++
+	}
+	if limit >= 0 && j > limit {
+		j = limit
+	}
+	keys = keys[:j]
+	if withvalues {
+		vals = vals[:j]
+	}
+	return keys, vals, nil
+}
+
+func (s *cryptStore) FlushDB() error {
+	if err := s.Store.FlushDB(); err != nil {
+		return err
+	}
+	if s.crypt == nil {
+		return nil
+	}
+	return s.Store.Set(cryptMarkerKey, s.crypt.seal(nil, cryptCheck))
+}
+
+func (s *cryptStore) scan(iter func(key, value []byte) bool) error {
+	var err error
+	serr := scanStore(s.Store, func(key, value []byte) bool {
+		if isCryptReserved(key) {
+			return true
+		}
+		value, err = s.decode(value)
+		if err != nil {
+			return false
+		}
+		return iter(key, value)
+	})
+	if serr != nil {
+		return serr
+	}
+	return err
+}
+
+func (s *cryptStore) info(buf []byte) []byte {
+	if i, ok := s.Store.(infoer); ok {
+		return i.info(buf)
+	}
+	return buf
+}
+
+// rotateKey re-encrypts every value with the new key. The new key is
+// recorded in the store first, and the marker is only replaced when every
+// value is re-encrypted. An interrupted rotation is resumed by running it
+// again with the same new key, which skips the values that already open
+// with it.
+func (s *cryptStore) rotateKey(crypt *crypter) error {
+	v, ok, err := s.Store.Get(cryptRotateKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.Store.Set(cryptRotateKey, crypt.seal(nil, cryptCheck)); err != nil {
+			return err
+		}
+	} else if !crypt.sealsCheck(v) {
+		return errRotating
+	}
+	s.rotating = true
+	const batch = 1000
+	err = eachBatch(s.Store, batch, func(keys, vals [][]byte) error {
+		var bkeys, bvals [][]byte
+		for i := range keys {
+			if isCryptReserved(keys[i]) {
+				continue
+			}
+			if _, err := crypt.open(nil, vals[i]); err == nil {
+				// rotated before an interruption
+				continue
+			}
+			v, err := s.decode(vals[i])
+			if err != nil {
+				return err
+			}
+			bkeys = append(bkeys, keys[i])
+			bvals = append(bvals, crypt.seal(nil, v))
+		}
+		if len(bkeys) == 0 {
+			return nil
+		}
+		return s.Store.PSet(bkeys, bvals)
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Set(cryptMarkerKey, crypt.seal(nil, cryptCheck)); err != nil {
+		return err
+	}
+	if _, err := s.Store.Del(cryptRotateKey); err != nil {
+		return err
+	}
+	s.crypt = crypt
+	s.rotating = false
+	return nil
+}
+
+// eachBatch calls fn with the keys and values of the store, n at a time.
+// Ordered stores are read from the key after the last one of a batch, the
+// other stores hold every key, but not the values, in memory.
+func eachBatch(store Store, n int, fn func(keys, vals [][]byte) error) error {
+	if r, ok := store.(ranger); ok {
+		var start []byte
+		for {
+			keys, vals, err := r.keysFrom(start, []byte("*"), n, true)
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err := fn(keys, vals); err != nil {
+					return err
+				}
+			}
+			if len(keys) < n {
+				return nil
+			}
+			last := keys[len(keys)-1]
+			start = append(append(start[:0:0], last...), 0)
+		}
+	}
+	keys, _, err := store.Keys([]byte("*"), -1, false)
+	if err != nil {
+		return err
+	}
+	for len(keys) > 0 {
+		bkeys := keys
+		if len(bkeys) > n {
+			bkeys = bkeys[:n]
+		}
+		keys = keys[len(bkeys):]
+		vals, oks, err := store.PGet(bkeys)
+		if err != nil {
+			return err
+		}
+		var j int
+		for i := range bkeys {
+			if oks[i] {
+				bkeys[j], vals[j] = bkeys[i], vals[i]
+				j++
+			}
+		}
+		if err := fn(bkeys[:j], vals[:j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyRotator is implemented by stores that can re-encrypt their data with a
+// new key.
+type keyRotator interface {
+	rotateKey(crypt *crypter) error
+}
@@ -0,0 +1,214 @@
+package kvbench
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func testCrypter(t *testing.T, b byte) *crypter {
+	t.Helper()
+	c, err := newCrypter(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCryptSealOpen(t *testing.T) {
+	c := testCrypter(t, 1)
+	for _, data := range [][]byte{nil, []byte("a"), bytes.Repeat([]byte("x"), 5000)} {
+		sealed := c.seal(nil, data)
+		got, err := c.open(nil, sealed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("open(seal(%q)) = %q, %v", data, got, err)
+		}
+		if _, err := testCrypter(t, 2).open(nil, sealed); err != errDecrypt {
+			t.Fatalf("open with the wrong key: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	buf.Write(c.appendHeader(nil))
+	if err := testCrypter(t, 2).readHeader(bytes.NewReader(buf.Bytes())); err != errWrongKey {
+		t.Fatalf("readHeader with the wrong key: %v", err)
+	}
+	if err := c.readHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptStoreMarker(t *testing.T) {
+	key1, key2 := testCrypter(t, 1), testCrypter(t, 2)
+	for _, which := range []string{"bitcask", "lsm", "bptree"} {
+		t.Run(which, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			plain := filepath.Join(t.TempDir(), "plain")
+			store, err := openStore(which, path, storeOptions{crypt: key1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Set([]byte("key"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			store, err = openStore(which, plain, storeOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Set([]byte("key"), []byte("value"))
+			store.Close()
+
+			for _, tc := range []struct {
+				path  string
+				crypt *crypter
+				err   error
+			}{
+				{path, nil, errEncrypted},
+				{path, key2, errWrongKey},
+				{plain, key1, errNotEncrypted},
+				{path, key1, nil},
+				{plain, nil, nil},
+			} {
+				store, err := openStore(which, tc.path, storeOptions{crypt: tc.crypt})
+				if err != tc.err {
+					t.Fatalf("open %s: got %v, expected %v", tc.path, err, tc.err)
+				}
+				if err != nil {
+					continue
+				}
+				v, ok, err := store.Get([]byte("key"))
+				if err != nil || !ok || string(v) != "value" {
+					t.Fatalf("get: %q %v %v", v, ok, err)
+				}
+				keys, _, err := store.Keys([]byte("*"), -1, false)
+				if err != nil || len(keys) != 1 {
+					t.Fatalf("keys: %q %v", keys, err)
+				}
+				if err := store.FlushDB(); err != nil {
+					t.Fatal(err)
+				}
+				store.Close()
+			}
+			// the marker survives a flush
+			if _, err := openStore(which, path, storeOptions{}); err != errEncrypted {
+				t.Fatalf("open after flush: %v", err)
+			}
+		})
+	}
+}
+
+func TestCryptStoreRotateResume(t *testing.T) {
+	key1, key2 := testCrypter(t, 1), testCrypter(t, 2)
+	for _, old := range []*crypter{nil, key1} {
+		t.Run(fmt.Sprintf("encrypted=%v", old != nil), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db")
+			store, err := openStore("lsm", path, storeOptions{crypt: old})
+			if err != nil {
+				t.Fatal(err)
+			}
+			const n = 100
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("key:%d", i))
+				if err := store.Set(key, key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// an interrupted rotation: half of the values have the new key
+			raw := unwrapCrypt(store)
+			raw.Set(cryptRotateKey, key2.seal(nil, cryptCheck))
+			for i := 0; i < n/2; i++ {
+				key := []byte(fmt.Sprintf("key:%d", i))
+				raw.Set(key, key2.seal(nil, key))
+			}
+			store.Close()
+
+			if _, err := openStore("lsm", path, storeOptions{crypt: old}); err != errRotating {
+				t.Fatalf("open without rotating: %v", err)
+			}
+			store, err = openStore("lsm", path, storeOptions{crypt: old, rotate: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, ok := store.(keyRotator)
+			if !ok {
+				t.Fatalf("%T is not a key rotator", store)
+			}
+			if err := r.rotateKey(testCrypter(t, 3)); err != errRotating {
+				t.Fatalf("rotate with another key: %v", err)
+			}
+			if err := r.rotateKey(key2); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			store, err = openStore("lsm", path, storeOptions{crypt: key2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			keys, vals, err := store.Keys([]byte("*"), -1, true)
+			if err != nil || len(keys) != n {
+				t.Fatalf("keys: %d %v", len(keys), err)
+			}
+			for i := range keys {
+				if !bytes.Equal(keys[i], vals[i]) {
+					t.Fatalf("%s = %q", keys[i], vals[i])
+				}
+			}
+			if _, ok, _ := unwrapCrypt(store).Get(cryptRotateKey); ok {
+				t.Fatal("the rotation key is left")
+			}
+		})
+	}
+}
+
+func unwrapCrypt(store Store) Store {
+	if s, ok := store.(*cryptStore); ok {
+		return s.Store
+	}
+	return store
+}
+
+func TestEachBatch(t *testing.T) {
+	for _, which := range []string{"lsm", "bitcask", "map"} {
+		for _, n := range []int{1, 7, 50, 1000} {
+			t.Run(fmt.Sprintf("%s/%d", which, n), func(t *testing.T) {
+				store, err := openStore(which, filepath.Join(t.TempDir(), "db"),
+					storeOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer store.Close()
+				store = unwrapCrypt(store)
+				want := make(map[string]bool)
+				for i := 0; i < 50; i++ {
+					key := fmt.Sprintf("key:%02d", i)
+					want[key] = true
+					if err := store.Set([]byte(key), []byte("v"+key)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				seen := make(map[string]bool)
+				err = eachBatch(store, n, func(keys, vals [][]byte) error {
+					if len(keys) > n {
+						t.Fatalf("a batch of %d keys", len(keys))
+					}
+					for i, key := range keys {
+						if seen[string(key)] || string(vals[i]) != "v"+string(key) {
+							t.Fatalf("%s: %q, seen %v", key, vals[i], seen[string(key)])
+						}
+						seen[string(key)] = true
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(seen) != len(want) {
+					t.Fatalf("got %d keys, expected %d", len(seen), len(want))
+				}
+			})
+		}
+	}
+}
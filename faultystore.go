@@ -0,0 +1,150 @@
+package kvbench
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errInjectedFault = errors.New("ERR injected fault")
+
+// parseFaultRates parses the percentages of the operations that are faulted,
+// which is a percentage for every method such as "10", or percentages by
+// method such as "get:10,pset:50".
+func parseFaultRates(s string) ([numOps]float64, error) {
+	var rates [numOps]float64
+	for _, part := range strings.Split(s, ",") {
+		name, value := "all", strings.TrimSpace(part)
+		if i := strings.IndexByte(value, ':'); i >= 0 {
+			name, value = strings.ToLower(value[:i]), value[i+1:]
+		}
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 100 {
+			return rates, fmt.Errorf("invalid percentage: %v", value)
+		}
+		var found bool
+		for op := range rates {
+			if name == "all" || name == opNames[op] {
+				rates[op] = rate
+				found = true
+			}
+		}
+		if !found {
+			return rates, fmt.Errorf("unknown method: %v", name)
+		}
+	}
+	return rates, nil
+}
+
+// faultyStore wraps a store and fails or delays a percentage of the
+// operations of every method. A failed operation isn't passed to the
+// backend.
+type faultyStore struct {
+	middlewareStore
+	errors  [numOps]float64
+	delays  [numOps]float64
+	delay   time.Duration
+	failed  [numOps]int64
+	delayed [numOps]int64
+}
+
+func newFaultyStore(path string, opts storeOptions) (*faultyStore, error) {
+	if opts.faultyBackend == "" || opts.faultyBackend == "faulty" {
+		return nil, fmt.Errorf("invalid faulty backend: %q", opts.faultyBackend)
+	}
+	backend, err := openStore(opts.faultyBackend, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyStore{
+		middlewareStore: middlewareStore{backend},
+		errors:          opts.faultyErrors,
+		delays:          opts.faultyDelays,
+		delay:           opts.faultyDelay,
+	}, nil
+}
+
+func (s *faultyStore) fault(op int) error {
+	if p := s.delays[op]; p > 0 && rand.Float64()*100 < p {
+		atomic.AddInt64(&s.delayed[op], 1)
+		time.Sleep(s.delay)
+	}
+	if p := s.errors[op]; p > 0 && rand.Float64()*100 < p {
+		atomic.AddInt64(&s.failed[op], 1)
+		return errInjectedFault
+	}
+	return nil
+}
+
+func (s *faultyStore) Set(key, value []byte) error {
+	if err := s.fault(opSet); err != nil {
+		return err
+	}
+	return s.Store.Set(key, value)
+}
+
+func (s *faultyStore) PSet(keys, values [][]byte) error {
+	if err := s.fault(opPSet); err != nil {
+		return err
+	}
+	return s.Store.PSet(keys, values)
+}
+
+func (s *faultyStore) Get(key []byte) ([]byte, bool, error) {
+	if err := s.fault(opGet); err != nil {
+		return nil, false, err
+	}
+	return s.Store.Get(key)
+}
+
+func (s *faultyStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	if err := s.fault(opPGet); err != nil {
+		return nil, nil, err
+	}
+	return s.Store.PGet(keys)
+}
+
+func (s *faultyStore) Del(key []byte) (bool, error) {
+	if err := s.fault(opDel); err != nil {
+		return false, err
+	}
+	return s.Store.Del(key)
+}
+
+func (s *faultyStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	if err := s.fault(opKeys); err != nil {
+		return nil, nil, err
+	}
+	return s.Store.Keys(pattern, limit, withvalues)
+}
+
+func (s *faultyStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	if err := s.fault(opKeys); err != nil {
+		return nil, nil, err
+	}
+	return s.middlewareStore.keysFrom(start, pattern, limit, withvalues)
+}
+
+func (s *faultyStore) FlushDB() error {
+	if err := s.fault(opFlushDB); err != nil {
+		return err
+	}
+	return s.Store.FlushDB()
+}
+
+func (s *faultyStore) info(buf []byte) []byte {
+	buf = append(buf, "# Faults\r\n"...)
+	for op := range opNames {
+		failed := atomic.LoadInt64(&s.failed[op])
+		delayed := atomic.LoadInt64(&s.delayed[op])
+		if s.errors[op] > 0 || s.delays[op] > 0 {
+			buf = append(buf, fmt.Sprintf("faults_%s:failed=%d,delayed=%d\r\n",
+				opNames[op], failed, delayed)...)
+		}
+	}
+	return s.storeInfo(buf)
+}
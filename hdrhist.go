@@ -0,0 +1,239 @@
+package kvbench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// hdrHist is a high dynamic range histogram that uses the bucket layout of
+// HdrHistogram. Every value between 1 and the highest trackable value is
+// recorded with the given number of significant decimal digits. It's
+// updated atomically without allocations.
+type hdrHist struct {
+	highest int64
+
+	subBucketHalfCountMagnitude uint
+	subBucketCount              int64
+	subBucketHalfCount          int64
+	subBucketMask               int64
+	bucketCount                 int
+
+	counts []int64
+	count  int64
+	max    int64
+}
+
+// newHDRHist returns a histogram of the values up to highest with 1 to 5
+// significant digits.
+func newHDRHist(highest int64, sigfigs int) *hdrHist {
+	if sigfigs < 1 || sigfigs > 5 {
+		panic("hdrhist: significant digits must be between 1 and 5")
+	}
+	if highest < 2 {
+		panic("hdrhist: highest trackable value must be at least 2")
+	}
+	h := &hdrHist{highest: highest}
+	largest := 2 * int64(math.Pow10(sigfigs))
+	subBucketCountMagnitude := uint(math.Ceil(math.Log2(float64(largest))))
+	h.subBucketHalfCountMagnitude = subBucketCountMagnitude - 1
+	h.subBucketCount = 1 << subBucketCountMagnitude
+	h.subBucketHalfCount = h.subBucketCount / 2
+	h.subBucketMask = h.subBucketCount - 1
+	// the number of buckets, where each bucket covers twice the range of
+	// the previous one
+	smallestUntrackable := h.subBucketCount
+	h.bucketCount = 1
+	for smallestUntrackable <= highest {
+		if smallestUntrackable > math.MaxInt64/2 {
+			h.bucketCount++
+			break
+		}
+		smallestUntrackable <<= 1
+		h.bucketCount++
+	}
+	h.counts = make([]int64, (h.bucketCount+1)*int(h.subBucketHalfCount))
+	return h
+}
+
+func (h *hdrHist) bucketIndex(v int64) int {
+	pow2Ceiling := 64 - bits.LeadingZeros64(uint64(v|h.subBucketMask))
+	return pow2Ceiling - int(h.subBucketHalfCountMagnitude+1)
+}
+
+func (h *hdrHist) countsIndex(v int64) int {
+	bucketIdx := h.bucketIndex(v)
+	subBucketIdx := v >> uint(bucketIdx)
+	return (bucketIdx+1)<<h.subBucketHalfCountMagnitude +
+		int(subBucketIdx-h.subBucketHalfCount)
+}
+
+// valueFromIndex returns the lowest value that is counted at the index.
+func (h *hdrHist) valueFromIndex(i int) int64 {
+	bucketIdx := (i >> h.subBucketHalfCountMagnitude) - 1
+	subBucketIdx := int64(i)&(h.subBucketHalfCount-1) + h.subBucketHalfCount
+	if bucketIdx < 0 {
+		subBucketIdx -= h.subBucketHalfCount
+		bucketIdx = 0
+	}
+	return subBucketIdx << uint(bucketIdx)
+}
+
+// highestEquivalent returns the highest value that is counted together
+// with the value.
+func (h *hdrHist) highestEquivalent(v int64) int64 {
+	bucketIdx := h.bucketIndex(v)
+	subBucketIdx := v >> uint(bucketIdx)
+	lowest := subBucketIdx << uint(bucketIdx)
+	if subBucketIdx >= h.subBucketCount {
+		bucketIdx++
+	}
+	return lowest + 1<<uint(bucketIdx) - 1
+}
+
+// record counts a value. Values below 0 count as 0 and values above the
+// highest trackable value count as the highest one.
+func (h *hdrHist) record(v int64) {
+	if v < 0 {
+		v = 0
+	} else if v > h.highest {
+		v = h.highest
+	}
+	atomic.AddInt64(&h.counts[h.countsIndex(v)], 1)
+	atomic.AddInt64(&h.count, 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if v <= max || atomic.CompareAndSwapInt64(&h.max, max, v) {
+			break
+		}
+	}
+}
+
+// total returns the number of recorded values.
+func (h *hdrHist) total() int64 {
+	return atomic.LoadInt64(&h.count)
+}
+
+// min returns the lowest recorded value, or rather the lowest value that
+// is counted together with it.
+func (h *hdrHist) min() int64 {
+	for i := range h.counts {
+		if atomic.LoadInt64(&h.counts[i]) > 0 {
+			return h.valueFromIndex(i)
+		}
+	}
+	return 0
+}
+
+// percentile returns the value at the percentile, between 0 and 100.
+func (h *hdrHist) percentile(p float64) int64 {
+	if p >= 100 {
+		return atomic.LoadInt64(&h.max)
+	}
+	target := int64(p/100*float64(h.total()) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var count int64
+	for i := range h.counts {
+		count += atomic.LoadInt64(&h.counts[i])
+		if count >= target {
+			v := h.highestEquivalent(h.valueFromIndex(i))
+			if max := atomic.LoadInt64(&h.max); v > max {
+				return max
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+// meanStdDev returns the mean and the standard deviation, using the middle
+// of the range of every count.
+func (h *hdrHist) meanStdDev() (float64, float64) {
+	var count int64
+	var sum float64
+	for i := range h.counts {
+		if c := atomic.LoadInt64(&h.counts[i]); c > 0 {
+			count += c
+			sum += float64(c) * h.middle(i)
+		}
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	mean := sum / float64(count)
+	var sq float64
+	for i := range h.counts {
+		if c := atomic.LoadInt64(&h.counts[i]); c > 0 {
+			d := h.middle(i) - mean
+			sq += float64(c) * d * d
+		}
+	}
+	return mean, math.Sqrt(sq / float64(count))
+}
+
+func (h *hdrHist) middle(i int) float64 {
+	v := h.valueFromIndex(i)
+	return (float64(v) + float64(h.highestEquivalent(v))) / 2
+}
+
+// writePercentiles writes the percentile distribution in the format of
+// HdrHistogram, which the HdrHistogram plotter reads. The values are
+// divided by scale, such as 1e6 for nanoseconds as milliseconds.
+func (h *hdrHist) writePercentiles(w io.Writer, scale float64) error {
+	const ticksPerHalfDistance = 5
+	total := h.total()
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	printf("%12s %14s %10s %14s\n\n", "Value", "Percentile", "TotalCount",
+		"1/(1-Percentile)")
+	var count int64
+	var level float64
+	max := atomic.LoadInt64(&h.max)
+	for i := range h.counts {
+		c := atomic.LoadInt64(&h.counts[i])
+		if c == 0 {
+			continue
+		}
+		count += c
+		// the bucket of the max can reach beyond it
+		v := h.highestEquivalent(h.valueFromIndex(i))
+		if v > max {
+			v = max
+		}
+		value := float64(v) / scale
+		for level <= 100*float64(count)/float64(total) {
+			printf("%12.3f %2.12f %10d %14.2f\n", value, level/100, count,
+				1/(1-level/100))
+			halfDistance := math.Pow(2,
+				math.Trunc(math.Log2(100/(100-level)))+1)
+			level += 100 / (ticksPerHalfDistance * halfDistance)
+			if count >= total {
+				// like HdrHistogram, the last value is reported once
+				// before the 100th percentile
+				break
+			}
+		}
+		if count >= total {
+			break
+		}
+	}
+	mean, stddev := h.meanStdDev()
+	if total > 0 {
+		printf("%12.3f %2.12f %10d\n", float64(max)/scale, 1.0, total)
+	}
+	printf("#[Mean    = %12.3f, StdDeviation   = %12.3f]\n", mean/scale,
+		stddev/scale)
+	printf("#[Max     = %12.3f, Total count    = %12d]\n", float64(max)/scale,
+		total)
+	printf("#[Buckets = %12d, SubBuckets     = %12d]\n", h.bucketCount,
+		h.subBucketCount)
+	return err
+}
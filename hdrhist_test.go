@@ -0,0 +1,86 @@
+package kvbench
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHDRHistPercentiles(t *testing.T) {
+	h := newHDRHist(3600*1e6, 3)
+	for v := int64(1); v <= 10000; v++ {
+		h.record(v)
+	}
+	tests := []struct {
+		p    float64
+		want int64
+	}{
+		{0, 1},
+		{50, 5000},
+		{90, 9000},
+		{99, 9900},
+		{99.9, 9990},
+		{100, 10000},
+	}
+	for _, tc := range tests {
+		got := h.percentile(tc.p)
+		// 3 significant digits
+		if got < tc.want || float64(got-tc.want) > float64(tc.want)/1000 {
+			t.Fatalf("p%v: got %d, expected %d", tc.p, got, tc.want)
+		}
+	}
+	if h.total() != 10000 || h.min() != 1 {
+		t.Fatalf("total %d, min %d", h.total(), h.min())
+	}
+	mean, _ := h.meanStdDev()
+	if mean < 5000 || mean > 5001+5 {
+		t.Fatalf("mean %v", mean)
+	}
+}
+
+func TestHDRHistWritePercentiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+	}{
+		{"empty", nil},
+		{"one", []int64{123457}},
+		// the max is in the middle of a wide bucket
+		{"wide", []int64{1, 2, 3, 1000001}},
+		{"above-highest", []int64{5, 1 << 40}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHDRHist(1<<30, 2)
+			for _, v := range tc.values {
+				h.record(v)
+			}
+			var buf bytes.Buffer
+			if err := h.writePercentiles(&buf, 1); err != nil {
+				t.Fatal(err)
+			}
+			max := float64(h.percentile(100))
+			var rows int
+			sc := bufio.NewScanner(&buf)
+			for sc.Scan() {
+				fields := strings.Fields(sc.Text())
+				if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+					continue
+				}
+				value, err := strconv.ParseFloat(fields[0], 64)
+				if err != nil {
+					continue
+				}
+				rows++
+				if value > max {
+					t.Fatalf("value %v is above the max %v", value, max)
+				}
+			}
+			if (rows == 0) != (len(tc.values) == 0) {
+				t.Fatalf("%d rows", rows)
+			}
+		})
+	}
+}
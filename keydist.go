@@ -0,0 +1,251 @@
+package kvbench
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// keyDist chooses the key numbers of a benchmark. It isn't safe for
+// concurrent use, every client has its own clone.
+type keyDist interface {
+	// next returns a key number below n, the current number of keys.
+	next(rnd *rand.Rand, n int64) int64
+	clone() keyDist
+}
+
+type uniformDist struct{}
+
+func (uniformDist) next(rnd *rand.Rand, n int64) int64 { return rnd.Int63n(n) }
+func (d uniformDist) clone() keyDist                   { return d }
+
+// zipfianTheta is the default skew of the zipfian distributions, the one of
+// YCSB.
+const zipfianTheta = 0.99
+
+// keyDistNames are the names of the key distributions for newKeyDist.
+var keyDistNames = []string{"uniform", "zipfian", "scrambled-zipfian",
+	"hotspot", "latest", "sequential"}
+
+// newKeyDist returns the named distribution over items keys. The zipfian
+// distributions use theta, between 0 and 1 exclusive, and the hotspot
+// distribution sends the hotOps fraction of the requests to the hotKeys
+// fraction of the keys.
+func newKeyDist(name string, items int64, theta, hotKeys, hotOps float64,
+) (keyDist, error) {
+	switch name {
+	case "zipfian", "scrambled-zipfian", "latest":
+		if theta <= 0 || theta >= 1 {
+			return nil, fmt.Errorf("invalid theta: %v", theta)
+		}
+	case "hotspot":
+		if hotKeys <= 0 || hotKeys > 1 {
+			return nil, fmt.Errorf("invalid hotspot keys fraction: %v", hotKeys)
+		}
+		if hotOps < 0 || hotOps > 1 {
+			return nil, fmt.Errorf("invalid hotspot ops fraction: %v", hotOps)
+		}
+	}
+	switch name {
+	case "uniform":
+		return uniformDist{}, nil
+	case "zipfian":
+		return newZipfianDist(items, theta), nil
+	case "scrambled-zipfian":
+		return newScrambledZipfianDist(theta), nil
+	case "hotspot":
+		return hotspotDist{hotKeys, hotOps}, nil
+	case "latest":
+		return latestDist{newZipfianDist(items, theta)}, nil
+	case "sequential":
+		return sequentialDist{new(int64)}, nil
+	}
+	return nil, fmt.Errorf("unknown key distribution: %v", name)
+}
+
+// zipfianDist is the zipfian distribution of YCSB, after "Quickly
+// Generating Billion-Record Synthetic Databases" by Gray et al. Key 0 is
+// the most popular one. When the number of keys grows, zeta is updated
+// incrementally.
+type zipfianDist struct {
+	items      int64
+	theta      float64
+	zetan      float64
+	zeta2theta float64
+	alpha      float64
+	eta        float64
+}
+
+func newZipfianDist(items int64, theta float64) *zipfianDist {
+	d := &zipfianDist{theta: theta, alpha: 1 / (1 - theta)}
+	d.zeta2theta = d.zeta(0, 2, 0)
+	d.resize(items)
+	return d
+}
+
+// zeta returns the sum of 1/i^theta for i in (from, to], adding to sum.
+func (d *zipfianDist) zeta(from, to int64, sum float64) float64 {
+	for i := from + 1; i <= to; i++ {
+		sum += 1 / math.Pow(float64(i), d.theta)
+	}
+	return sum
+}
+
+// zetaLarge returns the zeta of items without summing billions of terms.
+// The terms after the first million are estimated by the Euler-Maclaurin
+// formula.
+func (d *zipfianDist) zetaLarge(items int64) float64 {
+	const m = 1000000
+	if items <= m {
+		return d.zeta(0, items, 0)
+	}
+	f := func(x float64) float64 { return math.Pow(x, -d.theta) }
+	df := func(x float64) float64 { return -d.theta * math.Pow(x, -d.theta-1) }
+	a, b := float64(m), float64(items)
+	return d.zeta(0, m, 0) +
+		(math.Pow(b, 1-d.theta)-math.Pow(a, 1-d.theta))/(1-d.theta) +
+		(f(b)-f(a))/2 + (df(b)-df(a))/12
+}
+
+func (d *zipfianDist) resize(items int64) {
+	if items > d.items {
+		d.setZetan(items, d.zeta(d.items, items, d.zetan))
+	} else {
+		d.setZetan(items, d.zeta(0, items, 0))
+	}
+}
+
+// setZetan sets the number of items and their zeta.
+func (d *zipfianDist) setZetan(items int64, zetan float64) {
+	d.items = items
+	d.zetan = zetan
+	d.eta = (1 - math.Pow(2/float64(items), 1-d.theta)) /
+		(1 - d.zeta2theta/d.zetan)
+}
+
+func (d *zipfianDist) next(rnd *rand.Rand, n int64) int64 {
+	if n != d.items {
+		d.resize(n)
+	}
+	return d.value(rnd)
+}
+
+// value returns an item number below the number of items.
+func (d *zipfianDist) value(rnd *rand.Rand) int64 {
+	n := d.items
+	u := rnd.Float64()
+	uz := u * d.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < 1+math.Pow(0.5, d.theta) {
+		return 1
+	}
+	k := int64(float64(n) * math.Pow(d.eta*u-d.eta+1, d.alpha))
+	if k >= n {
+		k = n - 1
+	}
+	return k
+}
+
+func (d *zipfianDist) clone() keyDist {
+	c := *d
+	return &c
+}
+
+// ycsbItemCount is the number of items of the scrambled zipfian
+// distribution of YCSB, whatever the number of keys. The hashes of the
+// items are spread over the keys.
+const ycsbItemCount = 10000000000
+
+// ycsbZetan is the zeta of ycsbItemCount items for zipfianTheta, which
+// YCSB precomputes.
+const ycsbZetan = 26.46902820178302
+
+// scrambledZipfianDist is a zipfian distribution where the popular keys
+// are spread over the keyspace by a hash, instead of being the first ones.
+type scrambledZipfianDist struct {
+	zipf *zipfianDist
+}
+
+func newScrambledZipfianDist(theta float64) scrambledZipfianDist {
+	d := &zipfianDist{theta: theta, alpha: 1 / (1 - theta)}
+	d.zeta2theta = d.zeta(0, 2, 0)
+	zetan := ycsbZetan
+	if theta != zipfianTheta {
+		zetan = d.zetaLarge(ycsbItemCount)
+	}
+	d.setZetan(ycsbItemCount, zetan)
+	return scrambledZipfianDist{d}
+}
+
+func (d scrambledZipfianDist) next(rnd *rand.Rand, n int64) int64 {
+	return fnvHash64(d.zipf.value(rnd)) % n
+}
+
+func (d scrambledZipfianDist) clone() keyDist {
+	return scrambledZipfianDist{d.zipf.clone().(*zipfianDist)}
+}
+
+// latestDist is a zipfian distribution where the most recently inserted
+// keys are the most popular ones.
+type latestDist struct {
+	zipf *zipfianDist
+}
+
+func (d latestDist) next(rnd *rand.Rand, n int64) int64 {
+	return n - 1 - d.zipf.next(rnd, n)
+}
+
+func (d latestDist) clone() keyDist {
+	return latestDist{d.zipf.clone().(*zipfianDist)}
+}
+
+// hotspotDist sends a fraction of the requests to a hot set at the start
+// of the keyspace, and the rest to the other keys, both uniformly.
+type hotspotDist struct {
+	keys float64
+	ops  float64
+}
+
+func (d hotspotDist) next(rnd *rand.Rand, n int64) int64 {
+	hot := int64(float64(n) * d.keys)
+	if hot < 1 {
+		hot = 1
+	}
+	if hot >= n || rnd.Float64() < d.ops {
+		return rnd.Int63n(hot)
+	}
+	return hot + rnd.Int63n(n-hot)
+}
+
+func (d hotspotDist) clone() keyDist { return d }
+
+// sequentialDist returns the keys in order, starting over after the last
+// one. The clones share the position, so that all the clients together
+// send the keys in order.
+type sequentialDist struct {
+	pos *int64
+}
+
+func (d sequentialDist) next(rnd *rand.Rand, n int64) int64 {
+	return (atomic.AddInt64(d.pos, 1) - 1) % n
+}
+
+func (d sequentialDist) clone() keyDist { return d }
+
+// fnvHash64 is the absolute value of the FNV-1a hash of the bytes of v, as
+// YCSB hashes its key numbers.
+func fnvHash64(v int64) int64 {
+	h := uint64(0xcbf29ce484222325)
+	for i := 0; i < 8; i++ {
+		h ^= uint64(v) & 0xff
+		h *= 1099511628211
+		v >>= 8
+	}
+	if int64(h) < 0 {
+		return -int64(h) & math.MaxInt64
+	}
+	return int64(h)
+}
@@ -0,0 +1,76 @@
+package kvbench
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestZetaLarge(t *testing.T) {
+	d := newZipfianDist(1, zipfianTheta)
+	if z := d.zetaLarge(ycsbItemCount); math.Abs(z-ycsbZetan) > 1e-9 {
+		t.Fatalf("got %v, expected %v", z, ycsbZetan)
+	}
+	for _, items := range []int64{10, 2000000} {
+		z, want := d.zetaLarge(items), d.zeta(0, items, 0)
+		if math.Abs(z-want) > 1e-9 {
+			t.Fatalf("%d items: got %v, expected %v", items, z, want)
+		}
+	}
+}
+
+func TestKeyDist(t *testing.T) {
+	const n = 1000
+	tests := []struct {
+		name string
+		// hot is the most popular key, or -1 when no key is
+		hot int64
+	}{
+		{"uniform", -1},
+		{"zipfian", 0},
+		// the first item of YCSB's items
+		{"scrambled-zipfian", fnvHash64(0) % n},
+		{"hotspot", -1},
+		{"latest", n - 1},
+		{"sequential", -1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := newKeyDist(tc.name, n, zipfianTheta, 0.2, 0.8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d = d.clone()
+			rnd := rand.New(rand.NewSource(1))
+			counts := make([]int, n)
+			for i := 0; i < 100000; i++ {
+				k := d.next(rnd, n)
+				if k < 0 || k >= n {
+					t.Fatalf("key %d out of range", k)
+				}
+				counts[k]++
+			}
+			if tc.hot < 0 {
+				return
+			}
+			for k, c := range counts {
+				if c > counts[tc.hot] {
+					t.Fatalf("key %d (%d) is more popular than %d (%d)", k,
+						c, tc.hot, counts[tc.hot])
+				}
+			}
+		})
+	}
+	// the scrambled items don't follow the number of keys
+	d := newScrambledZipfianDist(zipfianTheta)
+	d.next(rand.New(rand.NewSource(1)), n)
+	if d.zipf.items != ycsbItemCount || d.zipf.zetan != ycsbZetan {
+		t.Fatalf("got %d items, zeta %v", d.zipf.items, d.zipf.zetan)
+	}
+	if _, err := newKeyDist("zipfian", n, 1, 0, 0); err == nil {
+		t.Fatal("expected an invalid theta")
+	}
+	if _, err := newKeyDist("foo", n, zipfianTheta, 0, 0); err == nil {
+		t.Fatal("expected an unknown distribution")
+	}
+}
@@ -1,66 +1,182 @@
 package kvbench
 
 import (
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/cznic/kv"
+	"github.com/tidwall/match"
 )
 
+// kvRedoLimit is the size of the redo log that triggers a checkpoint.
+const kvRedoLimit = 64 * 1024 * 1024
+
+// kvStore uses cznic/kv, which makes a commit durable after a grace period
+// that can't be configured. With fsync every commit is also written to a
+// redo log that's synced before the write returns, and the log is replayed
+// after a crash. Only committed writes are logged, so a write that failed
+// and was rolled back is never replayed. A checkpoint reopens the database,
+// which makes every commit durable, and empties the redo log.
 type kvStore struct {
-	mu    sync.RWMutex
-	db    *kv.DB
-	path  string
-	fsync bool
+	mu   sync.RWMutex
+	db   *kv.DB
+	path string
+	redo *AOF
+}
+
+func openKV(path string) (*kv.DB, error) {
+	if _, err := os.Stat(path); err == nil {
+		return kv.Open(path, &kv.Options{})
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return kv.Create(path, &kv.Options{})
 }
 
 func newKVStore(path string, fsync bool) (*kvStore, error) {
 	if path == ":memory:" {
 		return nil, errMemoryNotAllowed
 	}
-	db, err := kv.Create(path, &kv.Options{})
+	// the new database of a flush that didn't finish
+	os.Remove(path + ".flush")
+	db, err := openKV(path)
 	if err != nil {
 		return nil, err
 	}
+	s := &kvStore{db: db, path: path}
+	redoPath := path + ".redo"
+	_, err = os.Stat(redoPath)
+	if err != nil && !os.IsNotExist(err) {
+		s.db.Close()
+		return nil, err
+	}
+	if fsync || err == nil {
+		var replayed int
+		s.redo, err = openAOF(redoPath, storeOptions{fsync: true},
+			func(args [][]byte) error {
+				replayed++
+				return s.apply(args)
+			})
+		if err == nil && replayed > 0 {
+			log.Printf("replayed %d commands from the kv redo log", replayed)
+			err = s.checkpoint()
+		}
+		if err == nil && !fsync {
+			s.redo.Close()
+			s.redo = nil
+			err = os.Remove(redoPath)
+		}
+		if err != nil {
+			if s.redo != nil {
+				s.redo.Close()
+			}
+			s.db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
 
-	return &kvStore{
-		db:    db,
-		path:  path,
-		fsync: fsync,
-	}, nil
+// apply applies a command of the redo log.
+func (s *kvStore) apply(args [][]byte) error {
+	switch strings.ToLower(string(args[0])) {
+	case "set":
+		if len(args) != 3 {
+			return errInvalidLog
+		}
+		return s.db.Set(args[1], args[2])
+	case "del":
+		if len(args) != 2 {
+			return errInvalidLog
+		}
+		return s.db.Delete(args[1])
+	case "flushdb":
+		return s.flush()
+	}
+	return errInvalidLog
+}
+
+// checkpoint makes every commit durable by reopening the database, and
+// empties the redo log.
+func (s *kvStore) checkpoint() error {
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	db, err := openKV(s.path)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return s.redo.Rewrite(nil, func(emit func(args ...[]byte) error) error {
+		return nil
+	})
+}
+
+// write writes the committed commands to the redo log.
+func (s *kvStore) write(cmds ...[][]byte) error {
+	if s.redo == nil {
+		return nil
+	}
+	if s.redo.size() >= kvRedoLimit {
+		if err := s.checkpoint(); err != nil {
+			return err
+		}
+	}
+	s.redo.BeginBuffer()
+	for _, args := range cmds {
+		s.redo.AppendBuffer(args...)
+	}
+	return s.redo.WriteBuffer()
 }
 
 func (s *kvStore) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.db.Close()
-	return nil
+	if s.redo != nil {
+		s.redo.Close()
+	}
+	return s.db.Close()
 }
+
 func (s *kvStore) PSet(keys, values [][]byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err := s.db.BeginTransaction(); err != nil {
 		return err
 	}
-	defer s.db.Rollback()
 	for i := range keys {
 		if err := s.db.Set(keys[i], values[i]); err != nil {
+			s.db.Rollback()
 			return err
 		}
 	}
-	return s.db.Commit()
+	if err := s.db.Commit(); err != nil {
+		return err
+	}
+	cmds := make([][][]byte, len(keys))
+	for i := range keys {
+		cmds[i] = [][]byte{[]byte("set"), keys[i], values[i]}
+	}
+	return s.write(cmds...)
 }
 
+// PGet reads every key while holding the lock, so that no write is seen
+// halfway.
 func (s *kvStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var values [][]byte
 	var oks []bool
 	for i := range keys {
-		value, ok, err := s.Get(keys[i])
+		v, err := s.db.Get(nil, keys[i])
 		if err != nil {
 			return nil, nil, err
 		}
-		values = append(values, value)
-		oks = append(oks, ok)
+		values = append(values, v)
+		oks = append(oks, v != nil)
 	}
 	return values, oks, nil
 }
@@ -68,7 +184,10 @@ func (s *kvStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
 func (s *kvStore) Set(key, value []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.db.Set(key, value)
+	if err := s.db.Set(key, value); err != nil {
+		return err
+	}
+	return s.write([][]byte{[]byte("set"), key, value})
 }
 
 func (s *kvStore) Get(key []byte) ([]byte, bool, error) {
@@ -91,62 +210,123 @@ func (s *kvStore) Del(key []byte) (bool, error) {
 	if v == nil {
 		return false, nil
 	}
-	err = s.db.Delete(key)
-	if err != nil {
+	if err := s.db.Delete(key); err != nil {
+		return false, err
+	}
+	if err := s.write([][]byte{[]byte("del"), key}); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
-func (s *kvStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
-	return nil, nil, nil
-	/*
-		s.mu.RLock()
-		defer s.mu.RUnlock()
-		spattern := string(pattern)
-		min, max := match.Allowable(spattern)
-		bmin := []byte(min)
-		var keys [][]byte
-		var vals [][]byte
-		useMax := !(len(spattern) > 0 && spattern[0] == '*')
-		s.db.BeginTransaction()
-		iter := s.db.NewIterator(nil, nil)
-		for ok := iter.Seek(bmin); ok; ok = iter.Next() {
-			if limit > -1 && len(keys) >= limit {
-				break
-			}
-			key := iter.Key()
-			value := iter.Value()
-			skey := string(key)
-			if useMax && skey >= max {
-				break
-			}
-			if match.Match(skey, spattern) {
-				keys = append(keys, []byte(skey))
-				if withvalues {
-					vals = append(vals, bcopy(value))
-				}
-			}
+// ascend iterates over the keys that are greater than or equal to pivot.
+func (s *kvStore) ascend(pivot []byte, iter func(key, value []byte) bool) error {
+	e, _, err := s.db.Seek(pivot)
+	if err != nil {
+		if err == io.EOF {
+			return nil
 		}
-		iter.Release()
-		err := iter.Error()
+		return err
+	}
+	for {
+		key, value, err := e.Next()
 		if err != nil {
-			return nil, nil, err
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if !iter(key, value) {
+			return nil
 		}
-		return keys, vals, nil
-	*/
+	}
 }
 
-func (s *kvStore) FlushDB() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.db.Close()
-	os.RemoveAll(s.path)
-	s.db = nil
-	db, err := kv.Create(s.path, &kv.Options{})
+func (s *kvStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keysFrom(nil, pattern, limit, withvalues)
+}
+
+func (s *kvStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spattern := string(pattern)
+	min, max := match.Allowable(spattern)
+	useMax := !(len(spattern) > 0 && spattern[0] == '*')
+	if string(start) > min {
+		min = string(start)
+	}
+	var keys [][]byte
+	var vals [][]byte
+	err := s.ascend([]byte(min), func(key, value []byte) bool {
+		if limit > -1 && len(keys) >= limit {
+			return false
+		}
+		skey := string(key)
+		if useMax && skey >= max {
+			return false
+		}
+		if match.Match(skey, spattern) {
+			keys = append(keys, []byte(skey))
+			if withvalues {
+				vals = append(vals, bcopy(value))
+			}
+		}
+		return true
+	})
 	if err != nil {
+		return nil, nil, err
+	}
+	return keys, vals, nil
+}
+
+// flush replaces the database with a new one. The new database is created
+// next to it and renamed over it, so a crash leaves either the old or the
+// new database.
+func (s *kvStore) flush() error {
+	tmppath := s.path + ".flush"
+	os.Remove(tmppath)
+	db, err := kv.Create(tmppath, &kv.Options{})
+	if err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		os.Remove(tmppath)
 		return err
 	}
+	if err := s.db.Close(); err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+	err = os.Rename(tmppath, s.path)
+	if err != nil {
+		os.Remove(tmppath)
+	} else {
+		err = osFS{}.SyncDir(filepath.Dir(s.path))
+	}
+	db, oerr := openKV(s.path)
+	if oerr != nil {
+		return oerr
+	}
 	s.db = db
-	return nil
+	return err
+}
+
+func (s *kvStore) FlushDB() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.redo != nil {
+		// The commits of the old database are made durable and the redo
+		// log is emptied first, so that a crash during the flush never
+		// replays them into the new database.
+		if err := s.checkpoint(); err != nil {
+			return err
+		}
+	}
+	return s.flush()
+}
+
+func (s *kvStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ascend(nil, iter)
 }
@@ -0,0 +1,186 @@
+package kvbench
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVReopen(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "kv.db")
+		testReopen(t, "kv", path, storeOptions{fsync: fsync})
+	}
+}
+
+// writeKVRedo appends the commands to the redo log of the database at path.
+func writeKVRedo(t *testing.T, path string, cmds ...[]string) {
+	t.Helper()
+	f, err := os.OpenFile(path+".redo", os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	aw := newAOFWriter(f, aofPlain, aofRESP, nil)
+	for _, cmd := range cmds {
+		args := make([][]byte, len(cmd))
+		for i := range cmd {
+			args[i] = []byte(cmd[i])
+		}
+		aw.append(args...)
+	}
+	if err := aw.flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKVRedoReplay(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "kv.db")
+		s, err := openStore("kv", path, storeOptions{fsync: fsync})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"a": "1", "b": "2"}
+		for _, key := range []string{"a", "b"} {
+			if err := s.Set([]byte(key), []byte(want[key])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// the commits that were lost in a crash
+		writeKVRedo(t, path,
+			[]string{"set", "c", "3"},
+			[]string{"del", "a"},
+			[]string{"set", "b", "4"})
+		delete(want, "a")
+		want["b"], want["c"] = "4", "3"
+		if s, err = openStore("kv", path, storeOptions{fsync: fsync}); err != nil {
+			t.Fatal(err)
+		}
+		checkStore(t, s, want)
+		// the replay ends with a checkpoint, which empties the log or
+		// removes it without fsync
+		fi, err := os.Stat(path + ".redo")
+		if fsync && (err != nil || fi.Size() != 0) {
+			t.Fatalf("redo log: %v %v", fi, err)
+		} else if !fsync && !os.IsNotExist(err) {
+			t.Fatalf("redo log: %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s, err = openStore("kv", path, storeOptions{fsync: fsync}); err != nil {
+			t.Fatal(err)
+		}
+		checkStore(t, s, want)
+		s.Close()
+	}
+}
+
+func TestKVFailedWriteNotLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.db")
+	s, err := openStore("kv", path, storeOptions{fsync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	ks := s.(*kvStore)
+	// every write fails once the database is closed
+	if err := ks.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err = s.PSet([][]byte{[]byte("b"), []byte("c")},
+		[][]byte{[]byte("2"), []byte("3")})
+	if err == nil {
+		t.Fatal("expected a pset error")
+	}
+	if err := s.Set([]byte("d"), []byte("4")); err == nil {
+		t.Fatal("expected a set error")
+	}
+	if err := ks.redo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openStore("kv", path, storeOptions{fsync: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkStore(t, s, map[string]string{"a": "1"})
+}
+
+func TestKVCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.db")
+	s, err := openStore("kv", path, storeOptions{fsync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for _, step := range testSteps[:4] {
+		if err := step.run(s, want); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+	ks := s.(*kvStore)
+	if ks.redo.size() == 0 {
+		t.Fatal("empty redo log")
+	}
+	ks.mu.Lock()
+	err = ks.checkpoint()
+	ks.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.redo.size() != 0 {
+		t.Fatalf("redo log of %d bytes after a checkpoint", ks.redo.size())
+	}
+	checkStore(t, s, want)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openStore("kv", path, storeOptions{fsync: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkStore(t, s, want)
+}
+
+func TestKVFlushDB(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "kv.db")
+		// the new database of a flush that didn't finish
+		if err := ioutil.WriteFile(path+".flush", []byte("partial"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		s, err := openStore("kv", path, storeOptions{fsync: fsync})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path + ".flush"); !os.IsNotExist(err) {
+			t.Fatalf("flush database: %v", err)
+		}
+		want := make(map[string]string)
+		for _, step := range testSteps {
+			if err := step.run(s, want); err != nil {
+				t.Fatalf("%s: %v", step.name, err)
+			}
+		}
+		checkStore(t, s, want)
+		if _, err := os.Stat(path + ".flush"); !os.IsNotExist(err) {
+			t.Fatalf("flush database: %v", err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s, err = openStore("kv", path, storeOptions{fsync: fsync}); err != nil {
+			t.Fatal(err)
+		}
+		checkStore(t, s, want)
+		s.Close()
+	}
+}
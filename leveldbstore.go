@@ -98,10 +98,17 @@ func (s *leveldbStore) Del(key []byte) (bool, error) {
 }
 
 func (s *leveldbStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keysFrom(nil, pattern, limit, withvalues)
+}
+
+func (s *leveldbStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	spattern := string(pattern)
 	min, max := match.Allowable(spattern)
+	if string(start) > min {
+		min = string(start)
+	}
 	bmin := []byte(min)
 	var keys [][]byte
 	var vals [][]byte
@@ -149,3 +156,16 @@ func (s *leveldbStore) FlushDB() error {
 	s.db = db
 	return nil
 }
+
+func (s *leveldbStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it := s.db.NewIterator(nil, nil)
+	for ok := it.First(); ok; ok = it.Next() {
+		if !iter(it.Key(), it.Value()) {
+			break
+		}
+	}
+	it.Release()
+	return it.Error()
+}
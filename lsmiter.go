@@ -0,0 +1,141 @@
+package kvbench
+
+import (
+	"bytes"
+	"sort"
+)
+
+// lsmIter iterates over the entries of a memtable, a table, a level or a
+// merge of those, in key order. The key and value are only valid until the
+// next call to next.
+type lsmIter interface {
+	seek(key []byte) error
+	valid() bool
+	key() []byte
+	value() []byte
+	deleted() bool
+	next() error
+	close()
+}
+
+// levelIter iterates over the tables of a level, which are sorted and don't
+// overlap.
+type levelIter struct {
+	tables []*sstable
+	i      int
+	it     *sstableIter
+}
+
+func newLevelIter(tables []*sstable) *levelIter {
+	return &levelIter{tables: tables}
+}
+
+func (it *levelIter) open(i int) {
+	it.i = i
+	it.it = nil
+	if i < len(it.tables) {
+		it.it = it.tables[i].iter()
+	}
+}
+
+func (it *levelIter) seek(key []byte) error {
+	i := sort.Search(len(it.tables), func(i int) bool {
+		return bytes.Compare(it.tables[i].largest, key) >= 0
+	})
+	it.open(i)
+	if it.it == nil {
+		return nil
+	}
+	if err := it.it.seek(key); err != nil {
+		return err
+	}
+	return it.skipEmpty()
+}
+
+// skipEmpty moves to the next table when the current table is exhausted.
+func (it *levelIter) skipEmpty() error {
+	for it.it != nil && !it.it.valid() {
+		it.open(it.i + 1)
+		if it.it != nil {
+			if err := it.it.seek(nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (it *levelIter) valid() bool   { return it.it != nil && it.it.valid() }
+func (it *levelIter) key() []byte   { return it.it.key() }
+func (it *levelIter) value() []byte { return it.it.value() }
+func (it *levelIter) deleted() bool { return it.it.deleted() }
+func (it *levelIter) close()        {}
+
+func (it *levelIter) next() error {
+	if err := it.it.next(); err != nil {
+		return err
+	}
+	return it.skipEmpty()
+}
+
+// mergeIter merges iterators, which are ordered from newest to oldest. Only
+// the newest entry of a key is returned.
+type mergeIter struct {
+	its []lsmIter
+	cur int
+}
+
+func newMergeIter(its []lsmIter) *mergeIter {
+	return &mergeIter{its: its, cur: -1}
+}
+
+// pick finds the iterator with the smallest key. For equal keys the newest
+// iterator wins.
+func (it *mergeIter) pick() {
+	it.cur = -1
+	for i, sub := range it.its {
+		if sub.valid() && (it.cur == -1 ||
+			bytes.Compare(sub.key(), it.its[it.cur].key()) < 0) {
+			it.cur = i
+		}
+	}
+}
+
+func (it *mergeIter) seek(key []byte) error {
+	for _, sub := range it.its {
+		if err := sub.seek(key); err != nil {
+			return err
+		}
+	}
+	it.pick()
+	return nil
+}
+
+func (it *mergeIter) valid() bool   { return it.cur != -1 }
+func (it *mergeIter) key() []byte   { return it.its[it.cur].key() }
+func (it *mergeIter) value() []byte { return it.its[it.cur].value() }
+func (it *mergeIter) deleted() bool { return it.its[it.cur].deleted() }
+
+// next skips the older entries of the current key in the other iterators.
+func (it *mergeIter) next() error {
+	key := it.key()
+	for i, sub := range it.its {
+		if i == it.cur || !sub.valid() || !bytes.Equal(sub.key(), key) {
+			continue
+		}
+		if err := sub.next(); err != nil {
+			return err
+		}
+	}
+	if err := it.its[it.cur].next(); err != nil {
+		return err
+	}
+	it.pick()
+	return nil
+}
+
+func (it *mergeIter) close() {
+	for _, sub := range it.its {
+		sub.close()
+	}
+}
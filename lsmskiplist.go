@@ -0,0 +1,110 @@
+package kvbench
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel = 12
+	skiplistP        = 4
+)
+
+type skiplistNode struct {
+	key     []byte
+	value   []byte
+	deleted bool
+	next    []*skiplistNode
+}
+
+// skiplist is the memtable of the lsm store. It holds the latest value or
+// tombstone of each key and it's not safe for concurrent writes.
+type skiplist struct {
+	head  skiplistNode
+	level int
+	count int
+	size  int
+	rand  *rand.Rand
+}
+
+func newSkiplist() *skiplist {
+	sl := &skiplist{level: 1, rand: rand.New(rand.NewSource(1))}
+	sl.head.next = make([]*skiplistNode, skiplistMaxLevel)
+	return sl
+}
+
+func (sl *skiplist) randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && sl.rand.Intn(skiplistP) == 0 {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual returns the first node with a key that's greater than
+// or equal to key. The prev nodes are filled when provided.
+func (sl *skiplist) findGreaterOrEqual(key []byte, prev []*skiplistNode) *skiplistNode {
+	x := &sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && bytes.Compare(x.next[i].key, key) < 0 {
+			x = x.next[i]
+		}
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// put inserts or replaces the value of a key. The key and value are not
+// copied.
+func (sl *skiplist) put(key, value []byte, deleted bool) {
+	var prev [skiplistMaxLevel]*skiplistNode
+	x := sl.findGreaterOrEqual(key, prev[:])
+	if x != nil && bytes.Equal(x.key, key) {
+		sl.size += len(value) - len(x.value)
+		x.value, x.deleted = value, deleted
+		return
+	}
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			prev[i] = &sl.head
+		}
+		sl.level = level
+	}
+	x = &skiplistNode{key: key, value: value, deleted: deleted,
+		next: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = prev[i].next[i]
+		prev[i].next[i] = x
+	}
+	sl.count++
+	sl.size += len(key) + len(value)
+}
+
+// get returns the value of a key. The deleted result is true for a
+// tombstone.
+func (sl *skiplist) get(key []byte) (value []byte, deleted, ok bool) {
+	x := sl.findGreaterOrEqual(key, nil)
+	if x == nil || !bytes.Equal(x.key, key) {
+		return nil, false, false
+	}
+	return x.value, x.deleted, true
+}
+
+type skiplistIter struct {
+	sl *skiplist
+	x  *skiplistNode
+}
+
+func (it *skiplistIter) seek(key []byte) error {
+	it.x = it.sl.findGreaterOrEqual(key, nil)
+	return nil
+}
+func (it *skiplistIter) valid() bool   { return it.x != nil }
+func (it *skiplistIter) key() []byte   { return it.x.key }
+func (it *skiplistIter) value() []byte { return it.x.value }
+func (it *skiplistIter) deleted() bool { return it.x.deleted }
+func (it *skiplistIter) next() error   { it.x = it.x.next[0]; return nil }
+func (it *skiplistIter) close()        {}
@@ -0,0 +1,800 @@
+package kvbench
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/match"
+)
+
+// The lsm store is a log-structured merge tree. Writes go to the WAL, which
+// is an AOF, and to the memtable. A full memtable is frozen and flushed to a
+// new table in level 0 by the background job, which also compacts the
+// levels. The tables of level 0 may overlap. The tables of the other levels
+// are sorted and don't overlap, and each level holds ten times the bytes of
+// the previous level. The MANIFEST holds the tables of each level and the
+// number of the oldest WAL that isn't flushed yet.
+
+const (
+	lsmMemtableSize   = 4 * 1024 * 1024
+	lsmTableSize      = 2 * 1024 * 1024
+	lsmLevels         = 7
+	lsmL0Compact      = 4
+	lsmL0Stall        = 12
+	lsmL1MaxBytes     = 10 * 1024 * 1024
+	lsmLevelSizeRatio = 10
+)
+
+// lsmLevelStats are the statistics of a level.
+type lsmLevelStats struct {
+	compactions  int
+	bytesRead    int64
+	bytesWritten int64
+}
+
+type lsmManifest struct {
+	Next   int     `json:"next"`
+	Log    int     `json:"log"`
+	Levels [][]int `json:"levels"`
+}
+
+type lsmStore struct {
+	mu     sync.RWMutex
+	cond   *sync.Cond
+	fs     vfs
+	path   string
+	opts   storeOptions
+	mem    *skiplist
+	imm    *skiplist
+	wal    *AOF
+	walNum int
+	logNum int
+	next   int
+	levels [lsmLevels][]*sstable
+	// compactKey is the largest key of the last compacted table of each
+	// level, which rotates the compactions over the key space.
+	compactKey [lsmLevels][]byte
+
+	stats      [lsmLevels]lsmLevelStats
+	userBytes  int64
+	flushBytes int64
+
+	// bg is held by the background job while it flushes or compacts.
+	bg     sync.Mutex
+	work   chan struct{}
+	closed chan struct{}
+	done   chan struct{}
+	bgErr  error
+}
+
+func newLSMStore(path string, opts storeOptions) (*lsmStore, error) {
+	if path == ":memory:" {
+		return nil, errMemoryNotAllowed
+	}
+	fs := opts.filesystem()
+	if err := fs.MkdirAll(path, 0777); err != nil {
+		return nil, err
+	}
+	s := &lsmStore{
+		fs:     fs,
+		path:   path,
+		opts:   opts,
+		mem:    newSkiplist(),
+		work:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if err := s.load(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	go s.background()
+	s.signal()
+	return s, nil
+}
+
+func (s *lsmStore) filePath(num int, ext string) string {
+	return filepath.Join(s.path, fmt.Sprintf("%06d.%s", num, ext))
+}
+
+// load opens the tables of the manifest and replays the WALs that weren't
+// flushed. Files that aren't referenced by the manifest are left-overs of
+// an interrupted flush or compaction and are removed.
+func (s *lsmStore) load() error {
+	var m lsmManifest
+	data, err := vfsReadFile(s.fs, filepath.Join(s.path, "MANIFEST"))
+	if err == nil {
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("MANIFEST: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	s.next, s.logNum = m.Next, m.Log
+	live := make(map[int]bool)
+	for level, nums := range m.Levels {
+		if level >= lsmLevels {
+			return fmt.Errorf("MANIFEST: too many levels")
+		}
+		for _, num := range nums {
+			t, err := openSSTable(s.fs, s.filePath(num, "sst"), num)
+			if err != nil {
+				return fmt.Errorf("%06d.sst: %v", num, err)
+			}
+			s.levels[level] = append(s.levels[level], t)
+			live[num] = true
+		}
+	}
+	fis, err := s.fs.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+	var wals []int
+	for _, fi := range fis {
+		parts := strings.SplitN(fi.Name(), ".", 2)
+		num, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		if num >= s.next {
+			s.next = num + 1
+		}
+		switch parts[1] {
+		case "sst":
+			if !live[num] {
+				s.fs.Remove(filepath.Join(s.path, fi.Name()))
+			}
+		case "wal":
+			if num < s.logNum {
+				s.fs.Remove(filepath.Join(s.path, fi.Name()))
+			} else {
+				wals = append(wals, num)
+			}
+		}
+	}
+	sort.Ints(wals)
+	for i, num := range wals {
+		wal, err := openAOF(s.filePath(num, "wal"), s.opts,
+			func(args [][]byte) error {
+				switch {
+				case len(args) == 3 && eqFold(args[0], "set"):
+					s.mem.put(bcopy(args[1]), bcopy(args[2]), false)
+				case len(args) == 2 && eqFold(args[0], "del"):
+					s.mem.put(bcopy(args[1]), nil, true)
+				}
+				return nil
+			})
+		if err != nil {
+			return fmt.Errorf("%06d.wal: %v", num, err)
+		}
+		if i < len(wals)-1 {
+			wal.Close()
+			continue
+		}
+		s.wal, s.walNum = wal, num
+	}
+	if s.wal == nil {
+		return s.newWAL()
+	}
+	return nil
+}
+
+func (s *lsmStore) newWAL() error {
+	num := s.next
+	s.next++
+	wal, err := openAOF(s.filePath(num, "wal"), s.opts, nil)
+	if err != nil {
+		return err
+	}
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	s.wal, s.walNum = wal, num
+	return nil
+}
+
+// saveManifest writes the manifest. The caller holds the lock.
+func (s *lsmStore) saveManifest() error {
+	m := lsmManifest{Next: s.next, Log: s.logNum}
+	for _, tables := range s.levels {
+		nums := []int{}
+		for _, t := range tables {
+			nums = append(nums, t.num)
+		}
+		m.Levels = append(m.Levels, nums)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.fs, filepath.Join(s.path, "MANIFEST"), data)
+}
+
+func (s *lsmStore) signal() {
+	select {
+	case s.work <- struct{}{}:
+	default:
+	}
+}
+
+// makeRoom freezes a full memtable. Writers are stalled while the previous
+// memtable is being flushed or when level 0 has too many tables.
+func (s *lsmStore) makeRoom() error {
+	for s.mem.size >= lsmMemtableSize {
+		if s.bgErr != nil {
+			return s.bgErr
+		}
+		if s.imm == nil && len(s.levels[0]) < lsmL0Stall {
+			if err := s.newWAL(); err != nil {
+				return err
+			}
+			s.imm = s.mem
+			s.mem = newSkiplist()
+			s.signal()
+			return nil
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+func (s *lsmStore) closeFiles() {
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	for _, tables := range s.levels {
+		for _, t := range tables {
+			t.f.Close()
+		}
+	}
+}
+
+func (s *lsmStore) Close() error {
+	close(s.closed)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeFiles()
+	return nil
+}
+
+func (s *lsmStore) PSet(keys, values [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.makeRoom(); err != nil {
+		return err
+	}
+	s.wal.BeginBuffer()
+	for i := range keys {
+		s.wal.AppendBuffer([]byte("set"), keys[i], values[i])
+	}
+	if err := s.wal.WriteBuffer(); err != nil {
+		return err
+	}
+	for i := range keys {
+		s.mem.put(bcopy(keys[i]), bcopy(values[i]), false)
+		s.userBytes += int64(len(keys[i]) + len(values[i]))
+	}
+	return nil
+}
+
+func (s *lsmStore) Set(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.makeRoom(); err != nil {
+		return err
+	}
+	if err := s.wal.Write([]byte("set"), key, value); err != nil {
+		return err
+	}
+	s.mem.put(bcopy(key), bcopy(value), false)
+	s.userBytes += int64(len(key) + len(value))
+	return nil
+}
+
+// get looks up a key from the newest to the oldest data. The caller holds
+// the lock.
+func (s *lsmStore) get(key []byte) ([]byte, bool, error) {
+	for _, sl := range []*skiplist{s.mem, s.imm} {
+		if sl == nil {
+			continue
+		}
+		if value, deleted, ok := sl.get(key); ok {
+			return value, !deleted, nil
+		}
+	}
+	l0 := s.levels[0]
+	for i := len(l0) - 1; i >= 0; i-- {
+		value, deleted, ok, err := l0[i].get(key)
+		if err != nil || ok {
+			return value, ok && !deleted, err
+		}
+	}
+	for _, tables := range s.levels[1:] {
+		i := sort.Search(len(tables), func(i int) bool {
+			return bytes.Compare(tables[i].largest, key) >= 0
+		})
+		if i == len(tables) {
+			continue
+		}
+		value, deleted, ok, err := tables[i].get(key)
+		if err != nil || ok {
+			return value, ok && !deleted, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (s *lsmStore) Get(key []byte) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok, err := s.get(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *lsmStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var values [][]byte
+	var oks []bool
+	for i := range keys {
+		value, ok, err := s.get(keys[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		values = append(values, value)
+		oks = append(oks, ok)
+	}
+	return values, oks, nil
+}
+
+func (s *lsmStore) Del(key []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok, err := s.get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := s.makeRoom(); err != nil {
+		return false, err
+	}
+	if err := s.wal.Write([]byte("del"), key); err != nil {
+		return false, err
+	}
+	s.mem.put(bcopy(key), nil, true)
+	s.userBytes += int64(len(key))
+	return true, nil
+}
+
+// iter returns an iterator over all data. The caller holds the lock.
+func (s *lsmStore) iter() lsmIter {
+	its := []lsmIter{&skiplistIter{sl: s.mem}}
+	if s.imm != nil {
+		its = append(its, &skiplistIter{sl: s.imm})
+	}
+	l0 := s.levels[0]
+	for i := len(l0) - 1; i >= 0; i-- {
+		its = append(its, l0[i].iter())
+	}
+	for _, tables := range s.levels[1:] {
+		if len(tables) > 0 {
+			its = append(its, newLevelIter(tables))
+		}
+	}
+	return newMergeIter(its)
+}
+
+func (s *lsmStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keysFrom(nil, pattern, limit, withvalues)
+}
+
+func (s *lsmStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spattern := string(pattern)
+	min, max := match.Allowable(spattern)
+	useMax := !(len(spattern) > 0 && spattern[0] == '*')
+	if string(start) > min {
+		min = string(start)
+	}
+	var keys [][]byte
+	var vals [][]byte
+	it := s.iter()
+	defer it.close()
+	var err error
+	for err = it.seek([]byte(min)); err == nil && it.valid(); err = it.next() {
+		if limit > -1 && len(keys) >= limit {
+			break
+		}
+		skey := string(it.key())
+		if useMax && skey >= max {
+			break
+		}
+		if !it.deleted() && match.Match(skey, spattern) {
+			keys = append(keys, []byte(skey))
+			if withvalues {
+				vals = append(vals, bcopy(it.value()))
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, vals, nil
+}
+
+func (s *lsmStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	it := s.iter()
+	defer it.close()
+	var err error
+	for err = it.seek(nil); err == nil && it.valid(); err = it.next() {
+		if !it.deleted() && !iter(it.key(), it.value()) {
+			break
+		}
+	}
+	return err
+}
+
+// FlushDB empties the store. The empty manifest is written before any file
+// is removed, which makes the flush atomic.
+func (s *lsmStore) FlushDB() error {
+	s.bg.Lock()
+	defer s.bg.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.newWAL(); err != nil {
+		return err
+	}
+	old := s.levels
+	s.levels = [lsmLevels][]*sstable{}
+	s.mem, s.imm = newSkiplist(), nil
+	s.logNum = s.walNum
+	if err := s.saveManifest(); err != nil {
+		return err
+	}
+	for _, tables := range old {
+		for _, t := range tables {
+			t.f.Close()
+			s.fs.Remove(s.filePath(t.num, "sst"))
+		}
+	}
+	s.removeWALs()
+	s.cond.Broadcast()
+	return nil
+}
+
+// removeWALs removes the WALs that are older than logNum.
+func (s *lsmStore) removeWALs() {
+	fis, _ := s.fs.ReadDir(s.path)
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".wal") {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ".wal"))
+		if err == nil && num < s.logNum {
+			s.fs.Remove(filepath.Join(s.path, fi.Name()))
+		}
+	}
+}
+
+// background flushes the frozen memtable and compacts the levels until the
+// store is closed.
+func (s *lsmStore) background() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.work:
+		}
+		s.bg.Lock()
+		err := s.flush()
+		for err == nil {
+			var compacted bool
+			compacted, err = s.compact()
+			if !compacted {
+				break
+			}
+		}
+		s.bg.Unlock()
+		if err != nil {
+			log.Warningf("lsm: %v", err)
+			s.mu.Lock()
+			s.bgErr = err
+			s.cond.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+// flush writes the frozen memtable to a new table in level 0.
+func (s *lsmStore) flush() error {
+	s.mu.Lock()
+	imm := s.imm
+	if imm == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	num := s.next
+	s.next++
+	s.mu.Unlock()
+	tables, written, err := s.writeTables(&skiplistIter{sl: imm}, num, false,
+		true)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.levels[0] = append(s.levels[0], tables...)
+	s.imm = nil
+	s.logNum = s.walNum
+	s.flushBytes += written
+	s.stats[0].bytesWritten += written
+	if err := s.saveManifest(); err != nil {
+		return err
+	}
+	s.removeWALs()
+	s.cond.Broadcast()
+	return nil
+}
+
+// writeTables writes the entries of an iterator to new tables, which are
+// split at lsmTableSize unless single is true. The num is the number of the
+// first table and more numbers are allocated as needed.
+func (s *lsmStore) writeTables(it lsmIter, num int, dropDeleted, single bool,
+) ([]*sstable, int64, error) {
+	var tables []*sstable
+	var written int64
+	var tw *sstableWriter
+	finish := func() error {
+		size, err := tw.finish()
+		if err != nil {
+			return err
+		}
+		written += size
+		t, err := openSSTable(s.fs, s.filePath(num, "sst"), num)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, t)
+		tw = nil
+		return nil
+	}
+	fail := func(err error) ([]*sstable, int64, error) {
+		if tw != nil {
+			tw.abort()
+		}
+		for _, t := range tables {
+			t.f.Close()
+			s.fs.Remove(s.filePath(t.num, "sst"))
+		}
+		return nil, 0, err
+	}
+	var err error
+	for err = it.seek(nil); err == nil && it.valid(); err = it.next() {
+		if dropDeleted && it.deleted() {
+			continue
+		}
+		if tw == nil {
+			if len(tables) > 0 {
+				s.mu.Lock()
+				num = s.next
+				s.next++
+				s.mu.Unlock()
+			}
+			if tw, err = newSSTableWriter(s.fs, s.filePath(num, "sst")); err != nil {
+				return fail(err)
+			}
+		}
+		if err = tw.add(it.key(), it.value(), it.deleted()); err != nil {
+			return fail(err)
+		}
+		if !single && tw.size() >= lsmTableSize {
+			if err = finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if tw != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return tables, written, nil
+}
+
+// levelMaxBytes returns the target size of a level.
+func levelMaxBytes(level int) int64 {
+	max := int64(lsmL1MaxBytes)
+	for i := 1; i < level; i++ {
+		max *= lsmLevelSizeRatio
+	}
+	return max
+}
+
+func tablesSize(tables []*sstable) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// keyRange returns the smallest and largest key of the tables.
+func keyRange(tables []*sstable) ([]byte, []byte) {
+	smallest, largest := tables[0].smallest, tables[0].largest
+	for _, t := range tables[1:] {
+		if bytes.Compare(t.smallest, smallest) < 0 {
+			smallest = t.smallest
+		}
+		if bytes.Compare(t.largest, largest) > 0 {
+			largest = t.largest
+		}
+	}
+	return smallest, largest
+}
+
+func overlapping(tables []*sstable, smallest, largest []byte) []*sstable {
+	var res []*sstable
+	for _, t := range tables {
+		if t.overlaps(smallest, largest) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// pickCompaction returns the level and tables of the next compaction. Level
+// 0 is compacted when it has too many tables and the other levels when they
+// are larger than their target size.
+func (s *lsmStore) pickCompaction() (int, []*sstable) {
+	if len(s.levels[0]) >= lsmL0Compact {
+		return 0, append([]*sstable(nil), s.levels[0]...)
+	}
+	best, bestScore := -1, 1.0
+	for level := 1; level < lsmLevels-1; level++ {
+		score := float64(tablesSize(s.levels[level])) /
+			float64(levelMaxBytes(level))
+		if score > bestScore {
+			best, bestScore = level, score
+		}
+	}
+	if best == -1 {
+		return -1, nil
+	}
+	tables := s.levels[best]
+	for _, t := range tables {
+		if bytes.Compare(t.smallest, s.compactKey[best]) > 0 {
+			return best, []*sstable{t}
+		}
+	}
+	return best, []*sstable{tables[0]}
+}
+
+// compact runs one compaction, if any is needed. The input tables are
+// merged with the overlapping tables of the next level. The tombstones are
+// dropped when no deeper level has data.
+func (s *lsmStore) compact() (bool, error) {
+	s.mu.Lock()
+	level, inputs := s.pickCompaction()
+	if level == -1 {
+		s.mu.Unlock()
+		return false, nil
+	}
+	smallest, largest := keyRange(inputs)
+	next := overlapping(s.levels[level+1], smallest, largest)
+	bottom := true
+	for l := level + 2; l < lsmLevels; l++ {
+		if len(s.levels[l]) > 0 {
+			bottom = false
+		}
+	}
+	num := s.next
+	s.next++
+	s.mu.Unlock()
+
+	var its []lsmIter
+	for i := len(inputs) - 1; i >= 0; i-- {
+		its = append(its, inputs[i].iter())
+	}
+	if len(next) > 0 {
+		its = append(its, newLevelIter(next))
+	}
+	tables, written, err := s.writeTables(newMergeIter(its), num, bottom,
+		false)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obsolete := make(map[*sstable]bool)
+	for _, t := range inputs {
+		obsolete[t] = true
+	}
+	for _, t := range next {
+		obsolete[t] = true
+	}
+	remove := func(tables []*sstable) []*sstable {
+		var res []*sstable
+		for _, t := range tables {
+			if !obsolete[t] {
+				res = append(res, t)
+			}
+		}
+		return res
+	}
+	s.levels[level] = remove(s.levels[level])
+	merged := append(remove(s.levels[level+1]), tables...)
+	sort.Slice(merged, func(i, j int) bool {
+		return bytes.Compare(merged[i].smallest, merged[j].smallest) < 0
+	})
+	s.levels[level+1] = merged
+	s.compactKey[level] = largest
+	st := &s.stats[level+1]
+	st.compactions++
+	st.bytesRead += tablesSize(inputs) + tablesSize(next)
+	st.bytesWritten += written
+	if err := s.saveManifest(); err != nil {
+		return false, err
+	}
+	for t := range obsolete {
+		t.f.Close()
+		s.fs.Remove(s.filePath(t.num, "sst"))
+	}
+	s.cond.Broadcast()
+	return true, nil
+}
+
+// writeAmplification returns the bytes written to tables divided by the
+// bytes written by the user. The WAL is not included.
+func (s *lsmStore) writeAmplification() float64 {
+	if s.userBytes == 0 {
+		return 0
+	}
+	var written int64
+	for _, st := range s.stats {
+		written += st.bytesWritten
+	}
+	return float64(written) / float64(s.userBytes)
+}
+
+func (s *lsmStore) info(buf []byte) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	buf = append(buf, "# LSM\r\n"...)
+	memSize := s.mem.size
+	if s.imm != nil {
+		memSize += s.imm.size
+	}
+	buf = append(buf, fmt.Sprintf("memtable_bytes:%d\r\n", memSize)...)
+	for level, tables := range s.levels {
+		st := s.stats[level]
+		buf = append(buf, fmt.Sprintf("level%d:tables=%d,bytes=%d,"+
+			"compactions=%d,read_bytes=%d,written_bytes=%d\r\n",
+			level, len(tables), tablesSize(tables), st.compactions,
+			st.bytesRead, st.bytesWritten)...)
+	}
+	buf = append(buf, fmt.Sprintf("user_bytes:%d\r\n", s.userBytes)...)
+	buf = append(buf, fmt.Sprintf("flush_bytes:%d\r\n", s.flushBytes)...)
+	buf = append(buf, fmt.Sprintf("write_amplification:%.2f\r\n",
+		s.writeAmplification())...)
+	return buf
+}
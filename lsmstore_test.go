@@ -0,0 +1,56 @@
+package kvbench
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLSMReopen(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "lsm")
+		testReopen(t, "lsm", path, storeOptions{fsync: fsync})
+	}
+}
+
+func TestLSMTablesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsm")
+	s, err := openStore("lsm", path, storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a few memtables, which are flushed to tables
+	want := make(map[string]string)
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 3*lsmMemtableSize/len(value); i++ {
+		key := fmt.Sprintf("key:%06d", i%5000)
+		want[key] = fmt.Sprintf("%d%s", i, value)
+		if err := s.Set([]byte(key), []byte(want[key])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStore(t, s, want)
+	s.Close()
+	if s, err = openStore("lsm", path, storeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkStore(t, s, want)
+}
+
+func TestLSMInfoEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsm")
+	s, err := openStore("lsm", path, storeOptions{crypt: testCrypter(t, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	i, ok := s.(infoer)
+	if !ok {
+		t.Fatalf("%T has no info", s)
+	}
+	if info := string(i.info(nil)); !strings.Contains(info, "# LSM\r\n") {
+		t.Fatalf("info: %q", info)
+	}
+}
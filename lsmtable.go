@@ -0,0 +1,411 @@
+package kvbench
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"sort"
+)
+
+// An sstable is an immutable file of sorted key/values. The entries are
+// stored in data blocks of about sstableBlockSize bytes, each followed by a
+// CRC-32C. An entry is the uvarint key length, the uvarint value length plus
+// one, or zero for a tombstone, the key and the value. The data blocks are
+// followed by the index, which holds the last key, offset and size of each
+// block, the bloom filter, the smallest and largest key, and the footer.
+// The footer holds the offsets of the index, the bloom filter and the keys,
+// the number of entries, a CRC-32C of the meta data and the magic.
+
+const (
+	sstableBlockSize   = 4096
+	sstableFooterSize  = 40
+	sstableMagic       = 0x4c534d31 // "LSM1"
+	sstableBitsPerKey  = 10
+	sstableBloomHashes = 7
+)
+
+var errCorruptTable = errors.New("corrupt table")
+
+// bloomHash returns the two hashes of a key that are combined into the
+// hashes of the bloom filter.
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func bloomMayContain(bloom, key []byte) bool {
+	if len(bloom) < 2 {
+		return true
+	}
+	k := int(bloom[0])
+	bits := bloom[1:]
+	nbits := uint32(len(bits) * 8)
+	h1, h2 := bloomHash(key)
+	for i := 0; i < k; i++ {
+		bit := (h1 + uint32(i)*h2) % nbits
+		if bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func buildBloom(hashes [][2]uint32) []byte {
+	nbits := len(hashes) * sstableBitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	bloom := make([]byte, 1+(nbits+7)/8)
+	bloom[0] = sstableBloomHashes
+	bits := bloom[1:]
+	n := uint32(len(bits) * 8)
+	for _, h := range hashes {
+		for i := 0; i < sstableBloomHashes; i++ {
+			bit := (h[0] + uint32(i)*h[1]) % n
+			bits[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return bloom
+}
+
+// sstableWriter writes a new table. The entries must be added in key order.
+type sstableWriter struct {
+	fs       vfs
+	f        vfsFile
+	w        *bufio.Writer
+	off      int64
+	block    []byte
+	lastKey  []byte
+	smallest []byte
+	index    []byte
+	hashes   [][2]uint32
+	count    int
+}
+
+func newSSTableWriter(fs vfs, path string) (*sstableWriter, error) {
+	f, err := vfsCreate(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	return &sstableWriter{fs: fs, f: f, w: bufio.NewWriterSize(f, 256*1024)}, nil
+}
+
+func (tw *sstableWriter) add(key, value []byte, deleted bool) error {
+	if tw.count == 0 {
+		tw.smallest = bcopy(key)
+	}
+	tw.count++
+	tw.block = appendUvarint(tw.block, uint64(len(key)))
+	if deleted {
+		tw.block = appendUvarint(tw.block, 0)
+	} else {
+		tw.block = appendUvarint(tw.block, uint64(len(value))+1)
+	}
+	tw.block = append(tw.block, key...)
+	tw.block = append(tw.block, value...)
+	tw.lastKey = append(tw.lastKey[:0], key...)
+	h1, h2 := bloomHash(key)
+	tw.hashes = append(tw.hashes, [2]uint32{h1, h2})
+	if len(tw.block) >= sstableBlockSize {
+		return tw.flushBlock()
+	}
+	return nil
+}
+
+func (tw *sstableWriter) flushBlock() error {
+	if len(tw.block) == 0 {
+		return nil
+	}
+	tw.index = appendBinaryArg(tw.index, tw.lastKey)
+	tw.index = appendUvarint(tw.index, uint64(tw.off))
+	tw.index = appendUvarint(tw.index, uint64(len(tw.block)))
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(tw.block, crcTable))
+	tw.block = append(tw.block, sum[:]...)
+	if _, err := tw.w.Write(tw.block); err != nil {
+		return err
+	}
+	tw.off += int64(len(tw.block))
+	tw.block = tw.block[:0]
+	return nil
+}
+
+// size returns the number of bytes written so far.
+func (tw *sstableWriter) size() int64 {
+	return tw.off + int64(len(tw.block))
+}
+
+// finish writes the meta data and syncs the file.
+func (tw *sstableWriter) finish() (int64, error) {
+	if err := tw.flushBlock(); err != nil {
+		return 0, err
+	}
+	indexOff := tw.off
+	meta := tw.index
+	bloomOff := indexOff + int64(len(meta))
+	meta = append(meta, buildBloom(tw.hashes)...)
+	keysOff := indexOff + int64(len(meta))
+	meta = appendBinaryArg(meta, tw.smallest)
+	meta = appendBinaryArg(meta, tw.lastKey)
+	var footer [sstableFooterSize]byte
+	binary.BigEndian.PutUint64(footer[0:], uint64(indexOff))
+	binary.BigEndian.PutUint64(footer[8:], uint64(bloomOff))
+	binary.BigEndian.PutUint64(footer[16:], uint64(keysOff))
+	binary.BigEndian.PutUint64(footer[24:], uint64(tw.count))
+	binary.BigEndian.PutUint32(footer[32:], crc32.Checksum(meta, crcTable))
+	binary.BigEndian.PutUint32(footer[36:], sstableMagic)
+	meta = append(meta, footer[:]...)
+	if _, err := tw.w.Write(meta); err != nil {
+		return 0, err
+	}
+	if err := tw.w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := tw.f.Sync(); err != nil {
+		return 0, err
+	}
+	return indexOff + int64(len(meta)), tw.f.Close()
+}
+
+func (tw *sstableWriter) abort() {
+	tw.f.Close()
+	tw.fs.Remove(tw.f.Name())
+}
+
+type sstableBlock struct {
+	lastKey []byte
+	off     int64
+	size    int
+}
+
+// sstable is an open table. The index and bloom filter are kept in memory.
+type sstable struct {
+	num      int
+	f        vfsFile
+	size     int64
+	count    int
+	blocks   []sstableBlock
+	bloom    []byte
+	smallest []byte
+	largest  []byte
+}
+
+func openSSTable(fs vfs, path string, num int) (*sstable, error) {
+	f, err := vfsOpen(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := readSSTable(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.num = num
+	return t, nil
+}
+
+func readSSTable(f vfsFile) (*sstable, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < sstableFooterSize {
+		return nil, errCorruptTable
+	}
+	var footer [sstableFooterSize]byte
+	if _, err := f.ReadAt(footer[:], size-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(footer[36:]) != sstableMagic {
+		return nil, errCorruptTable
+	}
+	indexOff := int64(binary.BigEndian.Uint64(footer[0:]))
+	bloomOff := int64(binary.BigEndian.Uint64(footer[8:]))
+	keysOff := int64(binary.BigEndian.Uint64(footer[16:]))
+	metaEnd := size - sstableFooterSize
+	if indexOff < 0 || indexOff > bloomOff || bloomOff > keysOff ||
+		keysOff > metaEnd {
+		return nil, errCorruptTable
+	}
+	meta := make([]byte, metaEnd-indexOff)
+	if _, err := f.ReadAt(meta, indexOff); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(meta, crcTable) != binary.BigEndian.Uint32(footer[32:]) {
+		return nil, errCorruptTable
+	}
+	t := &sstable{
+		f:     f,
+		size:  size,
+		count: int(binary.BigEndian.Uint64(footer[24:])),
+		bloom: meta[bloomOff-indexOff : keysOff-indexOff],
+	}
+	index := meta[:bloomOff-indexOff]
+	for len(index) > 0 {
+		var b sstableBlock
+		var off, bsize uint64
+		var ok bool
+		if b.lastKey, index, ok = readArg(index); !ok {
+			return nil, errCorruptTable
+		}
+		if off, index, ok = readUvarintBytes(index); !ok {
+			return nil, errCorruptTable
+		}
+		if bsize, index, ok = readUvarintBytes(index); !ok {
+			return nil, errCorruptTable
+		}
+		b.off, b.size = int64(off), int(bsize)
+		t.blocks = append(t.blocks, b)
+	}
+	keys := meta[keysOff-indexOff:]
+	var ok bool
+	if t.smallest, keys, ok = readArg(keys); !ok {
+		return nil, errCorruptTable
+	}
+	if t.largest, _, ok = readArg(keys); !ok {
+		return nil, errCorruptTable
+	}
+	return t, nil
+}
+
+func readUvarintBytes(b []byte) (uint64, []byte, bool) {
+	n, sz := binary.Uvarint(b)
+	if sz <= 0 {
+		return 0, b, false
+	}
+	return n, b[sz:], true
+}
+
+// readArg reads a uvarint length-prefixed byte string.
+func readArg(b []byte) ([]byte, []byte, bool) {
+	n, b, ok := readUvarintBytes(b)
+	if !ok || n > uint64(len(b)) {
+		return nil, b, false
+	}
+	return b[:n:n], b[n:], true
+}
+
+func (t *sstable) readBlock(i int) ([]byte, error) {
+	b := t.blocks[i]
+	data := make([]byte, b.size+4)
+	if _, err := t.f.ReadAt(data, b.off); err != nil {
+		return nil, err
+	}
+	sum := binary.BigEndian.Uint32(data[b.size:])
+	data = data[:b.size]
+	if crc32.Checksum(data, crcTable) != sum {
+		return nil, errCorruptTable
+	}
+	return data, nil
+}
+
+// overlaps returns true when the table has keys between smallest and
+// largest.
+func (t *sstable) overlaps(smallest, largest []byte) bool {
+	return bytes.Compare(t.largest, smallest) >= 0 &&
+		bytes.Compare(t.smallest, largest) <= 0
+}
+
+// get looks up a key. The deleted result is true for a tombstone.
+func (t *sstable) get(key []byte) (value []byte, deleted, ok bool, err error) {
+	if bytes.Compare(key, t.smallest) < 0 || bytes.Compare(key, t.largest) > 0 {
+		return nil, false, false, nil
+	}
+	if !bloomMayContain(t.bloom, key) {
+		return nil, false, false, nil
+	}
+	it := t.iter()
+	if err := it.seek(key); err != nil {
+		return nil, false, false, err
+	}
+	if !it.valid() || !bytes.Equal(it.key(), key) {
+		return nil, false, false, nil
+	}
+	return it.value(), it.deleted(), true, nil
+}
+
+func (t *sstable) iter() *sstableIter {
+	return &sstableIter{t: t, bi: -1}
+}
+
+type sstableIter struct {
+	t     *sstable
+	bi    int
+	block []byte
+	k     []byte
+	v     []byte
+	del   bool
+	ok    bool
+}
+
+// loadBlock reads the block at bi and positions at its first entry.
+func (it *sstableIter) loadBlock(bi int) error {
+	it.bi = bi
+	it.ok = false
+	if bi >= len(it.t.blocks) {
+		return nil
+	}
+	block, err := it.t.readBlock(bi)
+	if err != nil {
+		return err
+	}
+	it.block = block
+	return it.next()
+}
+
+func (it *sstableIter) seek(key []byte) error {
+	bi := sort.Search(len(it.t.blocks), func(i int) bool {
+		return bytes.Compare(it.t.blocks[i].lastKey, key) >= 0
+	})
+	if err := it.loadBlock(bi); err != nil {
+		return err
+	}
+	for it.ok && bytes.Compare(it.k, key) < 0 {
+		if err := it.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (it *sstableIter) next() error {
+	if len(it.block) == 0 {
+		if it.bi+1 >= len(it.t.blocks) {
+			it.ok = false
+			return nil
+		}
+		return it.loadBlock(it.bi + 1)
+	}
+	klen, b, ok := readUvarintBytes(it.block)
+	if !ok {
+		return errCorruptTable
+	}
+	vlen, b, ok := readUvarintBytes(b)
+	if !ok {
+		return errCorruptTable
+	}
+	it.del = vlen == 0
+	if !it.del {
+		vlen--
+	}
+	if klen+vlen > uint64(len(b)) {
+		return errCorruptTable
+	}
+	it.k = b[:klen:klen]
+	it.v = b[klen : klen+vlen : klen+vlen]
+	it.block = b[klen+vlen:]
+	it.ok = true
+	return nil
+}
+
+func (it *sstableIter) valid() bool   { return it.ok }
+func (it *sstableIter) key() []byte   { return it.k }
+func (it *sstableIter) value() []byte { return it.v }
+func (it *sstableIter) deleted() bool { return it.del }
+func (it *sstableIter) close()        {}
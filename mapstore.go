@@ -1,9 +1,7 @@
 package kvbench
 
 import (
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/tidwall/match"
 )
@@ -12,46 +10,80 @@ type mapStore struct {
 	mu   sync.RWMutex
 	keys map[string][]byte
 	aof  *AOF
+	mem  *memLimit
 }
 
-func newMapStore(path string, fsync bool) (*mapStore, error) {
+func newMapStore(path string, opts storeOptions) (*mapStore, error) {
 	keys := make(map[string][]byte)
 	var err error
 	var aof *AOF
 	if path == ":memory:" {
 		log.Printf("persistance disabled")
 	} else {
-		var count int
-		start := time.Now()
-		aof, err = openAOF(path, fsync, func(args [][]byte) error {
-			switch strings.ToLower(string(args[0])) {
-			case "set":
-				if len(args) >= 3 {
-					keys[string(args[1])] = bcopy(args[2])
+		var stats replayStats
+		aof, stats, err = openAOFParallel(path, opts,
+			func(shards []map[string][]byte) {
+				if len(shards) == 1 {
+					keys = shards[0]
+					for key, value := range keys {
+						keys[key] = bcopy(value)
+					}
+					return
 				}
-			case "del":
-				if len(args) >= 2 {
-					delete(keys, string(args[1]))
+				var n int
+				for _, shard := range shards {
+					n += len(shard)
 				}
-			case "flushdb":
-				keys = make(map[string][]byte)
-			}
-			count++
-			return nil
-		})
+				keys = make(map[string][]byte, n)
+				for _, shard := range shards {
+					for key, value := range shard {
+						keys[key] = bcopy(value)
+					}
+				}
+			})
 		if err != nil {
 			return nil, err
 		}
-		if count > 0 {
-			log.Printf("loaded %d commands in %s", count, time.Since(start))
+		stats.logLoaded()
+	}
+	mem := newMemLimit(opts)
+	if mem != nil {
+		for key, value := range keys {
+			mem.set(key, len(key)+len(value))
 		}
 	}
 	return &mapStore{
 		aof:  aof,
 		keys: keys,
+		mem:  mem,
 	}, nil
 }
 
+// evict deletes keys until the memory limit is met and writes a DEL record
+// for every evicted key.
+func (s *mapStore) evict() error {
+	if s.mem == nil {
+		return nil
+	}
+	keys, err := s.mem.victims()
+	if len(keys) > 0 {
+		if s.aof != nil {
+			s.aof.BeginBuffer()
+			for _, key := range keys {
+				s.aof.AppendBuffer([]byte("del"), []byte(key))
+			}
+			if err := s.aof.WriteBuffer(); err != nil {
+				return err
+			}
+		}
+		for _, key := range keys {
+			delete(s.keys, key)
+		}
+		s.mem.evict(keys)
+	}
+	return err
+}
+
 func (s *mapStore) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -64,6 +96,9 @@ func (s *mapStore) Close() error {
 func (s *mapStore) PSet(keys, values [][]byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.evict(); err != nil {
+		return err
+	}
 	if s.aof != nil {
 		s.aof.BeginBuffer()
 		for i := range keys {
@@ -76,6 +111,9 @@ func (s *mapStore) PSet(keys, values [][]byte) error {
 	}
 	for i := range keys {
 		s.keys[string(keys[i])] = bcopy(values[i])
+		if s.mem != nil {
+			s.mem.set(string(keys[i]), len(keys[i])+len(values[i]))
+		}
 	}
 	return nil
 }
@@ -93,6 +131,9 @@ func (s *mapStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
 		} else {
 			values = append(values, v)
 			oks = append(oks, true)
+			if s.mem != nil {
+				s.mem.touch(string(keys[i]))
+			}
 		}
 	}
 	return values, oks, nil
@@ -101,12 +142,18 @@ func (s *mapStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
 func (s *mapStore) Set(key, value []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := s.evict(); err != nil {
+		return err
+	}
 	if s.aof != nil {
 		if err := s.aof.Write([]byte("set"), key, value); err != nil {
 			return err
 		}
 	}
 	s.keys[string(key)] = bcopy(value)
+	if s.mem != nil {
+		s.mem.set(string(key), len(key)+len(value))
+	}
 	return nil
 }
 
@@ -114,6 +161,9 @@ func (s *mapStore) Get(key []byte) ([]byte, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	v, ok := s.keys[string(key)]
+	if ok && s.mem != nil {
+		s.mem.touch(string(key))
+	}
 	return v, ok, nil
 }
 
@@ -128,6 +178,9 @@ func (s *mapStore) Del(key []byte) (bool, error) {
 			}
 		}
 		delete(s.keys, string(key))
+		if s.mem != nil {
+			s.mem.del(string(key))
+		}
 	}
 	return ok, nil
 }
@@ -161,5 +214,53 @@ func (s *mapStore) FlushDB() error {
 		}
 	}
 	s.keys = make(map[string][]byte)
+	if s.mem != nil {
+		s.mem.reset()
+	}
+	return nil
+}
+
+func (s *mapStore) rotateKey(crypt *crypter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof == nil {
+		return nil
+	}
+	return s.aof.Rewrite(crypt, func(emit func(args ...[]byte) error) error {
+		for key, value := range s.keys {
+			if err := emit([]byte("set"), []byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *mapStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key, value := range s.keys {
+		if !iter([]byte(key), value) {
+			break
+		}
+	}
 	return nil
 }
+
+func (s *mapStore) info(buf []byte) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.mem == nil {
+		return buf
+	}
+	return s.mem.info(buf)
+}
+
+func (s *mapStore) memUsage() (used, evicted int64, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.mem == nil {
+		return 0, 0, false
+	}
+	return s.mem.used, s.mem.evicted, true
+}
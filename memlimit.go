@@ -0,0 +1,312 @@
+package kvbench
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+type evictPolicy int
+
+const (
+	noEviction evictPolicy = iota
+	allKeysLRU
+	allKeysLFU
+	allKeysRandom
+)
+
+var evictPolicyNames = []string{"noeviction", "allkeys-lru", "allkeys-lfu",
+	"allkeys-random"}
+
+func (p evictPolicy) String() string {
+	return evictPolicyNames[p]
+}
+
+func parseEvictPolicy(s string) (evictPolicy, error) {
+	for i, name := range evictPolicyNames {
+		if strings.EqualFold(s, name) {
+			return evictPolicy(i), nil
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(s), "volatile-") {
+		// they only evict keys with an expiry
+		return 0, fmt.Errorf("unsupported maxmemory policy: %v, there is "+
+			"no TTL support", s)
+	}
+	return 0, fmt.Errorf("unknown maxmemory policy: %v", s)
+}
+
+// parseMemory parses a memory size like Redis does, such as "100mb" or
+// "1g". The k, m and g units are powers of 1000 and kb, mb and gb are
+// powers of 1024.
+func parseMemory(s string) (int64, error) {
+	ls := strings.ToLower(strings.TrimSpace(s))
+	mul := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	} {
+		if strings.HasSuffix(ls, u.suffix) {
+			ls, mul = ls[:len(ls)-len(u.suffix)], u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(ls, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size: %v", s)
+	}
+	return n * mul, nil
+}
+
+const (
+	memPoolSize      = 16
+	lfuInitVal       = 5
+	lfuLogFactor     = 10
+	lfuDecayMinutes  = 1
+	defaultMemSample = 5
+)
+
+// memMeta is the accounting of a key. The access field is the LRU clock in
+// milliseconds, or the minutes of the last decrement and the logarithmic
+// counter of LFU. It's updated atomically because reads only hold a read
+// lock.
+type memMeta struct {
+	access uint32
+	size   int64
+}
+
+type memCandidate struct {
+	key   string
+	score uint32
+}
+
+// memLimit accounts the memory of the stored keys and values and picks keys
+// to evict when the limit is exceeded. Like Redis it samples a few keys for
+// every eviction and keeps the best candidates in a pool. The keys are
+// sampled from the metadata map, using the random start of map iteration.
+// The caller must hold the store lock while calling any method but touch,
+// which only needs a read lock.
+type memLimit struct {
+	max     int64
+	used    int64
+	policy  evictPolicy
+	samples int
+	meta    map[string]*memMeta
+	pool    []memCandidate // ascending by score, best candidate last
+	evicted int64
+}
+
+// newMemLimit returns the memory limit of the options, or nil when there's
+// no limit.
+func newMemLimit(opts storeOptions) *memLimit {
+	if opts.maxMemory <= 0 {
+		return nil
+	}
+	samples := opts.maxMemorySamples
+	if samples <= 0 {
+		samples = defaultMemSample
+	}
+	return &memLimit{
+		max:     opts.maxMemory,
+		policy:  opts.maxMemoryPolicy,
+		samples: samples,
+		meta:    make(map[string]*memMeta),
+	}
+}
+
+func lruClock() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+func lfuMinutes() uint32 {
+	return uint32(time.Now().Unix()/60) & 0xFFFF
+}
+
+// lfuCounter returns the counter decremented by the minutes that passed
+// since the last decrement.
+func lfuCounter(access uint32) uint32 {
+	counter := access & 0xFF
+	elapsed := (lfuMinutes() - access>>8) & 0xFFFF
+	if decr := elapsed / lfuDecayMinutes; decr < counter {
+		return counter - decr
+	}
+	return 0
+}
+
+func lfuIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return counter
+	}
+	base := float64(0)
+	if counter > lfuInitVal {
+		base = float64(counter - lfuInitVal)
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+func (m *memLimit) lfu() bool {
+	return m.policy == allKeysLFU
+}
+
+// set accounts a new or replaced key.
+func (m *memLimit) set(key string, size int) {
+	if meta, ok := m.meta[key]; ok {
+		m.used += int64(size) - meta.size
+		meta.size = int64(size)
+		m.touch(key)
+		return
+	}
+	meta := &memMeta{size: int64(size), access: lruClock()}
+	if m.lfu() {
+		meta.access = lfuMinutes()<<8 | lfuInitVal
+	}
+	m.meta[key] = meta
+	m.used += int64(size)
+}
+
+// touch updates the access of a key that's read.
+func (m *memLimit) touch(key string) {
+	meta, ok := m.meta[key]
+	if !ok {
+		return
+	}
+	if m.lfu() {
+		access := atomic.LoadUint32(&meta.access)
+		counter := lfuIncr(lfuCounter(access))
+		atomic.StoreUint32(&meta.access, lfuMinutes()<<8|counter)
+	} else {
+		atomic.StoreUint32(&meta.access, lruClock())
+	}
+}
+
+func (m *memLimit) del(key string) {
+	if meta, ok := m.meta[key]; ok {
+		m.used -= meta.size
+		delete(m.meta, key)
+	}
+}
+
+func (m *memLimit) reset() {
+	m.used = 0
+	m.meta = make(map[string]*memMeta)
+	m.pool = nil
+}
+
+// score returns how good of a candidate for eviction a key is.
+func (m *memLimit) score(meta *memMeta) uint32 {
+	access := atomic.LoadUint32(&meta.access)
+	if m.lfu() {
+		return 255 - lfuCounter(access)
+	}
+	return lruClock() - access
+}
+
+func (m *memLimit) poolInsert(key string, score uint32) {
+	for _, c := range m.pool {
+		if c.key == key {
+			return
+		}
+	}
+	if len(m.pool) == memPoolSize {
+		if score <= m.pool[0].score {
+			return
+		}
+		m.pool = append(m.pool[:0], m.pool[1:]...)
+	}
+	i := sort.Search(len(m.pool), func(i int) bool {
+		return m.pool[i].score > score
+	})
+	m.pool = append(m.pool, memCandidate{})
+	copy(m.pool[i+1:], m.pool[i:])
+	m.pool[i] = memCandidate{key, score}
+}
+
+// pick returns the next key to evict that isn't picked yet, or false when
+// there's none.
+func (m *memLimit) pick(picked map[string]bool) (string, bool) {
+	switch m.policy {
+	case allKeysRandom:
+		for key := range m.meta {
+			if !picked[key] {
+				return key, true
+			}
+		}
+		return "", false
+	case allKeysLRU, allKeysLFU:
+	default:
+		return "", false
+	}
+	for len(m.meta) > len(picked) {
+		n := 0
+		for key, meta := range m.meta {
+			if picked[key] {
+				continue
+			}
+			m.poolInsert(key, m.score(meta))
+			if n++; n == m.samples {
+				break
+			}
+		}
+		for len(m.pool) > 0 {
+			c := m.pool[len(m.pool)-1]
+			m.pool = m.pool[:len(m.pool)-1]
+			if _, ok := m.meta[c.key]; ok && !picked[c.key] {
+				return c.key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// victims returns the keys that must be evicted to get below the limit.
+// The accounting isn't changed until the caller deleted the keys from the
+// store and calls evict. The OOM error is returned when not enough keys can
+// be evicted.
+func (m *memLimit) victims() ([]string, error) {
+	var keys []string
+	var picked map[string]bool
+	used := m.used
+	for used > m.max {
+		key, ok := m.pick(picked)
+		if !ok {
+			return keys, errOOM
+		}
+		if picked == nil {
+			picked = make(map[string]bool)
+		}
+		picked[key] = true
+		used -= m.meta[key].size
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// evict removes the evicted keys from the accounting.
+func (m *memLimit) evict(keys []string) {
+	for _, key := range keys {
+		m.del(key)
+	}
+	m.evicted += int64(len(keys))
+}
+
+func (m *memLimit) info(buf []byte) []byte {
+	buf = append(buf, "# Memory\r\n"...)
+	buf = append(buf, fmt.Sprintf("used_memory:%d\r\n", m.used)...)
+	buf = append(buf, fmt.Sprintf("maxmemory:%d\r\n", m.max)...)
+	buf = append(buf, fmt.Sprintf("maxmemory_policy:%s\r\n", m.policy)...)
+	buf = append(buf, fmt.Sprintf("evicted_keys:%d\r\n", m.evicted)...)
+	return buf
+}
@@ -0,0 +1,196 @@
+package kvbench
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int64
+		fail bool
+	}{
+		{"0", 0, false},
+		{"100", 100, false},
+		{"100b", 100, false},
+		{"1k", 1000, false},
+		{"1kb", 1024, false},
+		{"100MB", 100 << 20, false},
+		{" 2g ", 2e9, false},
+		{"1gb", 1 << 30, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"1tb", 0, true},
+	}
+	for _, tc := range tests {
+		n, err := parseMemory(tc.s)
+		if (err != nil) != tc.fail || n != tc.n {
+			t.Fatalf("parseMemory(%q) = %d, %v", tc.s, n, err)
+		}
+	}
+}
+
+func TestParseEvictPolicy(t *testing.T) {
+	tests := []struct {
+		s      string
+		policy evictPolicy
+		err    string
+	}{
+		{"noeviction", noEviction, ""},
+		{"allkeys-lru", allKeysLRU, ""},
+		{"ALLKEYS-LFU", allKeysLFU, ""},
+		{"allkeys-random", allKeysRandom, ""},
+		{"volatile-lru", 0, "no TTL support"},
+		{"volatile-ttl", 0, "no TTL support"},
+		{"lru", 0, "unknown"},
+	}
+	for _, tc := range tests {
+		policy, err := parseEvictPolicy(tc.s)
+		if tc.err == "" && (err != nil || policy != tc.policy) {
+			t.Fatalf("parseEvictPolicy(%q) = %v, %v", tc.s, policy, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("parseEvictPolicy(%q): %v", tc.s, err)
+		}
+	}
+}
+
+func TestEvictPolicies(t *testing.T) {
+	for _, policy := range []string{"allkeys-lru", "allkeys-lfu",
+		"allkeys-random", "noeviction"} {
+		for _, which := range []string{"map", "btree"} {
+			t.Run(which+"-"+policy, func(t *testing.T) {
+				s, err := openStore(which, ":memory:", storeOptions{
+					values: map[string]string{
+						"maxmemory":        "10000",
+						"maxmemory-policy": policy,
+					},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				var oom bool
+				for i := 0; i < 1000; i++ {
+					key := fmt.Sprintf("key:%04d", i)
+					err := s.Set([]byte(key), []byte("0123456789012345"))
+					if err == errOOM {
+						oom = true
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				if oom != (policy == "noeviction") {
+					t.Fatalf("oom: %v", oom)
+				}
+				keys, _, _ := s.Keys([]byte("*"), -1, false)
+				if n := len(keys) * len("key:0000012345678901234"); n > 10000+100 {
+					t.Fatalf("%d keys are over the limit", len(keys))
+				}
+			})
+		}
+	}
+}
+
+func TestEvictAOFFailure(t *testing.T) {
+	fs := newFaultFS()
+	s, err := openStore("map", "test.aof", storeOptions{
+		fs: fs,
+		values: map[string]string{
+			"maxmemory":        "1000",
+			"maxmemory-policy": "allkeys-lru",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	mem := s.(*mapStore).mem
+	for i := 0; mem.used <= mem.max; i++ {
+		key := fmt.Sprintf("key:%04d", i)
+		if err := s.Set([]byte(key), []byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := mem.used
+	keys, _, _ := s.Keys([]byte("*"), -1, false)
+	// the DELs of the evicted keys can't be written
+	fs.setSpace(0)
+	if err := s.Set([]byte("new"), []byte("value")); err == nil {
+		t.Fatal("expected a write error")
+	}
+	after, _, _ := s.Keys([]byte("*"), -1, false)
+	if mem.used != used || len(after) != len(keys) || mem.evicted != 0 {
+		t.Fatalf("used %d, expected %d; %d keys, expected %d; evicted %d",
+			mem.used, used, len(after), len(keys), mem.evicted)
+	}
+	fs.setSpace(-1)
+	if err := s.Set([]byte("new"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if mem.evicted == 0 || mem.used > mem.max+int64(len("newvalue")) {
+		t.Fatalf("used %d, evicted %d", mem.used, mem.evicted)
+	}
+}
+
+func TestShardMemoryInfo(t *testing.T) {
+	for _, which := range []string{"smap", "sbtree"} {
+		t.Run(which, func(t *testing.T) {
+			s, err := openStore(which, ":memory:", storeOptions{
+				values: map[string]string{
+					"maxmemory":        "16000",
+					"maxmemory-policy": "allkeys-lru",
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("key:%04d", i)
+				if err := s.Set([]byte(key), []byte("0123456789")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var used, evicted int64
+			for _, shard := range s.(*shardStore).shards {
+				u, e, _ := shard.(memUser).memUsage()
+				used += u
+				evicted += e
+			}
+			// every shard may go over its part by the last write
+			if evicted == 0 || used > 16000+16*int64(len("key:00000123456789")) {
+				t.Fatalf("used %d, evicted %d", used, evicted)
+			}
+			info := string(s.(infoer).info(nil))
+			for _, line := range []string{
+				fmt.Sprintf("used_memory:%d\r\n", used),
+				"maxmemory:16000\r\n",
+				"maxmemory_policy:allkeys-lru\r\n",
+				fmt.Sprintf("evicted_keys:%d\r\n", evicted),
+			} {
+				if !strings.Contains(info, line) {
+					t.Fatalf("%q is missing %q", info, line)
+				}
+			}
+		})
+	}
+	// a limit below the number of shards still limits every shard
+	s, err := openStore("smap", ":memory:", storeOptions{
+		values: map[string]string{"maxmemory": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set([]byte("key"), []byte("value")); err != errOOM {
+		t.Fatalf("got %v, expected %v", err, errOOM)
+	}
+}
@@ -0,0 +1,722 @@
+package kvbench
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware adds behavior to any store by wrapping it.
+type Middleware struct {
+	// Wrap returns a store that wraps the provided store. Closing the
+	// returned store must close the wrapped store.
+	Wrap func(store Store, opts StoreOptions) (Store, error)
+	// Options is the schema of the middleware options.
+	Options []StoreOption
+}
+
+// RegisterMiddleware makes a middleware available by name. It panics when
+// the name is already registered or the middleware has no Wrap function.
+func RegisterMiddleware(name string, m Middleware) {
+	registry.Lock()
+	defer registry.Unlock()
+	if m.Wrap == nil {
+		panic("kvbench: RegisterMiddleware middleware has no Wrap function")
+	}
+	if _, ok := registry.middleware[name]; ok {
+		panic("kvbench: RegisterMiddleware called twice for middleware " + name)
+	}
+	registry.mwNames = append(registry.mwNames, name)
+	registry.middleware[name] = m
+}
+
+// RegisteredMiddleware returns the names of the registered middleware in the
+// order that they were registered.
+func RegisteredMiddleware() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	return append([]string(nil), registry.mwNames...)
+}
+
+// wrapStore wraps the store with a chain of middleware. The first middleware
+// is the outermost one, which sees every operation first.
+func wrapStore(store Store, chain []string, opts storeOptions) (Store, error) {
+	if err := checkCompressed(store, chain); err != nil {
+		return nil, err
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		registry.Lock()
+		m, ok := registry.middleware[chain[i]]
+		registry.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware: %v, available: %v",
+				chain[i], strings.Join(RegisteredMiddleware(), ","))
+		}
+		mopts := opts
+		values, err := applyOptions(m.Options, &mopts)
+		if err != nil {
+			return nil, err
+		}
+		store, err = m.Wrap(store, StoreOptions{
+			Fsync:    opts.fsync,
+			values:   values,
+			internal: mopts,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// wrapper is implemented by the built-in middleware.
+type wrapper interface {
+	unwrap() Store
+}
+
+// unwrapStore returns the store under the built-in middleware.
+func unwrapStore(store Store) Store {
+	for {
+		w, ok := store.(wrapper)
+		if !ok {
+			return store
+		}
+		store = w.unwrap()
+	}
+}
+
+// middlewareStore is embedded by the built-in middleware, and passes the
+// scanner, ranger and infoer interfaces of the wrapped store through.
+type middlewareStore struct {
+	Store
+}
+
+func (s middlewareStore) unwrap() Store {
+	return s.Store
+}
+
+func (s middlewareStore) scan(iter func(key, value []byte) bool) error {
+	return scanStore(s.Store, iter)
+}
+
+func (s middlewareStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return keysFrom(s.Store, start, pattern, limit, withvalues)
+}
+
+func (s middlewareStore) info(buf []byte) []byte {
+	if i, ok := s.Store.(infoer); ok {
+		return i.info(buf)
+	}
+	return buf
+}
+
+// storeInfo appends the info of the wrapped store after a section of a
+// middleware.
+func (s middlewareStore) storeInfo(buf []byte) []byte {
+	if i, ok := s.Store.(infoer); ok {
+		buf = append(buf, "\r\n"...)
+		return i.info(buf)
+	}
+	return buf
+}
+
+const (
+	opSet = iota
+	opPSet
+	opGet
+	opPGet
+	opDel
+	opKeys
+	opFlushDB
+	numOps
+)
+
+var opNames = [numOps]string{"set", "pset", "get", "pget", "del", "keys",
+	"flushdb"}
+
+// latencyHist is a histogram of latencies in nanoseconds with a bucket for
+// every power of two. It's updated atomically without allocations.
+type latencyHist struct {
+	buckets [65]uint64
+	count   uint64
+	total   uint64
+	max     uint64
+}
+
+func (h *latencyHist) record(d time.Duration) {
+	ns := uint64(0)
+	if d > 0 {
+		ns = uint64(d)
+	}
+	atomic.AddUint64(&h.buckets[bits.Len64(ns)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.total, ns)
+	for {
+		max := atomic.LoadUint64(&h.max)
+		if ns <= max || atomic.CompareAndSwapUint64(&h.max, max, ns) {
+			break
+		}
+	}
+}
+
+// percentile returns the upper bound of the bucket of the percentile, which
+// is between 0 and 100.
+func (h *latencyHist) percentile(p float64) uint64 {
+	var counts [65]uint64
+	var count uint64
+	for i := range h.buckets {
+		counts[i] = atomic.LoadUint64(&h.buckets[i])
+		count += counts[i]
+	}
+	if count == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(count)))
+	if target == 0 {
+		target = 1
+	}
+	var n uint64
+	for i, c := range counts {
+		if n += c; n >= target {
+			if i == 0 {
+				return 0
+			}
+			bound := uint64(1)<<uint(i) - 1
+			if max := atomic.LoadUint64(&h.max); bound > max {
+				bound = max
+			}
+			return bound
+		}
+	}
+	return atomic.LoadUint64(&h.max)
+}
+
+// latencyStore records a latency histogram for every method.
+type latencyStore struct {
+	middlewareStore
+	hists [numOps]latencyHist
+}
+
+func (s *latencyStore) Set(key, value []byte) error {
+	start := time.Now()
+	err := s.Store.Set(key, value)
+	s.hists[opSet].record(time.Since(start))
+	return err
+}
+
+func (s *latencyStore) PSet(keys, values [][]byte) error {
+	start := time.Now()
+	err := s.Store.PSet(keys, values)
+	s.hists[opPSet].record(time.Since(start))
+	return err
+}
+
+func (s *latencyStore) Get(key []byte) ([]byte, bool, error) {
+	start := time.Now()
+	v, ok, err := s.Store.Get(key)
+	s.hists[opGet].record(time.Since(start))
+	return v, ok, err
+}
+
+func (s *latencyStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	start := time.Now()
+	values, oks, err := s.Store.PGet(keys)
+	s.hists[opPGet].record(time.Since(start))
+	return values, oks, err
+}
+
+func (s *latencyStore) Del(key []byte) (bool, error) {
+	start := time.Now()
+	ok, err := s.Store.Del(key)
+	s.hists[opDel].record(time.Since(start))
+	return ok, err
+}
+
+func (s *latencyStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	start := time.Now()
+	keys, vals, err := s.Store.Keys(pattern, limit, withvalues)
+	s.hists[opKeys].record(time.Since(start))
+	return keys, vals, err
+}
+
+func (s *latencyStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	t := time.Now()
+	keys, vals, err := s.middlewareStore.keysFrom(start, pattern, limit,
+		withvalues)
+	s.hists[opKeys].record(time.Since(t))
+	return keys, vals, err
+}
+
+func (s *latencyStore) FlushDB() error {
+	start := time.Now()
+	err := s.Store.FlushDB()
+	s.hists[opFlushDB].record(time.Since(start))
+	return err
+}
+
+// info reports the latencies in microseconds like the Redis latencystats.
+func (s *latencyStore) info(buf []byte) []byte {
+	usec := func(ns uint64) float64 { return float64(ns) / 1e3 }
+	buf = append(buf, "# Latency\r\n"...)
+	for i := range s.hists {
+		h := &s.hists[i]
+		count := atomic.LoadUint64(&h.count)
+		if count == 0 {
+			continue
+		}
+		total := atomic.LoadUint64(&h.total)
+		buf = append(buf, fmt.Sprintf(
+			"cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n",
+			opNames[i], count, total/1e3, usec(total)/float64(count))...)
+		buf = append(buf, fmt.Sprintf(
+			"latency_percentiles_usec_%s:p50=%.3f,p99=%.3f,p99.9=%.3f,max=%.3f\r\n",
+			opNames[i], usec(h.percentile(50)), usec(h.percentile(99)),
+			usec(h.percentile(99.9)), usec(atomic.LoadUint64(&h.max)))...)
+	}
+	return s.storeInfo(buf)
+}
+
+// delayStore adds a delay to every operation, to model a slower device or a
+// network hop.
+type delayStore struct {
+	middlewareStore
+	delay  time.Duration
+	jitter time.Duration
+}
+
+func (s *delayStore) wait() {
+	d := s.delay
+	if s.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(s.jitter)))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (s *delayStore) Set(key, value []byte) error {
+	s.wait()
+	return s.Store.Set(key, value)
+}
+
+func (s *delayStore) PSet(keys, values [][]byte) error {
+	s.wait()
+	return s.Store.PSet(keys, values)
+}
+
+func (s *delayStore) Get(key []byte) ([]byte, bool, error) {
+	s.wait()
+	return s.Store.Get(key)
+}
+
+func (s *delayStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	s.wait()
+	return s.Store.PGet(keys)
+}
+
+func (s *delayStore) Del(key []byte) (bool, error) {
+	s.wait()
+	return s.Store.Del(key)
+}
+
+func (s *delayStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	s.wait()
+	return s.Store.Keys(pattern, limit, withvalues)
+}
+
+func (s *delayStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	s.wait()
+	return s.middlewareStore.keysFrom(start, pattern, limit, withvalues)
+}
+
+func (s *delayStore) FlushDB() error {
+	s.wait()
+	return s.Store.FlushDB()
+}
+
+var errCompressedValue = errors.New("invalid compressed value")
+var errCompressed = errors.New("store has compressed values: use the compress middleware")
+var errNotCompressed = errors.New("store has values that are not compressed")
+
+// compressMarkerKey is the reserved key that marks a store with the values
+// of the compress middleware.
+var compressMarkerKey = []byte("\x00kvbench:compress")
+
+// checkCompressed refuses a store with compressed values when the chain has
+// no compress middleware, which would return the values with their header.
+func checkCompressed(store Store, chain []string) error {
+	for _, name := range chain {
+		if name == "compress" {
+			return nil
+		}
+	}
+	_, ok, err := store.Get(compressMarkerKey)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return errCompressed
+	}
+	return nil
+}
+
+// The first byte of a value of the compress middleware.
+const (
+	valueRaw     = 0
+	valueDeflate = 1
+)
+
+// compressStore compresses the values with deflate. Values that are smaller
+// than the minimum or that don't get smaller are stored as-is, after the
+// header byte. The store holds the compressMarkerKey, so that its values are
+// never read without the middleware, and a store with other values is
+// refused.
+type compressStore struct {
+	middlewareStore
+	min     int
+	writers sync.Pool
+	// in and out are the bytes of the values that are written before and
+	// after compression.
+	in, out int64
+}
+
+func newCompressStore(store Store, min int) (*compressStore, error) {
+	_, ok, err := store.Get(compressMarkerKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		keys, _, err := store.Keys([]byte("*"), 1, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			return nil, errNotCompressed
+		}
+		if err := store.Set(compressMarkerKey, []byte{valueRaw}); err != nil {
+			return nil, err
+		}
+	}
+	s := &compressStore{middlewareStore: middlewareStore{store}, min: min}
+	s.writers.New = func() interface{} {
+		zw, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return zw
+	}
+	return s, nil
+}
+
+func (s *compressStore) encode(value []byte) []byte {
+	atomic.AddInt64(&s.in, int64(len(value)))
+	if len(value) >= s.min {
+		var buf bytes.Buffer
+		buf.WriteByte(valueDeflate)
+		zw := s.writers.Get().(*flate.Writer)
+		zw.Reset(&buf)
+		zw.Write(value)
+		zw.Close()
+		s.writers.Put(zw)
+		if buf.Len() < len(value)+1 {
+			atomic.AddInt64(&s.out, int64(buf.Len()))
+			return buf.Bytes()
+		}
+	}
+	evalue := make([]byte, len(value)+1)
+	evalue[0] = valueRaw
+	copy(evalue[1:], value)
+	atomic.AddInt64(&s.out, int64(len(evalue)))
+	return evalue
+}
+
+func (s *compressStore) decode(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, errCompressedValue
+	}
+	switch value[0] {
+	case valueRaw:
+		return value[1:], nil
+	case valueDeflate:
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(value[1:])))
+	}
+	return nil, errCompressedValue
+}
+
+func (s *compressStore) Set(key, value []byte) error {
+	return s.Store.Set(key, s.encode(value))
+}
+
+func (s *compressStore) PSet(keys, values [][]byte) error {
+	evalues := make([][]byte, len(values))
+	for i := range values {
+		evalues[i] = s.encode(values[i])
+	}
+	return s.Store.PSet(keys, evalues)
+}
+
+func (s *compressStore) Get(key []byte) ([]byte, bool, error) {
+	v, ok, err := s.Store.Get(key)
+	if !ok || err != nil {
+		return v, ok, err
+	}
+	v, err = s.decode(v)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func (s *compressStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	values, oks, err := s.Store.PGet(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range values {
+		if oks[i] {
+			values[i], err = s.decode(values[i])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return values, oks, nil
+}
+
+func (s *compressStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	keys, vals, err := s.Store.Keys(pattern, reservedLimit(limit), withvalues)
+	return s.decodeKeys(keys, vals, limit, err)
+}
+
+func (s *compressStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	keys, vals, err := s.middlewareStore.keysFrom(start, pattern,
+		reservedLimit(limit), withvalues)
+	return s.decodeKeys(keys, vals, limit, err)
+}
+
+// decodeKeys drops the marker key and decodes the values of a Keys result.
+func (s *compressStore) decodeKeys(keys, vals [][]byte, limit int, err error,
+) ([][]byte, [][]byte, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	var j int
+	for i := range keys {
+		if bytes.Equal(keys[i], compressMarkerKey) {
+			continue
+		}
+		keys[j] = keys[i]
+		if vals != nil {
+			vals[j], err = s.decode(vals[i])
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		j++
+	}
+	if limit >= 0 && j > limit {
+		j = limit
+	}
+	keys = keys[:j]
+	if vals != nil {
+		vals = vals[:j]
+	}
+	return keys, vals, nil
+}
+
+func (s *compressStore) FlushDB() error {
+	if err := s.Store.FlushDB(); err != nil {
+		return err
+	}
+	return s.Store.Set(compressMarkerKey, []byte{valueRaw})
+}
+
+func (s *compressStore) scan(iter func(key, value []byte) bool) error {
+	var err error
+	serr := scanStore(s.Store, func(key, value []byte) bool {
+		if bytes.Equal(key, compressMarkerKey) {
+			return true
+		}
+		value, err = s.decode(value)
+		if err != nil {
+			return false
+		}
+		return iter(key, value)
+	})
+	if serr != nil {
+		return serr
+	}
+	return err
+}
+
+func (s *compressStore) info(buf []byte) []byte {
+	in, out := atomic.LoadInt64(&s.in), atomic.LoadInt64(&s.out)
+	var ratio float64
+	if out > 0 {
+		ratio = float64(in) / float64(out)
+	}
+	buf = append(buf, "# Compression\r\n"...)
+	buf = append(buf, fmt.Sprintf("compress_min:%d\r\n", s.min)...)
+	buf = append(buf, fmt.Sprintf("value_bytes_in:%d\r\n", in)...)
+	buf = append(buf, fmt.Sprintf("value_bytes_stored:%d\r\n", out)...)
+	buf = append(buf, fmt.Sprintf("compression_ratio:%.4f\r\n", ratio)...)
+	return s.storeInfo(buf)
+}
+
+// logStore logs the operations that fail or that are slower than a
+// threshold. Nothing is formatted for the other operations.
+type logStore struct {
+	middlewareStore
+	slower time.Duration
+}
+
+func (s *logStore) done(op int, key []byte, n int, start time.Time, err error) {
+	d := time.Since(start)
+	if d < s.slower && err == nil {
+		return
+	}
+	if len(key) > 64 {
+		key = key[:64]
+	}
+	var arg string
+	if n >= 0 {
+		arg = fmt.Sprintf(" keys=%d", n)
+	} else if key != nil {
+		arg = fmt.Sprintf(" key=%q", key)
+	}
+	if err != nil {
+		log.Warningf("%s%s %v: %v", opNames[op], arg, d, err)
+	} else {
+		log.Printf("%s%s %v", opNames[op], arg, d)
+	}
+}
+
+func (s *logStore) Set(key, value []byte) error {
+	start := time.Now()
+	err := s.Store.Set(key, value)
+	s.done(opSet, key, -1, start, err)
+	return err
+}
+
+func (s *logStore) PSet(keys, values [][]byte) error {
+	start := time.Now()
+	err := s.Store.PSet(keys, values)
+	s.done(opPSet, nil, len(keys), start, err)
+	return err
+}
+
+func (s *logStore) Get(key []byte) ([]byte, bool, error) {
+	start := time.Now()
+	v, ok, err := s.Store.Get(key)
+	s.done(opGet, key, -1, start, err)
+	return v, ok, err
+}
+
+func (s *logStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	start := time.Now()
+	values, oks, err := s.Store.PGet(keys)
+	s.done(opPGet, nil, len(keys), start, err)
+	return values, oks, err
+}
+
+func (s *logStore) Del(key []byte) (bool, error) {
+	start := time.Now()
+	ok, err := s.Store.Del(key)
+	s.done(opDel, key, -1, start, err)
+	return ok, err
+}
+
+func (s *logStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	start := time.Now()
+	keys, vals, err := s.Store.Keys(pattern, limit, withvalues)
+	s.done(opKeys, pattern, -1, start, err)
+	return keys, vals, err
+}
+
+func (s *logStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	t := time.Now()
+	keys, vals, err := s.middlewareStore.keysFrom(start, pattern, limit,
+		withvalues)
+	s.done(opKeys, pattern, -1, t, err)
+	return keys, vals, err
+}
+
+func (s *logStore) FlushDB() error {
+	start := time.Now()
+	err := s.Store.FlushDB()
+	s.done(opFlushDB, nil, -1, start, err)
+	return err
+}
+
+func init() {
+	RegisterMiddleware("latency", Middleware{
+		Wrap: func(store Store, opts StoreOptions) (Store, error) {
+			return &latencyStore{middlewareStore: middlewareStore{store}}, nil
+		},
+	})
+	RegisterMiddleware("delay", Middleware{
+		Options: []StoreOption{
+			{
+				Name:    "delay",
+				Default: "0s",
+				Usage:   "delay middleware: delay of every operation, such as 100us",
+				apply: durationOption(func(o *storeOptions, d time.Duration) {
+					o.delay = d
+				}),
+			}, {
+				Name:    "delay-jitter",
+				Default: "0s",
+				Usage:   "delay middleware: maximum random delay that's added to --delay",
+				apply: durationOption(func(o *storeOptions, d time.Duration) {
+					o.delayJitter = d
+				}),
+			},
+		},
+		Wrap: func(store Store, opts StoreOptions) (Store, error) {
+			return &delayStore{
+				middlewareStore: middlewareStore{store},
+				delay:           opts.internal.delay,
+				jitter:          opts.internal.delayJitter,
+			}, nil
+		},
+	})
+	RegisterMiddleware("compress", Middleware{
+		Options: []StoreOption{
+			{
+				Name:    "compress-min",
+				Default: "64",
+				Usage:   "compress middleware: values smaller than this are not compressed",
+				apply: intOption(func(o *storeOptions, n int) {
+					o.compressMin = n
+				}),
+			},
+		},
+		Wrap: func(store Store, opts StoreOptions) (Store, error) {
+			return newCompressStore(store, opts.internal.compressMin)
+		},
+	})
+	RegisterMiddleware("log", Middleware{
+		Options: []StoreOption{
+			{
+				Name:    "log-slower-than",
+				Default: "0s",
+				Usage:   "log middleware: only log the operations that are slower than this",
+				apply: durationOption(func(o *storeOptions, d time.Duration) {
+					o.logSlower = d
+				}),
+			},
+		},
+		Wrap: func(store Store, opts StoreOptions) (Store, error) {
+			return &logStore{
+				middlewareStore: middlewareStore{store},
+				slower:          opts.internal.logSlower,
+			}, nil
+		},
+	})
+}
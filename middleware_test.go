@@ -0,0 +1,238 @@
+package kvbench
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWrapStoreOrder(t *testing.T) {
+	base, err := openStore("map", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := wrapStore(base, []string{"latency", "delay", "compress", "log"},
+		storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the first middleware is the outermost one
+	var got []string
+	for store := s; ; {
+		got = append(got, reflect.TypeOf(store).String())
+		w, ok := store.(wrapper)
+		if !ok {
+			break
+		}
+		store = w.unwrap()
+	}
+	want := []string{"*kvbench.latencyStore", "*kvbench.delayStore",
+		"*kvbench.compressStore", "*kvbench.logStore", "*kvbench.mapStore"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, expected %v", got, want)
+	}
+	if unwrapStore(s) != base {
+		t.Fatal("unwrapStore didn't return the store")
+	}
+	other, err := openStore("map", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, err = wrapStore(other, []string{"latency", "unknown"}, storeOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unknown middleware") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	base, err := openStore("btree", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := wrapStore(base, []string{"compress"}, storeOptions{
+		values: map[string]string{"compress-min": "16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	random := make([]byte, 5000)
+	rand.Read(random)
+	values := map[string][]byte{
+		"empty":        {},
+		"small":        []byte("0123456789"),
+		"compressible": bytes.Repeat([]byte("0123456789"), 500),
+		"random":       random,
+	}
+	want := make(map[string]string)
+	for key, value := range values {
+		want[key] = string(value)
+		if err := s.Set([]byte(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStore(t, s, want)
+	var keys [][]byte
+	for key := range values {
+		keys = append(keys, []byte(key))
+	}
+	vals, oks, err := s.PGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		if !oks[i] || !bytes.Equal(vals[i], values[string(key)]) {
+			t.Fatalf("pget %s: %v", key, oks[i])
+		}
+	}
+	n := 0
+	err = scanStore(s, func(key, value []byte) bool {
+		n++
+		if !bytes.Equal(value, values[string(key)]) {
+			t.Fatalf("scan %s: got %d bytes", key, len(value))
+		}
+		return true
+	})
+	if err != nil || n != len(values) {
+		t.Fatalf("scanned %d keys: %v", n, err)
+	}
+	// the stored values have a header byte, and only the compressible
+	// value is compressed
+	for key, value := range values {
+		v, _, err := base.Get([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		deflated := key == "compressible"
+		if deflated && (v[0] != valueDeflate || len(v) >= len(value)/10) ||
+			!deflated && (v[0] != valueRaw || !bytes.Equal(v[1:], value)) {
+			t.Fatalf("%s: stored %d bytes for %d", key, len(v), len(value))
+		}
+	}
+	if _, err := base.(*btreeStore).Del([]byte("random")); err != nil {
+		t.Fatal(err)
+	}
+	if err := base.Set([]byte("invalid"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get([]byte("invalid")); err != errCompressedValue {
+		t.Fatalf("got %v, expected %v", err, errCompressedValue)
+	}
+}
+
+func TestCompressMarker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map.db")
+	open := func(chain ...string) (Store, error) {
+		t.Helper()
+		base, err := openStore("map", path, storeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := wrapStore(base, chain, storeOptions{})
+		if err != nil {
+			base.Close()
+		}
+		return s, err
+	}
+	s, err := open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set([]byte("plain"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// a store with uncompressed values
+	if _, err := open("compress"); err != errNotCompressed {
+		t.Fatalf("got %v, expected %v", err, errNotCompressed)
+	}
+	if s, err = open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FlushDB(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// an empty store gets the marker
+	if s, err = open("latency", "compress"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a": "1", "b": strings.Repeat("b", 1000)}
+	for key, value := range want {
+		if err := s.Set([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStore(t, s, want)
+	for _, limit := range []int{0, 1, 2} {
+		keys, _, err := s.Keys([]byte("*"), limit, false)
+		if err != nil || len(keys) != limit {
+			t.Fatalf("limit %d: got %q, %v", limit, keys, err)
+		}
+	}
+	s.Close()
+	// a store with compressed values
+	for _, chain := range [][]string{nil, {"latency", "log"}} {
+		if _, err := open(chain...); err != errCompressed {
+			t.Fatalf("%v: got %v, expected %v", chain, err, errCompressed)
+		}
+	}
+	if s, err = open("compress"); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, s, want)
+	// the flushed store keeps the marker
+	if err := s.FlushDB(); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, s, map[string]string{})
+	s.Close()
+	if _, err := open(); err != errCompressed {
+		t.Fatalf("got %v, expected %v", err, errCompressed)
+	}
+}
+
+func TestCompressInfo(t *testing.T) {
+	base, err := openStore("map", ":memory:", storeOptions{
+		values: map[string]string{"maxmemory": "1mb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := wrapStore(base, []string{"latency", "compress"}, storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	value := bytes.Repeat([]byte("x"), 1000)
+	for i := 0; i < 10; i++ {
+		if err := s.Set([]byte(fmt.Sprint(i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := string(s.(infoer).info(nil))
+	sections := []string{"# Latency\r\n", "# Compression\r\n", "# Memory\r\n"}
+	last := -1
+	for _, section := range sections {
+		i := strings.Index(info, section)
+		if i <= last {
+			t.Fatalf("%q is missing %q", info, section)
+		}
+		last = i
+	}
+	for _, line := range []string{
+		"compress_min:64\r\n",
+		"value_bytes_in:10000\r\n",
+		"maxmemory:1048576\r\n",
+	} {
+		if !strings.Contains(info, line) {
+			t.Fatalf("%q is missing %q", info, line)
+		}
+	}
+}
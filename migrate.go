@@ -0,0 +1,170 @@
+package kvbench
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+)
+
+// MigrateCommand runs the "migrate" subcommand, which copies every key/value
+// from one store to another.
+func MigrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fromWhich := fs.String("from-store", "", "source store type")
+	fromPath := fs.String("from-path", "", "source database path")
+	fromKeyFile := fs.String("from-keyfile", "", "source key file")
+	toWhich := fs.String("to-store", "", "destination store type")
+	toPath := fs.String("to-path", "", "destination database path")
+	toKeyFile := fs.String("to-keyfile", "", "destination key file")
+	fsync := fs.Bool("fsync", true, "fsync the destination")
+	batch := fs.Int("batch", 1000, "number of keys per write")
+	flush := fs.Bool("flush", false, "flush the destination before copying")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fromWhich == "" || *toWhich == "" {
+		return errors.New("--from-store and --to-store are required")
+	}
+	if *batch < 1 {
+		return errors.New("--batch must be greater than zero")
+	}
+	var fromCrypt, toCrypt *crypter
+	var err error
+	if *fromKeyFile != "" {
+		if fromCrypt, err = loadKeyFile(*fromKeyFile); err != nil {
+			return err
+		}
+	}
+	if *toKeyFile != "" {
+		if toCrypt, err = loadKeyFile(*toKeyFile); err != nil {
+			return err
+		}
+	}
+	if err := checkSource(*fromWhich, *fromPath); err != nil {
+		return err
+	}
+	from, err := openStore(*fromWhich, *fromPath, storeOptions{crypt: fromCrypt})
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+	to, err := openStore(*toWhich, *toPath, storeOptions{
+		fsync: *fsync,
+		crypt: toCrypt,
+	})
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	if *flush {
+		if err := to.FlushDB(); err != nil {
+			return err
+		}
+	} else {
+		keys, _, err := to.Keys([]byte("*"), 1, false)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return errors.New("destination store is not empty, use --flush")
+		}
+	}
+	return migrate(from, to, *batch)
+}
+
+// checkSource fails when the source store doesn't exist, instead of
+// creating an empty store at a mistyped path.
+func checkSource(which, path string) error {
+	factory, path, err := lookupStore(which, path)
+	if err != nil {
+		return err
+	}
+	if factory.Network {
+		return nil
+	}
+	if path == ":memory:" {
+		return errors.New("the source store can't be in memory")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("source store: %v", err)
+	}
+	return nil
+}
+
+// migrateSum is an order independent checksum of a set of key/values.
+type migrateSum struct {
+	count int
+	bytes int
+	sum   uint64
+}
+
+func (ms *migrateSum) add(key, value []byte) {
+	h := fnv.New64a()
+	h.Write(key)
+	h.Write([]byte{0})
+	h.Write(value)
+	ms.count++
+	ms.bytes += len(key) + len(value)
+	ms.sum += h.Sum64()
+}
+
+func migrate(from, to Store, batch int) error {
+	start := time.Now()
+	var src migrateSum
+	var keys, vals [][]byte
+	var werr error
+	write := func() bool {
+		if len(keys) == 0 {
+			return true
+		}
+		werr = to.PSet(keys, vals)
+		keys, vals = keys[:0], vals[:0]
+		return werr == nil
+	}
+	err := scanStore(from, func(key, value []byte) bool {
+		src.add(key, value)
+		keys = append(keys, bcopy(key))
+		vals = append(vals, bcopy(value))
+		if len(keys) < batch {
+			return true
+		}
+		if !write() {
+			return false
+		}
+		if src.count%(batch*100) == 0 {
+			log.Printf("copied %d keys", src.count)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if werr != nil || !write() {
+		return werr
+	}
+	elapsed := time.Since(start)
+	var dst migrateSum
+	err = scanStore(to, func(key, value []byte) bool {
+		dst.add(key, value)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if dst.count != src.count {
+		return fmt.Errorf("verify failed: copied %d keys, destination has %d",
+			src.count, dst.count)
+	}
+	if dst.sum != src.sum {
+		return errors.New("verify failed: checksum mismatch")
+	}
+	secs := elapsed.Seconds()
+	log.Printf("migrated %d keys (%d bytes) in %s, %.0f keys/sec, %.2f MB/sec",
+		src.count, src.bytes, elapsed, float64(src.count)/secs,
+		float64(src.bytes)/1024/1024/secs)
+	log.Printf("verified count and checksum")
+	return nil
+}
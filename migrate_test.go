@@ -0,0 +1,138 @@
+package kvbench
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dropStore loses the last key of every PSet.
+type dropStore struct {
+	Store
+}
+
+func (s dropStore) PSet(keys, values [][]byte) error {
+	return s.Store.PSet(keys[:len(keys)-1], values[:len(values)-1])
+}
+
+// changeStore changes the value of the first key of every PSet.
+type changeStore struct {
+	Store
+}
+
+func (s changeStore) PSet(keys, values [][]byte) error {
+	values[0] = append([]byte("x"), values[0]...)
+	return s.Store.PSet(keys, values)
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyfile, []byte(strings.Repeat("k", 32)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from, to string
+		// fromArgs and toArgs are the extra arguments of the stores
+		fromArgs, toArgs []string
+	}{
+		{"map", "btree", nil, nil},
+		{"btree", "lsm", nil, nil},
+		{"lsm", "bolt", nil, []string{"--to-keyfile=" + keyfile}},
+		{"bolt", "leveldb", []string{"--from-keyfile=" + keyfile}, nil},
+		{"leveldb", "bptree", nil, nil},
+		{"bptree", "bitcask", nil, []string{"--batch=7"}},
+	}
+	want := make(map[string]string)
+	var from string
+	for i, tc := range tests {
+		t.Run(tc.from+"-"+tc.to, func(t *testing.T) {
+			fromPath := filepath.Join(dir, fmt.Sprint(i))
+			toPath := filepath.Join(dir, fmt.Sprint(i+1))
+			if i == 0 {
+				s, err := openStore(tc.from, fromPath, storeOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, step := range testSteps[:4] {
+					if err := step.run(s, want); err != nil {
+						t.Fatal(err)
+					}
+				}
+				s.Close()
+			} else if tc.from != from {
+				t.Fatalf("the source is the destination of %s", from)
+			}
+			args := []string{"--from-store=" + tc.from, "--from-path=" + fromPath,
+				"--to-store=" + tc.to, "--to-path=" + toPath}
+			args = append(append(args, tc.fromArgs...), tc.toArgs...)
+			if err := MigrateCommand(args); err != nil {
+				t.Fatal(err)
+			}
+			var opts storeOptions
+			if len(tc.toArgs) > 0 && strings.HasPrefix(tc.toArgs[0], "--to-keyfile") {
+				crypt, err := loadKeyFile(keyfile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opts.crypt = crypt
+			}
+			s, err := openStore(tc.to, toPath, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStore(t, s, want)
+			s.Close()
+			// the destination isn't empty now
+			if err := MigrateCommand(args); err == nil ||
+				!strings.Contains(err.Error(), "not empty") {
+				t.Fatalf("migrate to a non-empty store: %v", err)
+			}
+		})
+		from = tc.to
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+	err := MigrateCommand([]string{"--from-store=btree", "--from-path=" + missing,
+		"--to-store=btree", "--to-path=" + filepath.Join(dir, "to")})
+	if err == nil {
+		t.Fatal("expected a missing source error")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("the source was created: %v", err)
+	}
+	if err := checkSource("btree", ":memory:"); err == nil {
+		t.Fatal("expected an in-memory source error")
+	}
+	if err := checkSource("remote", ""); err != nil {
+		t.Fatalf("a remote source: %v", err)
+	}
+
+	// the verification catches lost and changed values
+	from, _ := openStore("map", ":memory:", storeOptions{})
+	defer from.Close()
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key:%d", i))
+		from.Set(key, key)
+	}
+	for _, tc := range []struct {
+		wrap func(Store) Store
+		err  string
+	}{
+		{func(s Store) Store { return dropStore{s} }, "copied 10 keys"},
+		{func(s Store) Store { return changeStore{s} }, "checksum mismatch"},
+	} {
+		to, _ := openStore("map", ":memory:", storeOptions{})
+		err := migrate(from, tc.wrap(to), 3)
+		to.Close()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("got %v, expected %q", err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package kvbench
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tidwall/match"
+)
+
+var errRewriteInProgress = errors.New("a log rewrite is already in progress")
+var errPersistenceDisabled = errors.New("persistence is disabled")
+var errClosed = errors.New("store is closed")
+
+// mvccRewriteMinSize is the size the log must reach before it's rewritten
+// in the background. After that it's rewritten every time it doubles.
+const mvccRewriteMinSize = 64 * 1024 * 1024
+
+// mvccStore keeps the data in a copy-on-write btree. Every write publishes
+// a snapshot of the tree, which the readers load without locking, so the
+// readers never wait for the writers and the writers never wait for the
+// readers. Snapshots also allow for rewriting the log in the background.
+type mvccStore struct {
+	mu   sync.Mutex // writers
+	tr   *cowTree
+	snap atomic.Value // *cowTree
+	aof  *AOF
+
+	crypt     *crypter
+	closed    bool
+	rewriting bool
+	tail      [][][]byte // commands written during a rewrite
+	base      int64      // log size after the last rewrite
+	rewrites  int
+}
+
+func newMVCCStore(path string, opts storeOptions) (*mvccStore, error) {
+	s := &mvccStore{tr: newCowTree(), crypt: opts.crypt}
+	if path == ":memory:" {
+		log.Printf("persistance disabled")
+	} else {
+		var err error
+		var stats replayStats
+		s.aof, stats, err = openAOFParallel(path, opts,
+			func(shards []map[string][]byte) {
+				mergeShards(shards, func(key string, value []byte) {
+					s.tr.set(key, value)
+				})
+			})
+		if err != nil {
+			return nil, err
+		}
+		stats.logLoaded()
+		s.base = s.aof.size()
+	}
+	s.publish()
+	return s, nil
+}
+
+// publish makes the current tree visible to the readers and starts a
+// rewrite when the log has grown enough. Must be called while holding the
+// lock.
+func (s *mvccStore) publish() {
+	s.snap.Store(s.tr.copy())
+	if s.aof != nil && !s.rewriting {
+		size := s.aof.size()
+		if size >= mvccRewriteMinSize && size >= s.base*2 {
+			s.bgRewrite()
+		}
+	}
+}
+
+func (s *mvccStore) snapshot() *cowTree {
+	return s.snap.Load().(*cowTree)
+}
+
+// write writes the commands to the log. Must be called while holding the
+// lock.
+func (s *mvccStore) write(cmds ...[][]byte) error {
+	if s.aof == nil {
+		return nil
+	}
+	s.aof.BeginBuffer()
+	for _, args := range cmds {
+		s.aof.AppendBuffer(args...)
+	}
+	if err := s.aof.WriteBuffer(); err != nil {
+		return err
+	}
+	if s.rewriting {
+		for _, args := range cmds {
+			cargs := make([][]byte, len(args))
+			for i := range args {
+				cargs[i] = bcopy(args[i])
+			}
+			s.tail = append(s.tail, cargs)
+		}
+	}
+	return nil
+}
+
+func (s *mvccStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.aof != nil {
+		s.aof.Close()
+	}
+	return nil
+}
+
+func (s *mvccStore) PSet(keys, values [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmds := make([][][]byte, len(keys))
+	for i := range keys {
+		cmds[i] = [][]byte{[]byte("set"), keys[i], values[i]}
+	}
+	if err := s.write(cmds...); err != nil {
+		return err
+	}
+	for i := range keys {
+		s.tr.set(string(keys[i]), bcopy(values[i]))
+	}
+	s.publish()
+	return nil
+}
+
+func (s *mvccStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	tr := s.snapshot()
+	var values [][]byte
+	var oks []bool
+	for i := range keys {
+		v, ok := tr.get(string(keys[i]))
+		values = append(values, v)
+		oks = append(oks, ok)
+	}
+	return values, oks, nil
+}
+
+func (s *mvccStore) Set(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write([][]byte{[]byte("set"), key, value}); err != nil {
+		return err
+	}
+	s.tr.set(string(key), bcopy(value))
+	s.publish()
+	return nil
+}
+
+func (s *mvccStore) Get(key []byte) ([]byte, bool, error) {
+	v, ok := s.snapshot().get(string(key))
+	return v, ok, nil
+}
+
+func (s *mvccStore) Del(key []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tr.get(string(key)); !ok {
+		return false, nil
+	}
+	if err := s.write([][]byte{[]byte("del"), key}); err != nil {
+		return false, err
+	}
+	s.tr.del(string(key))
+	s.publish()
+	return true, nil
+}
+
+func (s *mvccStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keysFrom(nil, pattern, limit, withvalues)
+}
+
+func (s *mvccStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	spattern := string(pattern)
+	min, max := match.Allowable(spattern)
+	var useMax bool
+	var pivot string
+	if !(len(spattern) > 0 && spattern[0] == '*') {
+		pivot = min
+		useMax = true
+	}
+	if string(start) > pivot {
+		pivot = string(start)
+	}
+	var keys [][]byte
+	var vals [][]byte
+	s.snapshot().ascend(pivot, func(item cowItem) bool {
+		if limit > -1 && len(keys) >= limit {
+			return false
+		}
+		if useMax && item.key >= max {
+			return false
+		}
+		if match.Match(item.key, spattern) {
+			keys = append(keys, []byte(item.key))
+			if withvalues {
+				vals = append(vals, bcopy(item.value))
+			}
+		}
+		return true
+	})
+	return keys, vals, nil
+}
+
+func (s *mvccStore) FlushDB() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write([][]byte{[]byte("flushdb")}); err != nil {
+		return err
+	}
+	s.tr = newCowTree()
+	s.publish()
+	return nil
+}
+
+func (s *mvccStore) scan(iter func(key, value []byte) bool) error {
+	s.snapshot().ascend("", func(item cowItem) bool {
+		return iter([]byte(item.key), item.value)
+	})
+	return nil
+}
+
+// beginRewrite starts a rewrite of the log from a snapshot. The commands
+// that are written until the rewrite finishes are kept in the tail. Must be
+// called while holding the lock.
+func (s *mvccStore) beginRewrite(crypt *crypter) (*aofRewrite, *cowTree, error) {
+	if s.rewriting {
+		return nil, nil, errRewriteInProgress
+	}
+	rw, err := s.aof.beginRewrite(crypt)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.rewriting = true
+	return rw, s.tr.copy(), nil
+}
+
+// finishRewrite writes the snapshot to the new log without holding the lock,
+// then appends the tail and replaces the log.
+func (s *mvccStore) finishRewrite(rw *aofRewrite, tr *cowTree) error {
+	var err error
+	tr.ascend("", func(item cowItem) bool {
+		err = rw.emit([]byte("set"), []byte(item.key), item.value)
+		return err == nil
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tail := s.tail
+	s.tail = nil
+	s.rewriting = false
+	if err == nil && s.closed {
+		err = errClosed
+	}
+	for i := 0; err == nil && i < len(tail); i++ {
+		err = rw.emit(tail[i]...)
+	}
+	if err != nil {
+		rw.abort()
+		return err
+	}
+	if err := s.aof.finishRewrite(rw); err != nil {
+		return err
+	}
+	s.base = s.aof.size()
+	s.rewrites++
+	return nil
+}
+
+// bgRewrite rewrites the log in the background. Must be called while
+// holding the lock.
+func (s *mvccStore) bgRewrite() error {
+	rw, tr, err := s.beginRewrite(s.crypt)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.finishRewrite(rw, tr); err != nil && err != errClosed {
+			log.Warningf("log rewrite: %v", err)
+		}
+	}()
+	return nil
+}
+
+// rewriteAOF starts a background rewrite of the log.
+func (s *mvccStore) rewriteAOF() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aof == nil {
+		return errPersistenceDisabled
+	}
+	return s.bgRewrite()
+}
+
+func (s *mvccStore) rotateKey(crypt *crypter) error {
+	s.mu.Lock()
+	if s.aof == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	rw, tr, err := s.beginRewrite(crypt)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := s.finishRewrite(rw, tr); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.crypt = crypt
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *mvccStore) info(buf []byte) []byte {
+	tr := s.snapshot()
+	s.mu.Lock()
+	rewriting, rewrites := s.rewriting, s.rewrites
+	var size int64
+	if s.aof != nil {
+		size = s.aof.size()
+	}
+	s.mu.Unlock()
+	buf = append(buf, "# MVCC\r\n"...)
+	buf = append(buf, fmt.Sprintf("keys:%d\r\n", tr.len())...)
+	buf = append(buf, fmt.Sprintf("aof_size:%d\r\n", size)...)
+	buf = append(buf, fmt.Sprintf("aof_rewrite_in_progress:%d\r\n",
+		btoi(rewriting))...)
+	buf = append(buf, fmt.Sprintf("aof_rewrites:%d\r\n", rewrites)...)
+	return buf
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
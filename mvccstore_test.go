@@ -0,0 +1,43 @@
+package kvbench
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMVCCReopen(t *testing.T) {
+	for _, fsync := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "mvcc.db")
+		testReopen(t, "mvcc", path, storeOptions{fsync: fsync})
+	}
+}
+
+func TestMVCCRewriteReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mvcc.db")
+	s, err := openStore("mvcc", path, storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for _, step := range testSteps[:3] {
+		if err := step.run(s, want); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+	if err := s.(rewriter).rewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	// writes after the rewrite go to the new log
+	if err := testSteps[3].run(s, want); err != nil {
+		t.Fatal(err)
+	}
+	checkStore(t, s, want)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openStore("mvcc", path, storeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkStore(t, s, want)
+}
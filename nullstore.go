@@ -0,0 +1,48 @@
+package kvbench
+
+// nullStore accepts every write and returns the same value for every read.
+// It's a baseline for the overhead of the server itself.
+type nullStore struct {
+	value []byte
+}
+
+func newNullStore(opts storeOptions) *nullStore {
+	return &nullStore{value: make([]byte, opts.nullValueSize)}
+}
+
+func (s *nullStore) Close() error {
+	return nil
+}
+
+func (s *nullStore) Set(key, value []byte) error {
+	return nil
+}
+
+func (s *nullStore) PSet(keys, values [][]byte) error {
+	return nil
+}
+
+func (s *nullStore) Get(key []byte) ([]byte, bool, error) {
+	return s.value, true, nil
+}
+
+func (s *nullStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	values := make([][]byte, len(keys))
+	oks := make([]bool, len(keys))
+	for i := range keys {
+		values[i], oks[i] = s.value, true
+	}
+	return values, oks, nil
+}
+
+func (s *nullStore) Del(key []byte) (bool, error) {
+	return true, nil
+}
+
+func (s *nullStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return nil, nil, nil
+}
+
+func (s *nullStore) FlushDB() error {
+	return nil
+}
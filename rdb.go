@@ -0,0 +1,903 @@
+package kvbench
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+var errInvalidRDB = errors.New("invalid rdb")
+var errRDBChecksum = errors.New("rdb checksum mismatch")
+
+// rdbVersion is the version of the written files, which is loadable by
+// Redis 5.0 and later.
+const rdbVersion = 9
+
+// Opcodes and value types of the RDB format.
+const (
+	rdbOpFunction2    = 0xF6
+	rdbOpModuleAux    = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpFreq         = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireMs     = 0xFC
+	rdbOpExpire       = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+	rdbTypeString     = 0
+	rdbTypeList       = 1
+	rdbTypeSet        = 2
+	rdbTypeZSet       = 3
+	rdbTypeHash       = 4
+	rdbTypeZSet2      = 5
+	rdbTypeHashZM     = 9
+	rdbTypeListZL     = 10
+	rdbTypeSetIS      = 11
+	rdbTypeZSetZL     = 12
+	rdbTypeHashZL     = 13
+	rdbTypeListQL     = 14
+	rdbTypeHashLP     = 16
+	rdbTypeZSetLP     = 17
+	rdbTypeListQL2    = 18
+	rdbTypeSetLP      = 20
+	rdbEncInt8        = 0
+	rdbEncInt16       = 1
+	rdbEncInt32       = 2
+	rdbEncLZF         = 3
+	rdbQuicklistPlain = 1
+)
+
+// rdbEntry is a key and its value. The typ is one of the logical types
+// rdbTypeString, rdbTypeList, rdbTypeSet, rdbTypeZSet or rdbTypeHash,
+// regardless of how the value was encoded in the file.
+type rdbEntry struct {
+	db      int
+	expires int64 // unix time in milliseconds, zero for none
+	typ     byte
+	key     []byte
+	value   []byte    // string
+	elems   [][]byte  // list and set members, zset members, hash fields/values
+	scores  []float64 // zset scores
+}
+
+func rdbTypeName(typ byte) string {
+	switch typ {
+	case rdbTypeString:
+		return "string"
+	case rdbTypeList:
+		return "list"
+	case rdbTypeSet:
+		return "set"
+	case rdbTypeZSet:
+		return "zset"
+	case rdbTypeHash:
+		return "hash"
+	}
+	return "unknown"
+}
+
+// crc64Table is for the Jones polynomial, which Redis uses for the RDB
+// checksum. Unlike hash/crc64 there is no inversion of the input and output.
+var crc64Table = func() *[256]uint64 {
+	var t [256]uint64
+	const poly = 0x95AC9329AC4BC9B5 // reflected 0xAD93D23594C935A9
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return &t
+}()
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+type rdbReader struct {
+	rd  *bufio.Reader
+	crc uint64
+	buf [8]byte
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	b, err := r.rd.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	r.buf[0] = b
+	r.crc = crc64Update(r.crc, r.buf[:1])
+	return b, nil
+}
+
+func (r *rdbReader) readFull(p []byte) error {
+	if _, err := io.ReadFull(r.rd, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.crc = crc64Update(r.crc, p)
+	return nil
+}
+
+// readLength reads a length. When encoded is true the length is a special
+// string encoding instead.
+func (r *rdbReader) readLength() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		b2, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(b2), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			if err := r.readFull(r.buf[:4]); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(r.buf[:4])), false, nil
+		case 0x81:
+			if err := r.readFull(r.buf[:8]); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(r.buf[:8]), false, nil
+		}
+		return 0, false, errInvalidRDB
+	}
+	return uint64(b & 0x3F), true, nil
+}
+
+func (r *rdbReader) readLen() (int, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n > math.MaxInt32 {
+		return 0, errInvalidRDB
+	}
+	return int(n), nil
+}
+
+func (r *rdbReader) readString() ([]byte, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if encoded {
+		switch n {
+		case rdbEncInt8:
+			if err := r.readFull(r.buf[:1]); err != nil {
+				return nil, err
+			}
+			return strconv.AppendInt(nil, int64(int8(r.buf[0])), 10), nil
+		case rdbEncInt16:
+			if err := r.readFull(r.buf[:2]); err != nil {
+				return nil, err
+			}
+			v := int16(binary.LittleEndian.Uint16(r.buf[:2]))
+			return strconv.AppendInt(nil, int64(v), 10), nil
+		case rdbEncInt32:
+			if err := r.readFull(r.buf[:4]); err != nil {
+				return nil, err
+			}
+			v := int32(binary.LittleEndian.Uint32(r.buf[:4]))
+			return strconv.AppendInt(nil, int64(v), 10), nil
+		case rdbEncLZF:
+			clen, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			ulen, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			data := make([]byte, clen)
+			if err := r.readFull(data); err != nil {
+				return nil, err
+			}
+			return lzfDecompress(data, ulen)
+		}
+		return nil, errInvalidRDB
+	}
+	if n > math.MaxInt32 {
+		return nil, errInvalidRDB
+	}
+	data := make([]byte, int(n))
+	if err := r.readFull(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readDouble reads a zset score that's stored as a string.
+func (r *rdbReader) readDouble() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	data := make([]byte, n)
+	if err := r.readFull(data); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(data), 64)
+}
+
+func (r *rdbReader) readBinaryDouble() (float64, error) {
+	if err := r.readFull(r.buf[:8]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.buf[:8])), nil
+}
+
+// readValue reads a value of the provided type into the entry.
+func (r *rdbReader) readValue(typ byte, e *rdbEntry) error {
+	var err error
+	switch typ {
+	case rdbTypeString:
+		e.typ = rdbTypeString
+		e.value, err = r.readString()
+		return err
+	case rdbTypeList, rdbTypeSet, rdbTypeHash:
+		e.typ = typ
+		n, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		if typ == rdbTypeHash {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			elem, err := r.readString()
+			if err != nil {
+				return err
+			}
+			e.elems = append(e.elems, elem)
+		}
+		return nil
+	case rdbTypeZSet, rdbTypeZSet2:
+		e.typ = rdbTypeZSet
+		n, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			member, err := r.readString()
+			if err != nil {
+				return err
+			}
+			var score float64
+			if typ == rdbTypeZSet {
+				score, err = r.readDouble()
+			} else {
+				score, err = r.readBinaryDouble()
+			}
+			if err != nil {
+				return err
+			}
+			e.elems = append(e.elems, member)
+			e.scores = append(e.scores, score)
+		}
+		return nil
+	case rdbTypeListQL, rdbTypeListQL2:
+		e.typ = rdbTypeList
+		n, err := r.readLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			container := uint64(0)
+			if typ == rdbTypeListQL2 {
+				if container, _, err = r.readLength(); err != nil {
+					return err
+				}
+			}
+			data, err := r.readString()
+			if err != nil {
+				return err
+			}
+			if container == rdbQuicklistPlain {
+				e.elems = append(e.elems, data)
+				continue
+			}
+			var elems [][]byte
+			if typ == rdbTypeListQL {
+				elems, err = parseZiplist(data)
+			} else {
+				elems, err = parseListpack(data)
+			}
+			if err != nil {
+				return err
+			}
+			e.elems = append(e.elems, elems...)
+		}
+		return nil
+	case rdbTypeHashZM, rdbTypeListZL, rdbTypeSetIS, rdbTypeZSetZL,
+		rdbTypeHashZL, rdbTypeHashLP, rdbTypeZSetLP, rdbTypeSetLP:
+		data, err := r.readString()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case rdbTypeHashZM:
+			e.typ = rdbTypeHash
+			e.elems, err = parseZipmap(data)
+		case rdbTypeListZL:
+			e.typ = rdbTypeList
+			e.elems, err = parseZiplist(data)
+		case rdbTypeSetIS:
+			e.typ = rdbTypeSet
+			e.elems, err = parseIntset(data)
+		case rdbTypeZSetZL, rdbTypeZSetLP:
+			e.typ = rdbTypeZSet
+			if typ == rdbTypeZSetZL {
+				e.elems, err = parseZiplist(data)
+			} else {
+				e.elems, err = parseListpack(data)
+			}
+			if err == nil {
+				e.elems, e.scores, err = splitScores(e.elems)
+			}
+		case rdbTypeHashZL:
+			e.typ = rdbTypeHash
+			e.elems, err = parseZiplist(data)
+		case rdbTypeHashLP:
+			e.typ = rdbTypeHash
+			e.elems, err = parseListpack(data)
+		case rdbTypeSetLP:
+			e.typ = rdbTypeSet
+			e.elems, err = parseListpack(data)
+		}
+		if err == nil && e.typ == rdbTypeHash && len(e.elems)%2 != 0 {
+			err = errInvalidRDB
+		}
+		return err
+	}
+	return fmt.Errorf("unsupported rdb value type: %d", typ)
+}
+
+// splitScores splits alternating members and scores.
+func splitScores(elems [][]byte) ([][]byte, []float64, error) {
+	if len(elems)%2 != 0 {
+		return nil, nil, errInvalidRDB
+	}
+	members := make([][]byte, 0, len(elems)/2)
+	scores := make([]float64, 0, len(elems)/2)
+	for i := 0; i < len(elems); i += 2 {
+		score, err := strconv.ParseFloat(string(elems[i+1]), 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		members = append(members, elems[i])
+		scores = append(scores, score)
+	}
+	return members, scores, nil
+}
+
+// readRDB reads every entry in an RDB file. The entry is only valid until
+// the fn returns.
+func readRDB(rd io.Reader, fn func(e *rdbEntry) error) error {
+	r := &rdbReader{rd: bufio.NewReader(rd)}
+	var magic [9]byte
+	if err := r.readFull(magic[:]); err != nil {
+		return err
+	}
+	if string(magic[:5]) != "REDIS" {
+		return errInvalidRDB
+	}
+	version, err := strconv.ParseUint(string(magic[5:]), 10, 64)
+	if err != nil {
+		return errInvalidRDB
+	}
+	var e rdbEntry
+	var db int
+	var expires int64
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case rdbOpEOF:
+			if version < 5 {
+				return nil
+			}
+			crc := r.crc
+			if err := r.readFull(r.buf[:8]); err != nil {
+				return err
+			}
+			sum := binary.LittleEndian.Uint64(r.buf[:8])
+			if sum != 0 && sum != crc {
+				return errRDBChecksum
+			}
+			return nil
+		case rdbOpSelectDB:
+			if db, err = r.readLen(); err != nil {
+				return err
+			}
+		case rdbOpExpire:
+			if err := r.readFull(r.buf[:4]); err != nil {
+				return err
+			}
+			expires = int64(binary.LittleEndian.Uint32(r.buf[:4])) * 1000
+		case rdbOpExpireMs:
+			if err := r.readFull(r.buf[:8]); err != nil {
+				return err
+			}
+			expires = int64(binary.LittleEndian.Uint64(r.buf[:8]))
+		case rdbOpResizeDB:
+			if _, err := r.readLen(); err != nil {
+				return err
+			}
+			if _, err := r.readLen(); err != nil {
+				return err
+			}
+		case rdbOpAux:
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+		case rdbOpFreq:
+			if _, err := r.readByte(); err != nil {
+				return err
+			}
+		case rdbOpIdle:
+			if _, _, err := r.readLength(); err != nil {
+				return err
+			}
+		case rdbOpFunction2:
+			if _, err := r.readString(); err != nil {
+				return err
+			}
+		case rdbOpModuleAux:
+			return errors.New("unsupported rdb module data")
+		default:
+			e = rdbEntry{db: db, expires: expires, elems: e.elems[:0],
+				scores: e.scores[:0]}
+			if e.key, err = r.readString(); err != nil {
+				return err
+			}
+			if err := r.readValue(op, &e); err != nil {
+				return err
+			}
+			if err := fn(&e); err != nil {
+				return err
+			}
+			expires = 0
+		}
+	}
+}
+
+// lzfDecompress decompresses LZF data, which Redis uses for compressing
+// strings.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// literal run
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, errInvalidRDB
+			}
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+		// back reference
+		n := ctrl >> 5
+		ref := len(out) - (ctrl&0x1F)<<8 - 1
+		if n == 7 {
+			if i >= len(in) {
+				return nil, errInvalidRDB
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errInvalidRDB
+		}
+		ref -= int(in[i])
+		i++
+		n += 2
+		if ref < 0 {
+			return nil, errInvalidRDB
+		}
+		for j := 0; j < n; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errInvalidRDB
+	}
+	return out, nil
+}
+
+func parseZiplist(b []byte) ([][]byte, error) {
+	var elems [][]byte
+	i := 10
+	for {
+		if i >= len(b) {
+			return nil, errInvalidRDB
+		}
+		if b[i] == 0xFF {
+			return elems, nil
+		}
+		if b[i] < 254 {
+			i++
+		} else {
+			i += 5
+		}
+		if i >= len(b) {
+			return nil, errInvalidRDB
+		}
+		enc := b[i]
+		var size, n int
+		var v int64
+		var isInt bool
+		switch {
+		case enc>>6 == 0:
+			size, n = 1, int(enc&0x3F)
+		case enc>>6 == 1:
+			if i+2 > len(b) {
+				return nil, errInvalidRDB
+			}
+			size, n = 2, int(enc&0x3F)<<8|int(b[i+1])
+		case enc>>6 == 2:
+			if i+5 > len(b) {
+				return nil, errInvalidRDB
+			}
+			size, n = 5, int(binary.BigEndian.Uint32(b[i+1:]))
+		default:
+			isInt = true
+			switch enc {
+			case 0xC0:
+				size = 3
+			case 0xD0:
+				size = 5
+			case 0xE0:
+				size = 9
+			case 0xF0:
+				size = 4
+			case 0xFE:
+				size = 2
+			default:
+				if enc>>4 != 0xF || enc&0x0F < 1 || enc&0x0F > 13 {
+					return nil, errInvalidRDB
+				}
+				size, v = 1, int64(enc&0x0F)-1
+			}
+			if i+size > len(b) {
+				return nil, errInvalidRDB
+			}
+			p := b[i+1 : i+size]
+			switch enc {
+			case 0xC0:
+				v = int64(int16(binary.LittleEndian.Uint16(p)))
+			case 0xD0:
+				v = int64(int32(binary.LittleEndian.Uint32(p)))
+			case 0xE0:
+				v = int64(binary.LittleEndian.Uint64(p))
+			case 0xF0:
+				v = int64(int32(uint32(p[0])<<8|uint32(p[1])<<16|
+					uint32(p[2])<<24) >> 8)
+			case 0xFE:
+				v = int64(int8(p[0]))
+			}
+		}
+		i += size
+		if isInt {
+			elems = append(elems, strconv.AppendInt(nil, v, 10))
+			continue
+		}
+		if i+n > len(b) {
+			return nil, errInvalidRDB
+		}
+		elems = append(elems, b[i:i+n])
+		i += n
+	}
+}
+
+// listpackBacklen returns the number of bytes used for the back length of
+// a listpack entry with the provided size.
+func listpackBacklen(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+func parseListpack(b []byte) ([][]byte, error) {
+	var elems [][]byte
+	i := 6
+	for {
+		if i >= len(b) {
+			return nil, errInvalidRDB
+		}
+		enc := b[i]
+		if enc == 0xFF {
+			return elems, nil
+		}
+		var size, hdr, n int
+		var v int64
+		var isInt bool
+		switch {
+		case enc&0x80 == 0:
+			isInt, size, v = true, 1, int64(enc&0x7F)
+		case enc&0xC0 == 0x80:
+			hdr, n = 1, int(enc&0x3F)
+		case enc&0xE0 == 0xC0:
+			if i+2 > len(b) {
+				return nil, errInvalidRDB
+			}
+			isInt, size = true, 2
+			v = int64(enc&0x1F)<<8 | int64(b[i+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+		case enc&0xF0 == 0xE0:
+			if i+2 > len(b) {
+				return nil, errInvalidRDB
+			}
+			hdr, n = 2, int(enc&0x0F)<<8|int(b[i+1])
+		case enc == 0xF0:
+			if i+5 > len(b) {
+				return nil, errInvalidRDB
+			}
+			hdr, n = 5, int(binary.LittleEndian.Uint32(b[i+1:]))
+		case enc >= 0xF1 && enc <= 0xF4:
+			isInt = true
+			size = [...]int{3, 4, 5, 9}[enc-0xF1]
+			if i+size > len(b) {
+				return nil, errInvalidRDB
+			}
+			p := b[i+1 : i+size]
+			switch enc {
+			case 0xF1:
+				v = int64(int16(binary.LittleEndian.Uint16(p)))
+			case 0xF2:
+				v = int64(int32(uint32(p[0])<<8|uint32(p[1])<<16|
+					uint32(p[2])<<24) >> 8)
+			case 0xF3:
+				v = int64(int32(binary.LittleEndian.Uint32(p)))
+			case 0xF4:
+				v = int64(binary.LittleEndian.Uint64(p))
+			}
+		default:
+			return nil, errInvalidRDB
+		}
+		if isInt {
+			elems = append(elems, strconv.AppendInt(nil, v, 10))
+		} else {
+			if i+hdr+n > len(b) {
+				return nil, errInvalidRDB
+			}
+			elems = append(elems, b[i+hdr:i+hdr+n])
+			size = hdr + n
+		}
+		i += size + listpackBacklen(size)
+	}
+}
+
+func parseIntset(b []byte) ([][]byte, error) {
+	if len(b) < 8 {
+		return nil, errInvalidRDB
+	}
+	enc := int(binary.LittleEndian.Uint32(b[0:]))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if (enc != 2 && enc != 4 && enc != 8) || 8+n*enc > len(b) {
+		return nil, errInvalidRDB
+	}
+	elems := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		p := b[8+i*enc:]
+		var v int64
+		switch enc {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		elems[i] = strconv.AppendInt(nil, v, 10)
+	}
+	return elems, nil
+}
+
+func parseZipmap(b []byte) ([][]byte, error) {
+	var elems [][]byte
+	i := 1
+	readLen := func() (int, bool) {
+		if i >= len(b) || b[i] == 255 {
+			return 0, false
+		}
+		if b[i] < 254 {
+			i++
+			return int(b[i-1]), true
+		}
+		if i+5 > len(b) {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(b[i+1:]))
+		i += 5
+		return n, true
+	}
+	for {
+		if i >= len(b) {
+			return nil, errInvalidRDB
+		}
+		if b[i] == 255 {
+			return elems, nil
+		}
+		n, ok := readLen()
+		if !ok || i+n > len(b) {
+			return nil, errInvalidRDB
+		}
+		elems = append(elems, b[i:i+n])
+		i += n
+		n, ok = readLen()
+		if !ok || i+1+n > len(b) {
+			return nil, errInvalidRDB
+		}
+		free := int(b[i])
+		i++
+		elems = append(elems, b[i:i+n])
+		i += n + free
+	}
+}
+
+// rdbWriter writes an RDB file. Values are always written using the plain
+// encodings, which every version of Redis can load.
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	buf []byte
+	err error
+}
+
+func newRDBWriter(w io.Writer) *rdbWriter {
+	wr := &rdbWriter{w: bufio.NewWriter(w)}
+	wr.buf = append(wr.buf, fmt.Sprintf("REDIS%04d", rdbVersion)...)
+	wr.appendAux("redis-bits", "64")
+	wr.appendAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	wr.buf = append(wr.buf, rdbOpSelectDB)
+	wr.appendLength(0)
+	return wr
+}
+
+func (w *rdbWriter) appendLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.buf = append(w.buf, byte(n))
+	case n < 1<<14:
+		w.buf = append(w.buf, byte(n>>8)|0x40, byte(n))
+	case n <= math.MaxUint32:
+		w.buf = append(w.buf, 0x80, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(w.buf[len(w.buf)-4:], uint32(n))
+	default:
+		w.buf = append(w.buf, 0x81, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(w.buf[len(w.buf)-8:], n)
+	}
+}
+
+func (w *rdbWriter) appendString(s []byte) {
+	w.appendLength(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *rdbWriter) appendAux(key, value string) {
+	w.buf = append(w.buf, rdbOpAux)
+	w.appendString([]byte(key))
+	w.appendString([]byte(value))
+}
+
+func (w *rdbWriter) flush() error {
+	if w.err == nil {
+		w.crc = crc64Update(w.crc, w.buf)
+		_, w.err = w.w.Write(w.buf)
+	}
+	w.buf = w.buf[:0]
+	return w.err
+}
+
+// writeEntry writes a key and value.
+func (w *rdbWriter) writeEntry(e *rdbEntry) error {
+	if e.expires > 0 {
+		w.buf = append(w.buf, rdbOpExpireMs, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(w.buf[len(w.buf)-8:],
+			uint64(e.expires))
+	}
+	switch e.typ {
+	case rdbTypeString:
+		w.buf = append(w.buf, rdbTypeString)
+		w.appendString(e.key)
+		w.appendString(e.value)
+	case rdbTypeList, rdbTypeSet, rdbTypeHash:
+		if e.typ == rdbTypeHash && len(e.elems)%2 != 0 {
+			return errors.New("hash must have an even number of elements")
+		}
+		w.buf = append(w.buf, e.typ)
+		w.appendString(e.key)
+		n := len(e.elems)
+		if e.typ == rdbTypeHash {
+			n /= 2
+		}
+		w.appendLength(uint64(n))
+		for _, elem := range e.elems {
+			w.appendString(elem)
+		}
+	case rdbTypeZSet:
+		if len(e.elems) != len(e.scores) {
+			return errors.New("zset must have a score for each member")
+		}
+		w.buf = append(w.buf, rdbTypeZSet2)
+		w.appendString(e.key)
+		w.appendLength(uint64(len(e.elems)))
+		for i, member := range e.elems {
+			w.appendString(member)
+			w.buf = append(w.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint64(w.buf[len(w.buf)-8:],
+				math.Float64bits(e.scores[i]))
+		}
+	default:
+		return fmt.Errorf("unsupported rdb value type: %d", e.typ)
+	}
+	return w.flush()
+}
+
+// close writes the end of the file and the checksum.
+func (w *rdbWriter) close() error {
+	w.buf = append(w.buf, rdbOpEOF)
+	if err := w.flush(); err != nil {
+		return err
+	}
+	var sum [8]byte
+	binary.LittleEndian.PutUint64(sum[:], w.crc)
+	if _, err := w.w.Write(sum[:]); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
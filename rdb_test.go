@@ -0,0 +1,178 @@
+package kvbench
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCRC64(t *testing.T) {
+	tests := []struct {
+		data string
+		crc  uint64
+	}{
+		{"", 0},
+		// the test vector of Redis
+		{"123456789", 0xe9c6d914c4b8d9ca},
+	}
+	for _, tc := range tests {
+		if crc := crc64Update(0, []byte(tc.data)); crc != tc.crc {
+			t.Fatalf("crc64(%q) = %x, expected %x", tc.data, crc, tc.crc)
+		}
+		// incrementally
+		var crc uint64
+		for i := 0; i < len(tc.data); i++ {
+			crc = crc64Update(crc, []byte(tc.data[i:i+1]))
+		}
+		if crc != tc.crc {
+			t.Fatalf("incremental crc64(%q) = %x", tc.data, crc)
+		}
+	}
+}
+
+// rdbEntryString formats an entry for comparisons.
+func rdbEntryString(e *rdbEntry) string {
+	return fmt.Sprintf("%d %d %s %q %q %q %v", e.db, e.expires,
+		rdbTypeName(e.typ), e.key, e.value, e.elems, e.scores)
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	entries := []rdbEntry{
+		{typ: rdbTypeString, key: []byte("string"), value: []byte("value")},
+		{typ: rdbTypeString, key: []byte("empty"), value: []byte{}},
+		{typ: rdbTypeString, key: []byte("large"),
+			value: bytes.Repeat([]byte("0123456789"), 2000)},
+		{typ: rdbTypeString, key: []byte("expires"), value: []byte("v"),
+			expires: 1700000000000},
+		{typ: rdbTypeList, key: []byte("list"),
+			elems: [][]byte{[]byte("a"), []byte("b"), []byte("a")}},
+		{typ: rdbTypeSet, key: []byte("set"),
+			elems: [][]byte{[]byte("x"), []byte("y")}},
+		{typ: rdbTypeHash, key: []byte("hash"),
+			elems: [][]byte{[]byte("f1"), []byte("v1"), []byte("f2"), []byte("v2")}},
+		{typ: rdbTypeZSet, key: []byte("zset"),
+			elems: [][]byte{[]byte("m1"), []byte("m2")}, scores: []float64{1.5, -2}},
+	}
+	var buf bytes.Buffer
+	w := newRDBWriter(&buf)
+	for i := range entries {
+		if err := w.writeEntry(&entries[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var got, want []string
+	err := readRDB(bytes.NewReader(data), func(e *rdbEntry) error {
+		got = append(got, rdbEntryString(e))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range entries {
+		want = append(want, rdbEntryString(&entries[i]))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q\nexpected %q", got, want)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"checksum", func() []byte {
+			b := append([]byte(nil), data...)
+			b[len(b)-1] ^= 1
+			return b
+		}(), errRDBChecksum},
+		{"magic", append([]byte("RADIS"), data[5:]...), errInvalidRDB},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := readRDB(bytes.NewReader(tc.data), func(*rdbEntry) error {
+				return nil
+			})
+			if err != tc.err {
+				t.Fatalf("got %v, expected %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSaveRDB(t *testing.T) {
+	store, err := openStore("map", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key, value := fmt.Sprintf("key:%d", i), fmt.Sprintf("value:%d", i)
+		store.Set([]byte(key), []byte(value))
+		want[key] = value
+	}
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	n, err := saveRDB(osFS{}, store, path)
+	if err != nil || n != len(want) {
+		t.Fatalf("saveRDB: %d %v", n, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := make(map[string]string)
+	err = readRDB(f, func(e *rdbEntry) error {
+		if e.typ != rdbTypeString {
+			return fmt.Errorf("type %v", rdbTypeName(e.typ))
+		}
+		got[string(e.key)] = string(e.value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %d keys, expected %d", len(got), len(want))
+	}
+}
+
+func TestSaveRDBCrash(t *testing.T) {
+	fs := newMemFS()
+	for _, n := range []int{10, 20} {
+		store, err := openStore("map", ":memory:", storeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			store.Set([]byte(fmt.Sprintf("key:%d", i)), []byte("value"))
+		}
+		_, err = saveRDB(fs, store, "dump.rdb")
+		store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the file that replaced the first one is durable
+	fs.crash()
+	data, err := vfsReadFile(fs, "dump.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = readRDB(bytes.NewReader(data), func(e *rdbEntry) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 20 {
+		t.Fatalf("got %d keys: %v", n, err)
+	}
+}
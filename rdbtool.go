@@ -0,0 +1,169 @@
+package kvbench
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ImportRDBCommand runs the "import-rdb" subcommand, which loads a Redis RDB
+// file into a store. Only string values can be stored, keys of other types
+// are skipped. Expired keys are skipped and the expiry of other keys is
+// dropped.
+func ImportRDBCommand(args []string) error {
+	fs := flag.NewFlagSet("import-rdb", flag.ContinueOnError)
+	which := fs.String("store", "map", "store type")
+	path := fs.String("path", "", "database path")
+	keyFile := fs.String("keyfile", "", "key file for an encrypted store")
+	fsync := fs.Bool("fsync", true, "fsync")
+	batch := fs.Int("batch", 1000, "number of keys per write")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *batch < 1 {
+		return errors.New("usage: kvbench import-rdb [options] dump.rdb")
+	}
+	var crypt *crypter
+	if *keyFile != "" {
+		var err error
+		if crypt, err = loadKeyFile(*keyFile); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	store, err := openStore(*which, *path, storeOptions{
+		fsync: *fsync,
+		crypt: crypt,
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	start := time.Now()
+	now := start.UnixNano() / int64(time.Millisecond)
+	var loaded, expired, volatile int
+	skipped := make(map[string]int)
+	var keys, vals [][]byte
+	err = readRDB(f, func(e *rdbEntry) error {
+		if e.expires > 0 && e.expires <= now {
+			expired++
+			return nil
+		}
+		if e.typ != rdbTypeString {
+			skipped[rdbTypeName(e.typ)]++
+			return nil
+		}
+		if e.expires > 0 {
+			volatile++
+		}
+		keys = append(keys, e.key)
+		vals = append(vals, e.value)
+		loaded++
+		if len(keys) < *batch {
+			return nil
+		}
+		err := store.PSet(keys, vals)
+		keys, vals = keys[:0], vals[:0]
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		if err := store.PSet(keys, vals); err != nil {
+			return err
+		}
+	}
+	log.Printf("imported %d keys in %s", loaded, time.Since(start))
+	if expired > 0 {
+		log.Printf("skipped %d expired keys", expired)
+	}
+	if volatile > 0 {
+		log.Printf("dropped the expiry of %d keys", volatile)
+	}
+	for typ, n := range skipped {
+		log.Warningf("skipped %d %s keys", n, typ)
+	}
+	return nil
+}
+
+// ExportRDBCommand runs the "export-rdb" subcommand, which writes every
+// key/value of a store to a Redis RDB file.
+func ExportRDBCommand(args []string) error {
+	fs := flag.NewFlagSet("export-rdb", flag.ContinueOnError)
+	which := fs.String("store", "map", "store type")
+	path := fs.String("path", "", "database path")
+	keyFile := fs.String("keyfile", "", "key file for an encrypted store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: kvbench export-rdb [options] dump.rdb")
+	}
+	var crypt *crypter
+	if *keyFile != "" {
+		var err error
+		if crypt, err = loadKeyFile(*keyFile); err != nil {
+			return err
+		}
+	}
+	store, err := openStore(*which, *path, storeOptions{crypt: crypt})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	start := time.Now()
+	n, err := saveRDB(osFS{}, store, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d keys in %s", n, time.Since(start))
+	return nil
+}
+
+// saveRDB writes every key/value in the store to an RDB file at path.
+// The file is replaced atomically.
+func saveRDB(fs vfs, store Store, path string) (int, error) {
+	tmppath := path + ".tmp"
+	f, err := vfsCreate(fs, tmppath)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = func() error {
+		w := newRDBWriter(f)
+		e := rdbEntry{typ: rdbTypeString}
+		var werr error
+		err := scanStore(store, func(key, value []byte) bool {
+			e.key, e.value = key, value
+			werr = w.writeEntry(&e)
+			n++
+			return werr == nil
+		})
+		if err != nil {
+			return err
+		}
+		if werr != nil {
+			return werr
+		}
+		if err := w.close(); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	f.Close()
+	if err == nil {
+		err = fs.Rename(tmppath, path)
+	}
+	if err != nil {
+		fs.Remove(tmppath)
+		return 0, err
+	}
+	return n, fs.SyncDir(filepath.Dir(path))
+}
@@ -0,0 +1,398 @@
+package kvbench
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var errInvalidReply = errors.New("invalid reply from the upstream server")
+var errRemoteBusy = errors.New("timeout waiting for an upstream connection")
+
+// remoteError is an error reply of the upstream server. The connection can
+// still be used after one.
+type remoteError string
+
+func (err remoteError) Error() string {
+	return string(err)
+}
+
+// respReply is a reply of the upstream server. Errors are returned as a
+// remoteError instead.
+type respReply struct {
+	kind  byte // '+', ':', '$' or '*'
+	str   []byte
+	n     int64
+	array []respReply
+	null  bool
+}
+
+func readReplyLine(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errInvalidReply
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply. A remoteError is returned after the whole reply
+// is read, so that the next reply of a pipeline can be read.
+func readReply(rd *bufio.Reader) (respReply, error) {
+	line, err := readReplyLine(rd)
+	if err != nil {
+		return respReply{}, err
+	}
+	if len(line) == 0 {
+		return respReply{}, errInvalidReply
+	}
+	r := respReply{kind: line[0]}
+	switch line[0] {
+	case '-':
+		return r, remoteError(line[1:])
+	case '+':
+		r.str = append([]byte(nil), line[1:]...)
+		return r, nil
+	}
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil {
+		return respReply{}, errInvalidReply
+	}
+	switch line[0] {
+	case ':':
+		r.n = n
+	case '$':
+		if n < 0 {
+			r.null = true
+			break
+		}
+		r.str = make([]byte, n+2)
+		if _, err := io.ReadFull(rd, r.str); err != nil {
+			return respReply{}, err
+		}
+		if r.str[n] != '\r' || r.str[n+1] != '\n' {
+			return respReply{}, errInvalidReply
+		}
+		r.str = r.str[:n]
+	case '*':
+		if n < 0 {
+			r.null = true
+			break
+		}
+		var rerr error
+		for i := int64(0); i < n; i++ {
+			e, err := readReply(rd)
+			if err != nil {
+				if _, ok := err.(remoteError); !ok {
+					return respReply{}, err
+				}
+				rerr = err
+			}
+			r.array = append(r.array, e)
+		}
+		return r, rerr
+	default:
+		return respReply{}, errInvalidReply
+	}
+	return r, nil
+}
+
+type remoteConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+	buf  []byte
+}
+
+// remoteStore proxies to an upstream RESP server, such as Redis or another
+// kvbench. The PSet and PGet commands are pipelined.
+type remoteStore struct {
+	addr    string
+	timeout time.Duration
+	idle    chan *remoteConn
+	// sem holds a slot for every open connection, which limits the
+	// connections to the pool size.
+	sem    chan struct{}
+	closed int32
+	// useKeys is set when KEYS is used instead of SCAN, which is also the
+	// case when the upstream server doesn't know SCAN.
+	useKeys int32
+}
+
+func newRemoteStore(addr string, opts storeOptions) (*remoteStore, error) {
+	if addr == ":memory:" {
+		return nil, errMemoryNotAllowed
+	}
+	s := &remoteStore{addr: addr, timeout: opts.remoteTimeout}
+	if opts.remotePool <= 0 {
+		return nil, fmt.Errorf("invalid remote pool size: %d", opts.remotePool)
+	}
+	s.idle = make(chan *remoteConn, opts.remotePool)
+	s.sem = make(chan struct{}, opts.remotePool)
+	switch opts.remoteKeys {
+	case "", "scan":
+	case "keys":
+		s.useKeys = 1
+	default:
+		return nil, fmt.Errorf("unknown remote keys command: %v", opts.remoteKeys)
+	}
+	if _, err := s.do([]byte("ping")); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// get returns an idle connection or dials a new one. It waits for a
+// connection to be returned when the pool is in use.
+func (s *remoteStore) get() (*remoteConn, error) {
+	if s.timeout > 0 {
+		t := time.NewTimer(s.timeout)
+		defer t.Stop()
+		select {
+		case s.sem <- struct{}{}:
+		case <-t.C:
+			return nil, errRemoteBusy
+		}
+	} else {
+		s.sem <- struct{}{}
+	}
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		<-s.sem
+		return nil, err
+	}
+	return &remoteConn{conn: conn, rd: bufio.NewReader(conn)}, nil
+}
+
+// put returns a connection to the pool, unless the error broke it.
+func (s *remoteStore) put(c *remoteConn, err error) {
+	defer func() { <-s.sem }()
+	if err != nil {
+		if _, ok := err.(remoteError); !ok {
+			c.conn.Close()
+			return
+		}
+	}
+	if atomic.LoadInt32(&s.closed) == 1 {
+		c.conn.Close()
+		return
+	}
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// pipeline sends the commands at once and reads their replies. The first
+// error reply is returned with the replies.
+func (s *remoteStore) pipeline(cmds ...[][]byte) ([]respReply, error) {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return nil, errClosed
+	}
+	c, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	if s.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+	c.buf = c.buf[:0]
+	for _, args := range cmds {
+		c.buf = appendCommand(c.buf, args...)
+	}
+	if _, err := c.conn.Write(c.buf); err != nil {
+		s.put(c, err)
+		return nil, err
+	}
+	replies := make([]respReply, len(cmds))
+	var rerr error
+	for i := range cmds {
+		replies[i], err = readReply(c.rd)
+		if err != nil {
+			if _, ok := err.(remoteError); !ok {
+				s.put(c, err)
+				return nil, err
+			}
+			if rerr == nil {
+				rerr = err
+			}
+		}
+	}
+	s.put(c, nil)
+	return replies, rerr
+}
+
+func (s *remoteStore) do(args ...[]byte) (respReply, error) {
+	replies, err := s.pipeline(args)
+	if err != nil {
+		return respReply{}, err
+	}
+	return replies[0], nil
+}
+
+func (s *remoteStore) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (s *remoteStore) Set(key, value []byte) error {
+	_, err := s.do([]byte("set"), key, value)
+	return err
+}
+
+func (s *remoteStore) PSet(keys, values [][]byte) error {
+	cmds := make([][][]byte, len(keys))
+	for i := range keys {
+		cmds[i] = [][]byte{[]byte("set"), keys[i], values[i]}
+	}
+	_, err := s.pipeline(cmds...)
+	return err
+}
+
+func (s *remoteStore) Get(key []byte) ([]byte, bool, error) {
+	r, err := s.do([]byte("get"), key)
+	if err != nil {
+		return nil, false, err
+	}
+	if r.null {
+		return nil, false, nil
+	}
+	return r.str, true, nil
+}
+
+func (s *remoteStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	cmds := make([][][]byte, len(keys))
+	for i := range keys {
+		cmds[i] = [][]byte{[]byte("get"), keys[i]}
+	}
+	replies, err := s.pipeline(cmds...)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := make([][]byte, len(keys))
+	oks := make([]bool, len(keys))
+	for i, r := range replies {
+		if !r.null {
+			values[i], oks[i] = r.str, true
+		}
+	}
+	return values, oks, nil
+}
+
+func (s *remoteStore) Del(key []byte) (bool, error) {
+	r, err := s.do([]byte("del"), key)
+	if err != nil {
+		return false, err
+	}
+	return r.n > 0, nil
+}
+
+// scanKeys returns the matching keys using SCAN, or KEYS when the upstream
+// server doesn't know SCAN.
+func (s *remoteStore) scanKeys(pattern []byte, limit int) ([][]byte, error) {
+	var keys [][]byte
+	if atomic.LoadInt32(&s.useKeys) == 0 {
+		seen := make(map[string]bool)
+		cursor := []byte("0")
+		for {
+			r, err := s.do([]byte("scan"), cursor, []byte("match"), pattern,
+				[]byte("count"), []byte("1000"))
+			if err != nil {
+				if _, ok := err.(remoteError); !ok || len(seen) > 0 {
+					return nil, err
+				}
+				log.Warningf("upstream SCAN failed, using KEYS: %v", err)
+				atomic.StoreInt32(&s.useKeys, 1)
+				break
+			}
+			if len(r.array) != 2 {
+				return nil, errInvalidReply
+			}
+			for _, e := range r.array[1].array {
+				if !seen[string(e.str)] {
+					seen[string(e.str)] = true
+					keys = append(keys, e.str)
+				}
+			}
+			cursor = r.array[0].str
+			if string(cursor) == "0" || (limit > -1 && len(keys) >= limit) {
+				return keys, nil
+			}
+		}
+	}
+	r, err := s.do([]byte("keys"), pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range r.array {
+		keys = append(keys, e.str)
+	}
+	return keys, nil
+}
+
+// Keys returns the keys in the order of the upstream SCAN or KEYS, which
+// isn't sorted unless the upstream store is ordered.
+func (s *remoteStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	keys, err := s.scanKeys(pattern, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if limit > -1 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	if !withvalues {
+		return keys, nil, nil
+	}
+	values, oks, err := s.PGet(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	// skip the keys that were deleted in the meantime
+	var n int
+	for i := range keys {
+		if oks[i] {
+			keys[n], values[n] = keys[i], values[i]
+			n++
+		}
+	}
+	return keys[:n], values[:n], nil
+}
+
+func (s *remoteStore) FlushDB() error {
+	_, err := s.do([]byte("flushdb"))
+	return err
+}
+
+func (s *remoteStore) info(buf []byte) []byte {
+	keys := "scan"
+	if atomic.LoadInt32(&s.useKeys) == 1 {
+		keys = "keys"
+	}
+	buf = append(buf, "# Remote\r\n"...)
+	buf = append(buf, fmt.Sprintf("upstream:%s\r\n", s.addr)...)
+	buf = append(buf, fmt.Sprintf("pool_size:%d\r\n", cap(s.idle))...)
+	buf = append(buf, fmt.Sprintf("active_connections:%d\r\n", len(s.sem))...)
+	buf = append(buf, fmt.Sprintf("idle_connections:%d\r\n", len(s.idle))...)
+	buf = append(buf, fmt.Sprintf("keys_command:%s\r\n", keys)...)
+	return buf
+}
@@ -0,0 +1,143 @@
+package kvbench
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testServer serves the store on a local port using a handler, and
+// returns the address and the number of connections that were open at
+// once.
+func testServer(t *testing.T, store Store) (string, *int64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var open, maxOpen int64
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := atomic.AddInt64(&open, 1)
+			for {
+				max := atomic.LoadInt64(&maxOpen)
+				if n <= max || atomic.CompareAndSwapInt64(&maxOpen, max, n) {
+					break
+				}
+			}
+			go func() {
+				defer atomic.AddInt64(&open, -1)
+				defer c.Close()
+				conn := &respConn{w: bufio.NewWriter(c)}
+				readCommands(bufio.NewReader(c), func(args [][]byte) error {
+					h := &handler{store: store, which: "map"}
+					h.handle(conn, testCommand(argStrings(args)...))
+					if conn.closed {
+						c.Close()
+					}
+					return conn.w.Flush()
+				})
+			}()
+		}
+	}()
+	return ln.Addr().String(), &maxOpen
+}
+
+func argStrings(args [][]byte) []string {
+	s := make([]string, len(args))
+	for i := range args {
+		s[i] = string(args[i])
+	}
+	return s
+}
+
+func openTestRemote(t *testing.T, addr string, values map[string]string,
+) *remoteStore {
+	t.Helper()
+	s, err := openStore("remote", addr, storeOptions{values: values})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s.(*remoteStore)
+}
+
+func TestRemoteStore(t *testing.T) {
+	upstream, _ := openStore("map", ":memory:", storeOptions{})
+	defer upstream.Close()
+	addr, _ := testServer(t, upstream)
+	// the kvbench server has no SCAN, which falls back to KEYS
+	for _, keys := range []string{"keys", "scan"} {
+		t.Run(keys, func(t *testing.T) {
+			upstream.FlushDB()
+			testReopen(t, "remote", addr, storeOptions{
+				values: map[string]string{"remote-keys": keys},
+			})
+			s := openTestRemote(t, addr, map[string]string{"remote-keys": keys})
+			if _, _, err := s.Keys([]byte("*"), 1, false); err != nil {
+				t.Fatal(err)
+			}
+			if atomic.LoadInt32(&s.useKeys) != 1 {
+				t.Fatal("expected the KEYS fallback")
+			}
+		})
+	}
+	if _, err := openStore("remote", "127.0.0.1:1", storeOptions{}); err == nil {
+		t.Fatal("expected a dial error")
+	}
+}
+
+func TestRemotePool(t *testing.T) {
+	upstream, _ := openStore("map", ":memory:", storeOptions{})
+	defer upstream.Close()
+	addr, maxOpen := testServer(t, upstream)
+	s := openTestRemote(t, addr, map[string]string{
+		"remote-pool":    "2",
+		"remote-timeout": "0",
+	})
+	var wg sync.WaitGroup
+	for g := 0; g < 20; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("key:%d:%d", g, i))
+				if err := s.Set(key, key); err != nil {
+					t.Error(err)
+					return
+				}
+				if v, ok, err := s.Get(key); err != nil || !ok || string(v) != string(key) {
+					t.Errorf("get %s: %q %v %v", key, v, ok, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(maxOpen); n > 2 {
+		t.Fatalf("%d connections were open", n)
+	}
+
+	busy := openTestRemote(t, addr, map[string]string{
+		"remote-pool":    "1",
+		"remote-timeout": "50ms",
+	})
+	c, err := busy.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := busy.Set([]byte("a"), []byte("1")); err != errRemoteBusy {
+		t.Fatalf("got %v, expected %v", err, errRemoteBusy)
+	}
+	busy.put(c, nil)
+	if err := busy.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+}
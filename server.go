@@ -1,9 +1,12 @@
 package kvbench
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -20,17 +23,102 @@ type Options struct {
 	Fsync bool
 	Path  string
 	Log   *redlog.Logger
+
+	// KeyFile is the AES key used to encrypt data at rest. The file contains
+	// a 16, 24 or 32 byte key, raw or hex encoded.
+	KeyFile string
+	// NewKeyFile is the key that replaces KeyFile. All data is rewritten
+	// using the new key at startup.
+	NewKeyFile string
+	// AOFEncoding is the command encoding of a new AOF, "resp" or "binary".
+	AOFEncoding string
+
+	// StoreOptions are the store specific options by name, such as
+	// "page-size" for the bptree store. See RegisteredStoreOptions.
+	StoreOptions map[string]string
+	// Middleware is a chain of middleware that wrap the store, such as
+	// "latency" or "compress". The first one sees every operation first.
+	// See RegisteredMiddleware.
+	Middleware []string
+}
+
+// scanner is implemented by stores that can iterate over every key/value
+// without loading them all into memory. The key and value are only valid
+// until the iterator returns.
+type scanner interface {
+	scan(iter func(key, value []byte) bool) error
+}
+
+// infoer is implemented by stores that report statistics in the INFO
+// command. The info is appended as a section of "field:value" lines.
+type infoer interface {
+	info(buf []byte) []byte
+}
+
+// rewriter is implemented by stores that can rewrite their log in the
+// background.
+type rewriter interface {
+	rewriteAOF() error
 }
 
-type Store interface {
-	Close() error
-	Set(key, value []byte) error
-	PSet(keys, values [][]byte) error
-	Get(key []byte) ([]byte, bool, error)
-	PGet(keys [][]byte) ([][]byte, []bool, error)
-	Del(key []byte) (bool, error)
-	Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error)
-	FlushDB() error
+// ranger is implemented by ordered stores that can list the keys from a
+// start key without visiting the keys before it.
+type ranger interface {
+	keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error)
+}
+
+// scanStore iterates over every key/value in the store.
+func scanStore(store Store, iter func(key, value []byte) bool) error {
+	if s, ok := store.(scanner); ok {
+		return s.scan(iter)
+	}
+	keys, vals, err := store.Keys([]byte("*"), -1, true)
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if !iter(keys[i], vals[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// keysFrom returns the keys that match the pattern and aren't less than the
+// start key, in key order. Stores that aren't ordered list every key.
+func keysFrom(store Store, start, pattern []byte, limit int, withvalues bool,
+) ([][]byte, [][]byte, error) {
+	if s, ok := store.(ranger); ok {
+		return s.keysFrom(start, pattern, limit, withvalues)
+	}
+	keys, vals, err := store.Keys(pattern, -1, withvalues)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx := make([]int, 0, len(keys))
+	for i := range keys {
+		if bytes.Compare(keys[i], start) >= 0 {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return bytes.Compare(keys[idx[i]], keys[idx[j]]) < 0
+	})
+	if limit > -1 && len(idx) > limit {
+		idx = idx[:limit]
+	}
+	rkeys := make([][]byte, len(idx))
+	var rvals [][]byte
+	if withvalues {
+		rvals = make([][]byte, len(idx))
+	}
+	for i, j := range idx {
+		rkeys[i] = keys[j]
+		if withvalues {
+			rvals[i] = vals[j]
+		}
+	}
+	return rkeys, rvals, nil
 }
 
 func Start(opts Options) error {
@@ -39,190 +127,302 @@ func Start(opts Options) error {
 	fsync := opts.Fsync
 	path := opts.Path
 	log = opts.Log
-	var store Store
 	var err error
-	switch which {
-	default:
-		err = fmt.Errorf("unknown store type: %v", which)
-	case "map":
-		if path == "" {
-			path = "map.db"
-		}
-		store, err = newMapStore(path, fsync)
-	case "btree":
-		if path == "" {
-			path = "btree.db"
-		}
-		store, err = newBTreeStore(path, fsync)
-	case "bolt":
-		if path == "" {
-			path = "bolt.db"
-		}
-		store, err = newBoltStore(path, fsync)
-	case "leveldb":
-		if path == "" {
-			path = "leveldb.db"
-		}
-		store, err = newLevelDBStore(path, fsync)
-	case "kv":
-		log.Warningf("kv store is unstable")
-		if path == "" {
-			path = "kv.db"
-		}
-		store, err = newKVStore(path, fsync)
+	var crypt, newCrypt *crypter
+	if opts.KeyFile != "" {
+		if crypt, err = loadKeyFile(opts.KeyFile); err != nil {
+			return err
+		}
+	}
+	if opts.NewKeyFile != "" {
+		if newCrypt, err = loadKeyFile(opts.NewKeyFile); err != nil {
+			return err
+		}
 	}
+	encoding, err := parseAOFEncoding(opts.AOFEncoding)
+	if err != nil {
+		return err
+	}
+	for name := range opts.StoreOptions {
+		if !isStoreOption(name) {
+			return fmt.Errorf("unknown store option: %v", name)
+		}
+	}
+	store, err := openStore(which, path, storeOptions{
+		fsync:    fsync,
+		crypt:    crypt,
+		rotate:   newCrypt != nil,
+		encoding: encoding,
+		values:   opts.StoreOptions,
+	})
 	if err != nil {
 		return err
 	}
 	defer store.Close()
-	log.Printf("store type: %v, fsync: %v", which, fsync)
-	var srv *redcon.Server
-	srv = redcon.NewServer(fmt.Sprintf(":%d", port),
-		func(conn redcon.Conn, cmd redcon.Command) {
-			cmdp, keys, values, is := parsePipeline(conn, cmd)
-			if !is {
-				cmdp = cmdParse(cmd.Args[0])
+	if newCrypt != nil {
+		r, ok := store.(keyRotator)
+		if !ok {
+			// an unencrypted on-disk store
+			r, err = newCryptStore(store, nil)
+			if err != nil {
+				return err
 			}
-			switch cmdp {
-			default:
-				conn.WriteError(
-					"ERR unknown command '" + string(cmd.Args[0]) + "'")
-			case cmdSHUTDOWN:
-				conn.WriteString("OK")
-				conn.Close()
-				log.Warningf("shutting down")
-				srv.Close()
-			case cmdPING:
-				conn.WriteString("PONG")
-			case cmdQUIT:
+		}
+		log.Printf("rotating encryption key")
+		if err := r.rotateKey(newCrypt); err != nil {
+			return err
+		}
+		store = r.(Store)
+		crypt = newCrypt
+	}
+	store, err = wrapStore(store, opts.Middleware, storeOptions{
+		fsync:  fsync,
+		values: opts.StoreOptions,
+	})
+	if err != nil {
+		return err
+	}
+	if len(opts.Middleware) > 0 {
+		log.Printf("middleware: %v", strings.Join(opts.Middleware, ","))
+	}
+	log.Printf("store type: %v, fsync: %v, encrypted: %v", which, fsync, crypt != nil)
+	var srv *redcon.Server
+	h := newHandler(store, which, path, crypt != nil, func() { srv.Close() })
+	srv = redcon.NewServer(fmt.Sprintf(":%d", port), h.handle, nil, nil)
+	errch := make(chan error)
+	go func() {
+		err := <-errch
+		if err != nil {
+			log.Warningf("%v", err)
+		} else {
+			log.Printf("started server on port %d", port)
+		}
+	}()
+	return srv.ListenServeAndSignal(errch)
+}
+
+// handler runs the commands of the clients on a store of the given type.
+type handler struct {
+	store Store
+	which string
+	// rdbPath is the file that SAVE writes. SAVE is refused when it's
+	// empty, because the store is encrypted and the RDB file isn't.
+	rdbPath string
+	// shutdown is called by SHUTDOWN.
+	shutdown func()
+}
+
+// newHandler returns the handler of a store at path. SAVE writes the
+// dump.rdb file next to the store, unless the store is encrypted.
+func newHandler(store Store, which, path string, encrypted bool,
+	shutdown func(),
+) *handler {
+	h := &handler{store: store, which: which, shutdown: shutdown}
+	if !encrypted {
+		_, path, _ = lookupStore(which, path)
+		h.rdbPath = filepath.Join(filepath.Dir(path), "dump.rdb")
+	}
+	return h
+}
+
+func (h *handler) handle(conn redcon.Conn, cmd redcon.Command) {
+	store, which := h.store, h.which
+	cmdp, keys, values, is := parsePipeline(conn, cmd)
+	if !is {
+		cmdp = cmdParse(cmd.Args[0])
+	}
+	switch cmdp {
+	default:
+		conn.WriteError(
+			"ERR unknown command '" + string(cmd.Args[0]) + "'")
+	case cmdSHUTDOWN:
+		conn.WriteString("OK")
+		conn.Close()
+		log.Warningf("shutting down")
+		h.shutdown()
+	case cmdPING:
+		conn.WriteString("PONG")
+	case cmdQUIT:
+		conn.WriteString("OK")
+		conn.Close()
+	case cmdPSET:
+		err := store.PSet(keys, values)
+		for i := 0; i < len(keys); i++ {
+			if err != nil {
+				conn.WriteError(err.Error())
+			} else {
 				conn.WriteString("OK")
-				conn.Close()
-			case cmdPSET:
-				err := store.PSet(keys, values)
-				for i := 0; i < len(keys); i++ {
-					if err != nil {
-						conn.WriteError(err.Error())
-					} else {
-						conn.WriteString("OK")
-					}
-				}
-			case cmdPGET:
-				values, oks, err := store.PGet(keys)
-				if err != nil {
-					for i := 0; i < len(keys); i++ {
-						conn.WriteError(err.Error())
-					}
-				} else {
-					for i := 0; i < len(keys); i++ {
-						v, ok := values[i], oks[i]
-						if !ok {
-							conn.WriteNull()
-						} else {
-							conn.WriteBulk(v)
-						}
-					}
-				}
-			case cmdSET:
-				if len(cmd.Args) != 3 {
-					wrongArgs(conn, cmd.Args[0])
-					return
-				}
-				err := store.Set(cmd.Args[1], cmd.Args[2])
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else {
-					conn.WriteString("OK")
-				}
-			case cmdGET:
-				if len(cmd.Args) != 2 {
-					wrongArgs(conn, cmd.Args[0])
-					return
-				}
-				v, ok, err := store.Get(cmd.Args[1])
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else if !ok {
+			}
+		}
+	case cmdPGET:
+		values, oks, err := store.PGet(keys)
+		if err != nil {
+			for i := 0; i < len(keys); i++ {
+				conn.WriteError(err.Error())
+			}
+		} else {
+			for i := 0; i < len(keys); i++ {
+				v, ok := values[i], oks[i]
+				if !ok {
 					conn.WriteNull()
 				} else {
 					conn.WriteBulk(v)
 				}
-			case cmdDEL:
-				if len(cmd.Args) != 2 {
-					wrongArgs(conn, cmd.Args[0])
+			}
+		}
+	case cmdSET:
+		if len(cmd.Args) != 3 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		err := store.Set(cmd.Args[1], cmd.Args[2])
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteString("OK")
+		}
+	case cmdGET:
+		if len(cmd.Args) != 2 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		v, ok, err := store.Get(cmd.Args[1])
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else if !ok {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulk(v)
+		}
+	case cmdMSET:
+		if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		keys := make([][]byte, 0, len(cmd.Args)/2)
+		values := make([][]byte, 0, len(cmd.Args)/2)
+		for i := 1; i < len(cmd.Args); i += 2 {
+			keys = append(keys, cmd.Args[i])
+			values = append(values, cmd.Args[i+1])
+		}
+		if err := store.PSet(keys, values); err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteString("OK")
+		}
+	case cmdDEL:
+		if len(cmd.Args) != 2 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		ok, err := store.Del(cmd.Args[1])
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else if !ok {
+			conn.WriteInt(0)
+		} else {
+			conn.WriteInt(1)
+		}
+	case cmdFLUSHDB:
+		if len(cmd.Args) != 1 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		err := store.FlushDB()
+		if err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteString("OK")
+		}
+	case cmdSAVE:
+		if len(cmd.Args) != 1 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		if h.rdbPath == "" {
+			conn.WriteError("ERR SAVE would write the encrypted data in plain text")
+		} else if _, err := saveRDB(osFS{}, store, h.rdbPath); err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteString("OK")
+		}
+	case cmdBGREWRITEAOF:
+		if len(cmd.Args) != 1 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		s, ok := unwrapStore(store).(rewriter)
+		if !ok {
+			conn.WriteError("ERR not supported by the " + which + " store")
+		} else if err := s.rewriteAOF(); err != nil {
+			conn.WriteError(err.Error())
+		} else {
+			conn.WriteString("Background append only file rewriting started")
+		}
+	case cmdINFO:
+		buf := []byte("# Server\r\nstore:" + which + "\r\n")
+		if s, ok := store.(infoer); ok {
+			buf = append(buf, "\r\n"...)
+			buf = s.info(buf)
+		}
+		conn.WriteBulk(buf)
+	case cmdKEYS:
+		if len(cmd.Args) < 2 {
+			wrongArgs(conn, cmd.Args[0])
+			return
+		}
+		var withvalues bool
+		var start []byte
+		limit := -1
+		for i := 2; i < len(cmd.Args); i++ {
+			switch strings.ToLower(string(cmd.Args[i])) {
+			case "withvalues":
+				withvalues = true
+			case "start":
+				i++
+				if i == len(cmd.Args) {
+					syntaxErr(conn)
 					return
 				}
-				ok, err := store.Del(cmd.Args[1])
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else if !ok {
-					conn.WriteInt(0)
-				} else {
-					conn.WriteInt(1)
-				}
-			case cmdFLUSHDB:
-				if len(cmd.Args) != 1 {
-					wrongArgs(conn, cmd.Args[0])
+				start = cmd.Args[i]
+			case "limit":
+				i++
+				if i == len(cmd.Args) {
+					syntaxErr(conn)
 					return
 				}
-				err := store.FlushDB()
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else {
-					conn.WriteString("OK")
-				}
-			case cmdKEYS:
-				if len(cmd.Args) < 2 {
-					wrongArgs(conn, cmd.Args[0])
+				n, err := strconv.ParseInt(string(cmd.Args[i]), 10, 64)
+				if err != nil || n < 0 {
+					syntaxErr(conn)
 					return
 				}
-				var withvalues bool
-				limit := -1
-				for i := 2; i < len(cmd.Args); i++ {
-					switch strings.ToLower(string(cmd.Args[i])) {
-					case "withvalues":
-						withvalues = true
-					case "limit":
-						i++
-						if i == len(cmd.Args) {
-							syntaxErr(conn)
-							return
-						}
-						n, err := strconv.ParseInt(string(cmd.Args[i]), 10, 64)
-						if err != nil || n < 0 {
-							syntaxErr(conn)
-							return
-						}
-						limit = int(n)
-					}
-				}
-				keys, vals, err := store.Keys(cmd.Args[1], limit, withvalues)
-				if err != nil {
-					conn.WriteError(err.Error())
-				} else {
-					if withvalues {
-						conn.WriteArray(len(keys) * 2)
-					} else {
-						conn.WriteArray(len(keys))
-					}
-					for i := 0; i < len(keys); i++ {
-						conn.WriteBulk(keys[i])
-						if withvalues {
-							conn.WriteBulk(vals[i])
-						}
-					}
-				}
+				limit = int(n)
 			}
-		}, nil, nil)
-	errch := make(chan error)
-	go func() {
-		err := <-errch
+		}
+		var keys, vals [][]byte
+		var err error
+		if start != nil {
+			keys, vals, err = keysFrom(store, start, cmd.Args[1], limit,
+				withvalues)
+		} else {
+			keys, vals, err = store.Keys(cmd.Args[1], limit, withvalues)
+		}
 		if err != nil {
-			log.Warningf("%v", err)
+			conn.WriteError(err.Error())
 		} else {
-			log.Printf("started server on port %d", port)
+			if withvalues {
+				conn.WriteArray(len(keys) * 2)
+			} else {
+				conn.WriteArray(len(keys))
+			}
+			for i := 0; i < len(keys); i++ {
+				conn.WriteBulk(keys[i])
+				if withvalues {
+					conn.WriteBulk(vals[i])
+				}
+			}
 		}
-	}()
-	return srv.ListenServeAndSignal(errch)
+	}
 }
 
 type cmdType int
@@ -237,6 +437,10 @@ const (
 	cmdDEL
 	cmdGET
 	cmdSET
+	cmdSAVE
+	cmdINFO
+	cmdBGREWRITEAOF
+	cmdMSET
 
 	cmdPSET
 	cmdPGET
@@ -244,6 +448,10 @@ const (
 
 func cmdParse(cmd []byte) cmdType {
 	switch len(cmd) {
+	case 12:
+		if strings.EqualFold(string(cmd), "bgrewriteaof") {
+			return cmdBGREWRITEAOF
+		}
 	case 8:
 		if (cmd[0] == 'S' || cmd[0] == 's') &&
 			(cmd[1] == 'H' || cmd[1] == 'h') &&
@@ -266,6 +474,12 @@ func cmdParse(cmd []byte) cmdType {
 			return cmdFLUSHDB
 		}
 	case 4:
+		if (cmd[0] == 'M' || cmd[0] == 'm') &&
+			(cmd[1] == 'S' || cmd[1] == 's') &&
+			(cmd[2] == 'E' || cmd[2] == 'e') &&
+			(cmd[3] == 'T' || cmd[3] == 't') {
+			return cmdMSET
+		}
 		if (cmd[0] == 'K' || cmd[0] == 'k') &&
 			(cmd[1] == 'E' || cmd[1] == 'e') &&
 			(cmd[2] == 'Y' || cmd[2] == 'y') &&
@@ -284,6 +498,18 @@ func cmdParse(cmd []byte) cmdType {
 			(cmd[3] == 'T' || cmd[3] == 't') {
 			return cmdQUIT
 		}
+		if (cmd[0] == 'S' || cmd[0] == 's') &&
+			(cmd[1] == 'A' || cmd[1] == 'a') &&
+			(cmd[2] == 'V' || cmd[2] == 'v') &&
+			(cmd[3] == 'E' || cmd[3] == 'e') {
+			return cmdSAVE
+		}
+		if (cmd[0] == 'I' || cmd[0] == 'i') &&
+			(cmd[1] == 'N' || cmd[1] == 'n') &&
+			(cmd[2] == 'F' || cmd[2] == 'f') &&
+			(cmd[3] == 'O' || cmd[3] == 'o') {
+			return cmdINFO
+		}
 	case 3:
 		if (cmd[0] == 'D' || cmd[0] == 'd') &&
 			(cmd[1] == 'E' || cmd[1] == 'e') &&
@@ -292,7 +518,7 @@ func cmdParse(cmd []byte) cmdType {
 		}
 		if (cmd[0] == 'G' || cmd[0] == 'g') &&
 			(cmd[1] == 'E' || cmd[1] == 'e') &&
-			(cmd[2] == 'L' || cmd[2] == 't') {
+			(cmd[2] == 'T' || cmd[2] == 't') {
 			return cmdGET
 		}
 		if (cmd[0] == 'S' || cmd[0] == 's') &&
@@ -327,6 +553,15 @@ func parsePipeline(conn redcon.Conn, cmd redcon.Command) (
 	cmdt := cmdParse(cmd.Args[0])
 	switch cmdt {
 	case cmdSET, cmdGET:
+		// commands with the wrong number of arguments are not pipelined,
+		// which would leave keys without values
+		nargs := 2
+		if cmdt == cmdSET {
+			nargs = 3
+		}
+		if len(cmd.Args) != nargs {
+			return
+		}
 		cmdp = cmdt
 		keys = append(keys, cmd.Args[1])
 		if len(cmd.Args) == 3 {
@@ -334,7 +569,7 @@ func parsePipeline(conn redcon.Conn, cmd redcon.Command) (
 		}
 		for _, cmd := range cmds {
 			cmdt = cmdParse(cmd.Args[0])
-			if len(cmd.Args) > 3 || cmdp != cmdt {
+			if len(cmd.Args) != nargs || cmdp != cmdt {
 				return
 			}
 			keys = append(keys, cmd.Args[1])
@@ -0,0 +1,312 @@
+package kvbench
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+// respConn is a connection that writes the replies of a handler as
+// RESP. The pipeline holds the commands that follow the current one.
+type respConn struct {
+	redcon.Conn
+	w        *bufio.Writer
+	pipeline []redcon.Command
+	closed   bool
+}
+
+func (c *respConn) WriteError(msg string) { fmt.Fprintf(c.w, "-%s\r\n", msg) }
+func (c *respConn) WriteString(s string)  { fmt.Fprintf(c.w, "+%s\r\n", s) }
+func (c *respConn) WriteInt(n int)        { fmt.Fprintf(c.w, ":%d\r\n", n) }
+func (c *respConn) WriteArray(n int)      { fmt.Fprintf(c.w, "*%d\r\n", n) }
+func (c *respConn) WriteNull()            { c.w.WriteString("$-1\r\n") }
+func (c *respConn) Close() error          { c.closed = true; return nil }
+
+func (c *respConn) WriteBulk(b []byte) {
+	fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(b), b)
+}
+
+func (c *respConn) PeekPipeline() []redcon.Command { return c.pipeline }
+
+func (c *respConn) ReadPipeline() []redcon.Command {
+	cmds := c.pipeline
+	c.pipeline = nil
+	return cmds
+}
+
+func testCommand(args ...string) redcon.Command {
+	var cmd redcon.Command
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+	return cmd
+}
+
+// runCommands runs a line of space separated commands, where a '|' starts
+// the next command of a pipeline, and returns the replies.
+func runCommands(h *handler, line string) (string, bool) {
+	var buf bytes.Buffer
+	conn := &respConn{w: bufio.NewWriter(&buf)}
+	for _, s := range strings.Split(line, "|") {
+		conn.pipeline = append(conn.pipeline, testCommand(strings.Fields(s)...))
+	}
+	for len(conn.pipeline) > 0 {
+		cmd := conn.pipeline[0]
+		conn.pipeline = conn.pipeline[1:]
+		h.handle(conn, cmd)
+	}
+	conn.w.Flush()
+	return buf.String(), conn.closed
+}
+
+func TestServerCommands(t *testing.T) {
+	tests := []struct {
+		line  string
+		reply string
+	}{
+		{"PING", "+PONG\r\n"},
+		{"ping", "+PONG\r\n"},
+		{"SET a 1", "+OK\r\n"},
+		{"GET a", "$1\r\n1\r\n"},
+		{"get missing", "$-1\r\n"},
+		{"MSET b 2 c 3", "+OK\r\n"},
+		{"SET a 1 | SET b 2 | SET c 3", "+OK\r\n+OK\r\n+OK\r\n"},
+		{"GET a | GET missing | GET c", "$1\r\n1\r\n$-1\r\n$1\r\n3\r\n"},
+		{"KEYS * LIMIT 2", "*2\r\n$1\r\na\r\n$1\r\nb\r\n"},
+		{"KEYS c* WITHVALUES", "*2\r\n$1\r\nc\r\n$1\r\n3\r\n"},
+		{"KEYS * START b LIMIT 1 WITHVALUES", "*2\r\n$1\r\nb\r\n$1\r\n2\r\n"},
+		{"KEYS * START bb", "*1\r\n$1\r\nc\r\n"},
+		{"DEL a", ":1\r\n"},
+		{"DEL a", ":0\r\n"},
+		{"FLUSHDB", "+OK\r\n"},
+		{"KEYS *", "*0\r\n"},
+		{"QUIT", "+OK\r\n"},
+	}
+	store, err := openStore("btree", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, tc := range tests {
+		reply, _ := runCommands(&handler{store: store, which: "btree"}, tc.line)
+		if reply != tc.reply {
+			t.Fatalf("%s: got %q, expected %q", tc.line, reply, tc.reply)
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	wrong := func(cmd string) string {
+		return "-ERR wrong number of arguments for '" + cmd + "' command\r\n"
+	}
+	syntax := "-ERR syntax error\r\n"
+	fault := "-ERR injected fault\r\n"
+	tests := []struct {
+		which string
+		line  string
+		reply string
+	}{
+		{"map", "FOO", "-ERR unknown command 'FOO'\r\n"},
+		{"map", "SET a", wrong("SET")},
+		{"map", "SET a 1 2", wrong("SET")},
+		{"map", "GET", wrong("GET")},
+		{"map", "get a b", wrong("get")},
+		{"map", "MSET a", wrong("MSET")},
+		{"map", "MSET a 1 b", wrong("MSET")},
+		{"map", "DEL", wrong("DEL")},
+		{"map", "FLUSHDB now", wrong("FLUSHDB")},
+		{"map", "SAVE now", wrong("SAVE")},
+		{"map", "BGREWRITEAOF now", wrong("BGREWRITEAOF")},
+		{"map", "KEYS", wrong("KEYS")},
+		{"map", "KEYS * LIMIT", syntax},
+		{"map", "KEYS * LIMIT -1", syntax},
+		{"map", "KEYS * LIMIT x", syntax},
+		{"map", "KEYS * START", syntax},
+		// a pipeline with a wrong number of arguments isn't batched
+		{"map", "SET a | SET b 1", wrong("SET") + "+OK\r\n"},
+		{"map", "SET a 1 | SET b", "+OK\r\n" + wrong("SET")},
+		{"map", "GET a | GET", "$1\r\n1\r\n" + wrong("GET")},
+		{"null", "BGREWRITEAOF", "-ERR not supported by the null store\r\n"},
+		{"faulty", "SET a 1", fault},
+		{"faulty", "GET a", fault},
+		{"faulty", "DEL a", fault},
+		{"faulty", "MSET a 1", fault},
+		{"faulty", "KEYS *", fault},
+		{"faulty", "FLUSHDB", fault},
+		{"faulty", "SET a 1 | SET b 2", fault + fault},
+		{"faulty", "GET a | GET b", fault + fault},
+	}
+	stores := make(map[string]Store)
+	for _, which := range []string{"map", "null", "faulty"} {
+		store, err := openStore(which, ":memory:", storeOptions{
+			values: map[string]string{"faulty-errors": "100"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		stores[which] = store
+	}
+	for _, tc := range tests {
+		h := &handler{store: stores[tc.which], which: tc.which}
+		reply, _ := runCommands(h, tc.line)
+		if reply != tc.reply {
+			t.Fatalf("%s %s: got %q, expected %q", tc.which, tc.line, reply,
+				tc.reply)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	store, err := openStore("map", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var shutdown bool
+	reply, closed := runCommands(&handler{store: store, which: "map",
+		shutdown: func() { shutdown = true }}, "SHUTDOWN")
+	if reply != "+OK\r\n" || !closed || !shutdown {
+		t.Fatalf("got %q, closed %v, shutdown %v", reply, closed, shutdown)
+	}
+}
+
+func TestServerSave(t *testing.T) {
+	tests := []struct {
+		which string
+		crypt bool
+	}{
+		{"map", false},
+		{"lsm", false},
+		// the map store encrypts its AOF, and lsm is wrapped by cryptStore
+		{"map", true},
+		{"lsm", true},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s/encrypted=%v", tc.which, tc.crypt), func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "db")
+			var crypt *crypter
+			if tc.crypt {
+				crypt = testCrypter(t, 1)
+			}
+			store, err := openStore(tc.which, path, storeOptions{crypt: crypt})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			h := newHandler(store, tc.which, path, tc.crypt, nil)
+			reply, _ := runCommands(h, "SET a 1 | SAVE")
+			rdb := filepath.Join(dir, "dump.rdb")
+			_, err = os.Stat(rdb)
+			if tc.crypt {
+				if reply != "+OK\r\n-ERR SAVE would write the encrypted data in plain text\r\n" {
+					t.Fatalf("got %q", reply)
+				}
+				if !os.IsNotExist(err) {
+					t.Fatalf("the RDB file was written: %v", err)
+				}
+				return
+			}
+			if reply != "+OK\r\n+OK\r\n" || err != nil {
+				t.Fatalf("got %q, %v", reply, err)
+			}
+		})
+	}
+}
+
+func TestKeysFrom(t *testing.T) {
+	tests := []struct {
+		start   string
+		pattern string
+		limit   int
+		keys    string
+	}{
+		{"", "*", -1, "a a1 a2 b b1 c m"},
+		{"a1", "*", -1, "a1 a2 b b1 c m"},
+		{"a10", "*", 2, "a2 b"},
+		{"a", "a*", -1, "a a1 a2"},
+		{"a", "b*", 1, "b"},
+		{"b0", "a*", -1, ""},
+		{"c", "*1", -1, ""},
+		{"0", "*1", -1, "a1 b1"},
+		{"d", "*", -1, "m"},
+		{"", "m*", -1, "m"},
+		{"n", "*", -1, ""},
+	}
+	stores := []struct {
+		name  string
+		which string
+		opts  storeOptions
+		chain []string
+		// ranged is set when the store seeks to the start key, instead of
+		// listing every key
+		ranged bool
+	}{
+		{"map", "map", storeOptions{}, nil, false},
+		{"btree", "btree", storeOptions{}, nil, true},
+		{"lsm", "lsm", storeOptions{}, nil, true},
+		{"bptree", "bptree", storeOptions{}, nil, true},
+		{"bolt", "bolt", storeOptions{}, nil, true},
+		{"leveldb", "leveldb", storeOptions{}, nil, true},
+		{"mvcc", "mvcc", storeOptions{}, nil, true},
+		{"art", "art", storeOptions{}, nil, true},
+		{"smap", "smap", storeOptions{}, nil, true},
+		{"sbtree", "sbtree", storeOptions{}, nil, true},
+		{"tiered", "tiered", storeOptions{}, nil, true},
+		{"tiered-write-back", "tiered", storeOptions{values: map[string]string{
+			"tier-mode": "write-back", "tier-cache": "btree"}}, nil, true},
+		{"encrypted", "lsm", storeOptions{crypt: testCrypter(t, 1)}, nil, true},
+		{"middleware", "btree", storeOptions{},
+			[]string{"latency", "delay", "compress", "log"}, true},
+		{"faulty", "faulty", storeOptions{values: map[string]string{
+			"faulty-backend": "btree"}}, nil, true},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			s, err := openStore(st.which, t.TempDir()+"/db", st.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s, err = wrapStore(s, st.chain, st.opts); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if _, ok := s.(ranger); ok != st.ranged {
+				t.Fatalf("ranger: %v", ok)
+			}
+			for _, key := range strings.Fields("c b1 a2 a b a1 m x") {
+				if err := s.Set([]byte(key), []byte("v:"+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := s.Del([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			for _, tc := range tests {
+				keys, vals, err := keysFrom(s, []byte(tc.start),
+					[]byte(tc.pattern), tc.limit, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for i, key := range keys {
+					if string(vals[i]) != "v:"+string(key) {
+						t.Fatalf("%s: got %q", key, vals[i])
+					}
+					got = append(got, string(key))
+				}
+				if strings.Join(got, " ") != tc.keys {
+					t.Fatalf("%s %s %d: got %q, expected %q", tc.start,
+						tc.pattern, tc.limit, got, tc.keys)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package kvbench
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// shardCount is the number of shards of a new sharded store. An existing
+// store keeps the number of shards that it was created with.
+const shardCount = 16
+
+// shardStore hashes the keys into shards, where each shard is a mapStore or
+// a btreeStore with its own lock and AOF. The AOFs are stored in the
+// directory at path.
+type shardStore struct {
+	shards  []Store
+	ordered bool
+	// maxMemory and policy are the memory limit of the whole store
+	maxMemory int64
+	policy    evictPolicy
+}
+
+// memUser is implemented by the stores of the shards, which report the
+// memory that they use when there's a limit.
+type memUser interface {
+	memUsage() (used, evicted int64, ok bool)
+}
+
+func newShardStore(path string, opts storeOptions, ordered bool) (*shardStore, error) {
+	n := shardCount
+	if path != ":memory:" {
+		fs := opts.filesystem()
+		if err := fs.MkdirAll(path, 0777); err != nil {
+			return nil, err
+		}
+		fis, err := fs.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var aofs int
+		for _, fi := range fis {
+			if strings.HasSuffix(fi.Name(), ".aof") {
+				aofs++
+			}
+		}
+		if aofs > 0 {
+			n = aofs
+		}
+	}
+	s := &shardStore{shards: make([]Store, n), ordered: ordered,
+		maxMemory: opts.maxMemory, policy: opts.maxMemoryPolicy}
+	// every shard gets an equal part of the memory limit
+	if opts.maxMemory > 0 {
+		opts.maxMemory /= int64(n)
+		if opts.maxMemory < 1 {
+			opts.maxMemory = 1
+		}
+	}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range s.shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			spath := path
+			if path != ":memory:" {
+				spath = filepath.Join(path, fmt.Sprintf("%03d.aof", i))
+			}
+			if ordered {
+				s.shards[i], errs[i] = newBTreeStore(spath, opts)
+			} else {
+				s.shards[i], errs[i] = newMapStore(spath, opts)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			for j := range s.shards {
+				if errs[j] == nil {
+					s.shards[j].Close()
+				}
+			}
+			return nil, fmt.Errorf("shard %d: %v", i, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *shardStore) shard(key []byte) Store {
+	return s.shards[keyShard(key, len(s.shards))]
+}
+
+// split returns the indexes of the keys for each shard.
+func (s *shardStore) split(keys [][]byte) [][]int {
+	idxs := make([][]int, len(s.shards))
+	for i, key := range keys {
+		sh := keyShard(key, len(s.shards))
+		idxs[sh] = append(idxs[sh], i)
+	}
+	return idxs
+}
+
+func (s *shardStore) Close() error {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+	return nil
+}
+
+func (s *shardStore) PSet(keys, values [][]byte) error {
+	var skeys, svals [][]byte
+	for sh, idxs := range s.split(keys) {
+		if len(idxs) == 0 {
+			continue
+		}
+		skeys, svals = skeys[:0], svals[:0]
+		for _, i := range idxs {
+			skeys = append(skeys, keys[i])
+			svals = append(svals, values[i])
+		}
+		if err := s.shards[sh].PSet(skeys, svals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	values := make([][]byte, len(keys))
+	oks := make([]bool, len(keys))
+	var skeys [][]byte
+	for sh, idxs := range s.split(keys) {
+		if len(idxs) == 0 {
+			continue
+		}
+		skeys = skeys[:0]
+		for _, i := range idxs {
+			skeys = append(skeys, keys[i])
+		}
+		svals, soks, err := s.shards[sh].PGet(skeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, i := range idxs {
+			values[i], oks[i] = svals[j], soks[j]
+		}
+	}
+	return values, oks, nil
+}
+
+func (s *shardStore) Set(key, value []byte) error {
+	return s.shard(key).Set(key, value)
+}
+
+func (s *shardStore) Get(key []byte) ([]byte, bool, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *shardStore) Del(key []byte) (bool, error) {
+	return s.shard(key).Del(key)
+}
+
+// Keys returns the matching keys of all shards. The keys of the btree
+// shards are merged in order.
+func (s *shardStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	if s.ordered {
+		return s.keysFrom(nil, pattern, limit, withvalues)
+	}
+	var keys [][]byte
+	var vals [][]byte
+	for _, shard := range s.shards {
+		slimit := limit
+		if limit > -1 {
+			slimit = limit - len(keys)
+		}
+		skeys, svals, err := shard.Keys(pattern, slimit, withvalues)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, skeys...)
+		vals = append(vals, svals...)
+		if limit > -1 && len(keys) >= limit {
+			break
+		}
+	}
+	return keys, vals, nil
+}
+
+// keysFrom merges the keys of all shards from the start key in order.
+func (s *shardStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	skeys := make([][][]byte, len(s.shards))
+	svals := make([][][]byte, len(s.shards))
+	for i, shard := range s.shards {
+		var err error
+		skeys[i], svals[i], err = keysFrom(shard, start, pattern, limit,
+			withvalues)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var keys [][]byte
+	var vals [][]byte
+	for limit < 0 || len(keys) < limit {
+		min := -1
+		for i := range skeys {
+			if len(skeys[i]) > 0 && (min == -1 ||
+				bytes.Compare(skeys[i][0], skeys[min][0]) < 0) {
+				min = i
+			}
+		}
+		if min == -1 {
+			break
+		}
+		keys = append(keys, skeys[min][0])
+		skeys[min] = skeys[min][1:]
+		if withvalues {
+			vals = append(vals, svals[min][0])
+			svals[min] = svals[min][1:]
+		}
+	}
+	return keys, vals, nil
+}
+
+func (s *shardStore) FlushDB() error {
+	for _, shard := range s.shards {
+		if err := shard.FlushDB(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardStore) rotateKey(crypt *crypter) error {
+	for _, shard := range s.shards {
+		if err := shard.(keyRotator).rotateKey(crypt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardStore) scan(iter func(key, value []byte) bool) error {
+	for _, shard := range s.shards {
+		var stopped bool
+		err := scanStore(shard, func(key, value []byte) bool {
+			if !iter(key, value) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// info reports the memory used and the keys evicted by all shards, with
+// the limit of the whole store.
+func (s *shardStore) info(buf []byte) []byte {
+	total := memLimit{max: s.maxMemory, policy: s.policy}
+	for _, shard := range s.shards {
+		used, evicted, ok := shard.(memUser).memUsage()
+		if !ok {
+			return buf
+		}
+		total.used += used
+		total.evicted += evicted
+	}
+	return total.info(buf)
+}
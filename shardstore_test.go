@@ -0,0 +1,79 @@
+package kvbench
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/match"
+)
+
+func TestShardReopen(t *testing.T) {
+	for _, which := range []string{"smap", "sbtree"} {
+		t.Run(which, func(t *testing.T) {
+			testReopen(t, which, filepath.Join(t.TempDir(), which),
+				storeOptions{})
+		})
+	}
+}
+
+func TestShardKeysOrder(t *testing.T) {
+	s, err := openStore("sbtree", filepath.Join(t.TempDir(), "sbtree"),
+		storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var all []string
+	for _, i := range rand.Perm(500) {
+		key := fmt.Sprintf("key:%04d", i)
+		if i%2 == 0 {
+			key = fmt.Sprintf("other:%04d", i)
+		}
+		all = append(all, key)
+		if err := s.Set([]byte(key), []byte("v:"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(all)
+	tests := []struct {
+		pattern string
+		limit   int
+	}{
+		{"*", -1},
+		{"*", 1},
+		{"*", 17},
+		{"key:*", 10},
+		{"key:*", -1},
+		{"other:01*", 3},
+		{"*:00*", 7},
+		{"none:*", 5},
+	}
+	for _, tc := range tests {
+		var want []string
+		for _, key := range all {
+			if (tc.limit < 0 || len(want) < tc.limit) &&
+				match.Match(key, tc.pattern) {
+				want = append(want, key)
+			}
+		}
+		keys, vals, err := s.Keys([]byte(tc.pattern), tc.limit, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i, key := range keys {
+			if string(vals[i]) != "v:"+string(key) {
+				t.Fatalf("%s: got %q", key, vals[i])
+			}
+			got = append(got, string(key))
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Fatalf("%s %d: got %d keys %.60q, expected %d keys %.60q",
+				tc.pattern, tc.limit, len(got), got, len(want), want)
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package kvbench
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a key/value database that's served by kvbench. Other packages can
+// add a store with RegisterStore.
+//
+// A store must be safe for concurrent use. The key and value slices that are
+// passed to a store are only valid until the method returns, so the store
+// must copy them when it keeps them. The values that a store returns are only
+// read by the caller and may be shared with the store.
+type Store interface {
+	// Close flushes and closes the store.
+	Close() error
+	// Set sets the value of a key.
+	Set(key, value []byte) error
+	// PSet sets the values of many keys, which is used for pipelined SETs.
+	PSet(keys, values [][]byte) error
+	// Get returns the value of a key and whether it exists.
+	Get(key []byte) ([]byte, bool, error)
+	// PGet returns the values of many keys, which is used for pipelined
+	// GETs.
+	PGet(keys [][]byte) ([][]byte, []bool, error)
+	// Del deletes a key and returns whether it existed.
+	Del(key []byte) (bool, error)
+	// Keys returns the keys that match a Redis glob pattern, at most limit
+	// keys unless limit is -1. The values are returned too when withvalues
+	// is true. Ordered stores return the keys in ascending order.
+	Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error)
+	// FlushDB deletes every key.
+	FlushDB() error
+}
+
+// StoreOption is a store specific option, which is a command line flag of
+// kvbench.
+type StoreOption struct {
+	// Name is the name of the option and its flag, such as "page-size".
+	Name string
+	// Default is the value used when the option isn't provided.
+	Default string
+	// Usage is the help text of the flag.
+	Usage string
+
+	// apply sets the option of a built-in store.
+	apply func(o *storeOptions, value string) error
+}
+
+// StoreOptions are the options that are passed to a StoreFactory.
+type StoreOptions struct {
+	// Fsync is true when writes must be synced to disk before they return.
+	Fsync bool
+
+	values   map[string]string
+	internal storeOptions
+}
+
+// Value returns the value of an option of the store schema. The default is
+// returned when the option isn't provided.
+func (o StoreOptions) Value(name string) string {
+	return o.values[name]
+}
+
+// StoreFactory opens the stores of a type.
+type StoreFactory struct {
+	// Open opens the store at path. The path is the default path when none
+	// is provided, and ":memory:" only when Memory is true.
+	Open func(path string, opts StoreOptions) (Store, error)
+	// DefaultPath is the path used when none is provided. Empty means the
+	// name of the store with a ".db" extension.
+	DefaultPath string
+	// Memory is true when the store accepts the ":memory:" path, which
+	// disables persistence.
+	Memory bool
+	// Network is true when the path is the address of a server instead of
+	// a file.
+	Network bool
+	// EncryptValues wraps the store with one that encrypts the values when
+	// a key file is provided. It's for stores that persist the values as
+	// they are given.
+	EncryptValues bool
+	// Options is the schema of the store specific options.
+	Options []StoreOption
+}
+
+// storeOptions are the options that are passed to the built-in store
+// constructors.
+type storeOptions struct {
+	fsync bool
+	// crypt encrypts the data at rest, when not nil.
+	crypt *crypter
+	// rotate is set when the key is rotated after opening, which resumes
+	// an interrupted rotation.
+	rotate bool
+	// encoding is the encoding of a new AOF.
+	encoding aofEncoding
+	// fs is the filesystem of the AOF and the in-tree engines, nil for the
+	// OS filesystem.
+	fs vfs
+	// values are the store specific options by name.
+	values map[string]string
+	// pageSize, fillPercent and mmapSize tune the bptree store.
+	pageSize    int
+	fillPercent float64
+	mmapSize    int
+	// tierBackend, tierCache, tierSize, tierMode and tierPolicy configure
+	// the tiered store.
+	tierBackend string
+	tierCache   string
+	tierSize    int
+	tierMode    string
+	tierPolicy  string
+	// maxMemory, maxMemoryPolicy and maxMemorySamples limit the memory of
+	// the map and btree stores.
+	maxMemory        int64
+	maxMemoryPolicy  evictPolicy
+	maxMemorySamples int
+	// remotePool, remoteTimeout and remoteKeys configure the remote store.
+	remotePool    int
+	remoteTimeout time.Duration
+	remoteKeys    string
+	// nullValueSize is the size of the value that the null store returns.
+	nullValueSize int
+	// faultyBackend, faultyErrors, faultyDelays and faultyDelay configure
+	// the faulty store.
+	faultyBackend string
+	faultyErrors  [numOps]float64
+	faultyDelays  [numOps]float64
+	faultyDelay   time.Duration
+	// delay, delayJitter, compressMin and logSlower configure the built-in
+	// middleware.
+	delay       time.Duration
+	delayJitter time.Duration
+	compressMin int
+	logSlower   time.Duration
+}
+
+var registry = struct {
+	sync.Mutex
+	names      []string
+	factories  map[string]StoreFactory
+	mwNames    []string
+	middleware map[string]Middleware
+}{
+	factories:  make(map[string]StoreFactory),
+	middleware: make(map[string]Middleware),
+}
+
+// RegisterStore makes a store type available by name, usually from the init
+// function of the package that implements it. It panics when the name is
+// already registered or the factory has no Open function.
+func RegisterStore(name string, factory StoreFactory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if factory.Open == nil {
+		panic("kvbench: RegisterStore factory has no Open function")
+	}
+	if _, ok := registry.factories[name]; ok {
+		panic("kvbench: RegisterStore called twice for store " + name)
+	}
+	registry.names = append(registry.names, name)
+	registry.factories[name] = factory
+}
+
+// RegisteredStores returns the names of the registered stores in the order
+// that they were registered.
+func RegisteredStores() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	return append([]string(nil), registry.names...)
+}
+
+// RegisteredStoreOptions returns the options of every registered store and
+// middleware sorted by name. An option that's shared by stores is only
+// returned once.
+func RegisteredStoreOptions() []StoreOption {
+	registry.Lock()
+	defer registry.Unlock()
+	var opts []StoreOption
+	seen := make(map[string]bool)
+	add := func(schema []StoreOption) {
+		for _, opt := range schema {
+			if !seen[opt.Name] {
+				seen[opt.Name] = true
+				opts = append(opts, opt)
+			}
+		}
+	}
+	for _, name := range registry.names {
+		add(registry.factories[name].Options)
+	}
+	for _, name := range registry.mwNames {
+		add(registry.middleware[name].Options)
+	}
+	sort.Slice(opts, func(i, j int) bool { return opts[i].Name < opts[j].Name })
+	return opts
+}
+
+func isStoreOption(name string) bool {
+	for _, opt := range RegisteredStoreOptions() {
+		if opt.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOptions fills the options of the schema with their defaults and sets
+// the fields of the built-in options.
+func applyOptions(schema []StoreOption, opts *storeOptions) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, opt := range schema {
+		value, ok := opts.values[opt.Name]
+		if !ok {
+			value = opt.Default
+		}
+		values[opt.Name] = value
+		if opt.apply != nil {
+			if err := opt.apply(opts, value); err != nil {
+				return nil, fmt.Errorf("invalid --%s: %v", opt.Name, err)
+			}
+		}
+	}
+	return values, nil
+}
+
+// lookupStore returns the factory of the store type and the path, where an
+// empty path is the default path for the type.
+func lookupStore(which, path string) (StoreFactory, string, error) {
+	registry.Lock()
+	factory, ok := registry.factories[which]
+	registry.Unlock()
+	if !ok {
+		return factory, "", fmt.Errorf("unknown store type: %v, available: %v",
+			which, strings.Join(RegisteredStores(), ","))
+	}
+	if path == "" {
+		path = factory.DefaultPath
+		if path == "" {
+			path = which + ".db"
+		}
+	}
+	return factory, path, nil
+}
+
+// openStore opens the store of the provided type. An empty path means the
+// default path for the type.
+func openStore(which, path string, opts storeOptions) (Store, error) {
+	factory, path, err := lookupStore(which, path)
+	if err != nil {
+		return nil, err
+	}
+	if path == ":memory:" && !factory.Memory {
+		return nil, errMemoryNotAllowed
+	}
+	values, err := applyOptions(factory.Options, &opts)
+	if err != nil {
+		return nil, err
+	}
+	crypt := opts.crypt
+	if factory.EncryptValues {
+		// the values are encrypted by the wrapper
+		opts.crypt = nil
+	}
+	store, err := factory.Open(path, StoreOptions{
+		Fsync:    opts.fsync,
+		values:   values,
+		internal: opts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if factory.EncryptValues {
+		cstore, err := newCryptStore(store, crypt)
+		if err == nil && cstore.rotating && !opts.rotate {
+			err = errRotating
+		}
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		if crypt != nil || cstore.rotating {
+			return cstore, nil
+		}
+	}
+	return store, nil
+}
+
+func intOption(set func(o *storeOptions, n int)) func(*storeOptions, string) error {
+	return func(o *storeOptions, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		set(o, n)
+		return nil
+	}
+}
+
+func stringOption(set func(o *storeOptions, s string)) func(*storeOptions, string) error {
+	return func(o *storeOptions, value string) error {
+		set(o, value)
+		return nil
+	}
+}
+
+func durationOption(set func(o *storeOptions, d time.Duration)) func(*storeOptions, string) error {
+	return func(o *storeOptions, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		set(o, d)
+		return nil
+	}
+}
+
+func init() {
+	memOptions := []StoreOption{
+		{
+			Name:  "maxmemory",
+			Usage: "memory limit of the map and btree stores, such as 100mb",
+			apply: func(o *storeOptions, value string) (err error) {
+				if value != "" {
+					o.maxMemory, err = parseMemory(value)
+				}
+				return err
+			},
+		}, {
+			Name:    "maxmemory-policy",
+			Default: "noeviction",
+			Usage: "eviction policy: noeviction,allkeys-lru,allkeys-lfu," +
+				"allkeys-random",
+			apply: func(o *storeOptions, value string) (err error) {
+				o.maxMemoryPolicy, err = parseEvictPolicy(value)
+				return err
+			},
+		}, {
+			Name:    "maxmemory-samples",
+			Default: "5",
+			Usage:   "number of keys sampled for every eviction",
+			apply: intOption(func(o *storeOptions, n int) {
+				o.maxMemorySamples = n
+			}),
+		},
+	}
+	RegisterStore("map", StoreFactory{
+		Memory:  true,
+		Options: memOptions,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newMapStore(path, opts.internal)
+		},
+	})
+	RegisterStore("btree", StoreFactory{
+		Memory:  true,
+		Options: memOptions,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newBTreeStore(path, opts.internal)
+		},
+	})
+	RegisterStore("smap", StoreFactory{
+		Memory:  true,
+		Options: memOptions,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newShardStore(path, opts.internal, false)
+		},
+	})
+	RegisterStore("sbtree", StoreFactory{
+		Memory:  true,
+		Options: memOptions,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newShardStore(path, opts.internal, true)
+		},
+	})
+	RegisterStore("mvcc", StoreFactory{
+		Memory: true,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newMVCCStore(path, opts.internal)
+		},
+	})
+	RegisterStore("art", StoreFactory{
+		Memory: true,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newARTStore(path, opts.internal)
+		},
+	})
+	RegisterStore("bolt", StoreFactory{
+		EncryptValues: true,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newBoltStore(path, opts.Fsync)
+		},
+	})
+	RegisterStore("leveldb", StoreFactory{
+		EncryptValues: true,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newLevelDBStore(path, opts.Fsync)
+		},
+	})
+	RegisterStore("kv", StoreFactory{
+		EncryptValues: true,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newKVStore(path, opts.Fsync)
+		},
+	})
+	RegisterStore("bitcask", StoreFactory{
+		EncryptValues: true,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newBitcaskStore(path, opts.internal)
+		},
+	})
+	RegisterStore("lsm", StoreFactory{
+		EncryptValues: true,
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newLSMStore(path, opts.internal)
+		},
+	})
+	RegisterStore("bptree", StoreFactory{
+		EncryptValues: true,
+		Options: []StoreOption{
+			{
+				Name:    "page-size",
+				Default: "0",
+				Usage:   "bptree page size, default is the OS page size",
+				apply: intOption(func(o *storeOptions, n int) {
+					o.pageSize = n
+				}),
+			}, {
+				Name:    "fill-percent",
+				Default: "0.5",
+				Usage:   "bptree page fill percent when splitting",
+				apply: func(o *storeOptions, value string) (err error) {
+					o.fillPercent, err = strconv.ParseFloat(value, 64)
+					return err
+				},
+			}, {
+				Name:    "mmap-size",
+				Default: "0",
+				Usage:   "bptree initial mmap size in bytes",
+				apply: intOption(func(o *storeOptions, n int) {
+					o.mmapSize = n
+				}),
+			},
+		},
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newBPTreeStore(path, opts.internal)
+		},
+	})
+	RegisterStore("tiered", StoreFactory{
+		// the backend decides about the ":memory:" path
+		Memory: true,
+		Options: []StoreOption{
+			{
+				Name:    "tier-backend",
+				Default: "leveldb",
+				Usage:   "tiered store backend: bolt,leveldb,kv or any other store",
+				apply: stringOption(func(o *storeOptions, s string) {
+					o.tierBackend = s
+				}),
+			}, {
+				Name:    "tier-cache",
+				Default: "map",
+				Usage:   "tiered store memory tier: map,btree",
+				apply: stringOption(func(o *storeOptions, s string) {
+					o.tierCache = s
+				}),
+			}, {
+				Name:    "tier-size",
+				Default: "67108864",
+				Usage:   "tiered store memory tier size in bytes",
+				apply: intOption(func(o *storeOptions, n int) {
+					o.tierSize = n
+				}),
+			}, {
+				Name:    "tier-mode",
+				Default: "write-through",
+				Usage:   "tiered store write mode: write-through,write-back",
+				apply: stringOption(func(o *storeOptions, s string) {
+					o.tierMode = s
+				}),
+			}, {
+				Name:    "tier-policy",
+				Default: "lru",
+				Usage:   "tiered store eviction policy: lru,clock",
+				apply: stringOption(func(o *storeOptions, s string) {
+					o.tierPolicy = s
+				}),
+			},
+		},
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newTieredStore(path, opts.internal)
+		},
+	})
+	RegisterStore("remote", StoreFactory{
+		// the path is the address of the upstream server
+		DefaultPath:   "127.0.0.1:6379",
+		Network:       true,
+		EncryptValues: true,
+		Options: []StoreOption{
+			{
+				Name:    "remote-pool",
+				Default: "16",
+				Usage:   "remote store connections to the upstream server",
+				apply: intOption(func(o *storeOptions, n int) {
+					o.remotePool = n
+				}),
+			}, {
+				Name:    "remote-timeout",
+				Default: "5s",
+				Usage:   "remote store dial and command timeout, 0 for none",
+				apply: durationOption(func(o *storeOptions, d time.Duration) {
+					o.remoteTimeout = d
+				}),
+			}, {
+				Name:    "remote-keys",
+				Default: "scan",
+				Usage:   "remote store command for KEYS: scan,keys",
+				apply: stringOption(func(o *storeOptions, s string) {
+					o.remoteKeys = s
+				}),
+			},
+		},
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newRemoteStore(path, opts.internal)
+		},
+	})
+	RegisterStore("null", StoreFactory{
+		Memory: true,
+		Options: []StoreOption{
+			{
+				Name:    "null-value-size",
+				Default: "100",
+				Usage:   "null store size of the value that's returned by every read",
+				apply: intOption(func(o *storeOptions, n int) {
+					o.nullValueSize = n
+				}),
+			},
+		},
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newNullStore(opts.internal), nil
+		},
+	})
+	RegisterStore("faulty", StoreFactory{
+		// the backend decides about the ":memory:" path
+		Memory: true,
+		Options: []StoreOption{
+			{
+				Name:    "faulty-backend",
+				Default: "map",
+				Usage:   "faulty store backend: map,btree,bolt or any other store",
+				apply: stringOption(func(o *storeOptions, s string) {
+					o.faultyBackend = s
+				}),
+			}, {
+				Name:    "faulty-errors",
+				Default: "0",
+				Usage:   "faulty store percentage of the operations that fail, such as 10 or get:10,pset:50",
+				apply: func(o *storeOptions, value string) (err error) {
+					o.faultyErrors, err = parseFaultRates(value)
+					return err
+				},
+			}, {
+				Name:    "faulty-delays",
+				Default: "0",
+				Usage:   "faulty store percentage of the operations that are delayed, such as 10 or get:10,pset:50",
+				apply: func(o *storeOptions, value string) (err error) {
+					o.faultyDelays, err = parseFaultRates(value)
+					return err
+				},
+			}, {
+				Name:    "faulty-delay",
+				Default: "10ms",
+				Usage:   "faulty store delay of a delayed operation",
+				apply: durationOption(func(o *storeOptions, d time.Duration) {
+					o.faultyDelay = d
+				}),
+			},
+		},
+		Open: func(path string, opts StoreOptions) (Store, error) {
+			return newFaultyStore(path, opts.internal)
+		},
+	})
+}
@@ -0,0 +1,132 @@
+package kvbench
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStep changes a store and the map of what it must hold.
+type testStep struct {
+	name string
+	run  func(s Store, want map[string]string) error
+}
+
+// testSteps are the writes of the reopen tests.
+var testSteps = []testStep{
+	{"set", func(s Store, want map[string]string) error {
+		for i := 0; i < 500; i++ {
+			key := fmt.Sprintf("key:%04d", i)
+			want[key] = "value:" + key
+			if err := s.Set([]byte(key), []byte(want[key])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"overwrite", func(s Store, want map[string]string) error {
+		for i := 0; i < 500; i += 3 {
+			key := fmt.Sprintf("key:%04d", i)
+			want[key] = strings.Repeat("x", i)
+			if err := s.Set([]byte(key), []byte(want[key])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"del", func(s Store, want map[string]string) error {
+		for i := 0; i < 500; i += 5 {
+			key := fmt.Sprintf("key:%04d", i)
+			ok, err := s.Del([]byte(key))
+			if err != nil {
+				return err
+			}
+			if _, exists := want[key]; ok != exists {
+				return fmt.Errorf("del %s: %v", key, ok)
+			}
+			delete(want, key)
+		}
+		return nil
+	}},
+	{"pset", func(s Store, want map[string]string) error {
+		var keys, values [][]byte
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("pset:%04d", i)
+			want[key] = key
+			keys = append(keys, []byte(key))
+			values = append(values, []byte(key))
+		}
+		return s.PSet(keys, values)
+	}},
+	{"large", func(s Store, want map[string]string) error {
+		want["large"] = strings.Repeat("0123456789", 100000)
+		return s.Set([]byte("large"), []byte(want["large"]))
+	}},
+	{"flushdb", func(s Store, want map[string]string) error {
+		for key := range want {
+			delete(want, key)
+		}
+		if err := s.FlushDB(); err != nil {
+			return err
+		}
+		want["after"] = "flush"
+		return s.Set([]byte("after"), []byte("flush"))
+	}},
+}
+
+// checkStore compares the keys and values of a store with want.
+func checkStore(t *testing.T, s Store, want map[string]string) {
+	t.Helper()
+	keys, vals, err := s.Keys([]byte("*"), -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("got %d keys, expected %d", len(keys), len(want))
+	}
+	for i, key := range keys {
+		if v, ok := want[string(key)]; !ok || v != string(vals[i]) {
+			t.Fatalf("%s: got %.20q (%d bytes), expected %.20q (%d bytes)",
+				key, vals[i], len(vals[i]), v, len(v))
+		}
+	}
+	var sorted []string
+	for key := range want {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	for i := 0; i < len(sorted); i += 10 {
+		key := sorted[i]
+		v, ok, err := s.Get([]byte(key))
+		if err != nil || !ok || string(v) != want[key] {
+			t.Fatalf("get %s: %v %v", key, ok, err)
+		}
+	}
+}
+
+// testReopen runs the steps, reopening the store after each one.
+func testReopen(t *testing.T, which, path string, opts storeOptions) {
+	t.Helper()
+	want := make(map[string]string)
+	for _, step := range testSteps {
+		s, err := openStore(which, path, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		checkStore(t, s, want)
+		if err := step.run(s, want); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		checkStore(t, s, want)
+		if err := s.Close(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+	s, err := openStore(which, path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkStore(t, s, want)
+}
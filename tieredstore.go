@@ -0,0 +1,635 @@
+package kvbench
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tidwall/btree"
+	"github.com/tidwall/match"
+)
+
+// tierEntrySize is the estimated memory overhead of a cached entry.
+const tierEntrySize = 96
+
+// tierEntry is a cached key. In write-back mode a dirty entry has not been
+// written to the backend yet, and a deleted entry is a pending delete.
+type tierEntry struct {
+	key     string
+	value   []byte
+	dirty   bool
+	deleted bool
+	// lru list, or clock slot and reference bit
+	prev, next *tierEntry
+	slot       int
+	ref        bool
+}
+
+func (e *tierEntry) Less(v btree.Item, ctx interface{}) bool {
+	return e.key < v.(*tierEntry).key
+}
+
+func (e *tierEntry) size() int {
+	return len(e.key) + len(e.value) + tierEntrySize
+}
+
+// tierIndex holds the cached entries.
+type tierIndex interface {
+	get(key string) *tierEntry
+	set(e *tierEntry)
+	del(key string)
+	// ascend iterates over the entries with a key that's greater than or
+	// equal to pivot. The map index ignores the pivot and isn't ordered.
+	ascend(pivot string, iter func(e *tierEntry) bool)
+}
+
+type tierMap map[string]*tierEntry
+
+func (m tierMap) get(key string) *tierEntry { return m[key] }
+func (m tierMap) set(e *tierEntry)          { m[e.key] = e }
+func (m tierMap) del(key string)            { delete(m, key) }
+func (m tierMap) ascend(pivot string, iter func(e *tierEntry) bool) {
+	for _, e := range m {
+		if !iter(e) {
+			return
+		}
+	}
+}
+
+type tierBTree struct {
+	tr *btree.BTree
+}
+
+func (t tierBTree) get(key string) *tierEntry {
+	v := t.tr.Get(&tierEntry{key: key})
+	if v == nil {
+		return nil
+	}
+	return v.(*tierEntry)
+}
+func (t tierBTree) set(e *tierEntry) { t.tr.ReplaceOrInsert(e) }
+func (t tierBTree) del(key string)   { t.tr.Delete(&tierEntry{key: key}) }
+func (t tierBTree) ascend(pivot string, iter func(e *tierEntry) bool) {
+	t.tr.AscendGreaterOrEqual(&tierEntry{key: pivot}, func(v btree.Item) bool {
+		return iter(v.(*tierEntry))
+	})
+}
+
+// tierPolicy picks the entries that are evicted.
+type tierPolicy interface {
+	add(e *tierEntry)
+	touch(e *tierEntry)
+	remove(e *tierEntry)
+	// victim returns the next entry to evict, or nil when empty.
+	victim() *tierEntry
+}
+
+// tierLRU evicts the least recently used entry.
+type tierLRU struct {
+	head tierEntry // head.next is the most recently used
+}
+
+func newTierLRU() *tierLRU {
+	l := &tierLRU{}
+	l.head.next = &l.head
+	l.head.prev = &l.head
+	return l
+}
+
+func (l *tierLRU) add(e *tierEntry) {
+	e.prev = &l.head
+	e.next = l.head.next
+	e.next.prev = e
+	l.head.next = e
+}
+
+func (l *tierLRU) touch(e *tierEntry) {
+	l.remove(e)
+	l.add(e)
+}
+
+func (l *tierLRU) remove(e *tierEntry) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
+}
+
+func (l *tierLRU) victim() *tierEntry {
+	if l.head.prev == &l.head {
+		return nil
+	}
+	return l.head.prev
+}
+
+// tierClock approximates LRU with a reference bit per entry and a hand that
+// sweeps the entries, which makes a hit cheaper than moving an entry in the
+// LRU list.
+type tierClock struct {
+	ring []*tierEntry
+	free []int
+	hand int
+	n    int
+}
+
+func (c *tierClock) add(e *tierEntry) {
+	if len(c.free) > 0 {
+		e.slot = c.free[len(c.free)-1]
+		c.free = c.free[:len(c.free)-1]
+		c.ring[e.slot] = e
+	} else {
+		e.slot = len(c.ring)
+		c.ring = append(c.ring, e)
+	}
+	c.n++
+}
+
+func (c *tierClock) touch(e *tierEntry) {
+	e.ref = true
+}
+
+func (c *tierClock) remove(e *tierEntry) {
+	c.ring[e.slot] = nil
+	c.free = append(c.free, e.slot)
+	c.n--
+}
+
+func (c *tierClock) victim() *tierEntry {
+	if c.n == 0 {
+		return nil
+	}
+	for {
+		if c.hand >= len(c.ring) {
+			c.hand = 0
+		}
+		e := c.ring[c.hand]
+		c.hand++
+		if e == nil {
+			continue
+		}
+		if !e.ref {
+			return e
+		}
+		e.ref = false
+	}
+}
+
+// tieredStore is a bounded in-memory tier in front of a persistent store.
+// In write-through mode every write goes to the backend before it's cached.
+// In write-back mode writes are only cached and the dirty entries are
+// written to the backend when they are evicted, every second and on close.
+type tieredStore struct {
+	mu        sync.Mutex
+	backend   Store
+	index     tierIndex
+	newIndex  func() tierIndex
+	policy    tierPolicy
+	writeBack bool
+	maxSize   int
+	size      int
+	count     int
+	dirty     int
+	closed    bool
+	done      chan bool
+	opts      storeOptions
+
+	hits, misses, evictions, flushes int64
+}
+
+func newTieredStore(path string, opts storeOptions) (*tieredStore, error) {
+	if opts.tierBackend == "" || opts.tierBackend == "tiered" {
+		return nil, fmt.Errorf("invalid tier backend: %q", opts.tierBackend)
+	}
+	s := &tieredStore{opts: opts, maxSize: opts.tierSize,
+		done: make(chan bool)}
+	switch opts.tierCache {
+	case "", "map":
+		s.newIndex = func() tierIndex { return tierMap{} }
+	case "btree":
+		s.newIndex = func() tierIndex { return tierBTree{btree.New(32, nil)} }
+	default:
+		return nil, fmt.Errorf("unknown tier cache: %v", opts.tierCache)
+	}
+	switch opts.tierMode {
+	case "", "write-through":
+	case "write-back":
+		s.writeBack = true
+	default:
+		return nil, fmt.Errorf("unknown tier mode: %v", opts.tierMode)
+	}
+	switch opts.tierPolicy {
+	case "", "lru":
+		s.policy = newTierLRU()
+	case "clock":
+		s.policy = &tierClock{}
+	default:
+		return nil, fmt.Errorf("unknown tier policy: %v", opts.tierPolicy)
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = 64 * 1024 * 1024
+	}
+	s.index = s.newIndex()
+	backend, err := openStore(opts.tierBackend, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.backend = backend
+	if s.writeBack {
+		go s.bgFlush()
+	}
+	return s, nil
+}
+
+func (s *tieredStore) bgFlush() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		s.mu.Lock()
+		if !s.closed {
+			if err := s.flushDirty(); err != nil {
+				log.Warningf("tier flush: %v", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// flushDirty writes the dirty entries to the backend.
+func (s *tieredStore) flushDirty() error {
+	if s.dirty == 0 {
+		return nil
+	}
+	var entries []*tierEntry
+	s.index.ascend("", func(e *tierEntry) bool {
+		if e.dirty {
+			entries = append(entries, e)
+		}
+		return true
+	})
+	if err := s.writeEntries(entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e.dirty = false
+		s.dirty--
+		if e.deleted {
+			s.drop(e)
+		}
+	}
+	s.flushes++
+	return nil
+}
+
+// writeEntries writes dirty entries to the backend.
+func (s *tieredStore) writeEntries(entries []*tierEntry) error {
+	var keys, values [][]byte
+	for _, e := range entries {
+		if e.deleted {
+			if _, err := s.backend.Del([]byte(e.key)); err != nil {
+				return err
+			}
+		} else {
+			keys = append(keys, []byte(e.key))
+			values = append(values, e.value)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.backend.PSet(keys, values)
+}
+
+func (s *tieredStore) drop(e *tierEntry) {
+	s.index.del(e.key)
+	s.policy.remove(e)
+	s.size -= e.size()
+	s.count--
+	if e.dirty {
+		s.dirty--
+	}
+}
+
+// put caches a value. A nil value with deleted set caches a pending delete.
+func (s *tieredStore) put(key string, value []byte, dirty, deleted bool) {
+	if e := s.index.get(key); e != nil {
+		s.size -= e.size()
+		if e.dirty {
+			s.dirty--
+		}
+		e.value, e.dirty, e.deleted = value, dirty, deleted
+		s.size += e.size()
+		if dirty {
+			s.dirty++
+		}
+		s.policy.touch(e)
+		return
+	}
+	e := &tierEntry{key: key, value: value, dirty: dirty, deleted: deleted}
+	s.index.set(e)
+	s.policy.add(e)
+	s.size += e.size()
+	s.count++
+	if dirty {
+		s.dirty++
+	}
+}
+
+// evict removes entries until the tier fits. Dirty entries are written to
+// the backend first.
+func (s *tieredStore) evict() error {
+	var victims []*tierEntry
+	var dirty []*tierEntry
+	for s.size > s.maxSize {
+		e := s.policy.victim()
+		if e == nil {
+			break
+		}
+		if e.dirty {
+			dirty = append(dirty, e)
+		}
+		s.drop(e)
+		victims = append(victims, e)
+	}
+	if err := s.writeEntries(dirty); err != nil {
+		// keep the entries that could not be written
+		for _, e := range victims {
+			if e.dirty {
+				s.put(e.key, e.value, true, e.deleted)
+			}
+		}
+		return err
+	}
+	s.evictions += int64(len(victims))
+	return nil
+}
+
+func (s *tieredStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	err := s.flushDirty()
+	if cerr := s.backend.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *tieredStore) Set(key, value []byte) error {
+	return s.PSet([][]byte{key}, [][]byte{value})
+}
+
+func (s *tieredStore) PSet(keys, values [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.writeBack {
+		if err := s.backend.PSet(keys, values); err != nil {
+			return err
+		}
+	}
+	for i := range keys {
+		s.put(string(keys[i]), bcopy(values[i]), s.writeBack, false)
+	}
+	return s.evict()
+}
+
+// get returns a value from the tier, or from the backend which caches it.
+func (s *tieredStore) get(key []byte) ([]byte, bool, error) {
+	if e := s.index.get(string(key)); e != nil {
+		s.hits++
+		s.policy.touch(e)
+		if e.deleted {
+			return nil, false, nil
+		}
+		return e.value, true, nil
+	}
+	s.misses++
+	v, ok, err := s.backend.Get(key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	v = bcopy(v)
+	s.put(string(key), v, false, false)
+	return v, true, s.evict()
+}
+
+func (s *tieredStore) Get(key []byte) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key)
+}
+
+func (s *tieredStore) PGet(keys [][]byte) ([][]byte, []bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([][]byte, len(keys))
+	oks := make([]bool, len(keys))
+	for i := range keys {
+		var err error
+		values[i], oks[i], err = s.get(keys[i])
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, oks, nil
+}
+
+func (s *tieredStore) Del(key []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.index.get(string(key))
+	if s.writeBack && e != nil {
+		if e.deleted {
+			return false, nil
+		}
+		s.put(e.key, nil, true, true)
+		return true, s.evict()
+	}
+	ok, err := s.backend.Del(key)
+	if err != nil {
+		return false, err
+	}
+	if e != nil {
+		s.drop(e)
+	}
+	return ok, nil
+}
+
+// Keys merges the keys of the backend with the dirty entries of the tier.
+func (s *tieredStore) Keys(pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keys(nil, false, pattern, limit, withvalues)
+}
+
+func (s *tieredStore) keysFrom(start, pattern []byte, limit int, withvalues bool) ([][]byte, [][]byte, error) {
+	return s.keys(start, true, pattern, limit, withvalues)
+}
+
+// keys is Keys, or keysFrom when ranged is set.
+func (s *tieredStore) keys(start []byte, ranged bool, pattern []byte,
+	limit int, withvalues bool,
+) ([][]byte, [][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backendKeys := func(limit int) ([][]byte, [][]byte, error) {
+		if ranged {
+			return keysFrom(s.backend, start, pattern, limit, withvalues)
+		}
+		return s.backend.Keys(pattern, limit, withvalues)
+	}
+	if s.dirty == 0 {
+		return backendKeys(limit)
+	}
+	// A pending delete may remove a key from the backend results, so ask
+	// for enough keys to still fill the limit.
+	blimit := limit
+	if limit > -1 {
+		blimit += s.dirty
+	}
+	keys, vals, err := backendKeys(blimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	spattern := string(pattern)
+	min, max := match.Allowable(spattern)
+	useMax := !(len(spattern) > 0 && spattern[0] == '*')
+	if string(start) > min {
+		min = string(start)
+	}
+	merged := make(map[string]*tierEntry)
+	s.index.ascend(min, func(e *tierEntry) bool {
+		if _, ordered := s.index.(tierBTree); ordered && useMax &&
+			e.key >= max {
+			return false
+		}
+		if e.dirty && e.key >= string(start) && match.Match(e.key, spattern) {
+			merged[e.key] = e
+		}
+		return true
+	})
+	type kv struct {
+		key   string
+		value []byte
+	}
+	var all []kv
+	for i := range keys {
+		if _, ok := merged[string(keys[i])]; ok {
+			continue
+		}
+		var value []byte
+		if withvalues {
+			value = vals[i]
+		}
+		all = append(all, kv{string(keys[i]), value})
+	}
+	for _, e := range merged {
+		if !e.deleted {
+			all = append(all, kv{e.key, bcopy(e.value)})
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].key < all[j].key })
+	if limit > -1 && len(all) > limit {
+		all = all[:limit]
+	}
+	keys, vals = nil, nil
+	for _, item := range all {
+		keys = append(keys, []byte(item.key))
+		if withvalues {
+			vals = append(vals, item.value)
+		}
+	}
+	return keys, vals, nil
+}
+
+func (s *tieredStore) FlushDB() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.backend.FlushDB(); err != nil {
+		return err
+	}
+	s.index = s.newIndex()
+	if s.opts.tierPolicy == "clock" {
+		s.policy = &tierClock{}
+	} else {
+		s.policy = newTierLRU()
+	}
+	s.size, s.count, s.dirty = 0, 0, 0
+	return nil
+}
+
+func (s *tieredStore) scan(iter func(key, value []byte) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushDirty(); err != nil {
+		return err
+	}
+	return scanStore(s.backend, iter)
+}
+
+func (s *tieredStore) rotateKey(crypt *crypter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushDirty(); err != nil {
+		return err
+	}
+	r, ok := s.backend.(keyRotator)
+	if !ok {
+		cstore, err := newCryptStore(s.backend, nil)
+		if err != nil {
+			return err
+		}
+		r = cstore
+	}
+	if err := r.rotateKey(crypt); err != nil {
+		return err
+	}
+	s.backend = r.(Store)
+	return nil
+}
+
+func (s *tieredStore) info(buf []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mode := "write-through"
+	if s.writeBack {
+		mode = "write-back"
+	}
+	policy := "lru"
+	if _, ok := s.policy.(*tierClock); ok {
+		policy = "clock"
+	}
+	cache := "map"
+	if _, ok := s.index.(tierBTree); ok {
+		cache = "btree"
+	}
+	var hitRate float64
+	if s.hits+s.misses > 0 {
+		hitRate = float64(s.hits) / float64(s.hits+s.misses)
+	}
+	buf = append(buf, "# Tiered\r\n"...)
+	buf = append(buf, fmt.Sprintf("backend:%s\r\n", s.opts.tierBackend)...)
+	buf = append(buf, fmt.Sprintf("cache:%s\r\n", cache)...)
+	buf = append(buf, fmt.Sprintf("mode:%s\r\n", mode)...)
+	buf = append(buf, fmt.Sprintf("policy:%s\r\n", policy)...)
+	buf = append(buf, fmt.Sprintf("cached_keys:%d\r\n", s.count)...)
+	buf = append(buf, fmt.Sprintf("cached_bytes:%d\r\n", s.size)...)
+	buf = append(buf, fmt.Sprintf("max_bytes:%d\r\n", s.maxSize)...)
+	buf = append(buf, fmt.Sprintf("dirty_keys:%d\r\n", s.dirty)...)
+	buf = append(buf, fmt.Sprintf("hits:%d\r\n", s.hits)...)
+	buf = append(buf, fmt.Sprintf("misses:%d\r\n", s.misses)...)
+	buf = append(buf, fmt.Sprintf("hit_rate:%.4f\r\n", hitRate)...)
+	buf = append(buf, fmt.Sprintf("evictions:%d\r\n", s.evictions)...)
+	buf = append(buf, fmt.Sprintf("flushes:%d\r\n", s.flushes)...)
+	if b, ok := s.backend.(infoer); ok {
+		buf = append(buf, "\r\n"...)
+		buf = b.info(buf)
+	}
+	return buf
+}
@@ -0,0 +1,114 @@
+package kvbench
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTieredReopen(t *testing.T) {
+	for _, mode := range []string{"write-through", "write-back"} {
+		for _, policy := range []string{"lru", "clock"} {
+			// a tier that holds every key, and one that evicts often
+			for _, size := range []string{"67108864", "4096"} {
+				name := fmt.Sprintf("%s,%s,%s", mode, policy, size)
+				t.Run(name, func(t *testing.T) {
+					path := filepath.Join(t.TempDir(), "tiered")
+					testReopen(t, "tiered", path, storeOptions{
+						values: map[string]string{
+							"tier-backend": "btree",
+							"tier-mode":    mode,
+							"tier-policy":  policy,
+							"tier-size":    size,
+						}})
+				})
+			}
+		}
+	}
+}
+
+func TestTieredWriteBackKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiered")
+	opts := storeOptions{values: map[string]string{
+		"tier-backend": "btree",
+		"tier-cache":   "btree",
+		"tier-mode":    "write-back",
+	}}
+	s, err := openStore("tiered", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range strings.Fields("a b c d e") {
+		if err := s.Set([]byte(key), []byte("old:"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the dirty entries are written to the backend on close
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = openStore("tiered", path, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// dirty entries, and pending deletes of cached keys
+	for _, key := range strings.Fields("b bb f") {
+		if err := s.Set([]byte(key), []byte("new:"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range strings.Fields("a d") {
+		if _, _, err := s.Get([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := s.Del([]byte(key)); err != nil || !ok {
+			t.Fatalf("del %s: %v %v", key, ok, err)
+		}
+	}
+	ts := s.(*tieredStore)
+	ts.mu.Lock()
+	dirty := ts.dirty
+	bkeys, _, err := ts.backend.Keys([]byte("*"), -1, false)
+	ts.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirty != 5 || len(bkeys) != 5 {
+		t.Fatalf("got %d dirty entries and %d backend keys", dirty, len(bkeys))
+	}
+	tests := []struct {
+		pattern string
+		limit   int
+		keys    string
+	}{
+		{"*", -1, "b bb c e f"},
+		{"*", 2, "b bb"},
+		{"*", 3, "b bb c"},
+		{"b*", -1, "b bb"},
+		{"a*", -1, ""},
+		{"[ad]", 1, ""},
+		{"?", -1, "b c e f"},
+	}
+	for _, tc := range tests {
+		keys, vals, err := s.Keys([]byte(tc.pattern), tc.limit, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i, key := range keys {
+			want := "old:" + string(key)
+			if strings.Contains("b bb f", string(key)) {
+				want = "new:" + string(key)
+			}
+			if string(vals[i]) != want {
+				t.Fatalf("%s: got %q, expected %q", key, vals[i], want)
+			}
+			got = append(got, string(key))
+		}
+		if strings.Join(got, " ") != tc.keys {
+			t.Fatalf("%s %d: got %q, expected %q", tc.pattern, tc.limit,
+				got, tc.keys)
+		}
+	}
+}
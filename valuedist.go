@@ -0,0 +1,257 @@
+package kvbench
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// valueSizes chooses the value sizes of a benchmark. It's safe for
+// concurrent use.
+type valueSizes interface {
+	next(rnd *rand.Rand) int
+	// max is the largest size.
+	max() int
+	String() string
+}
+
+type constantSizes int
+
+func (s constantSizes) next(rnd *rand.Rand) int { return int(s) }
+func (s constantSizes) max() int                { return int(s) }
+func (s constantSizes) String() string          { return strconv.Itoa(int(s)) }
+
+// uniformSizes are the sizes from lo to hi.
+type uniformSizes struct {
+	lo, hi int
+}
+
+func (s uniformSizes) next(rnd *rand.Rand) int {
+	return s.lo + rnd.Intn(s.hi-s.lo+1)
+}
+
+func (s uniformSizes) max() int { return s.hi }
+
+func (s uniformSizes) String() string {
+	return fmt.Sprintf("uniform %d-%d", s.lo, s.hi)
+}
+
+// normalSizes is a normal distribution that is cut off at lo and hi.
+type normalSizes struct {
+	mean, stddev float64
+	lo, hi       int
+}
+
+func (s normalSizes) next(rnd *rand.Rand) int {
+	n := int(math.Round(rnd.NormFloat64()*s.stddev + s.mean))
+	if n < s.lo {
+		return s.lo
+	}
+	if n > s.hi {
+		return s.hi
+	}
+	return n
+}
+
+func (s normalSizes) max() int { return s.hi }
+
+func (s normalSizes) String() string {
+	return fmt.Sprintf("normal %v±%v", s.mean, s.stddev)
+}
+
+// maxValueSize is the largest value size of a benchmark, the largest bulk
+// string of Redis.
+const maxValueSize = 512 << 20
+
+// parseValueSizes returns the named size distribution. The sizes are
+// parsed by parseMemory. A constant distribution has the given size, a
+// uniform one goes from lo to hi, where hi defaults to size, and a normal
+// one has the size as its mean and is cut off at lo and hi, where hi
+// defaults to twice the size. A histogram is read from a file.
+func parseValueSizes(name, size, lo, hi, stddev, hist string,
+) (valueSizes, error) {
+	if name == "histogram" {
+		if hist == "" {
+			return nil, errors.New("a histogram needs a --value-hist file")
+		}
+		s, err := loadHistogramSizes(hist)
+		if err != nil {
+			return nil, err
+		}
+		if s.max() > maxValueSize {
+			return nil, fmt.Errorf("%s: size larger than %d", hist, maxValueSize)
+		}
+		return s, nil
+	}
+	parse := func(flag, s string, def int64) (int, error) {
+		if s == "" {
+			if def > maxValueSize {
+				def = maxValueSize
+			}
+			return int(def), nil
+		}
+		n, err := parseMemory(s)
+		if err != nil || n > maxValueSize {
+			return 0, fmt.Errorf("invalid --%s: %v", flag, s)
+		}
+		return int(n), nil
+	}
+	n, err := parse("value-size", size, 0)
+	if err != nil {
+		return nil, err
+	}
+	min, err := parse("value-min", lo, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "constant":
+		return constantSizes(n), nil
+	case "uniform":
+		max, err := parse("value-max", hi, int64(n))
+		if err != nil {
+			return nil, err
+		}
+		if min > max {
+			return nil, fmt.Errorf("--value-min is larger than %d", max)
+		}
+		return uniformSizes{min, max}, nil
+	case "normal":
+		max, err := parse("value-max", hi, 2*int64(n))
+		if err != nil {
+			return nil, err
+		}
+		sd, err := parse("value-stddev", stddev, int64(n/4))
+		if err != nil {
+			return nil, err
+		}
+		if min > max {
+			return nil, fmt.Errorf("--value-min is larger than %d", max)
+		}
+		return normalSizes{float64(n), float64(sd), min, max}, nil
+	}
+	return nil, fmt.Errorf("unknown value distribution: %v", name)
+}
+
+// histogramSizes chooses the sizes of a histogram file by their weights.
+type histogramSizes struct {
+	path  string
+	sizes []int
+	// cum are the cumulative weights of the sizes.
+	cum []float64
+}
+
+func (s *histogramSizes) next(rnd *rand.Rand) int {
+	u := rnd.Float64() * s.cum[len(s.cum)-1]
+	i := sort.Search(len(s.cum), func(i int) bool { return s.cum[i] > u })
+	if i == len(s.sizes) {
+		i--
+	}
+	return s.sizes[i]
+}
+
+func (s *histogramSizes) max() int {
+	var max int
+	for _, size := range s.sizes {
+		if size > max {
+			max = size
+		}
+	}
+	return max
+}
+
+func (s *histogramSizes) String() string { return "histogram " + s.path }
+
+// loadHistogramSizes reads a histogram file, which has a size and a weight
+// on every line, such as "4kb 10". Empty lines and lines that start with
+// '#' are skipped.
+func loadHistogramSizes(path string) (*histogramSizes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &histogramSizes{path: path}
+	var total float64
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a size and a weight",
+				path, line)
+		}
+		size, err := parseMemory(fields[0])
+		if err != nil || size > math.MaxInt32 {
+			return nil, fmt.Errorf("%s:%d: invalid size: %v", path, line,
+				fields[0])
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid weight: %v", path, line,
+				fields[1])
+		}
+		total += weight
+		s.sizes = append(s.sizes, int(size))
+		s.cum = append(s.cum, total)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s: no sizes with a weight", path)
+	}
+	return s, nil
+}
+
+// valuePoolChunk is the size of the pieces of a value pool that compress
+// to the ratio by themselves.
+const valuePoolChunk = 100
+
+// valuePool is random data that compresses to about a ratio of its size,
+// like the values of LevelDB's db_bench. Values are slices of the pool at
+// random offsets, so that they don't need to be generated for every
+// request.
+type valuePool struct {
+	data []byte
+}
+
+// newValuePool returns a pool for values up to max bytes, with a
+// compression ratio between 0 and 1, where 1 is incompressible.
+func newValuePool(max int, ratio float64, rnd *rand.Rand) *valuePool {
+	p := &valuePool{data: make([]byte, max+1<<20)}
+	raw := int(valuePoolChunk * ratio)
+	if raw < 1 {
+		raw = 1
+	}
+	for i := 0; i < len(p.data); i += valuePoolChunk {
+		chunk := p.data[i:]
+		if len(chunk) > valuePoolChunk {
+			chunk = chunk[:valuePoolChunk]
+		}
+		// random bytes, repeated to fill the chunk
+		n := raw
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		rnd.Read(chunk[:n])
+		for j := n; j < len(chunk); j++ {
+			chunk[j] = chunk[j-raw]
+		}
+	}
+	return p
+}
+
+// value returns a value of n bytes.
+func (p *valuePool) value(rnd *rand.Rand, n int) []byte {
+	off := rnd.Intn(len(p.data) - n + 1)
+	return p.data[off : off+n : off+n]
+}
@@ -0,0 +1,163 @@
+package kvbench
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseValueSizes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name, size, lo, hi, stddev string
+		min, max                   int
+	}{
+		{"constant", "1kb", "", "", "", 1024, 1024},
+		{"uniform", "100", "", "", "", 0, 100},
+		{"uniform", "100", "10", "20", "", 10, 20},
+		{"uniform", "7", "7", "", "", 7, 7},
+		{"normal", "100", "", "", "", 0, 200},
+		{"normal", "100", "90", "110", "50", 90, 110},
+	}
+	for _, tc := range tests {
+		s, err := parseValueSizes(tc.name, tc.size, tc.lo, tc.hi, tc.stddev, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.max() != tc.max {
+			t.Fatalf("%v: max %d, expected %d", s, s.max(), tc.max)
+		}
+		// the bounds are reached, and never exceeded
+		lo, hi := tc.max, tc.min
+		for i := 0; i < 10000; i++ {
+			n := s.next(rnd)
+			if n < tc.min || n > tc.max {
+				t.Fatalf("%v: size %d out of %d-%d", s, n, tc.min, tc.max)
+			}
+			if n < lo {
+				lo = n
+			}
+			if n > hi {
+				hi = n
+			}
+		}
+		if tc.stddev != "" && (lo != tc.min || hi != tc.max) {
+			t.Fatalf("%v: sizes %d-%d, expected %d-%d", s, lo, hi, tc.min,
+				tc.max)
+		}
+	}
+	// the mean of a normal distribution is its size
+	s, _ := parseValueSizes("normal", "1000", "", "", "", "")
+	var sum int
+	for i := 0; i < 10000; i++ {
+		sum += s.next(rnd)
+	}
+	if mean := sum / 10000; mean < 990 || mean > 1010 {
+		t.Fatalf("mean %d, expected 1000", mean)
+	}
+
+	for _, args := range [][6]string{
+		{"uniform", "100", "200", "", "", ""},
+		{"normal", "100", "300", "", "", ""},
+		{"constant", "x", "", "", "", ""},
+		{"constant", "1gb", "", "", "", ""},
+		{"uniform", "1", "", "-1", "", ""},
+		{"pareto", "1", "", "", "", ""},
+		{"histogram", "", "", "", "", ""},
+	} {
+		if _, err := parseValueSizes(args[0], args[1], args[2], args[3],
+			args[4], args[5]); err == nil {
+			t.Fatalf("expected an error for %q", args)
+		}
+	}
+}
+
+func TestHistogramSizes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(data string) string {
+		path := filepath.Join(dir, "sizes.txt")
+		if err := ioutil.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	for _, tc := range []struct{ data, err string }{
+		{"100\n", "expected a size and a weight"},
+		{"100 1 2\n", "expected a size and a weight"},
+		{"# sizes\n\nx 1\n", ":3: invalid size"},
+		{"100 x\n", "invalid weight"},
+		{"100 -1\n", "invalid weight"},
+		{"100 0\n# 200 1\n", "no sizes with a weight"},
+		{"", "no sizes with a weight"},
+		{"1gb 1\n", "size larger than"},
+	} {
+		_, err := parseValueSizes("histogram", "", "", "", "", write(tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Fatalf("%q: %v", tc.data, err)
+		}
+	}
+	if _, err := parseValueSizes("histogram", "", "", "", "",
+		filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+
+	path := write("# size weight\n10 1\n1kb 3\n\n100 0\n4kb 6\n")
+	s, err := parseValueSizes("histogram", "", "", "", "", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.max() != 4096 {
+		t.Fatalf("max %d, expected 4096", s.max())
+	}
+	// the sizes are chosen by their weights
+	rnd := rand.New(rand.NewSource(1))
+	counts := map[int]int{}
+	const n = 100000
+	for i := 0; i < n; i++ {
+		counts[s.next(rnd)]++
+	}
+	if len(counts) != 3 || counts[100] != 0 {
+		t.Fatalf("sizes %v", counts)
+	}
+	for size, weight := range map[int]float64{10: 1, 1024: 3, 4096: 6} {
+		if got := float64(counts[size]) / n; got < weight/10-0.01 ||
+			got > weight/10+0.01 {
+			t.Fatalf("size %d chosen %.3f of the time, expected %.1f",
+				size, got, weight/10)
+		}
+	}
+}
+
+func TestValuePool(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		ratio, lo, hi float64
+	}{
+		{0.5, 0.45, 0.6},
+		{1, 0.95, 1.05},
+	} {
+		p := newValuePool(4096, tc.ratio, rnd)
+		if len(p.data) < 4096 {
+			t.Fatalf("pool of %d bytes", len(p.data))
+		}
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		w.Write(p.data)
+		w.Close()
+		ratio := float64(buf.Len()) / float64(len(p.data))
+		if ratio < tc.lo || ratio > tc.hi {
+			t.Fatalf("ratio %v compressed to %.3f", tc.ratio, ratio)
+		}
+		for _, n := range []int{0, 1, 100, 4096} {
+			v := p.value(rnd, n)
+			if len(v) != n || cap(v) != n {
+				t.Fatalf("value of %d bytes, cap %d, expected %d", len(v),
+					cap(v), n)
+			}
+		}
+	}
+}
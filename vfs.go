@@ -0,0 +1,602 @@
+package kvbench
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// vfs is the filesystem that's used by the AOF and by the in-tree engines,
+// which allows for testing them against an in-memory filesystem that
+// injects faults. A nil vfs in the store options is the OS filesystem.
+type vfs interface {
+	OpenFile(name string, flag int, perm os.FileMode) (vfsFile, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	// SyncDir makes the creates, renames and removes of the files in a
+	// directory durable.
+	SyncDir(dirname string) error
+}
+
+// vfsFile is a file of a vfs. The *os.File type implements it.
+type vfsFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// filesystem returns the vfs of the options.
+func (o *storeOptions) filesystem() vfs {
+	if o.fs == nil {
+		return osFS{}
+	}
+	return o.fs
+}
+
+func vfsCreate(fs vfs, name string) (vfsFile, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func vfsOpen(fs vfs, name string) (vfsFile, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func vfsReadFile(fs vfs, name string) ([]byte, error) {
+	f, err := vfsOpen(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// mmapShares returns true when the writes to the file are visible in its
+// mapping, which is only the case for an OS file.
+func mmapShares(f vfsFile) bool {
+	_, ok := f.(*os.File)
+	return ok && mmapShared
+}
+
+// osFS is the OS filesystem.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (vfsFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// not a nil vfsFile holding a nil *os.File
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (osFS) SyncDir(dirname string) error {
+	if runtime.GOOS == "windows" {
+		// directories can't be synced, and renames are durable
+		return nil
+	}
+	f, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// memFS is an in-memory filesystem. It keeps the synced contents of every
+// file apart from the written contents, so that a crash can drop the data
+// that wasn't synced. In the same way the creates, renames and removes of
+// files are only durable once their directory is synced. Creating a
+// directory is durable right away.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	// durable are the files of the synced directory entries.
+	durable map[string]*memNode
+	dirs    map[string]bool
+	// gen is incremented by a crash, which invalidates the open files.
+	gen int
+}
+
+type memNode struct {
+	data    []byte
+	synced  []byte
+	modTime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memNode),
+		durable: make(map[string]*memNode),
+		dirs:    map[string]bool{".": true, string(filepath.Separator): true}}
+}
+
+func (fs *memFS) OpenFile(name string, flag int, perm os.FileMode) (vfsFile, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.dirs[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	node, ok := fs.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	return &memFile{fs: fs, node: node, name: name, flag: flag, gen: fs.gen}, nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if fs.dirs[name] {
+		for fname := range fs.files {
+			if filepath.Dir(fname) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	node, ok := fs.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath,
+			Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = node
+	return nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if node, ok := fs.files[name]; ok {
+		return memFileInfo{name: filepath.Base(name),
+			size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if fs.dirs[name] {
+		return memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *memFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for ; ; path = filepath.Dir(path) {
+		if _, ok := fs.files[path]; ok {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		fs.dirs[path] = true
+		if parent := filepath.Dir(path); parent == path {
+			return nil
+		}
+	}
+}
+
+func (fs *memFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	dirname = filepath.Clean(dirname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[dirname] {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+	var fis []os.FileInfo
+	for name, node := range fs.files {
+		if filepath.Dir(name) == dirname {
+			fis = append(fis, memFileInfo{name: filepath.Base(name),
+				size: int64(len(node.data)), modTime: node.modTime})
+		}
+	}
+	for name := range fs.dirs {
+		if name != dirname && filepath.Dir(name) == dirname {
+			fis = append(fis, memFileInfo{name: filepath.Base(name), dir: true})
+		}
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (fs *memFS) SyncDir(dirname string) error {
+	dirname = filepath.Clean(dirname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.dirs[dirname] {
+		return &os.PathError{Op: "open", Path: dirname, Err: os.ErrNotExist}
+	}
+	for name := range fs.durable {
+		if filepath.Dir(name) == dirname {
+			delete(fs.durable, name)
+		}
+	}
+	for name, node := range fs.files {
+		if filepath.Dir(name) == dirname {
+			fs.durable[name] = node
+		}
+	}
+	return nil
+}
+
+// crash drops the data and the directory entries that weren't synced, like
+// a power loss. The files that are open stop working and must be opened
+// again.
+func (fs *memFS) crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files = make(map[string]*memNode)
+	for name, node := range fs.durable {
+		node.data = append([]byte(nil), node.synced...)
+		fs.files[name] = node
+	}
+	fs.gen++
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+
+type memFile struct {
+	fs     *memFS
+	node   *memNode
+	name   string
+	flag   int
+	gen    int
+	off    int64
+	closed bool
+}
+
+// check returns an error when the file can't be used. The caller holds the
+// filesystem lock.
+func (f *memFile) check(op string) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if f.gen != f.fs.gen {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EIO}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if f.off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// writeAt writes at the offset, or at the end of the file when it's opened
+// for appending, and returns the end of the write. The caller holds the
+// filesystem lock.
+func (f *memFile) writeAt(p []byte, off int64) (int64, error) {
+	if err := f.check("write"); err != nil {
+		return off, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return off, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	if f.flag&os.O_APPEND != 0 {
+		off = int64(len(f.node.data))
+	}
+	end := off + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, len(f.node.data), end*2)
+			copy(data, f.node.data)
+			f.node.data = data
+		}
+		if off > int64(len(f.node.data)) {
+			// the gap of a write past the end reads as zeros
+			gap := f.node.data[len(f.node.data):off]
+			for i := range gap {
+				gap[i] = 0
+			}
+		}
+		f.node.data = f.node.data[:end]
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return end, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	end, err := f.writeAt(p, f.off)
+	if err != nil {
+		return 0, err
+	}
+	f.off = end
+	return len(p), nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if _, err := f.writeAt(p, off); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: filepath.Base(f.name),
+		size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+// sync makes the written data durable. The caller holds the filesystem
+// lock.
+func (f *memFile) sync() error {
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	f.node.synced = append(f.node.synced[:0], f.node.data...)
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.sync()
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data,
+			make([]byte, size-int64(len(f.node.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// faultFS is an in-memory filesystem that injects faults. The faults are
+// deterministic, so that a test can fail a specific write or sync.
+type faultFS struct {
+	*memFS
+	// space is the number of bytes that can still be written before the
+	// writes fail with ENOSPC, or -1 for no limit.
+	space int64
+	// shortWrites is the number of the next writes that only write half of
+	// their data.
+	shortWrites int
+	// failSyncs is the number of the next syncs that fail with EIO, without
+	// making the data durable. It's -1 to fail every sync.
+	failSyncs int
+}
+
+func newFaultFS() *faultFS {
+	return &faultFS{memFS: newMemFS(), space: -1}
+}
+
+// setSpace sets the number of bytes that can be written, or -1 for no
+// limit.
+func (fs *faultFS) setSpace(n int64) {
+	fs.mu.Lock()
+	fs.space = n
+	fs.mu.Unlock()
+}
+
+// setShortWrites makes the next n writes short.
+func (fs *faultFS) setShortWrites(n int) {
+	fs.mu.Lock()
+	fs.shortWrites = n
+	fs.mu.Unlock()
+}
+
+// setFailSyncs makes the next n syncs fail, or every sync when n is -1.
+func (fs *faultFS) setFailSyncs(n int) {
+	fs.mu.Lock()
+	fs.failSyncs = n
+	fs.mu.Unlock()
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (vfsFile, error) {
+	f, err := fs.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{memFile: f.(*memFile), fs: fs}, nil
+}
+
+type faultFile struct {
+	*memFile
+	fs *faultFS
+}
+
+// write writes the part of the data that the faults allow. The caller holds
+// the filesystem lock.
+func (f *faultFile) write(p []byte, off int64) (int, int64, error) {
+	if err := f.check("write"); err != nil {
+		return 0, off, err
+	}
+	var ferr error
+	if f.fs.shortWrites > 0 {
+		f.fs.shortWrites--
+		p = p[:len(p)/2]
+		ferr = io.ErrShortWrite
+	}
+	if f.fs.space >= 0 && int64(len(p)) > f.fs.space {
+		p = p[:f.fs.space]
+		ferr = &os.PathError{Op: "write", Path: f.name, Err: syscall.ENOSPC}
+	}
+	end, err := f.writeAt(p, off)
+	if err != nil {
+		return 0, off, err
+	}
+	if f.fs.space >= 0 {
+		f.fs.space -= int64(len(p))
+	}
+	return len(p), end, ferr
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, end, err := f.write(p, f.off)
+	f.off = end
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n, _, err := f.write(p, off)
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("sync"); err != nil {
+		return err
+	}
+	if f.fs.failSyncs != 0 {
+		if f.fs.failSyncs > 0 {
+			f.fs.failSyncs--
+		}
+		return &os.PathError{Op: "sync", Path: f.name, Err: syscall.EIO}
+	}
+	return f.sync()
+}
@@ -0,0 +1,273 @@
+package kvbench
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// crashWrites sets the keys from lo to hi and records the written values.
+// A value is only acknowledged when the write succeeds.
+func crashWrites(s Store, gen string, lo, hi int,
+	acked map[string]string, written map[string]map[string]bool,
+) (failed int) {
+	for i := lo; i < hi; i++ {
+		key := fmt.Sprintf("key:%04d", i)
+		value := fmt.Sprintf("%s:%d:%s", gen, i, key)
+		if written[key] == nil {
+			written[key] = make(map[string]bool)
+		}
+		written[key][value] = true
+		if err := s.Set([]byte(key), []byte(value)); err != nil {
+			failed++
+			continue
+		}
+		acked[key] = value
+		// the earlier values can't come back
+		written[key] = map[string]bool{value: true}
+	}
+	return failed
+}
+
+func TestCrashRecovery(t *testing.T) {
+	engines := []struct {
+		which string
+		path  string
+	}{
+		{"map", "test.aof"},
+		{"btree", "test.aof"},
+		{"bitcask", "bitcask"},
+		{"lsm", "lsm"},
+		{"bptree", "bptree.db"},
+	}
+	faults := []struct {
+		name   string
+		inject func(fs *faultFS)
+	}{
+		{"crash", func(fs *faultFS) {}},
+		{"enospc", func(fs *faultFS) { fs.setSpace(4096) }},
+		{"short-write", func(fs *faultFS) { fs.setShortWrites(1) }},
+		{"failed-sync", func(fs *faultFS) { fs.setFailSyncs(1) }},
+	}
+	for _, e := range engines {
+		for _, fsync := range []bool{false, true} {
+			for _, fault := range faults {
+				name := fmt.Sprintf("%s/fsync=%v/%s", e.which, fsync, fault.name)
+				t.Run(name, func(t *testing.T) {
+					fs := newFaultFS()
+					opts := storeOptions{fs: fs, fsync: fsync}
+					s, err := openStore(e.which, e.path, opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					acked := make(map[string]string)
+					written := make(map[string]map[string]bool)
+					if n := crashWrites(s, "a", 0, 200, acked, written); n > 0 {
+						t.Fatalf("%d writes failed", n)
+					}
+					fault.inject(fs)
+					failed := crashWrites(s, "b", 100, 300, acked, written)
+					if fault.name != "crash" && (fsync || fault.name != "failed-sync") &&
+						failed == 0 {
+						t.Fatal("no write failed")
+					}
+					fs.setSpace(-1)
+					fs.setShortWrites(0)
+					fs.setFailSyncs(0)
+					fs.crash()
+					s.Close()
+
+					s, err = openStore(e.which, e.path, opts)
+					if err != nil {
+						t.Fatalf("reopen: %v", err)
+					}
+					defer s.Close()
+					keys, vals, err := s.Keys([]byte("*"), -1, true)
+					if err != nil {
+						t.Fatal(err)
+					}
+					found := make(map[string]bool)
+					for i, key := range keys {
+						found[string(key)] = true
+						if !written[string(key)][string(vals[i])] {
+							t.Fatalf("%s: unexpected value %q", key, vals[i])
+						}
+					}
+					if fsync {
+						for key := range acked {
+							if !found[key] {
+								t.Fatalf("%s: acknowledged write was lost", key)
+							}
+						}
+					}
+					// the store is writable after the recovery
+					if err := s.Set([]byte("after"), []byte("crash")); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestMemFSDirSync(t *testing.T) {
+	fs := newMemFS()
+	if err := fs.MkdirAll("dir", 0777); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, data string) {
+		t.Helper()
+		f, err := vfsCreate(fs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want map[string]string) {
+		t.Helper()
+		fis, err := fs.ReadDir("dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, fi := range fis {
+			data, err := vfsReadFile(fs, filepath.Join("dir", fi.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[fi.Name()] = string(data)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %q, expected %q", got, want)
+		}
+	}
+	// a synced file of an unsynced directory
+	write("dir/a", "1")
+	fs.crash()
+	check(map[string]string{})
+	write("dir/a", "1")
+	write("dir/b", "2")
+	if err := fs.SyncDir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	fs.crash()
+	check(map[string]string{"a": "1", "b": "2"})
+	// an unsynced rename and remove
+	write("dir/a.tmp", "3")
+	if err := fs.Rename("dir/a.tmp", "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("dir/b"); err != nil {
+		t.Fatal(err)
+	}
+	check(map[string]string{"a": "3"})
+	fs.crash()
+	check(map[string]string{"a": "1", "b": "2"})
+	write("dir/a.tmp", "3")
+	if err := fs.Rename("dir/a.tmp", "dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("dir/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SyncDir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	fs.crash()
+	check(map[string]string{"a": "3"})
+	if err := fs.SyncDir("none"); !os.IsNotExist(err) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// TestCrashAfterRename crashes after the operations that create, rename or
+// remove files, which must sync their directory before the writes that
+// follow are acknowledged.
+func TestCrashAfterRename(t *testing.T) {
+	ops := []struct {
+		name   string
+		stores []string
+		// flush is set when the operation deletes every key
+		flush bool
+		run   func(s Store) error
+	}{
+		{"rewrite", []string{"map", "btree"}, false, func(s Store) error {
+			// a rotation to no key rewrites the log
+			return s.(keyRotator).rotateKey(nil)
+		}},
+		{"merge", []string{"bitcask"}, false, func(s Store) error {
+			bs := s.(*bitcaskStore)
+			bs.mu.Lock()
+			err := bs.openActive(bs.active + 1)
+			bs.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			bs.merging.Lock()
+			defer bs.merging.Unlock()
+			if err := bs.writeHints(); err != nil {
+				return err
+			}
+			return bs.maybeMerge()
+		}},
+		{"flushdb", []string{"map", "btree", "bitcask", "lsm", "bptree"}, true,
+			func(s Store) error { return s.FlushDB() }},
+	}
+	paths := map[string]string{"map": "test.aof", "btree": "test.aof",
+		"bitcask": "bitcask", "lsm": "lsm", "bptree": "bptree.db"}
+	for _, op := range ops {
+		for _, which := range op.stores {
+			t.Run(op.name+"/"+which, func(t *testing.T) {
+				fs := newFaultFS()
+				opts := storeOptions{fs: fs, fsync: true}
+				s, err := openStore(which, paths[which], opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				acked := make(map[string]string)
+				written := make(map[string]map[string]bool)
+				crashWrites(s, "a", 0, 200, acked, written)
+				// overwrites, which leave dead records to merge
+				crashWrites(s, "b", 0, 200, acked, written)
+				if err := op.run(s); err != nil {
+					t.Fatal(err)
+				}
+				if op.flush {
+					acked = make(map[string]string)
+					written = make(map[string]map[string]bool)
+				}
+				if n := crashWrites(s, "c", 100, 300, acked, written); n > 0 {
+					t.Fatalf("%d writes failed", n)
+				}
+				fs.crash()
+				s.Close()
+
+				s, err = openStore(which, paths[which], opts)
+				if err != nil {
+					t.Fatalf("reopen: %v", err)
+				}
+				defer s.Close()
+				keys, vals, err := s.Keys([]byte("*"), -1, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, key := range keys {
+					if !written[string(key)][string(vals[i])] {
+						t.Fatalf("%s: unexpected value %q", key, vals[i])
+					}
+				}
+				if len(keys) != len(acked) {
+					t.Fatalf("got %d keys, expected %d", len(keys), len(acked))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package kvbench
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type ycsbOp int
+
+const (
+	ycsbRead ycsbOp = iota
+	ycsbUpdate
+	ycsbInsert
+	ycsbScan
+	ycsbReadModifyWrite
+	numYCSBOps
+)
+
+var ycsbOpNames = [numYCSBOps]string{
+	"READ", "UPDATE", "INSERT", "SCAN", "READ-MODIFY-WRITE",
+}
+
+// ycsbIndex is the sorted set of the inserted keys, which orders the scans
+// on a server without KEYS START, like in the YCSB Redis binding.
+const ycsbIndex = "_indices"
+
+// ycsbWorkload is one of the YCSB core workloads.
+type ycsbWorkload struct {
+	proportions [numYCSBOps]float64
+	// dist is the request distribution. The zipfian distribution of YCSB
+	// is scrambled.
+	dist string
+}
+
+var ycsbWorkloads = map[string]ycsbWorkload{
+	// update heavy
+	"a": {[numYCSBOps]float64{ycsbRead: 0.5, ycsbUpdate: 0.5}, "scrambled-zipfian"},
+	// read mostly
+	"b": {[numYCSBOps]float64{ycsbRead: 0.95, ycsbUpdate: 0.05}, "scrambled-zipfian"},
+	// read only
+	"c": {[numYCSBOps]float64{ycsbRead: 1}, "scrambled-zipfian"},
+	// read latest
+	"d": {[numYCSBOps]float64{ycsbRead: 0.95, ycsbInsert: 0.05}, "latest"},
+	// short ranges
+	"e": {[numYCSBOps]float64{ycsbScan: 0.95, ycsbInsert: 0.05}, "scrambled-zipfian"},
+	// read-modify-write
+	"f": {[numYCSBOps]float64{ycsbRead: 0.5, ycsbReadModifyWrite: 0.5}, "scrambled-zipfian"},
+}
+
+// ycsbConfig is the YCSB part of a benchmark. The keyspace of the benchmark
+// is the record count and the requests are the operation count.
+type ycsbConfig struct {
+	workload      ycsbWorkload
+	load, run     bool
+	fieldCount    int
+	fieldLength   int
+	maxScanLength int
+	// ordered makes the key order the insert order, instead of hashing the
+	// key numbers.
+	ordered bool
+}
+
+// setWorkload sets the workload by name and the phases to run, "load",
+// "run" or "both".
+func (ycfg *ycsbConfig) setWorkload(workload, phase string) error {
+	var ok bool
+	ycfg.workload, ok = ycsbWorkloads[strings.ToLower(workload)]
+	if !ok {
+		return fmt.Errorf("unknown workload: %v", workload)
+	}
+	switch phase {
+	case "load":
+		ycfg.load = true
+	case "run":
+		ycfg.run = true
+	case "both":
+		ycfg.load, ycfg.run = true, true
+	default:
+		return fmt.Errorf("unknown phase: %v", phase)
+	}
+	return nil
+}
+
+type ycsbResult struct {
+	hists    [numYCSBOps]*hdrHist
+	ok       [numYCSBOps]int64
+	notFound [numYCSBOps]int64
+	errors   [numYCSBOps]int64
+	// ops is the number of operations, where a read-modify-write is one.
+	ops     int64
+	elapsed time.Duration
+}
+
+func newYCSBResult() *ycsbResult {
+	res := new(ycsbResult)
+	for op := range res.hists {
+		res.hists[op] = newHDRHist(benchHighest, 3)
+	}
+	return res
+}
+
+// ycsbRun is the state that the clients of a phase share.
+type ycsbRun struct {
+	cfg  *benchConfig
+	ycfg *ycsbConfig
+	res  *ycsbResult
+	// remaining is the number of operations that aren't claimed yet.
+	remaining int64
+	stopped   int32
+	measure   time.Time
+	deadline  time.Time
+	// nextKey is the number of the next key to insert, and inserted is the
+	// number of inserted keys, which the reads choose from.
+	nextKey  int64
+	inserted int64
+}
+
+// ycsbClient runs the operations of a workload on a connection.
+type ycsbClient struct {
+	*benchClient
+	yr *ycsbRun
+	// record is a record of the standard layout, "field0=...,field1=...".
+	// The fields are at the offsets in fields.
+	record []byte
+	fields []int
+}
+
+func newYCSBClient(c *benchClient, yr *ycsbRun) *ycsbClient {
+	yc := &ycsbClient{benchClient: c, yr: yr}
+	for i := 0; i < yr.ycfg.fieldCount; i++ {
+		if i > 0 {
+			yc.record = append(yc.record, ',')
+		}
+		yc.record = append(yc.record, "field"+strconv.Itoa(i)+"="...)
+		yc.fields = append(yc.fields, len(yc.record))
+		for j := 0; j < yr.ycfg.fieldLength; j++ {
+			yc.record = append(yc.record, ' ')
+		}
+	}
+	return yc
+}
+
+// ycsbKey returns the name of the key number, which is hashed so that the
+// insert order isn't the key order, unless the inserts are ordered.
+func (yc *ycsbClient) ycsbKey(n int64) []byte {
+	if yc.yr.ycfg.ordered {
+		return yc.appendKey("user", n)
+	}
+	yc.key = append(yc.key[:0], "user"...)
+	yc.key = strconv.AppendInt(yc.key, fnvHash64(n), 10)
+	return yc.key
+}
+
+// nextRecord fills the fields with random printable bytes.
+func (yc *ycsbClient) nextRecord() []byte {
+	for _, off := range yc.fields {
+		field := yc.record[off : off+yc.yr.ycfg.fieldLength]
+		yc.rnd.Read(field)
+		for i := range field {
+			field[i] = ' ' + field[i]&63
+		}
+	}
+	return yc.record
+}
+
+func (yc *ycsbClient) nextOp() ycsbOp {
+	u := yc.rnd.Float64()
+	for op, p := range yc.yr.ycfg.workload.proportions {
+		if u < p {
+			return ycsbOp(op)
+		}
+		u -= p
+	}
+	return ycsbRead
+}
+
+// measured records the latency and status of an operation, unless it's
+// sent during the warmup. Only connection errors are returned.
+func (yc *ycsbClient) measured(op ycsbOp, warm bool, start time.Time,
+	r respReply, err error,
+) error {
+	if err != nil {
+		if _, ok := err.(remoteError); !ok {
+			return err
+		}
+	}
+	if warm {
+		return nil
+	}
+	res := yc.yr.res
+	res.hists[op].record(int64(time.Since(start)))
+	switch {
+	case err != nil:
+		atomic.AddInt64(&res.errors[op], 1)
+	case r.null:
+		atomic.AddInt64(&res.notFound[op], 1)
+	default:
+		atomic.AddInt64(&res.ok[op], 1)
+	}
+	return nil
+}
+
+// indexed reports whether the inserted keys are added to the index.
+func (yc *ycsbClient) indexed() bool {
+	return !yc.cfg.useKeys && yc.yr.ycfg.workload.proportions[ycsbScan] > 0
+}
+
+// insert inserts the record of the key number.
+func (yc *ycsbClient) insert(warm bool, n int64) error {
+	start := time.Now()
+	key := yc.ycsbKey(n)
+	r, err := yc.do([]byte("set"), key, yc.nextRecord())
+	if err == nil && yc.indexed() {
+		r, err = yc.do([]byte("zadd"), []byte(ycsbIndex), []byte("0"), key)
+	}
+	if err := yc.measured(ycsbInsert, warm, start, r, err); err != nil {
+		return err
+	}
+	atomic.AddInt64(&yc.yr.inserted, 1)
+	return nil
+}
+
+func (yc *ycsbClient) read(warm bool, key []byte) error {
+	start := time.Now()
+	r, err := yc.do([]byte("get"), key)
+	return yc.measured(ycsbRead, warm, start, r, err)
+}
+
+func (yc *ycsbClient) update(warm bool, key []byte) error {
+	start := time.Now()
+	r, err := yc.do([]byte("set"), key, yc.nextRecord())
+	return yc.measured(ycsbUpdate, warm, start, r, err)
+}
+
+// scan reads up to the max scan length of records in key order, from the
+// start key on. Other servers than kvbench read the keys from the index and
+// then the records.
+func (yc *ycsbClient) scan(warm bool, key []byte) error {
+	count := []byte(strconv.Itoa(1 + yc.rnd.Intn(yc.yr.ycfg.maxScanLength)))
+	start := time.Now()
+	var r respReply
+	var err error
+	if yc.cfg.useKeys {
+		r, err = yc.do([]byte("keys"), []byte("user*"), []byte("start"), key,
+			[]byte("limit"), count, []byte("withvalues"))
+	} else {
+		r, err = yc.do([]byte("zrangebylex"), []byte(ycsbIndex),
+			append([]byte("["), key...), []byte("+"), []byte("limit"),
+			[]byte("0"), count)
+		if err == nil && len(r.array) > 0 {
+			args := [][]byte{[]byte("mget")}
+			for _, k := range r.array {
+				args = append(args, k.str)
+			}
+			r, err = yc.do(args...)
+		}
+	}
+	return yc.measured(ycsbScan, warm, start, r, err)
+}
+
+// doOp runs one operation of the workload.
+func (yc *ycsbClient) doOp(warm bool) error {
+	op := yc.nextOp()
+	switch op {
+	case ycsbInsert:
+		return yc.insert(warm, atomic.AddInt64(&yc.yr.nextKey, 1)-1)
+	}
+	n := yc.dist.next(yc.rnd, atomic.LoadInt64(&yc.yr.inserted))
+	key := yc.ycsbKey(n)
+	switch op {
+	case ycsbScan:
+		return yc.scan(warm, key)
+	case ycsbRead:
+		return yc.read(warm, key)
+	case ycsbUpdate:
+		return yc.update(warm, key)
+	}
+	start := time.Now()
+	if err := yc.read(warm, key); err != nil {
+		return err
+	}
+	if err := yc.update(warm, key); err != nil {
+		return err
+	}
+	// the read and update statuses are counted by themselves
+	if !warm {
+		yc.yr.res.hists[op].record(int64(time.Since(start)))
+		atomic.AddInt64(&yc.yr.res.ok[op], 1)
+	}
+	return nil
+}
+
+// load inserts records until the record count is reached.
+func (yc *ycsbClient) load() error {
+	for atomic.LoadInt32(&yc.yr.stopped) == 0 {
+		n := atomic.AddInt64(&yc.yr.nextKey, 1) - 1
+		if n >= yc.cfg.keyspace {
+			return nil
+		}
+		if err := yc.insert(false, n); err != nil {
+			return err
+		}
+		atomic.AddInt64(&yc.yr.res.ops, 1)
+	}
+	return nil
+}
+
+// run runs operations until they're claimed, the deadline is reached or
+// the run is stopped, like benchClient.run.
+func (yc *ycsbClient) run() error {
+	yr := yc.yr
+	for atomic.LoadInt32(&yr.stopped) == 0 {
+		now := time.Now()
+		warm := now.Before(yr.measure)
+		if !warm {
+			if yc.cfg.duration > 0 {
+				if !now.Before(yr.deadline) {
+					return nil
+				}
+			} else if atomic.AddInt64(&yr.remaining, -1) < 0 {
+				return nil
+			}
+		}
+		if err := yc.doOp(warm); err != nil {
+			return err
+		}
+		if !warm {
+			atomic.AddInt64(&yr.res.ops, 1)
+		}
+	}
+	return nil
+}
+
+// runYCSBPhase runs the load or the run phase of the workload.
+func runYCSBPhase(clients []*benchClient, cfg *benchConfig,
+	ycfg *ycsbConfig, load bool,
+) (*ycsbResult, error) {
+	yr := &ycsbRun{cfg: cfg, ycfg: ycfg, res: newYCSBResult()}
+	yr.measure = time.Now()
+	if !load {
+		yr.nextKey, yr.inserted = cfg.keyspace, cfg.keyspace
+		yr.remaining = cfg.requests
+		yr.measure = yr.measure.Add(cfg.warmup)
+		yr.deadline = yr.measure.Add(cfg.duration)
+	}
+	err := runBenchClients(clients, &yr.stopped, func(c *benchClient) error {
+		yc := newYCSBClient(c, yr)
+		if load {
+			return yc.load()
+		}
+		return yc.run()
+	})
+	if err != nil {
+		return nil, err
+	}
+	yr.res.elapsed = time.Since(yr.measure)
+	return yr.res, nil
+}
+
+// runYCSB runs the phases of the workload and prints the results of every
+// phase in the YCSB output format.
+func runYCSB(w io.Writer, cfg *benchConfig, ycfg *ycsbConfig,
+	hgrm string,
+) error {
+	clients, err := dialBenchClients(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeBenchClients(clients)
+	if ycfg.workload.proportions[ycsbScan] > 0 {
+		if err := probeScan(cfg, clients[0]); err != nil {
+			return err
+		}
+	}
+	for _, load := range []bool{true, false} {
+		if (load && !ycfg.load) || (!load && !ycfg.run) {
+			continue
+		}
+		res, err := runYCSBPhase(clients, cfg, ycfg, load)
+		if err != nil {
+			return err
+		}
+		phase := "run"
+		if load {
+			phase = "load"
+		}
+		fmt.Fprintf(w, "# %s phase\n", phase)
+		printYCSB(w, res)
+		if hgrm != "" {
+			for op, h := range res.hists {
+				if h.total() == 0 {
+					continue
+				}
+				path := hgrm + "." + phase + "." +
+					strings.ToLower(ycsbOpNames[op]) + ".hgrm"
+				if err := writeHgrm(path, h); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// printYCSB prints the results like the YCSB text exporter, with the
+// latencies in microseconds.
+func printYCSB(w io.Writer, res *ycsbResult) {
+	ms := res.elapsed.Nanoseconds() / 1e6
+	fmt.Fprintf(w, "[OVERALL], RunTime(ms), %d\n", ms)
+	fmt.Fprintf(w, "[OVERALL], Throughput(ops/sec), %v\n",
+		float64(res.ops)/math.Max(res.elapsed.Seconds(), 1e-9))
+	us := func(ns int64) int64 { return ns / 1e3 }
+	for op, h := range res.hists {
+		if h.total() == 0 {
+			continue
+		}
+		name := ycsbOpNames[op]
+		mean, _ := h.meanStdDev()
+		fmt.Fprintf(w, "[%s], Operations, %d\n", name, h.total())
+		fmt.Fprintf(w, "[%s], AverageLatency(us), %v\n", name, mean/1e3)
+		fmt.Fprintf(w, "[%s], MinLatency(us), %d\n", name, us(h.min()))
+		fmt.Fprintf(w, "[%s], MaxLatency(us), %d\n", name, us(h.percentile(100)))
+		fmt.Fprintf(w, "[%s], 95thPercentileLatency(us), %d\n", name,
+			us(h.percentile(95)))
+		fmt.Fprintf(w, "[%s], 99thPercentileLatency(us), %d\n", name,
+			us(h.percentile(99)))
+		fmt.Fprintf(w, "[%s], Return=OK, %d\n", name, res.ok[op])
+		if res.notFound[op] > 0 {
+			fmt.Fprintf(w, "[%s], Return=NOT_FOUND, %d\n", name,
+				res.notFound[op])
+		}
+		if res.errors[op] > 0 {
+			fmt.Fprintf(w, "[%s], Return=ERROR, %d\n", name, res.errors[op])
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package kvbench
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestYCSBScan(t *testing.T) {
+	store, err := openStore("btree", ":memory:", storeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	addr, _ := testServer(t, store)
+	for _, ordered := range []bool{false, true} {
+		store.FlushDB()
+		cfg := benchConfig{addr: addr, clients: 2, pipeline: 1,
+			requests: 200, keyspace: 100}
+		if cfg.sizes, err = parseValueSizes("constant", "10", "0", "", "",
+			""); err != nil {
+			t.Fatal(err)
+		}
+		ycfg := ycsbConfig{fieldCount: 2, fieldLength: 4, maxScanLength: 10,
+			ordered: ordered}
+		if err := ycfg.setWorkload("e", "both"); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.dist, err = newKeyDist(ycfg.workload.dist, cfg.keyspace,
+			zipfianTheta, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := runYCSB(&out, &cfg, &ycfg, ""); err != nil {
+			t.Fatal(err)
+		}
+		if !cfg.useKeys {
+			t.Fatal("expected KEYS START")
+		}
+		if !strings.Contains(out.String(), "[SCAN], Return=OK") ||
+			strings.Contains(out.String(), "Return=ERROR") {
+			t.Fatalf("ordered %v:\n%s", ordered, out.String())
+		}
+	}
+}